@@ -0,0 +1,65 @@
+package sockguard
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/sockguard/sockguardtest"
+)
+
+func benchmarkDirect(b *testing.B, method, url, body string) {
+	l := log.New(ioutil.Discard, "", 0)
+
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"owned": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+		},
+		Networks: map[string]sockguardtest.Network{},
+	}
+	r := mockRulesDirectorWithUpstreamState(&us)
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = ioutil.ReadAll(req.Body)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			b.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			b.Fatalf("%s %s : handler returned wrong status code: got %v want %v", method, url, rr.Code, http.StatusOK)
+		}
+	}
+}
+
+func BenchmarkDirectPassthrough(b *testing.B) {
+	benchmarkDirect(b, "GET", "/v1.37/version", "")
+}
+
+func BenchmarkDirectListContainers(b *testing.B) {
+	benchmarkDirect(b, "GET", "/v1.37/containers/json?all=1&filters=%7B%22label%22%3A%5B%22com.docker.compose.project%3Dapp%22%5D%7D", "")
+}
+
+func BenchmarkDirectOwnedContainer(b *testing.B) {
+	benchmarkDirect(b, "POST", "/v1.37/containers/owned/start", "")
+}
+
+func BenchmarkDirectContainerCreate(b *testing.B) {
+	body, err := ioutil.ReadFile("fixtures/containers_create_1_in.json")
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkDirect(b, "POST", "/v1.37/containers/create", string(body))
+}
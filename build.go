@@ -0,0 +1,172 @@
+package sockguard
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// checkBuildRemote checks a remote build context (a git repository or URL that the daemon
+// fetches itself) against DenyBuildRemotes and AllowBuildRemotes. BuildKit builds (version 2)
+// with a remote of client-session send their context over the session, so aren't remote.
+func (r *RulesDirector) checkBuildRemote(l socketproxy.Logger, remote, version string) error {
+	if version == "2" && remote == "client-session" {
+		return nil
+	}
+	if r.DenyBuildRemotes {
+		l.Printf("Denied remote build context %q", remote)
+		return fmt.Errorf("Image builds aren't allowed to use remote contexts (received '%s')", remote)
+	}
+	if len(r.AllowBuildRemotes) == 0 {
+		return nil
+	}
+	for _, pattern := range r.AllowBuildRemotes {
+		if matchImagePattern(pattern, remote) {
+			l.Printf("Allow, remote build context %q matches allowed pattern %q", remote, pattern)
+			return nil
+		}
+	}
+	l.Printf("Denied remote build context %q, doesn't match any allowed patterns", remote)
+	return fmt.Errorf("Image builds aren't allowed to use remote context '%s'", remote)
+}
+
+// checkBuildParams applies the ExtraHosts, Ulimits and Isolation policies that containers
+// are subject to, to the corresponding build parameters
+func (r *RulesDirector) checkBuildParams(l socketproxy.Logger, q url.Values) error {
+	if extraHosts := q.Get("extrahosts"); extraHosts != "" && r.DenyExtraHosts {
+		l.Printf("Denied extra hosts %q on build", extraHosts)
+		return fmt.Errorf("Image builds aren't allowed to add hosts (received '%s')", extraHosts)
+	}
+	if ulimits := q.Get("ulimits"); ulimits != "" && ulimits != "null" && ulimits != "[]" && r.DenyUlimits {
+		l.Printf("Denied ulimits %q on build", ulimits)
+		return fmt.Errorf("Image builds aren't allowed to set ulimits (received '%s')", ulimits)
+	}
+	if isolation := q.Get("isolation"); !r.isIsolationAllowed(isolation) {
+		l.Printf("Denied isolation %q on build", isolation)
+		return fmt.Errorf("Image builds aren't allowed to use isolation '%s'", isolation)
+	}
+	if squash, _ := strconv.ParseBool(q.Get("squash")); squash && r.DenyBuildSquash {
+		l.Printf("Denied squash on build")
+		return fmt.Errorf("Image builds aren't allowed to squash layers")
+	}
+	return nil
+}
+
+// handleBuildPrune only allows pruning the build cache if AllowBuildPrune is set. Build cache records
+// have no labels to scope them to an owner, so all is dropped to only prune dangling cache rather than
+// the cache shared by everything else on the host.
+func (r *RulesDirector) handleBuildPrune(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !r.AllowBuildPrune {
+			l.Printf("Denied build cache prune (flag disabled)")
+			r.writeDenied(w, req, "Pruning the shared build cache isn't allowed")
+			return
+		}
+
+		q := req.URL.Query()
+		if all := q.Get("all"); all != "" {
+			l.Printf("Removing all=%s from build cache prune", all)
+			q.Del("all")
+		}
+		req.URL.RawQuery = q.Encode()
+
+		upstream.ServeHTTP(w, req)
+	})
+}
+
+// lockBuildCache serialises our builds while BuildCacheQuota is measured, so each is checked against
+// the build cache of the ones before it. Call the returned func to unlock.
+func (r *RulesDirector) lockBuildCache() func() {
+	s := r.lockState()
+	s.mu.Unlock()
+	s.buildCacheMu.Lock()
+	return s.buildCacheMu.Unlock
+}
+
+// buildCacheRecords returns the size of each build cache record, keyed by ID
+func (r *RulesDirector) buildCacheRecords() (map[string]int64, error) {
+	var df struct {
+		BuildCache []struct {
+			ID   string
+			Size int64
+		}
+	}
+	if err := r.getInto(&df, "/system/df"); err != nil {
+		return nil, err
+	}
+	records := map[string]int64{}
+	for _, record := range df.BuildCache {
+		records[record.ID] = record.Size
+	}
+	return records, nil
+}
+
+// recordOwnedBuildCache tracks build cache records created by builds we proxied, as they
+// can't be labelled
+func (r *RulesDirector) recordOwnedBuildCache(before, after map[string]int64) {
+	s := r.lockState()
+	defer s.mu.Unlock()
+
+	for id := range after {
+		if _, existed := before[id]; !existed {
+			s.ownedBuildCache[id] = true
+		}
+	}
+}
+
+// ownedBuildCacheUsage sums the size of the build cache records owned by us
+func (r *RulesDirector) ownedBuildCacheUsage(records map[string]int64) int64 {
+	s := r.lockState()
+	defer s.mu.Unlock()
+
+	var usage int64
+	for id, size := range records {
+		if s.ownedBuildCache[id] {
+			usage += size
+		}
+	}
+	return usage
+}
+
+// The build parameters that resource defaults and limits can be applied to
+var buildResourceParams = []string{"memory", "memswap", "cpuperiod", "cpuquota", "cpushares"}
+
+// ParseBuildResources parses a comma separated list of param=value resources for builds,
+// e.g. memory=1073741824,cpushares=512
+func ParseBuildResources(s string) (map[string]int64, error) {
+	return parseResources(s, buildResourceParams)
+}
+
+// applyBuildResources applies BuildResourceDefaults to unset resource parameters, then checks
+// them against BuildResourceLimits. Unset means unlimited, so the limit is applied instead.
+func (r *RulesDirector) applyBuildResources(l socketproxy.Logger, q url.Values) error {
+	for _, param := range buildResourceParams {
+		var value int64
+		if s := q.Get(param); s != "" {
+			var err error
+			if value, err = strconv.ParseInt(s, 10, 64); err != nil {
+				return fmt.Errorf("Invalid value for %s: %v", param, err)
+			}
+		}
+		if value == 0 && r.BuildResourceDefaults[param] != 0 {
+			value = r.BuildResourceDefaults[param]
+			l.Printf("Applied default %s=%d to image build", param, value)
+			q.Set(param, strconv.FormatInt(value, 10))
+		}
+		limit := r.BuildResourceLimits[param]
+		if limit == 0 {
+			continue
+		}
+		if value == 0 {
+			l.Printf("Applied limit %s=%d to image build", param, limit)
+			q.Set(param, strconv.FormatInt(limit, 10))
+		} else if value < 0 || value > limit {
+			l.Printf("Denied %s=%d on build, exceeds limit of %d", param, value, limit)
+			return fmt.Errorf("Image builds aren't allowed to set %s above %d (received %d)", param, limit, value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package sockguard
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckBuildRemote(t *testing.T) {
+	l := mockLogger()
+
+	tests := []struct {
+		rd      *RulesDirector
+		remote  string
+		version string
+		ok      bool
+	}{
+		{&RulesDirector{}, "https://github.com/example/repo.git", "", true},
+		{&RulesDirector{DenyBuildRemotes: true}, "https://github.com/example/repo.git", "", false},
+		{&RulesDirector{AllowBuildRemotes: []string{"https://github.com/example/*"}}, "https://github.com/example/repo.git", "", true},
+		{&RulesDirector{AllowBuildRemotes: []string{"https://github.com/example/*"}}, "https://github.com/other/repo.git", "", false},
+		{&RulesDirector{AllowBuildRemotes: []string{"https://github.com/example/*"}}, "http://169.254.169.254/latest/meta-data", "", false},
+		// docker build with BuildKit sends the context over the session
+		{&RulesDirector{DenyBuildRemotes: true}, "client-session", "2", true},
+		{&RulesDirector{AllowBuildRemotes: []string{"https://github.com/example/*"}}, "client-session", "2", true},
+		{&RulesDirector{DenyBuildRemotes: true}, "client-session", "1", false},
+		{&RulesDirector{DenyBuildRemotes: true}, "https://github.com/example/repo.git", "2", false},
+	}
+
+	for _, test := range tests {
+		err := test.rd.checkBuildRemote(l, test.remote, test.version)
+		if (err == nil) != test.ok {
+			t.Errorf("%s (version %q) : Expected allowed %t, got error %v", test.remote, test.version, test.ok, err)
+		}
+	}
+}
+
+func TestCheckBuildParams(t *testing.T) {
+	l := mockLogger()
+
+	tests := []struct {
+		rd    *RulesDirector
+		query string
+		ok    bool
+	}{
+		{&RulesDirector{}, "extrahosts=metadata:169.254.169.254&ulimits=[{\"Name\":\"nofile\"}]&squash=1", true},
+		{&RulesDirector{DenyExtraHosts: true}, "extrahosts=", true},
+		{&RulesDirector{DenyExtraHosts: true}, "extrahosts=metadata:169.254.169.254", false},
+		{&RulesDirector{DenyUlimits: true}, "ulimits=null", true},
+		{&RulesDirector{DenyUlimits: true}, "ulimits=[{\"Name\":\"nofile\"}]", false},
+		{&RulesDirector{}, "isolation=default", true},
+		{&RulesDirector{}, "isolation=hyperv", false},
+		{&RulesDirector{AllowIsolation: []string{"hyperv"}}, "isolation=hyperv", true},
+		{&RulesDirector{DenyBuildSquash: true}, "squash=0", true},
+		{&RulesDirector{DenyBuildSquash: true}, "squash=1", false},
+	}
+
+	for _, test := range tests {
+		q, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = test.rd.checkBuildParams(l, q)
+		if (err == nil) != test.ok {
+			t.Errorf("%s : Expected allowed %t, got error %v", test.query, test.ok, err)
+		}
+	}
+}
+
+func TestHandleBuildPrune(t *testing.T) {
+	l := mockLogger()
+
+	tests := []struct {
+		rd            *RulesDirector
+		inQueryString string
+		esc           int
+		expected      string
+	}{
+		{&RulesDirector{}, "all=1", 401, ""},
+		{&RulesDirector{AllowBuildPrune: true}, "all=1&keep-storage=1000", 200, "keep-storage=1000"},
+		{&RulesDirector{AllowBuildPrune: true}, "", 200, ""},
+	}
+
+	for _, test := range tests {
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.RawQuery != test.expected {
+				t.Errorf("%s : Expected query string %q, got %q", test.inQueryString, test.expected, req.URL.RawQuery)
+			}
+		})
+
+		req, err := http.NewRequest("POST", "/v1.37/build/prune?"+test.inQueryString, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		test.rd.handleBuildPrune(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.esc {
+			t.Errorf("%s : handler returned wrong status code: got %v want %v", test.inQueryString, status, test.esc)
+		}
+	}
+}
+
+func TestHandleBuildCacheQuota(t *testing.T) {
+	l := mockLogger()
+
+	// Build cache records that "exist" upstream, keyed by ID
+	records := map[string]int64{
+		"sharedcache": 5000,
+	}
+
+	r := &RulesDirector{
+		Owner:           "test-owner",
+		BuildCacheQuota: 1000,
+		Client: &http.Client{
+			Transport: roundTripFunc(func(req *http.Request) *http.Response {
+				if req.URL.Path != "/v1.32/system/df" {
+					t.Fatalf("Unexpected request to %s", req.URL.Path)
+				}
+				var df struct {
+					BuildCache []map[string]interface{}
+				}
+				for id, size := range records {
+					df.BuildCache = append(df.BuildCache, map[string]interface{}{"ID": id, "Size": size})
+				}
+				body, err := json.Marshal(df)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     make(http.Header),
+					Body:       ioutil.NopCloser(bytes.NewReader(body)),
+				}
+			}),
+		},
+	}
+
+	// Each build adds a record to the build cache
+	builds := 0
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		builds++
+		records[fmt.Sprintf("buildcache%d", builds)] = 800
+	})
+
+	// The shared cache isn't ours, so doesn't count towards the quota. The second build
+	// takes usage over the quota, so the third is denied.
+	for i, esc := range []int{200, 200, 401} {
+		req, err := http.NewRequest("POST", "/v1.37/build", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.handleBuild(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != esc {
+			t.Errorf("build %d : handler returned wrong status code: got %v want %v", i+1, status, esc)
+		}
+	}
+}
+
+func TestHandleBuildCacheQuotaConcurrent(t *testing.T) {
+	l := mockLogger()
+
+	var mu sync.Mutex
+	records := map[string]int64{}
+	client := &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) *http.Response {
+			mu.Lock()
+			defer mu.Unlock()
+			var df struct {
+				BuildCache []map[string]interface{}
+			}
+			for id, size := range records {
+				df.BuildCache = append(df.BuildCache, map[string]interface{}{"ID": id, "Size": size})
+			}
+			body, err := json.Marshal(df)
+			if err != nil {
+				t.Error(err)
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     make(http.Header),
+				Body:       ioutil.NopCloser(bytes.NewReader(body)),
+			}
+		}),
+	}
+
+	// Each build adds a record named after its tag part way through
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		records[req.URL.Query().Get("t")] = 600
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	})
+
+	// Builds of one owner are checked against the cache of the ones before them, so the third is
+	// over the quota rather than all three starting with none used
+	r := &RulesDirector{Owner: "test-owner", BuildCacheQuota: 1000, Client: client}
+	codes := make(chan int, 3)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, err := http.NewRequest("POST", fmt.Sprintf("/v1.37/build?t=build%d", i), nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			rr := httptest.NewRecorder()
+			r.handleBuild(l, req, upstream).ServeHTTP(rr, req)
+			codes <- rr.Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+
+	denied := 0
+	for code := range codes {
+		if code == http.StatusUnauthorized {
+			denied++
+		}
+	}
+	if denied != 1 {
+		t.Errorf("Expected 1 of 3 concurrent builds to be denied, got %d", denied)
+	}
+}
+
+func TestApplyBuildResources(t *testing.T) {
+	l := mockLogger()
+
+	r := &RulesDirector{
+		BuildResourceDefaults: map[string]int64{"memory": 1000, "cpushares": 512},
+		BuildResourceLimits:   map[string]int64{"memory": 2000, "memswap": 4000},
+	}
+
+	tests := []struct {
+		query    string
+		ok       bool
+		expected string
+	}{
+		{"memory=0&memswap=0&cpushares=0", true, "cpushares=512&memory=1000&memswap=4000"},
+		{"memory=1500&memswap=3000&cpushares=1024", true, "cpushares=1024&memory=1500&memswap=3000"},
+		{"memory=3000", false, ""},
+		{"memswap=-1", false, ""},
+		{"memory=lots", false, ""},
+	}
+
+	for _, test := range tests {
+		q, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = r.applyBuildResources(l, q)
+		if (err == nil) != test.ok {
+			t.Errorf("%s : Expected allowed %t, got error %v", test.query, test.ok, err)
+		} else if err == nil && q.Encode() != test.expected {
+			t.Errorf("%s : Expected %q, got %q", test.query, test.expected, q.Encode())
+		}
+	}
+}
+
+func TestParseBuildResources(t *testing.T) {
+	resources, err := ParseBuildResources("memory=1073741824,cpushares=512")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resources["memory"] != 1073741824 || resources["cpushares"] != 512 {
+		t.Errorf("Unexpected resources %v", resources)
+	}
+	for _, invalid := range []string{"memory", "disk=1", "memory=1g"} {
+		if _, err := ParseBuildResources(invalid); err == nil {
+			t.Errorf("%s : Expected an error", invalid)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package sockguard
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// Version and GitCommit identify a release build, and are set with ldflags, e.g.
+//
+//	go build -ldflags "-X github.com/buildkite/sockguard.Version=v1.2.0 -X github.com/buildkite/sockguard.GitCommit=$(git rev-parse HEAD)" ./cmd/sockguard
+//
+// When they aren't set, the module version and VCS revision recorded by go build are used.
+var (
+	Version   string
+	GitCommit string
+)
+
+// BuildInfo describes a build of sockguard and the docker API versions it supports, so operators
+// can tell which behaviour an agent is running
+type BuildInfo struct {
+	Version   string
+	GitCommit string
+	GoVersion string
+	// The oldest docker API version sockguard supports, daemons older than this are refused
+	MinAPIVersion string
+	// The newest docker API version clients can use (see MaxAPIVersion), empty if uncapped
+	MaxAPIVersion string `json:",omitempty"`
+}
+
+// ReadBuildInfo returns the BuildInfo of the running binary
+func ReadBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:       Version,
+		GitCommit:     GitCommit,
+		GoVersion:     runtime.Version(),
+		MinAPIVersion: apiVersion,
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" {
+			info.Version = build.Main.Version
+		}
+		for _, setting := range build.Settings {
+			if setting.Key == "vcs.revision" && info.GitCommit == "" {
+				info.GitCommit = setting.Value
+			}
+		}
+	}
+	if info.Version == "" {
+		info.Version = "(devel)"
+	}
+	return info
+}
+
+// BuildInfo returns the BuildInfo of the running binary, with the API versions this director allows
+func (r *RulesDirector) BuildInfo() BuildInfo {
+	info := ReadBuildInfo()
+	info.MaxAPIVersion = r.MaxAPIVersion
+	return info
+}
+
+// handleBuildInfo reports the BuildInfo at /_sockguard/version, which isn't passed upstream
+func (r *RulesDirector) handleBuildInfo(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(r.BuildInfo())
+	})
+}
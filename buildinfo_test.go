@@ -0,0 +1,40 @@
+package sockguard
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBuildInfoEndpoint(t *testing.T) {
+	l := mockLogger()
+
+	defer func(version string) { Version = version }(Version)
+	Version = "v1.2.3"
+
+	r := mockRulesDirector()
+	r.MaxAPIVersion = "1.41"
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("Expected %s not to be passed upstream", req.URL.Path)
+	})
+
+	for _, path := range []string{"/_sockguard/version", "/v1.40/_sockguard/version"} {
+		req := httptest.NewRequest("GET", path, nil)
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s : Expected 200, got %d", path, rr.Code)
+		}
+
+		var info BuildInfo
+		if err := json.Unmarshal(rr.Body.Bytes(), &info); err != nil {
+			t.Fatal(err)
+		}
+		if info.Version != "v1.2.3" || info.MinAPIVersion != apiVersion || info.MaxAPIVersion != "1.41" {
+			t.Errorf("%s : Unexpected build info %+v", path, info)
+		}
+	}
+}
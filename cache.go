@@ -0,0 +1,89 @@
+package sockguard
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// Requests that remove or rename resources, after which cached labels of that kind are invalidated
+var invalidatesInspectCacheRegex = regexp.MustCompile(`^/(containers|networks|volumes|services|secrets|configs)/([^/]+)(/rename)?$`)
+
+type inspectCacheEntry struct {
+	labels  map[string]string
+	expires time.Time
+}
+
+// isInspectCacheable returns whether inspected labels of kind can be cached. Image names are tags
+// that move between images as they're pulled and built, and volumes only have names, which can be
+// reused, so they aren't.
+func isInspectCacheable(kind string) bool {
+	return kind != "images" && kind != "volumes"
+}
+
+func (r *RulesDirector) cachedLabels(kind, id string) (map[string]string, bool) {
+	if r.InspectCacheTTL == 0 || !isInspectCacheable(kind) {
+		return nil, false
+	}
+	s := r.lockState()
+	defer s.mu.Unlock()
+
+	entry, ok := s.inspectCache[kind+"/"+id]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.labels, true
+}
+
+func (r *RulesDirector) cacheLabels(kind, id string, labels map[string]string) {
+	if r.InspectCacheTTL == 0 || !isInspectCacheable(kind) {
+		return
+	}
+	s := r.lockState()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.inspectCache[kind+"/"+id] = inspectCacheEntry{labels: labels, expires: now.Add(r.InspectCacheTTL)}
+
+	// drop expired entries, so the cache doesn't grow with every resource ever inspected
+	for key, entry := range s.inspectCache {
+		if now.After(entry.expires) {
+			delete(s.inspectCache, key)
+		}
+	}
+}
+
+// invalidateInspectCache removes all cached labels of kind, rather than working out which IDs a
+// request (e.g. a prune) removed
+func (r *RulesDirector) invalidateInspectCache(kind string) {
+	s := r.lockState()
+	defer s.mu.Unlock()
+
+	for key := range s.inspectCache {
+		if strings.HasPrefix(key, kind+"/") {
+			delete(s.inspectCache, key)
+		}
+	}
+}
+
+// invalidatingInspectCache invalidates cached labels after requests that remove or rename resources
+// (including prunes) are passed upstream
+func (r *RulesDirector) invalidatingInspectCache(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	m := invalidatesInspectCacheRegex.FindStringSubmatch(versionRegex.ReplaceAllString(req.URL.Path, ""))
+	switch {
+	case m == nil:
+		return upstream
+	case req.Method == "DELETE" && m[3] == "":
+	case req.Method == "POST" && (m[2] == "prune" || m[3] != ""):
+	default:
+		return upstream
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstream.ServeHTTP(w, req)
+		l.Printf("Invalidating cached %s labels", m[1])
+		r.invalidateInspectCache(m[1])
+	})
+}
@@ -0,0 +1,76 @@
+package sockguard
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInspectCache(t *testing.T) {
+	l := mockLogger()
+
+	inspects := map[string]int{}
+	r := mockRulesDirector()
+	r.InspectCacheTTL = time.Hour
+	r.Client = &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) *http.Response {
+			inspects[req.URL.Path]++
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"Id":"abc","Config":{"Labels":{"com.buildkite.sockguard.owner":"test-owner"}}}`)),
+			}
+		}),
+	}
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	serve := func(method, url string) {
+		req, err := http.NewRequest(method, url, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s %s : handler returned wrong status code: got %v want %v", method, url, rr.Code, http.StatusOK)
+		}
+	}
+
+	serve("POST", "/v1.37/containers/abc/start")
+	serve("POST", "/v1.37/containers/abc/pause")
+	serve("POST", "/v1.37/containers/abc/unpause")
+	if n := inspects["/v1.37/containers/abc/json"]; n != 1 {
+		t.Errorf("Expected 1 inspect with the labels cached, got %d", n)
+	}
+
+	// the name could be given to another container, so lookups by name aren't cached
+	serve("POST", "/v1.37/containers/web/start")
+	serve("POST", "/v1.37/containers/web/stop")
+	if n := inspects["/v1.37/containers/web/json"]; n != 2 {
+		t.Errorf("Expected lookups by name not to be cached, got %d inspects", n)
+	}
+
+	serve("DELETE", "/v1.37/containers/abc")
+	serve("POST", "/v1.37/containers/abc/start")
+	if n := inspects["/v1.37/containers/abc/json"]; n != 2 {
+		t.Errorf("Expected the cache to be invalidated by removing a container, got %d inspects", n)
+	}
+
+	// config is copied to the directors for each API version, so start again with a new one
+	client := r.Client
+	r = mockRulesDirector()
+	r.InspectCacheTTL = time.Nanosecond
+	r.Client = client
+	serve("POST", "/v1.37/containers/abc/stop")
+	time.Sleep(time.Millisecond)
+	serve("POST", "/v1.37/containers/abc/stop")
+	if n := inspects["/v1.37/containers/abc/json"]; n != 4 {
+		t.Errorf("Expected the cached labels to expire, got %d inspects", n)
+	}
+}
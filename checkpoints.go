@@ -0,0 +1,101 @@
+package sockguard
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// checkCheckpointDir checks a custom checkpoint directory is under one of AllowCheckpointDirs,
+// as checkpoints contain a full dump of the container's process memory. An empty dir is the
+// daemon's default location.
+func (r *RulesDirector) checkCheckpointDir(l socketproxy.Logger, dir string) error {
+	if dir == "" {
+		return nil
+	}
+	dir = path.Clean("/" + dir)
+	for _, allowed := range r.AllowCheckpointDirs {
+		if pathHasPrefix(dir, path.Clean(allowed)) {
+			return nil
+		}
+	}
+	l.Printf("Denied checkpoint dir %q, not under an allowed checkpoint dir", dir)
+	return fmt.Errorf("Checkpoint dir %q is not allowed", dir)
+}
+
+// checkCheckpointRequest checks checkpoint list, create and delete requests, and container starts
+// that restore from a checkpoint
+func (r *RulesDirector) checkCheckpointRequest(l socketproxy.Logger, req *http.Request) error {
+	q := req.URL.Query()
+
+	// Starts are only checkpoint requests if they restore from one
+	if req.Method == "POST" && q.Get("checkpoint") == "" && path.Base(req.URL.Path) == "start" {
+		return nil
+	}
+
+	if !r.AllowCheckpoints {
+		l.Printf("Denied checkpoint request, checkpoints aren't allowed")
+		return fmt.Errorf("Container checkpoints are not allowed")
+	}
+
+	// the dir can be given in the query and (for creates) the body, every one of them is checked
+	// and they must agree, so a check of one can't be bypassed by the daemon using another
+	var dirs []string
+	for _, param := range []string{"checkpoint-dir", "dir"} {
+		for _, dir := range q[param] {
+			if dir != "" {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	if req.Method == "POST" && path.Base(req.URL.Path) == "checkpoints" {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		var decoded struct {
+			CheckpointDir string
+		}
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, &decoded); err != nil {
+				return err
+			}
+		}
+		if decoded.CheckpointDir != "" {
+			dirs = append(dirs, decoded.CheckpointDir)
+		}
+	}
+
+	for _, dir := range dirs {
+		if err := r.checkCheckpointDir(l, dir); err != nil {
+			return err
+		}
+		if path.Clean("/"+dir) != path.Clean("/"+dirs[0]) {
+			l.Printf("Denied checkpoint dirs %q and %q, which disagree", dirs[0], dir)
+			return fmt.Errorf("Checkpoint dirs %q and %q disagree", dirs[0], dir)
+		}
+	}
+	return nil
+}
+
+func (r *RulesDirector) handleContainerCheckpoint(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !r.requireContainerOwner(l, w, req) {
+			return
+		}
+
+		if err := r.checkCheckpointRequest(l, req); err != nil {
+			r.writeDenied(w, req, err.Error())
+			return
+		}
+
+		upstream.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,80 @@
+package sockguard
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/sockguard/sockguardtest"
+)
+
+func TestHandleContainerCheckpoint(t *testing.T) {
+	l := mockLogger()
+
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"owned": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+			"foreign": sockguardtest.Container{
+				Owner: "adifferentowner",
+			},
+			"my-app": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+		},
+	}
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		allow  bool
+		method string
+		url    string
+		body   string
+		status int
+	}{
+		{false, "GET", "/v1.37/containers/owned/checkpoints", "", 401},
+		{false, "POST", "/v1.37/containers/owned/checkpoints", `{"CheckpointID":"c1"}`, 401},
+		{false, "POST", "/v1.37/containers/owned/start", "", 200},
+		{false, "POST", "/v1.37/containers/owned/start?checkpoint=c1", "", 401},
+		{true, "GET", "/v1.37/containers/foreign/checkpoints", "", 401},
+		{true, "GET", "/v1.37/containers/owned/checkpoints", "", 200},
+		{true, "GET", "/v1.37/containers/owned/checkpoints?dir=/etc", "", 401},
+		{true, "POST", "/v1.37/containers/owned/checkpoints", `{"CheckpointID":"c1"}`, 200},
+		{true, "POST", "/v1.37/containers/owned/checkpoints", `{"CheckpointID":"c1","CheckpointDir":"/var/checkpoints/job"}`, 200},
+		{true, "POST", "/v1.37/containers/owned/checkpoints", `{"CheckpointID":"c1","CheckpointDir":"/var/checkpoints/../lib"}`, 401},
+		{true, "DELETE", "/v1.37/containers/owned/checkpoints/c1?dir=/var/checkpoints", "", 200},
+		{true, "POST", "/v1.37/containers/owned/checkpoints?dir=/var/checkpoints", `{"CheckpointID":"c1","CheckpointDir":"/etc"}`, 401},
+		{true, "POST", "/v1.37/containers/owned/checkpoints?dir=/var/checkpoints", `{"CheckpointID":"c1","CheckpointDir":"/var/checkpoints/job"}`, 401},
+		{true, "POST", "/v1.37/containers/owned/checkpoints?dir=/var/checkpoints", `{"CheckpointID":"c1","CheckpointDir":"/var/checkpoints/"}`, 200},
+		{true, "POST", "/v1.37/containers/owned/checkpoints", `{"CheckpointID":"c1","checkpointdir":"/etc"}`, 401},
+		{true, "DELETE", "/v1.37/containers/owned/checkpoints/c1?dir=/var/checkpoints&dir=/etc", "", 401},
+		{true, "POST", "/v1.37/containers/owned/start?checkpoint=c1&checkpoint-dir=/tmp", "", 401},
+		{true, "POST", "/v1.37/containers/owned/start?checkpoint=c1", "", 200},
+		{false, "GET", "/v1.37/containers/my-app/checkpoints", "", 401},
+		{false, "POST", "/v1.37/containers/my-app/start?checkpoint=c1", "", 401},
+		{true, "POST", "/v1.37/containers/my-app/checkpoints", `{"CheckpointID":"c1","CheckpointDir":"/etc"}`, 401},
+		{true, "POST", "/v1.37/containers/my-app/start?checkpoint=c1", "", 200},
+	}
+
+	for _, test := range tests {
+		r := mockRulesDirectorWithUpstreamState(&us)
+		r.AllowCheckpoints = test.allow
+		r.AllowCheckpointDirs = []string{"/var/checkpoints"}
+
+		req, err := http.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("%s %s %s : handler returned wrong status code: got %v want %v", test.method, test.url, test.body, status, test.status)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package sockguard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// The kinds of resources that are owned, in the order they can be removed in (containers
+// hold on to networks, volumes and images)
+var ownedKinds = []string{"containers", "networks", "volumes", "images"}
+
+// OwnedResource is a resource with our owner label
+type OwnedResource struct {
+	Kind    string    `json:"kind"`
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	// Running containers, other resources in use are found out when removing them
+	Running bool `json:"running,omitempty"`
+}
+
+// listOwned returns the resources of kind with our owner label. Volumes are identified by name.
+func (r *RulesDirector) listOwned(kind string) ([]OwnedResource, error) {
+	filters, err := json.Marshal(map[string][]string{
+		"label": {ownerKey + "=" + r.Owner},
+	})
+	if err != nil {
+		return nil, err
+	}
+	escaped := url.QueryEscape(string(filters))
+
+	var resources []OwnedResource
+	switch kind {
+	case "containers", "images":
+		var results []struct {
+			Id      string
+			Created int64
+			State   string
+		}
+		if err := r.getInto(&results, "/"+kind+"/json?all=1&filters=%s", escaped); err != nil {
+			return nil, err
+		}
+		for _, result := range results {
+			resources = append(resources, OwnedResource{Kind: kind, ID: result.Id, Created: time.Unix(result.Created, 0), Running: result.State == "running"})
+		}
+	case "networks":
+		var results []struct {
+			Id      string
+			Created time.Time
+		}
+		if err := r.getInto(&results, "/networks?filters=%s", escaped); err != nil {
+			return nil, err
+		}
+		for _, result := range results {
+			resources = append(resources, OwnedResource{Kind: kind, ID: result.Id, Created: result.Created})
+		}
+	case "volumes":
+		var results struct {
+			Volumes []struct {
+				Name      string
+				CreatedAt time.Time
+			}
+		}
+		if err := r.getInto(&results, "/volumes?filters=%s", escaped); err != nil {
+			return nil, err
+		}
+		for _, result := range results.Volumes {
+			resources = append(resources, OwnedResource{Kind: kind, ID: result.Name, Created: result.CreatedAt})
+		}
+	default:
+		return nil, fmt.Errorf("Unknown kind %q", kind)
+	}
+	return resources, nil
+}
+
+var errResourceInUse = errors.New("Resource is in use")
+
+// ListOwnedResources returns the containers, networks, volumes and images with our owner label
+func (r *RulesDirector) ListOwnedResources() ([]OwnedResource, error) {
+	var resources []OwnedResource
+	for _, kind := range ownedKinds {
+		owned, err := r.listOwned(kind)
+		if err != nil {
+			return nil, fmt.Errorf("Error listing owned %s: %v", kind, err)
+		}
+		resources = append(resources, owned...)
+	}
+	return resources, nil
+}
+
+// remove deletes a resource of kind, resources that no longer exist are ignored
+func (r *RulesDirector) remove(kind string, id string, force bool) error {
+	q := url.Values{}
+	switch kind {
+	case "containers":
+		// remove anonymous volumes along with containers
+		q.Set("v", "1")
+		fallthrough
+	case "volumes", "images":
+		if force {
+			q.Set("force", "1")
+		}
+	}
+
+	u := fmt.Sprintf("http://docker/v%s/%s/%s", r.internalAPIVersion(), kind, id)
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := r.newRequest("DELETE", u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode/100 == 2 {
+		return nil
+	} else if resp.StatusCode == http.StatusConflict {
+		return errResourceInUse
+	} else if resp.StatusCode == http.StatusForbidden && kind == "networks" {
+		// the daemon refuses to remove networks with active endpoints as forbidden
+		return errResourceInUse
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("Removing %s/%s failed: %s %s", kind, id, resp.Status, strings.TrimSpace(string(body)))
+}
+
+// RemoveOwnedResources removes all the containers, networks, volumes and images with our owner
+// label, and images tracked as owned. Only labelled resources are force removed. Failures are
+// logged, and don't stop other resources being removed.
+func (r *RulesDirector) RemoveOwnedResources(l socketproxy.Logger, force bool) error {
+	var failed int
+	for _, kind := range ownedKinds {
+		resources, err := r.listOwned(kind)
+		if err != nil {
+			l.Printf("Error listing owned %s: %s", kind, err.Error())
+			failed++
+			continue
+		}
+		for _, resource := range resources {
+			l.Printf("Removing %s/%s owned by %q", kind, resource.ID, r.Owner)
+			if err := r.remove(kind, resource.ID, force); err != nil {
+				l.Printf("Error: %s", err.Error())
+				failed++
+			}
+		}
+		if kind != "images" {
+			continue
+		}
+		// tracked images don't have our owner label, so could also be another owner's (e.g. the
+		// same image loaded by both). They're untagged, and only removed if nothing else uses them.
+		for _, image := range r.ownedImageRefs() {
+			l.Printf("Removing images/%s tracked as owned by %q", image, r.Owner)
+			if err := r.remove(kind, image, false); err == errResourceInUse {
+				l.Printf("Skipping images/%s, still in use", image)
+			} else if err != nil {
+				l.Printf("Error: %s", err.Error())
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("Failed to remove %d owned resources", failed)
+	}
+	return nil
+}
+
+// ReapOwnedResources removes resources with our owner label that were created more than olderThan
+// ago and aren't in use. Resources the daemon refuses to remove because they are in use are skipped.
+func (r *RulesDirector) ReapOwnedResources(l socketproxy.Logger, olderThan time.Duration) error {
+	var failed int
+	cutoff := time.Now().Add(-olderThan)
+	for _, kind := range ownedKinds {
+		resources, err := r.listOwned(kind)
+		if err != nil {
+			l.Printf("Error listing owned %s: %s", kind, err.Error())
+			failed++
+			continue
+		}
+		for _, resource := range resources {
+			if resource.Running || resource.Created.After(cutoff) {
+				continue
+			}
+			l.Printf("Reaping %s/%s owned by %q, created %s", kind, resource.ID, r.Owner, resource.Created.Format(time.RFC3339))
+			if err := r.remove(kind, resource.ID, false); err == errResourceInUse {
+				l.Printf("Skipping %s/%s, still in use", kind, resource.ID)
+			} else if err != nil {
+				l.Printf("Error: %s", err.Error())
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("Failed to reap %d owned resources", failed)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package sockguard
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoveOwnedResources(t *testing.T) {
+	l := mockLogger()
+
+	lists := map[string]string{
+		"/v1.32/containers/json": `[{"Id":"c1"}]`,
+		"/v1.32/networks":        `[{"Id":"n1"}]`,
+		"/v1.32/volumes":         `{"Volumes":[{"Name":"v1"}]}`,
+		"/v1.32/images/json":     `[{"Id":"sha256:i1"}]`,
+	}
+
+	var removed []string
+	r := mockRulesDirector()
+	r.Client = &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) *http.Response {
+			resp := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     make(http.Header),
+				Body:       ioutil.NopCloser(bytes.NewBufferString("")),
+			}
+			switch req.Method {
+			case "GET":
+				if !strings.Contains(req.URL.Query().Get("filters"), `com.buildkite.sockguard.owner=test-owner`) {
+					t.Errorf("Expected %s to be filtered by owner, got %q", req.URL.Path, req.URL.RawQuery)
+				}
+				resp.Body = ioutil.NopCloser(bytes.NewBufferString(lists[req.URL.Path]))
+			case "DELETE":
+				// a tracked image another owner also uses
+				if strings.Contains(req.URL.Path, "shared") {
+					resp.StatusCode = http.StatusConflict
+					return resp
+				}
+				removed = append(removed, req.URL.RequestURI())
+				resp.StatusCode = http.StatusNoContent
+			}
+			return resp
+		}),
+	}
+	r.recordOwnedImages([]string{"sha256:loaded", "docker.io/library/loaded:latest", "sha256:shared"})
+
+	if err := r.RemoveOwnedResources(l, true); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"/v1.32/containers/c1?force=1&v=1",
+		"/v1.32/networks/n1",
+		"/v1.32/volumes/v1?force=1",
+		"/v1.32/images/sha256:i1?force=1",
+		"/v1.32/images/docker.io/library/loaded:latest",
+		"/v1.32/images/sha256:loaded",
+	}
+	if !reflect.DeepEqual(removed, expected) {
+		t.Errorf("Expected removals %v, got %v", expected, removed)
+	}
+}
+
+func TestReapOwnedResources(t *testing.T) {
+	l := mockLogger()
+
+	old := time.Now().Add(-3 * time.Hour)
+	recent := time.Now().Add(-time.Minute)
+	lists := map[string]string{
+		"/v1.32/containers/json": fmt.Sprintf(`[{"Id":"oldstopped","Created":%d,"State":"exited"},{"Id":"oldrunning","Created":%d,"State":"running"},{"Id":"recent","Created":%d,"State":"exited"}]`, old.Unix(), old.Unix(), recent.Unix()),
+		"/v1.32/networks":        fmt.Sprintf(`[{"Id":"oldnetwork","Created":%q},{"Id":"recentnetwork","Created":%q},{"Id":"oldactivenetwork","Created":%q}]`, old.Format(time.RFC3339Nano), recent.Format(time.RFC3339Nano), old.Format(time.RFC3339Nano)),
+		"/v1.32/volumes":         fmt.Sprintf(`{"Volumes":[{"Name":"oldinuse","CreatedAt":%q}]}`, old.Format(time.RFC3339)),
+		"/v1.32/images/json":     `[]`,
+	}
+
+	var removed []string
+	r := mockRulesDirector()
+	r.Client = &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) *http.Response {
+			resp := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     make(http.Header),
+				Body:       ioutil.NopCloser(bytes.NewBufferString("")),
+			}
+			switch req.Method {
+			case "GET":
+				resp.Body = ioutil.NopCloser(bytes.NewBufferString(lists[req.URL.Path]))
+			case "DELETE":
+				if strings.Contains(req.URL.Path, "oldinuse") {
+					resp.StatusCode = http.StatusConflict
+					return resp
+				}
+				if strings.Contains(req.URL.Path, "oldactivenetwork") {
+					resp.StatusCode = http.StatusForbidden
+					return resp
+				}
+				removed = append(removed, req.URL.RequestURI())
+				resp.StatusCode = http.StatusNoContent
+			}
+			return resp
+		}),
+	}
+
+	if err := r.ReapOwnedResources(l, 2*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"/v1.32/containers/oldstopped?v=1",
+		"/v1.32/networks/oldnetwork",
+	}
+	if !reflect.DeepEqual(removed, expected) {
+		t.Errorf("Expected removals %v, got %v", expected, removed)
+	}
+}
+
+func TestListOwnedResources(t *testing.T) {
+	created := time.Unix(1500000000, 0)
+	lists := map[string]string{
+		"/v1.32/containers/json": `[{"Id":"c1","Created":1500000000,"State":"running"}]`,
+		"/v1.32/networks":        `[]`,
+		"/v1.32/volumes":         `{"Volumes":[{"Name":"v1","CreatedAt":"2017-07-14T02:40:00Z"}]}`,
+		"/v1.32/images/json":     `[]`,
+	}
+
+	r := mockRulesDirector()
+	r.Client = &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) *http.Response {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     make(http.Header),
+				Body:       ioutil.NopCloser(bytes.NewBufferString(lists[req.URL.Path])),
+			}
+		}),
+	}
+
+	resources, err := r.ListOwnedResources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []OwnedResource{
+		{Kind: "containers", ID: "c1", Created: created, Running: true},
+		{Kind: "volumes", ID: "v1", Created: created},
+	}
+	if len(resources) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, resources)
+	}
+	for i := range expected {
+		if resources[i].Kind != expected[i].Kind || resources[i].ID != expected[i].ID ||
+			!resources[i].Created.Equal(expected[i].Created) || resources[i].Running != expected[i].Running {
+			t.Errorf("Expected %v, got %v", expected[i], resources[i])
+		}
+	}
+}
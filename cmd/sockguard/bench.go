@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// benchStep is a request in the bench workload. {name} in the path or body is replaced with a
+// name unique to the iteration.
+type benchStep struct {
+	method string
+	path   string
+	body   string
+}
+
+// A docker-compose style workload: checking the daemon, looking for existing resources, and
+// creating, inspecting and removing a network and volume
+var benchWorkload = []benchStep{
+	{"GET", "/_ping", ""},
+	{"GET", "/v1.32/version", ""},
+	{"GET", "/v1.32/containers/json?all=1&filters=%7B%22label%22%3A%5B%22com.docker.compose.project%3Dbench%22%5D%7D", ""},
+	{"GET", "/v1.32/networks?filters=%7B%22label%22%3A%5B%22com.docker.compose.project%3Dbench%22%5D%7D", ""},
+	{"POST", "/v1.32/networks/create", `{"Name":"{name}","Labels":{"com.docker.compose.project":"bench"}}`},
+	{"GET", "/v1.32/networks/{name}", ""},
+	{"POST", "/v1.32/volumes/create", `{"Name":"{name}","Labels":{"com.docker.compose.project":"bench"}}`},
+	{"GET", "/v1.32/volumes/{name}", ""},
+	{"DELETE", "/v1.32/volumes/{name}", ""},
+	{"DELETE", "/v1.32/networks/{name}", ""},
+}
+
+// bench replays benchWorkload against a guarded socket and the raw socket, and reports the
+// latency sockguard adds to each request
+func bench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s bench -socket <guarded socket> [options]\n\nReplays a docker-compose style workload against a guarded socket and the raw docker socket,\nand reports the latency added by sockguard. Creates and removes networks and volumes.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	guarded := fs.String("socket", "sockguard.sock", "The path to the guarded socket")
+	raw := fs.String("upstream-socket", "/var/run/docker.sock", "The path to the original docker socket")
+	iterations := fs.Int("iterations", 20, "How many times to replay the workload against each socket")
+	_ = fs.Parse(args)
+
+	guardedTimes, err := replayWorkload(*guarded, *iterations)
+	if err != nil {
+		log.Fatalf("Failed to replay workload against %s: %v", *guarded, err)
+	}
+	rawTimes, err := replayWorkload(*raw, *iterations)
+	if err != nil {
+		log.Fatalf("Failed to replay workload against %s: %v", *raw, err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "REQUEST\tRAW P50\tGUARDED P50\tGUARDED P95\tOVERHEAD P50")
+	for i, step := range benchWorkload {
+		rawP50 := percentile(rawTimes[i], 50)
+		guardedP50 := percentile(guardedTimes[i], 50)
+		fmt.Fprintf(tw, "%s %s\t%v\t%v\t%v\t%v\n",
+			step.method, truncatePath(step.path), rawP50, guardedP50, percentile(guardedTimes[i], 95), guardedP50-rawP50)
+	}
+	_ = tw.Flush()
+}
+
+// replayWorkload runs benchWorkload iterations times against the socket at path, returning the
+// durations of each step
+func replayWorkload(path string, iterations int) ([][]time.Duration, error) {
+	client := &http.Client{Transport: socketproxy.NewTransport(path)}
+	times := make([][]time.Duration, len(benchWorkload))
+
+	for i := 0; i < iterations; i++ {
+		name := fmt.Sprintf("sockguard-bench-%d-%d", os.Getpid(), i)
+		for j, step := range benchWorkload {
+			var body io.Reader = http.NoBody
+			if step.body != "" {
+				body = strings.NewReader(strings.Replace(step.body, "{name}", name, -1))
+			}
+			req, err := http.NewRequest(step.method, "http://docker"+strings.Replace(step.path, "{name}", name, -1), body)
+			if err != nil {
+				return nil, err
+			}
+			if step.body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+
+			start := time.Now()
+			resp, err := client.Do(req)
+			if err != nil {
+				return nil, err
+			}
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			times[j] = append(times[j], time.Since(start))
+
+			if resp.StatusCode >= 300 {
+				return nil, fmt.Errorf("%s %s failed: %s", req.Method, req.URL.Path, resp.Status)
+			}
+		}
+	}
+	return times, nil
+}
+
+// percentile returns the p'th percentile of durations
+func percentile(durations []time.Duration, p int) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration{}, durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[(len(sorted)-1)*p/100].Round(time.Microsecond)
+}
+
+func truncatePath(path string) string {
+	if i := strings.Index(path, "?"); i >= 0 {
+		return path[:i]
+	}
+	return path
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/buildkite/sockguard"
+	"github.com/buildkite/sockguard/guard"
+)
+
+// execCommand runs a command with DOCKER_HOST set to a temporary guarded socket, then removes the
+// socket and the resources the command created through it, so each step of a pipeline is isolated
+func execCommand(args []string) {
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s exec [serve options] -- <command> [args...]\n\nRuns a command with DOCKER_HOST set to a temporary guarded socket, then removes the socket\nand the containers, networks, volumes and images with the owner. Exits with the command's\nexit code.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	config := serveFlags(fs)
+	_ = fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config()
+	if err != nil {
+		log.Fatal(err)
+	}
+	director, err := sockguard.NewDirector(cfg.Rules...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if errs := checkUpstream(cfg, director, false); len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("Error: %v", err)
+		}
+		os.Exit(1)
+	}
+
+	dir, err := ioutil.TempDir("", "sockguard")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ready := make(chan struct{})
+	cfg.Listen = filepath.Join(dir, "docker.sock")
+	cfg.Cleanup = true
+	cfg.HandleSignals = false
+	cfg.Ready = func() {
+		debugf("Listening on %s for %v", cfg.Listen, fs.Args())
+		close(ready)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- guard.Run(ctx, cfg.Config)
+	}()
+
+	select {
+	case <-ready:
+	case err := <-runErr:
+		_ = os.RemoveAll(dir)
+		log.Fatal(err)
+	}
+
+	code := run(fs.Args(), "DOCKER_HOST=unix://"+cfg.Listen)
+
+	// closes the socket and removes the owned resources
+	cancel()
+	if err := <-runErr; err != nil {
+		log.Printf("Error cleaning up: %v", err)
+		if code == 0 {
+			code = 1
+		}
+	}
+	_ = os.RemoveAll(dir)
+
+	os.Exit(code)
+}
+
+// run runs a command with extra environment, returning its exit code. Interrupts are passed on
+// to the command rather than stopping sockguard, so it can clean up once the command exits.
+func run(args []string, env ...string) int {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), env...)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		log.Printf("Error: %v", err)
+		return 127
+	}
+	go func() {
+		for sig := range signals {
+			_ = cmd.Process.Signal(sig)
+		}
+	}()
+
+	if err := cmd.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() >= 0 {
+			return exitErr.ExitCode()
+		}
+		log.Printf("Error: %v", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/buildkite/sockguard"
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// upstreamHttpClient returns a client that talks to the docker daemon on the upstream socket
+func upstreamHttpClient(upstream string) *http.Client {
+	return &http.Client{
+		Transport: socketproxy.NewTransport(upstream),
+	}
+}
+
+// gc removes all the resources with an owner label, e.g. from an agent post-job hook
+func gc(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s gc -owner-label <owner> [options]\n\nRemoves containers, networks, volumes and images with an owner label.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	upstream := fs.String("upstream-socket", "/var/run/docker.sock", "The path to the original docker socket")
+	owner := fs.String("owner-label", "", "The owner to remove the resources of")
+	force := fs.Bool("force", true, "Force removal of running containers, and images in use")
+	_ = fs.Parse(args)
+
+	if *owner == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	director := &sockguard.RulesDirector{
+		Owner:  *owner,
+		Client: upstreamHttpClient(*upstream),
+	}
+	l := log.New(os.Stderr, "gc ", log.Ltime|log.Lmicroseconds)
+	if err := director.RemoveOwnedResources(l, *force); err != nil {
+		log.Fatal(err)
+	}
+}
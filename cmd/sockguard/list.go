@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/buildkite/sockguard"
+)
+
+// list prints the resources with an owner label, for debugging leaks and verifying cleanup
+func list(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s list -owner-label <owner> [options]\n\nLists containers, networks, volumes and images with an owner label.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	upstream := fs.String("upstream-socket", "/var/run/docker.sock", "The path to the original docker socket")
+	owner := fs.String("owner-label", "", "The owner to list the resources of")
+	format := fs.String("format", "table", "Output format, table or json")
+	_ = fs.Parse(args)
+
+	if *owner == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	director := &sockguard.RulesDirector{
+		Owner:  *owner,
+		Client: upstreamHttpClient(*upstream),
+	}
+	resources, err := director.ListOwnedResources()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch *format {
+	case "json":
+		if resources == nil {
+			resources = []sockguard.OwnedResource{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(resources); err != nil {
+			log.Fatal(err)
+		}
+	case "table":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "KIND\tID\tCREATED\tRUNNING")
+		for _, resource := range resources {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%t\n", resource.Kind, resource.ID, resource.Created.Format(time.RFC3339), resource.Running)
+		}
+		_ = tw.Flush()
+	default:
+		log.Fatalf("Unknown format %q, expected table or json", *format)
+	}
+}
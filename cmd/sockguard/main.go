@@ -1,173 +1,66 @@
 package main
 
 import (
-	"context"
-	"flag"
 	"fmt"
-	"log"
-	"net"
-	"net/http"
 	"os"
-	"os/signal"
-	"strconv"
 	"strings"
-	"syscall"
-
-	"github.com/buildkite/sockguard"
-	"github.com/buildkite/sockguard/socketproxy"
 )
 
 var (
 	debug bool
 )
 
-func init() {
-	flag.BoolVar(&debug, "debug", false, "Show debugging logging for the socket")
+// commands are the subcommands of sockguard, see usage
+var commands = []struct {
+	name    string
+	summary string
+	run     func(args []string)
+}{
+	{"serve", "Run a guarded socket (the default)", serve},
+	{"validate", "Check the options of serve, without serving", validate},
+	{"test", "Report what the rules decide for a request", simulate},
+	{"exec", "Run a command with a temporary guarded socket", execCommand},
+	{"gc", "Remove the resources of an owner", gc},
+	{"list", "List the resources of an owner", list},
+	{"bench", "Measure the latency sockguard adds", bench},
+	{"version", "Print the version of sockguard", version},
 }
 
-func main() {
-	filename := flag.String("filename", "sockguard.sock", "The guarded socket to create")
-	socketMode := flag.String("mode", "0600", "Permissions of the guarded socket")
-	socketUid := flag.Int("uid", -1, "The UID (owner) of the guarded socket (defaults to -1 - process owner)")
-	socketGid := flag.Int("gid", -1, "The GID (group) of the guarded socket (defaults to -1 - process group)")
-	upstream := flag.String("upstream-socket", "/var/run/docker.sock", "The path to the original docker socket")
-	owner := flag.String("owner-label", "", "The value to use as the owner of the socket, defaults to the process id")
-	allowBind := flag.String("allow-bind", "", "A path to allow host binds to occur under")
-	allowHostModeNetworking := flag.Bool("allow-host-mode-networking", false, "Allow containers to run with --net host")
-	cgroupParent := flag.String("cgroup-parent", "", "Set CgroupParent to an arbitrary value on new containers")
-	user := flag.String("user", "", "Forces --user on containers")
-	dockerLink := flag.String("docker-link", "", "Add a Docker --link from any spawned containers to another container")
-	containerJoinNetwork := flag.String("container-join-network", "", "Always connect this container to new user defined bridge networks (and disconnect on delete)")
-	containerJoinNetworkAlias := flag.String("container-join-network-alias", "", "Alias for network connection of specified container (Requires -container-join-network)")
-	flag.Parse()
-
-	if debug {
-		socketproxy.Debug = true
-	}
-
-	if *socketUid == -1 {
-		// Default to the process UID
-		sockUid := os.Getuid()
-		socketUid = &sockUid
-	}
-	if *socketGid == -1 {
-		// Default to the process GID
-		sockGid := os.Getgid()
-		socketGid = &sockGid
-	}
-
-	useSocketMode, err := strconv.ParseUint(*socketMode, 0, 32)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	if *owner == "" {
-		*owner = fmt.Sprintf("sockguard-pid-%d", os.Getpid())
-	}
-
-	var allowBinds []string
-
-	if *allowBind != "" {
-		allowBinds = strings.Split(*allowBind, ",")
-	}
-
-	if *cgroupParent != "" {
-		debugf("Setting CgroupParent on new containers to '%s'", *cgroupParent)
-	}
-
-	// These should not be used together, one or the other
-	if *dockerLink != "" && *containerJoinNetwork != "" {
-		log.Fatal("Error: -docker-link and -join-network should not be used together.")
-	}
-
-	// Make sure -container-join-network-alias is only specified if -container-join-network is set
-	if *containerJoinNetworkAlias != "" && *containerJoinNetwork == "" {
-		log.Fatal("Error: -container-join-network-alias requires -container-join-network")
-	}
-
-	proxyHttpClient := http.Client{
-		Transport: &http.Transport{
-			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
-				debugf("Dialing directly")
-				return net.Dial("unix", *upstream)
-			},
-		},
-	}
-
-	if *dockerLink != "" {
-		container, _, err := parseDockerLink(*dockerLink)
-		if err != nil {
-			log.Fatal(err)
-		}
-		dockerLinkContainerExists, err := sockguard.CheckContainerExists(&proxyHttpClient, container)
-		if err != nil {
-			log.Fatal(err.Error())
-		}
-		if dockerLinkContainerExists == false {
-			log.Fatalf("Error: -docker-link '%s' specified but this container does not exist", container)
-		}
-		debugf("Adding a Docker --link to new containers: '%s'", *dockerLink)
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [options]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", cmd.name, cmd.summary)
 	}
+	fmt.Fprintf(os.Stderr, "\nRun %s <command> -h for the options of a command. Without a command, serve is run.\n", os.Args[0])
+}
 
-	if *containerJoinNetwork != "" {
-		// TODOLATER: how much does it matter that this container is running?
-		joinNetworkContainerExists, err := sockguard.CheckContainerExists(&proxyHttpClient, *containerJoinNetwork)
-		if err != nil {
-			log.Fatal(err.Error())
-		}
-		if joinNetworkContainerExists == false {
-			log.Fatalf("Error: -container-join-network '%s' specified but this container does not exist", *containerJoinNetwork)
-		}
-		debugContainerJoinNetworkAlias := ""
-		if *containerJoinNetworkAlias != "" {
-			debugContainerJoinNetworkAlias = fmt.Sprintf(" (using alias '%s')", *containerJoinNetworkAlias)
-		}
-		debugf("Container '%s'%s will always be connected to user defined bridged networks created via sockguard", *containerJoinNetwork, debugContainerJoinNetworkAlias)
+func main() {
+	if len(os.Args) == 2 && (os.Args[1] == "-version" || os.Args[1] == "--version") {
+		version(nil)
+		return
 	}
 
-	proxy := socketproxy.New(*upstream, &sockguard.RulesDirector{
-		AllowBinds:                allowBinds,
-		AllowHostModeNetworking:   *allowHostModeNetworking,
-		ContainerCgroupParent:     *cgroupParent,
-		ContainerDockerLink:       *dockerLink,
-		ContainerJoinNetwork:      *containerJoinNetwork,
-		ContainerJoinNetworkAlias: *containerJoinNetworkAlias,
-		Owner:                     *owner,
-		User:                      *user,
-		Client:                    &proxyHttpClient,
-	})
-	listener, err := net.Listen("unix", *filename)
-	if err != nil {
-		log.Fatal(err)
+	// Bare invocations and ones starting with a flag serve, as before there were subcommands
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		serve(os.Args[1:])
+		return
 	}
 
-	if *socketUid >= 0 && *socketGid >= 0 {
-		if err = os.Chown(*filename, *socketUid, *socketGid); err != nil {
-			_ = listener.Close()
-			log.Fatal(err)
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			cmd.run(os.Args[2:])
+			return
 		}
 	}
 
-	if err = os.Chmod(*filename, os.FileMode(useSocketMode)); err != nil {
-		_ = listener.Close()
-		log.Fatal(err)
+	if os.Args[1] == "help" {
+		usage()
+		return
 	}
 
-	fmt.Printf("Listening on %s (socket UID %d GID %d permissions %s), upstream is %s\n", *filename, *socketUid, *socketGid, *socketMode, *upstream)
-
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, os.Kill, syscall.SIGTERM)
-
-	go func() {
-		sig := <-sigCh
-		debugf("Caught signal %s: shutting down.", sig)
-		_ = listener.Close()
-		os.Exit(0)
-	}()
-
-	if err = http.Serve(listener, proxy); err != nil {
-		log.Fatal(err)
-	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", os.Args[1])
+	usage()
+	os.Exit(2)
 }
 
 // extractd from director.go, to be refactored out
@@ -183,6 +76,17 @@ func parseDockerLink(input string) (string, string, error) {
 		"Unable to parse docker link %q, expected container:alias", input)
 }
 
+// ownerFromEnvironment returns the value of the first of the environment variables that is set
+func ownerFromEnvironment(names []string) string {
+	for _, name := range names {
+		if value := os.Getenv(strings.TrimSpace(name)); value != "" {
+			debugf("Using owner %q from $%s", value, name)
+			return value
+		}
+	}
+	return ""
+}
+
 func debugf(format string, v ...interface{}) {
 	if debug {
 		fmt.Printf(format+"\n", v...)
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// profiles are presets of serve flags for workloads that need a particular combination of them,
+// applied with -profile. Flags that are set explicitly take precedence.
+var profiles = map[string]map[string]string{
+	// docker:dind sidecars run their own daemon, which needs to be privileged. The anonymous
+	// volumes the image declares (/var/lib/docker and /certs) are allowed without any flags.
+	//
+	// No cgroup flags are needed: privileged containers get a writable cgroup filesystem, and on
+	// cgroup v2 their own cgroup namespace, so the inner daemon nests its containers' cgroups under
+	// the sidecar's. Those containers are then accounted to, and limited by, the sidecar's cgroup
+	// (including -container-cgroup-parent and -container-limits, which still apply to it).
+	"dind": {
+		"allow-privileged": "true",
+	},
+}
+
+// profileRequiredFlags are the flags a profile can't default, which must be set explicitly
+var profileRequiredFlags = map[string][]string{
+	// privileged containers have full access to the host, so only a digest pinned docker:dind
+	// image can be allowed, and which one is up to the operator
+	"dind": {"allow-privileged-images"},
+}
+
+// profileNames returns the names of the profiles, for usage and errors
+func profileNames() string {
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// applyProfile sets the flags of a profile on fs that haven't been set explicitly
+func applyProfile(fs *flag.FlagSet, name string) error {
+	profile, ok := profiles[name]
+	if !ok {
+		return fmt.Errorf("Unknown profile %q, expected one of %s", name, profileNames())
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	for _, flagName := range profileRequiredFlags[name] {
+		if !set[flagName] {
+			return fmt.Errorf("Profile %s requires -%s to be set", name, flagName)
+		}
+	}
+
+	for flagName, value := range profile {
+		if set[flagName] {
+			continue
+		}
+		if err := fs.Set(flagName, value); err != nil {
+			return err
+		}
+		debugf("Profile %s set -%s=%s", name, flagName, value)
+	}
+	return nil
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildkite/sockguard"
+	"github.com/buildkite/sockguard/guard"
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// serveConfig is what serve runs, built from its flags
+type serveConfig struct {
+	guard.Config
+	// Start even if the upstream docker daemon is older than supported
+	skipVersionCheck bool
+}
+
+// serve runs a guarded socket until interrupted. It's also what a bare invocation (or one
+// starting with a flag) runs, as sockguard did before it had subcommands.
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s serve [options]\n\nRuns a guarded socket that proxies to the docker socket.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	config := serveFlags(fs)
+	_ = fs.Parse(args)
+
+	cfg, err := config()
+	if err != nil {
+		log.Fatal(err)
+	}
+	director, err := sockguard.NewDirector(cfg.Rules...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if errs := checkUpstream(cfg, director, false); len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("Error: %v", err)
+		}
+		os.Exit(1)
+	}
+
+	if err := guard.Run(context.Background(), cfg.Config); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serveFlags defines the flags of serve on fs, returning a function that builds a serveConfig
+// from them once they're parsed
+func serveFlags(fs *flag.FlagSet) func() (serveConfig, error) {
+	fs.BoolVar(&debug, "debug", false, "Show debugging logging for the socket")
+	profile := fs.String("profile", "", "A preset of options for a kind of workload (one of "+profileNames()+"), options that are set explicitly take precedence")
+	filename := fs.String("filename", "sockguard.sock", "The guarded socket to create")
+	socketMode := fs.String("mode", "0600", "Permissions of the guarded socket")
+	socketUid := fs.Int("uid", -1, "The UID (owner) of the guarded socket (defaults to -1 - process owner)")
+	socketGid := fs.Int("gid", -1, "The GID (group) of the guarded socket (defaults to -1 - process group)")
+	socketUser := fs.String("user-owner", "", "The name of the user to own the guarded socket, instead of -uid")
+	socketGroup := fs.String("group", "", "The name of the group of the guarded socket (e.g. docker-users), instead of -gid")
+	upstream := fs.String("upstream-socket", "/var/run/docker.sock", "The path to the original docker socket")
+	owner := fs.String("owner-label", "", "The value to use as the owner of the socket, defaults to the process id")
+	trustOwnerHeader := fs.Bool("trust-owner-header", false, "Use the owner in the X-Sockguard-Owner header when set, for use behind a trusted front proxy (the socket must only be reachable via that proxy)")
+	denyStatusCode := fs.Int("deny-status-code", 0, "The status code of responses to denied requests, e.g. 403 (defaults to 401)")
+	denyMessage := fs.String("deny-message", "", "A template for the message of responses to denied requests, with {reason}, {endpoint} and {owner} replaced, e.g. '{reason} (see https://example.com/runbook)'")
+	strict := fs.Bool("strict", false, "Deny anything the rules don't explicitly recognize and allow (e.g. unknown HostConfig fields, volume driver options and image imports), rather than passing it on")
+	allowEndpoints := fs.String("allow-endpoints", "", "Comma separated endpoints that are the only ones that can be used, as a method and a path where * matches a path segment and ** one or more, e.g. 'POST /containers/create,GET /containers/*/logs'")
+	alsoAllowOwners := fs.String("also-allow-owners", "", "Comma separated owners whose resources can also be accessed, e.g. those of a shared cache warming job")
+	allowUnowned := fs.String("allow-unowned", "", "Comma separated kinds (containers, images, networks, volumes, services, secrets or configs) that can be accessed without an owner label")
+	denyUnowned := fs.String("deny-unowned", "", "Comma separated kinds (containers, images, networks, volumes, services, secrets or configs) that can't be accessed without an owner label")
+	ownerFromEnv := fs.String("owner-from-env", "", "Comma separated environment variables (e.g. BUILDKITE_JOB_ID) to use the first set of as the owner, if -owner-label isn't set")
+	allowBind := fs.String("allow-bind", "", "A path to allow host binds to occur under")
+	allowVolumes := fs.String("allow-volumes", "", "Comma separated named volume patterns (e.g. cache-*) that containers can mount without owning them")
+	allowNetworks := fs.String("allow-networks", "", "Comma separated network patterns (e.g. ci-*) that containers can attach to without owning them")
+	allowImages := fs.String("allow-images", "", "Comma separated image repository patterns (e.g. registry.example.com/*) that can be pulled or used for containers, defaults to any")
+	allowPlatforms := fs.String("allow-platforms", "", "Comma separated platforms (e.g. linux/amd64) that images can be pulled and containers created for, defaults to any")
+	allowPushImages := fs.String("allow-push-images", "", "Comma separated image repository patterns that can be pushed without being built by this owner")
+	rewriteImages := fs.String("rewrite-images", "", "Comma separated from=to rules to rewrite image pulls with, e.g. docker.io/*=mirror.example.com/* (pulled images are tagged with the original name)")
+	requireImageDigest := fs.Bool("require-image-digest", false, "Require images to be referenced by digest (repo@sha256:...) when pulled or used for containers")
+	denyLatestImageTag := fs.Bool("deny-latest-tag", false, "Deny images referenced by the latest tag (or no tag) when pulled or used for containers")
+	verifyImageKeys := fs.String("verify-image-keys", "", "Comma separated cosign public keys to verify image signatures against before pulling")
+	cosignPath := fs.String("cosign-path", "cosign", "The path to the cosign binary, used with -verify-image-keys")
+	denyBuildRemotes := fs.Bool("deny-build-remotes", false, "Deny image builds from remote contexts (git repositories or URLs)")
+	allowBuildRemotes := fs.String("allow-build-remotes", "", "Comma separated patterns (e.g. https://github.com/example/*) of remote build contexts to allow, defaults to any")
+	denyExtraHosts := fs.Bool("deny-extra-hosts", false, "Deny containers and builds from adding /etc/hosts entries (--add-host)")
+	denyUlimits := fs.Bool("deny-ulimits", false, "Deny containers and builds from setting ulimits (--ulimit)")
+	allowRuntimes := fs.String("allow-runtimes", "", "Comma separated OCI runtimes (e.g. nvidia,sysbox-runc) that are the only ones containers can use besides the default")
+	allowIsolation := fs.String("allow-isolation", "", "Comma separated isolation technologies (e.g. hyperv) containers and builds can use besides the default")
+	denyBuildSquash := fs.Bool("deny-build-squash", false, "Deny image builds from squashing layers (--squash)")
+	buildkitImage := fs.String("buildkit-image", "", "A digest pinned BuildKit image (e.g. moby/buildkit@sha256:...) that can be run privileged, for docker buildx create")
+	allowPrivileged := fs.Bool("allow-privileged", false, "Allow containers to run privileged (e.g. docker:dind sidecars), which gives them full access to the host")
+	allowPrivilegedImages := fs.String("allow-privileged-images", "", "Comma separated digest pinned images (e.g. docker@sha256:...) that can run privileged with -allow-privileged, defaults to any")
+	containerLimits := fs.String("container-limits", "", "Comma separated param=value maximums for container Memory, MemorySwap, NanoCpus, CpuShares, CpuPeriod, CpuQuota and PidsLimit, applied on create and update")
+	containerLogDriver := fs.String("container-log-driver", "", "Force containers to use this log driver (json-file or local), other drivers are denied")
+	containerLogOpts := fs.String("container-log-opts", "", "Comma separated key=value options for the forced log driver, e.g. max-size=10m,max-file=3")
+	containerStorageSize := fs.String("container-storage-size", "", "The size of the writable layer of containers that don't set one (--storage-opt size), e.g. 20G, on storage drivers that support it")
+	maxContainerStorageSize := fs.String("max-container-storage-size", "", "The maximum size of the writable layer containers can set (--storage-opt size), e.g. 50G, also the default if -container-storage-size isn't set")
+	ownerQuota := fs.String("owner-quota", "", "Comma separated param=value budgets for the total Memory and NanoCpus of all containers with the owner, checked on create")
+	buildDefaults := fs.String("build-defaults", "", "Comma separated param=value defaults for build memory, memswap, cpuperiod, cpuquota and cpushares (e.g. memory=1073741824)")
+	buildLimits := fs.String("build-limits", "", "Comma separated param=value maximums for build memory, memswap, cpuperiod, cpuquota and cpushares")
+	dockerfilePolicyFile := fs.String("dockerfile-policy-file", "", "A file of regular expressions, one per line, matching Dockerfile instructions to deny in builds")
+	buildCacheQuota := fs.Int64("build-cache-quota", 0, "Maximum bytes of build cache that builds can create before further builds are denied, defaults to unlimited")
+	allowBuildPrune := fs.Bool("allow-build-prune", false, "Allow pruning dangling build cache, which is shared between owners (all is removed so only dangling cache is pruned)")
+	minFreeSpace := fs.Uint64("min-free-space", 0, "Deny image pulls and builds when the docker daemon's data-root has less than this many bytes free")
+	dataRoot := fs.String("data-root", "", "The path of the docker daemon's data-root to check the free space of, defaults to the DockerRootDir reported by the daemon")
+	maxStreamRate := fs.Int64("max-stream-rate", 0, "Bytes per second to throttle the image pull and build streams of each owner to (in total), defaults to unlimited")
+	buildNetwork := fs.String("build-network", "", "Force image builds to use this network for RUN steps")
+	denyBuildSecrets := fs.Bool("deny-build-secrets", false, "Deny BuildKit builds from using secrets (--secret)")
+	denyBuildSSH := fs.Bool("deny-build-ssh", false, "Deny BuildKit builds from using ssh forwarding (--ssh)")
+	registryAuthFile := fs.String("registry-auth-file", "", "A docker config.json format file of registry credentials to inject into pulls and builds (defaults to the contents of $SOCKGUARD_REGISTRY_AUTH)")
+	denyBind := fs.String("deny-bind", "", "A path to deny host binds of, even if under an -allow-bind path (/var/run/docker.sock, /proc, /sys and /etc are always denied)")
+	skipVersionCheck := fs.Bool("skip-version-check", false, "Start even if the upstream docker daemon's API version is older than sockguard supports")
+	maxAPIVersion := fs.String("max-api-version", "", "The newest docker API version (e.g. 1.41) clients can use, clients negotiate down to it")
+	redactInspectEnv := fs.String("redact-inspect-env", "", "Comma separated env var names (or patterns, e.g. *_TOKEN) to redact the values of in container inspects")
+	redactInspectHostPaths := fs.Bool("redact-inspect-host-paths", false, "Redact host paths (binds, mount sources, log and storage paths) from container inspects")
+	denyContainerNames := fs.Bool("deny-container-names", false, "Deny containers being given names (docker run --name, docker rename), so they all get generated names")
+	prefixNames := fs.Bool("prefix-names", false, "Prefix the names of created containers, networks and volumes with the owner, so parallel jobs don't collide")
+	scrubInfo := fs.Bool("scrub-info", false, "Remove host details (registry config, labels, security options etc) from /info responses")
+	filterListResponses := fs.Bool("filter-list-responses", false, "Remove entries not owned by us from container, image and network list responses, for daemons that don't fully apply label filters")
+	allowSwarm := fs.Bool("allow-swarm", false, "Allow services, tasks, secrets, configs and read-only node endpoints, with services, secrets and configs given the owner label (swarm management is always denied)")
+	denyConfigs := fs.Bool("deny-configs", false, "Deny swarm configs, even with -allow-swarm")
+	allowCheckpoints := fs.Bool("allow-checkpoints", false, "Allow the experimental container checkpoint endpoints (docker checkpoint), which dump process memory to disk")
+	allowCheckpointDir := fs.String("allow-checkpoint-dir", "", "Comma separated host paths that custom checkpoint directories (--checkpoint-dir) can be under, used with -allow-checkpoints")
+	allowKillSignals := fs.String("allow-kill-signals", "TERM,KILL,INT,HUP,QUIT", "Comma separated signals that can be sent to containers (docker kill --signal)")
+	denyArchiveWrite := fs.String("deny-archive-write", "", "Comma separated container paths (e.g. /etc) to deny copying files into (docker cp)")
+	denyArchiveRead := fs.String("deny-archive-read", "", "Comma separated container paths (e.g. /root) to deny copying files out of (docker cp)")
+	resolveBindSymlinks := fs.Bool("resolve-bind-symlinks", false, "Resolve symlinks in host bind paths (where they exist on this host) before checking -allow-bind")
+	allowSharedBindPropagation := fs.Bool("allow-shared-bind-propagation", false, "Allow shared/rshared propagation on host binds")
+	allowHostModeNetworking := fs.Bool("allow-host-mode-networking", false, "Allow containers to run with --net host")
+	cgroupParent := fs.String("cgroup-parent", "", "Set CgroupParent to an arbitrary value on new containers")
+	user := fs.String("user", "", "Forces --user on containers")
+	containerStopTimeout := fs.Int("container-stop-timeout", 0, "The seconds containers that don't set a --stop-timeout get to stop before they're killed (defaults to the daemon's 10s)")
+	minContainerStopTimeout := fs.Int("min-container-stop-timeout", 0, "The minimum --stop-timeout in seconds, containers setting less get this instead")
+	forceInit := fs.Bool("force-init", false, "Forces --init on containers, so zombie processes are reaped")
+	dockerLink := fs.String("docker-link", "", "Add a Docker --link from any spawned containers to another container")
+	containerJoinNetwork := fs.String("container-join-network", "", "Always connect this container to new user defined bridge networks (and disconnect on delete)")
+	containerJoinNetworkAlias := fs.String("container-join-network-alias", "", "Alias for network connection of specified container (Requires -container-join-network)")
+	cleanupOnExit := fs.Bool("cleanup-on-exit", false, "On exit, remove containers, networks, volumes and images with this owner")
+	cleanupForce := fs.Bool("cleanup-force", true, "Force removal of running containers, and images in use, with -cleanup-on-exit")
+	reapAfter := fs.Duration("reap-after", 0, "Periodically remove resources with this owner created longer ago than this (e.g. 2h) that aren't in use")
+	reapInterval := fs.Duration("reap-interval", 10*time.Minute, "How often to look for resources to remove with -reap-after")
+	maxStreamDuration := fs.String("max-stream-duration", "", "Comma separated kind=duration maximums for how long attach, logs, events, stats and exec streams can stay open, e.g. logs=2h,events=1h")
+	inspectCacheTTL := fs.Duration("inspect-cache-ttl", 0, "How long to cache the labels of containers, networks, services, secrets and configs inspected by ID for ownership checks (e.g. 2s), defaults to not caching")
+	maxRequests := fs.Int64("max-requests", 0, "Maximum concurrent requests (other than streaming ones) before requests are denied with a 503, defaults to unlimited")
+	maxStreamingRequests := fs.Int64("max-streaming-requests", 0, "Maximum concurrent streaming requests (attach, followed logs, events, pulls, builds etc) before they are denied with a 503, defaults to unlimited")
+	shedLatency := fs.Duration("shed-latency", 0, "Deny low priority requests (lists and stats) with a 503 while the docker daemon takes longer than this on average to respond (e.g. 2s)")
+	debugUnredacted := fs.Bool("debug-unredacted", false, "Don't redact build args and registry credentials in logs and debug output")
+	return func() (serveConfig, error) {
+		if *profile != "" {
+			if err := applyProfile(fs, *profile); err != nil {
+				return serveConfig{}, err
+			}
+		}
+
+		if debug {
+			socketproxy.Debug = true
+		}
+		if *debugUnredacted {
+			socketproxy.Redact = false
+		}
+
+		if *socketUser != "" {
+			if *socketUid != -1 {
+				return serveConfig{}, fmt.Errorf("-uid and -user-owner can't be used together")
+			}
+			sockUid, err := lookupUID(*socketUser)
+			if err != nil {
+				return serveConfig{}, err
+			}
+			socketUid = &sockUid
+		}
+		if *socketGroup != "" {
+			if *socketGid != -1 {
+				return serveConfig{}, fmt.Errorf("-gid and -group can't be used together")
+			}
+			sockGid, err := lookupGID(*socketGroup)
+			if err != nil {
+				return serveConfig{}, err
+			}
+			socketGid = &sockGid
+		}
+		if *socketUid == -1 {
+			// Default to the process UID
+			sockUid := os.Getuid()
+			socketUid = &sockUid
+		}
+		if *socketGid == -1 {
+			// Default to the process GID
+			sockGid := os.Getgid()
+			socketGid = &sockGid
+		}
+
+		useSocketMode, err := strconv.ParseUint(*socketMode, 0, 32)
+		if err != nil {
+			return serveConfig{}, err
+		}
+
+		if *owner == "" && *ownerFromEnv != "" {
+			*owner = ownerFromEnvironment(strings.Split(*ownerFromEnv, ","))
+		}
+		if *owner == "" {
+			*owner = fmt.Sprintf("sockguard-pid-%d", os.Getpid())
+		}
+
+		var alsoAllowOwnerList []string
+		if *alsoAllowOwners != "" {
+			alsoAllowOwnerList = strings.Split(*alsoAllowOwners, ",")
+		}
+
+		allowUnownedKinds := map[string]bool{}
+		for _, setting := range []struct {
+			kinds string
+			allow bool
+		}{{*allowUnowned, true}, {*denyUnowned, false}} {
+			if setting.kinds == "" {
+				continue
+			}
+			for _, kind := range strings.Split(setting.kinds, ",") {
+				switch kind {
+				case "containers", "images", "networks", "volumes", "services", "secrets", "configs":
+					allowUnownedKinds[kind] = setting.allow
+				default:
+					return serveConfig{}, fmt.Errorf("unknown kind %q, expected containers, images, networks, volumes, services, secrets or configs", kind)
+				}
+			}
+		}
+
+		var allowBinds []string
+
+		if *allowBind != "" {
+			allowBinds = strings.Split(*allowBind, ",")
+		}
+
+		var allowVolumePatterns []string
+
+		if *allowVolumes != "" {
+			allowVolumePatterns = strings.Split(*allowVolumes, ",")
+		}
+
+		var allowNetworkPatterns []string
+
+		if *allowNetworks != "" {
+			allowNetworkPatterns = strings.Split(*allowNetworks, ",")
+		}
+
+		var allowImagePatterns []string
+
+		if *allowImages != "" {
+			allowImagePatterns = strings.Split(*allowImages, ",")
+		}
+
+		var containerResourceLimits map[string]int64
+		if *containerLimits != "" {
+			if containerResourceLimits, err = sockguard.ParseContainerResources(*containerLimits); err != nil {
+				return serveConfig{}, err
+			}
+		}
+
+		var containerLogOptions map[string]string
+		if *containerLogOpts != "" {
+			if containerLogOptions, err = sockguard.ParseLogOptions(*containerLogOpts); err != nil {
+				return serveConfig{}, err
+			}
+		}
+
+		var containerStorageSizeBytes, maxContainerStorageSizeBytes int64
+		if *containerStorageSize != "" {
+			if containerStorageSizeBytes, err = sockguard.ParseStorageSize(*containerStorageSize); err != nil {
+				return serveConfig{}, err
+			}
+		}
+		if *maxContainerStorageSize != "" {
+			if maxContainerStorageSizeBytes, err = sockguard.ParseStorageSize(*maxContainerStorageSize); err != nil {
+				return serveConfig{}, err
+			}
+		}
+
+		var maxStreamDurations map[string]time.Duration
+		if *maxStreamDuration != "" {
+			if maxStreamDurations, err = sockguard.ParseStreamDurations(*maxStreamDuration); err != nil {
+				return serveConfig{}, err
+			}
+		}
+
+		var ownerResourceQuota map[string]int64
+		if *ownerQuota != "" {
+			if ownerResourceQuota, err = sockguard.ParseOwnerQuota(*ownerQuota); err != nil {
+				return serveConfig{}, err
+			}
+		}
+
+		var buildResourceDefaults, buildResourceLimits map[string]int64
+		if *buildDefaults != "" {
+			if buildResourceDefaults, err = sockguard.ParseBuildResources(*buildDefaults); err != nil {
+				return serveConfig{}, err
+			}
+		}
+		if *buildLimits != "" {
+			if buildResourceLimits, err = sockguard.ParseBuildResources(*buildLimits); err != nil {
+				return serveConfig{}, err
+			}
+		}
+
+		var denyDockerfilePatterns []*regexp.Regexp
+		if *dockerfilePolicyFile != "" {
+			if denyDockerfilePatterns, err = sockguard.LoadDockerfilePolicyFile(*dockerfilePolicyFile); err != nil {
+				return serveConfig{}, err
+			}
+		}
+
+		var allowPrivilegedImagePatterns []string
+		if *allowPrivilegedImages != "" {
+			allowPrivilegedImagePatterns = strings.Split(*allowPrivilegedImages, ",")
+		}
+
+		var allowEndpointList []string
+		if *allowEndpoints != "" {
+			allowEndpointList = strings.Split(*allowEndpoints, ",")
+		}
+
+		var allowRuntimeList []string
+		if *allowRuntimes != "" {
+			allowRuntimeList = strings.Split(*allowRuntimes, ",")
+		}
+
+		var allowIsolationList []string
+		if *allowIsolation != "" {
+			allowIsolationList = strings.Split(*allowIsolation, ",")
+		}
+
+		var allowBuildRemotePatterns []string
+		if *allowBuildRemotes != "" {
+			allowBuildRemotePatterns = strings.Split(*allowBuildRemotes, ",")
+		}
+
+		var allowPlatformList []string
+
+		if *allowPlatforms != "" {
+			allowPlatformList = strings.Split(*allowPlatforms, ",")
+		}
+
+		var allowPushImagePatterns []string
+
+		if *allowPushImages != "" {
+			allowPushImagePatterns = strings.Split(*allowPushImages, ",")
+		}
+
+		var imageRewrites []sockguard.ImageRewrite
+
+		if *rewriteImages != "" {
+			for _, rule := range strings.Split(*rewriteImages, ",") {
+				rewrite, err := sockguard.ParseImageRewrite(rule)
+				if err != nil {
+					return serveConfig{}, err
+				}
+				debugf("Rewriting pulls of %s to %s", rewrite.From, rewrite.To)
+				imageRewrites = append(imageRewrites, rewrite)
+			}
+		}
+
+		var imageVerifier sockguard.ImageVerifier
+
+		if *verifyImageKeys != "" {
+			imageVerifier = &sockguard.CosignVerifier{
+				Path: *cosignPath,
+				Keys: strings.Split(*verifyImageKeys, ","),
+			}
+			debugf("Verifying image signatures with cosign keys %s", *verifyImageKeys)
+		}
+
+		var registryAuth sockguard.RegistryAuth
+
+		if *registryAuthFile != "" {
+			registryAuth, err = sockguard.LoadRegistryAuthFile(*registryAuthFile)
+			if err != nil {
+				return serveConfig{}, err
+			}
+		} else if env := os.Getenv("SOCKGUARD_REGISTRY_AUTH"); env != "" {
+			registryAuth, err = sockguard.ParseRegistryAuth([]byte(env))
+			if err != nil {
+				return serveConfig{}, err
+			}
+		}
+
+		for domain := range registryAuth {
+			debugf("Injecting registry credentials for %s", domain)
+		}
+
+		var denyBinds []string
+
+		if *denyBind != "" {
+			denyBinds = strings.Split(*denyBind, ",")
+		}
+
+		var redactInspectEnvNames []string
+
+		if *redactInspectEnv != "" {
+			redactInspectEnvNames = strings.Split(*redactInspectEnv, ",")
+		}
+
+		var allowCheckpointDirs []string
+
+		if *allowCheckpointDir != "" {
+			allowCheckpointDirs = strings.Split(*allowCheckpointDir, ",")
+		}
+
+		// empty entries are dropped, and an empty list allows no signals rather than the defaults
+		allowKillSignalList := []string{}
+		for _, signal := range strings.Split(*allowKillSignals, ",") {
+			if signal = strings.TrimSpace(signal); signal != "" {
+				allowKillSignalList = append(allowKillSignalList, signal)
+			}
+		}
+
+		var denyArchiveWritePaths, denyArchiveReadPaths []string
+
+		if *denyArchiveWrite != "" {
+			denyArchiveWritePaths = strings.Split(*denyArchiveWrite, ",")
+		}
+		if *denyArchiveRead != "" {
+			denyArchiveReadPaths = strings.Split(*denyArchiveRead, ",")
+		}
+
+		if *cgroupParent != "" {
+			debugf("Setting CgroupParent on new containers to '%s'", *cgroupParent)
+		}
+
+		proxyHttpClient := upstreamHttpClient(*upstream)
+
+		rules := []sockguard.Option{
+			sockguard.WithAllowBinds(allowBinds),
+			sockguard.WithDenyBinds(denyBinds),
+			sockguard.WithAllowSwarm(*allowSwarm),
+			sockguard.WithFilterListResponses(*filterListResponses),
+			sockguard.WithScrubInfo(*scrubInfo),
+			sockguard.WithDenyContainerNames(*denyContainerNames),
+			sockguard.WithPrefixNames(*prefixNames),
+			sockguard.WithRedactInspectEnv(redactInspectEnvNames),
+			sockguard.WithRedactInspectHostPaths(*redactInspectHostPaths),
+			sockguard.WithMaxAPIVersion(*maxAPIVersion),
+			sockguard.WithDenyConfigs(*denyConfigs),
+			sockguard.WithAllowCheckpoints(*allowCheckpoints),
+			sockguard.WithAllowCheckpointDirs(allowCheckpointDirs),
+			sockguard.WithAllowKillSignals(allowKillSignalList),
+			sockguard.WithDenyArchiveWritePaths(denyArchiveWritePaths),
+			sockguard.WithDenyArchiveReadPaths(denyArchiveReadPaths),
+			sockguard.WithAllowVolumes(allowVolumePatterns),
+			sockguard.WithAllowNetworks(allowNetworkPatterns),
+			sockguard.WithAllowImages(allowImagePatterns),
+			sockguard.WithAllowPushImages(allowPushImagePatterns),
+			sockguard.WithAllowPlatforms(allowPlatformList),
+			sockguard.WithImageRewrites(imageRewrites),
+			sockguard.WithRequireImageDigest(*requireImageDigest),
+			sockguard.WithDenyLatestImageTag(*denyLatestImageTag),
+			sockguard.WithImageVerifier(imageVerifier),
+			sockguard.WithRegistryAuth(registryAuth),
+			sockguard.WithDenyBuildRemotes(*denyBuildRemotes),
+			sockguard.WithAllowBuildRemotes(allowBuildRemotePatterns),
+			sockguard.WithBuildNetwork(*buildNetwork),
+			sockguard.WithAllowBuildPrune(*allowBuildPrune),
+			sockguard.WithBuildCacheQuota(*buildCacheQuota),
+			sockguard.WithDenyDockerfilePatterns(denyDockerfilePatterns),
+			sockguard.WithBuildResourceDefaults(buildResourceDefaults),
+			sockguard.WithBuildResourceLimits(buildResourceLimits),
+			sockguard.WithBuildkitImage(*buildkitImage),
+			sockguard.WithAllowPrivileged(*allowPrivileged),
+			sockguard.WithAllowPrivilegedImages(allowPrivilegedImagePatterns),
+			sockguard.WithContainerResourceLimits(containerResourceLimits),
+			sockguard.WithContainerLogDriver(*containerLogDriver),
+			sockguard.WithContainerLogOptions(containerLogOptions),
+			sockguard.WithContainerStorageSize(containerStorageSizeBytes),
+			sockguard.WithMaxContainerStorageSize(maxContainerStorageSizeBytes),
+			sockguard.WithOwnerQuota(ownerResourceQuota),
+			sockguard.WithMinFreeDiskSpace(*minFreeSpace),
+			sockguard.WithDataRoot(*dataRoot),
+			sockguard.WithMaxStreamRate(*maxStreamRate),
+			sockguard.WithMaxStreamDurations(maxStreamDurations),
+			sockguard.WithInspectCacheTTL(*inspectCacheTTL),
+			sockguard.WithDenyExtraHosts(*denyExtraHosts),
+			sockguard.WithDenyUlimits(*denyUlimits),
+			sockguard.WithAllowIsolation(allowIsolationList),
+			sockguard.WithAllowRuntimes(allowRuntimeList),
+			sockguard.WithDenyBuildSquash(*denyBuildSquash),
+			sockguard.WithDenyBuildSecrets(*denyBuildSecrets),
+			sockguard.WithDenyBuildSSH(*denyBuildSSH),
+			sockguard.WithAllowHostModeNetworking(*allowHostModeNetworking),
+			sockguard.WithResolveBindSymlinks(*resolveBindSymlinks),
+			sockguard.WithAllowSharedBindPropagation(*allowSharedBindPropagation),
+			sockguard.WithContainerCgroupParent(*cgroupParent),
+			sockguard.WithContainerDockerLink(*dockerLink),
+			sockguard.WithContainerJoinNetwork(*containerJoinNetwork),
+			sockguard.WithContainerJoinNetworkAlias(*containerJoinNetworkAlias),
+			sockguard.WithOwner(*owner),
+			sockguard.WithTrustOwnerHeader(*trustOwnerHeader),
+			sockguard.WithDenyStatusCode(*denyStatusCode),
+			sockguard.WithDenyMessage(*denyMessage),
+			sockguard.WithStrict(*strict),
+			sockguard.WithAllowEndpoints(allowEndpointList),
+			sockguard.WithAlsoAllowOwners(alsoAllowOwnerList),
+			sockguard.WithAllowUnowned(allowUnownedKinds),
+			sockguard.WithUser(*user),
+			sockguard.WithForceInit(*forceInit),
+			sockguard.WithContainerStopTimeout(*containerStopTimeout),
+			sockguard.WithMinContainerStopTimeout(*minContainerStopTimeout),
+			sockguard.WithClient(proxyHttpClient),
+		}
+
+		uid, gid := 0, 0
+		if *socketUid >= 0 && *socketGid >= 0 {
+			uid, gid = *socketUid, *socketGid
+		}
+
+		return serveConfig{
+			Config: guard.Config{
+				Listen:               *filename,
+				Upstream:             *upstream,
+				Rules:                rules,
+				Mode:                 os.FileMode(useSocketMode),
+				UID:                  uid,
+				GID:                  gid,
+				MaxRequests:          *maxRequests,
+				MaxStreamingRequests: *maxStreamingRequests,
+				ShedLatency:          *shedLatency,
+				Cleanup:              *cleanupOnExit,
+				CleanupForce:         *cleanupForce,
+				ReapAfter:            *reapAfter,
+				ReapInterval:         *reapInterval,
+				HandleSignals:        true,
+				Ready: func() {
+					fmt.Printf("Listening on %s (socket UID %d GID %d permissions %s), upstream is %s\n", *filename, *socketUid, *socketGid, *socketMode, *upstream)
+				},
+				Logger: log.New(os.Stderr, "", log.Ltime|log.Lmicroseconds),
+			},
+			skipVersionCheck: *skipVersionCheck,
+		}, nil
+	}
+}
+
+// lookupUID returns the UID of a user, by name in the OS user database
+func lookupUID(name string) (int, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to find the user %q for -user-owner: %v", name, err)
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGID returns the GID of a group, by name in the OS group database
+func lookupGID(name string) (int, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to find the group %q for -group: %v", name, err)
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// checkUpstream checks the upstream docker daemon is new enough for sockguard (unless skipped)
+// and that containers the rules refer to exist. An unreachable daemon is only a warning unless
+// strict, as it may still be starting.
+func checkUpstream(cfg serveConfig, director *sockguard.RulesDirector, strict bool) []error {
+	var errs []error
+
+	// strict checks always check the daemon is reachable, even if its version isn't checked
+	if strict || !cfg.skipVersionCheck {
+		daemonAPIVersion, supported, err := sockguard.CheckUpstreamAPIVersion(director.Client)
+		switch {
+		case err != nil && strict:
+			// nothing else can be checked without the daemon
+			return []error{fmt.Errorf("unable to reach the docker daemon at %s: %v", cfg.Upstream, err)}
+		case err != nil:
+			log.Printf("Warning: unable to check the API version of %s: %v", cfg.Upstream, err)
+		case !supported && !cfg.skipVersionCheck:
+			errs = append(errs, fmt.Errorf("the docker daemon at %s has API version %s, which is older than sockguard supports (use -skip-version-check to start anyway)", cfg.Upstream, daemonAPIVersion))
+		default:
+			debugf("Upstream docker daemon has API version %s", daemonAPIVersion)
+		}
+	}
+
+	if director.ContainerDockerLink != "" {
+		container, _, err := parseDockerLink(director.ContainerDockerLink)
+		if err != nil {
+			return append(errs, err)
+		}
+		dockerLinkContainerExists, err := sockguard.CheckContainerExists(director.Client, container)
+		if err != nil {
+			errs = append(errs, err)
+		} else if dockerLinkContainerExists == false {
+			errs = append(errs, fmt.Errorf("-docker-link '%s' specified but this container does not exist", container))
+		} else {
+			debugf("Adding a Docker --link to new containers: '%s'", director.ContainerDockerLink)
+		}
+	}
+
+	if director.ContainerJoinNetwork != "" {
+		// TODOLATER: how much does it matter that this container is running?
+		joinNetworkContainerExists, err := sockguard.CheckContainerExists(director.Client, director.ContainerJoinNetwork)
+		if err != nil {
+			errs = append(errs, err)
+		} else if joinNetworkContainerExists == false {
+			errs = append(errs, fmt.Errorf("-container-join-network '%s' specified but this container does not exist", director.ContainerJoinNetwork))
+		} else {
+			debugContainerJoinNetworkAlias := ""
+			if director.ContainerJoinNetworkAlias != "" {
+				debugContainerJoinNetworkAlias = fmt.Sprintf(" (using alias '%s')", director.ContainerJoinNetworkAlias)
+			}
+			debugf("Container '%s'%s will always be connected to user defined bridged networks created via sockguard", director.ContainerJoinNetwork, debugContainerJoinNetworkAlias)
+		}
+	}
+
+	return errs
+}
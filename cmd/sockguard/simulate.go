@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/buildkite/sockguard"
+)
+
+// simulate reports what the rules serve would be run with decide for a request, without passing
+// it on to the docker daemon, so policies can be checked without running docker commands
+func simulate(args []string) {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s test [serve options] <method> <path> [body]\n\nReports whether the rules would allow, deny or modify a request, and the request that would be\nsent to the docker daemon. A body of - is read from stdin. Only requests that read from the\ndaemon (e.g. ownership inspects) are made. Exits 1 if the request would be denied.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	config := serveFlags(fs)
+	_ = fs.Parse(args)
+
+	if fs.NArg() < 2 || fs.NArg() > 3 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	method, path := strings.ToUpper(fs.Arg(0)), fs.Arg(1)
+
+	var body []byte
+	if fs.NArg() == 3 {
+		if fs.Arg(2) == "-" {
+			var err error
+			if body, err = ioutil.ReadAll(os.Stdin); err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			body = []byte(fs.Arg(2))
+		}
+	}
+
+	cfg, err := config()
+	if err != nil {
+		log.Fatal(err)
+	}
+	upstreamClient := upstreamHttpClient(cfg.Upstream)
+	director, err := sockguard.NewDirector(append(cfg.Rules, sockguard.WithClient(&http.Client{
+		Transport: readOnlyTransport{upstreamClient.Transport},
+	}))...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sim := simulateRequest(director, log.New(os.Stderr, "", 0), method, path, body)
+	if sim.Decision == "deny" {
+		fmt.Printf("Decision: deny (%d %s)\n", sim.Code, sim.Message)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Decision: %s\n", sim.Decision)
+	if sim.Request == nil {
+		// the response was made by sockguard itself, e.g. a filtered list
+		fmt.Printf("Response: %d (made by sockguard)\n%s\n", sim.Code, indentJSON(sim.Body))
+		return
+	}
+	fmt.Printf("Request: %s %s\n", sim.Request.Method, sim.Request.URL.RequestURI())
+	if len(sim.Body) > 0 {
+		fmt.Printf("%s\n", indentJSON(sim.Body))
+	}
+}
+
+// simulation is the decision the rules made for a simulated request
+type simulation struct {
+	// allow, modify or deny
+	Decision string
+	// The status code of the response to the client
+	Code int
+	// The reason for a deny
+	Message string
+	// The request that would be sent to the docker daemon, if any
+	Request *http.Request
+	// The body of Request, or of the response if sockguard made it itself
+	Body []byte
+}
+
+// simulateRequest passes a request through director to a fake upstream, recording what would be
+// sent to the docker daemon. Any error response is a deny, even if upstream was reached.
+func simulateRequest(director *sockguard.RulesDirector, l *log.Logger, method, path string, body []byte) simulation {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	var upstreamReq *http.Request
+	var upstreamBody []byte
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstreamReq = req
+		if req.Body != nil {
+			upstreamBody, _ = ioutil.ReadAll(req.Body)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, "{}")
+	})
+
+	rec := httptest.NewRecorder()
+	director.Direct(l, req, upstream).ServeHTTP(rec, req)
+
+	if rec.Code >= http.StatusBadRequest {
+		var denied struct {
+			Message string `json:"message"`
+		}
+		_ = json.Unmarshal(rec.Body.Bytes(), &denied)
+		return simulation{Decision: "deny", Code: rec.Code, Message: denied.Message}
+	}
+
+	if upstreamReq == nil {
+		// sockguard made the request to the daemon itself, e.g. to filter the response
+		return simulation{Decision: "allow", Code: rec.Code, Body: rec.Body.Bytes()}
+	}
+
+	decision := "allow"
+	if upstreamReq.Method != method || upstreamReq.URL.RequestURI() != req.URL.RequestURI() || !sameBody(body, upstreamBody) {
+		decision = "modify"
+	}
+	return simulation{Decision: decision, Code: rec.Code, Request: upstreamReq, Body: upstreamBody}
+}
+
+// indentJSON indents a JSON body for printing, or returns it unchanged if it isn't JSON
+func indentJSON(body []byte) []byte {
+	var indented bytes.Buffer
+	if json.Indent(&indented, bytes.TrimSpace(body), "", "  ") != nil {
+		return body
+	}
+	return indented.Bytes()
+}
+
+// sameBody returns whether two request bodies are the same, ignoring JSON formatting and key order
+func sameBody(a, b []byte) bool {
+	var decodedA, decodedB interface{}
+	if json.Unmarshal(a, &decodedA) == nil && json.Unmarshal(b, &decodedB) == nil {
+		return reflect.DeepEqual(decodedA, decodedB)
+	}
+	return bytes.Equal(a, b)
+}
+
+// readOnlyTransport makes requests that only read from the daemon, such as the inspects of
+// ownership checks, and refuses the rest so simulated requests don't change anything
+type readOnlyTransport struct {
+	http.RoundTripper
+}
+
+func (t readOnlyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return nil, fmt.Errorf("%s %s would change the docker daemon, so isn't made by sockguard test", req.Method, req.URL.Path)
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
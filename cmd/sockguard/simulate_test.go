@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/sockguard"
+	"github.com/buildkite/sockguard/sockguardtest"
+)
+
+func TestSimulateRequest(t *testing.T) {
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"owned": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+			"other": sockguardtest.Container{
+				Owner: "other-owner",
+			},
+		},
+	}
+
+	director, err := sockguard.NewDirector(
+		sockguard.WithOwner("test-owner"),
+		sockguard.WithFilterListResponses(true),
+		sockguard.WithClient(us.Client()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := log.New(ioutil.Discard, "", 0)
+
+	tests := []struct {
+		method   string
+		path     string
+		body     string
+		decision string
+		// a string the body sent upstream, or of the response made by sockguard, contains
+		contains string
+	}{
+		{"POST", "/v1.37/containers/owned/kill", "", "allow", ""},
+		{"POST", "/v1.37/containers/other/kill", "", "deny", ""},
+		{"POST", "/v1.37/containers/create", `{"Image":"alpine","Labels":{}}`, "modify", `"com.buildkite.sockguard.owner":"test-owner"`},
+		// the list is made and filtered by sockguard, rather than passed upstream
+		{"GET", "/v1.37/containers/json", "", "allow", `"Id":"owned"`},
+	}
+
+	for _, test := range tests {
+		sim := simulateRequest(director, l, test.method, test.path, []byte(test.body))
+		if sim.Decision != test.decision {
+			t.Errorf("%s %s : expected %s, got %s (%d %s)", test.method, test.path, test.decision, sim.Decision, sim.Code, sim.Message)
+			continue
+		}
+		if !strings.Contains(string(sim.Body), test.contains) {
+			t.Errorf("%s %s : expected the body to contain %s, got %s", test.method, test.path, test.contains, sim.Body)
+		}
+	}
+
+	sim := simulateRequest(director, l, "GET", "/v1.37/containers/json", nil)
+	if strings.Contains(string(sim.Body), `"Id":"other"`) {
+		t.Errorf("Expected containers of other owners to be filtered out, got %s", sim.Body)
+	}
+}
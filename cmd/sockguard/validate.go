@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/buildkite/sockguard"
+)
+
+// validate checks the options serve would be run with, without serving, e.g. from an agent
+// bootstrap script so misconfiguration fails a job early rather than when docker is first used
+func validate(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s validate [serve options]\n\nChecks the options of serve, and any policy files they refer to, that the docker daemon is\nreachable and that containers the options refer to exist. Exits non-zero if any checks fail.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	config := serveFlags(fs)
+	_ = fs.Parse(args)
+
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Error: unexpected arguments %v\n", fs.Args())
+		os.Exit(2)
+	}
+
+	errs := validateServeConfig(config)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+	fmt.Println("OK")
+}
+
+// validateServeConfig builds the config from the parsed flags, validates the rules it
+// configures and checks them against the upstream daemon
+func validateServeConfig(config func() (serveConfig, error)) []error {
+	cfg, err := config()
+	if err != nil {
+		return []error{err}
+	}
+	director, err := sockguard.NewDirector(cfg.Rules...)
+	if err != nil {
+		return []error{err}
+	}
+	return checkUpstream(cfg, director, true)
+}
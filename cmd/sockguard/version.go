@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/buildkite/sockguard"
+)
+
+// version prints the version of sockguard and the docker API versions it supports
+func version(args []string) {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s version [options]\n\nPrints the version of sockguard and the docker API versions it supports.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	format := fs.String("format", "text", "Output format, text or json")
+	_ = fs.Parse(args)
+
+	info := sockguard.ReadBuildInfo()
+
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(info); err != nil {
+			log.Fatal(err)
+		}
+	case "text":
+		fmt.Printf("sockguard %s\n", info.Version)
+		if info.GitCommit != "" {
+			fmt.Printf("Git commit: %s\n", info.GitCommit)
+		}
+		fmt.Printf("Go version: %s\n", info.GoVersion)
+		fmt.Printf("Docker API versions: %s and newer (see -max-api-version)\n", info.MinAPIVersion)
+	default:
+		log.Fatalf("Unknown format %q, expected text or json", *format)
+	}
+}
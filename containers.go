@@ -0,0 +1,201 @@
+package sockguard
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+var (
+	defaultAllowKillSignals = []string{"TERM", "KILL", "INT", "HUP", "QUIT"}
+
+	// Linux signal numbers, as the daemon also accepts signals by number
+	signalNames = map[int]string{
+		1: "HUP", 2: "INT", 3: "QUIT", 4: "ILL", 5: "TRAP", 6: "ABRT", 7: "BUS", 8: "FPE",
+		9: "KILL", 10: "USR1", 11: "SEGV", 12: "USR2", 13: "PIPE", 14: "ALRM", 15: "TERM",
+		16: "STKFLT", 17: "CHLD", 18: "CONT", 19: "STOP", 20: "TSTP", 21: "TTIN", 22: "TTOU",
+		23: "URG", 24: "XCPU", 25: "XFSZ", 26: "VTALRM", 27: "PROF", 28: "WINCH", 29: "IO",
+		30: "PWR", 31: "SYS",
+	}
+)
+
+// normalizeSignal returns the name of a signal given by name (with or without SIG) or number
+func normalizeSignal(signal string) string {
+	if n, err := strconv.Atoi(signal); err == nil {
+		if name, ok := signalNames[n]; ok {
+			return name
+		}
+		return signal
+	}
+	return strings.TrimPrefix(strings.ToUpper(signal), "SIG")
+}
+
+// isKillSignalAllowed returns whether signal is in AllowKillSignals (or the defaults if unset),
+// an empty signal is the daemon's default and is always allowed
+func (r *RulesDirector) isKillSignalAllowed(signal string) bool {
+	if signal == "" {
+		return true
+	}
+	allowed := r.AllowKillSignals
+	if allowed == nil {
+		allowed = defaultAllowKillSignals
+	}
+	for _, a := range allowed {
+		if normalizeSignal(a) == normalizeSignal(signal) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyContainerStopTimeout sets the StopTimeout of a container that doesn't set one to
+// ContainerStopTimeout, and raises ones below MinContainerStopTimeout to it. Negative timeouts
+// wait forever, so are left alone.
+func (r *RulesDirector) applyContainerStopTimeout(l socketproxy.Logger, create map[string]interface{}) error {
+	if r.ContainerStopTimeout == 0 && r.MinContainerStopTimeout == 0 {
+		return nil
+	}
+
+	if requested, ok := create["StopTimeout"]; ok && requested != nil {
+		timeout, ok := jsonInt64(requested)
+		if !ok {
+			return fmt.Errorf("Invalid StopTimeout %v", requested)
+		}
+		if timeout >= 0 && timeout < int64(r.MinContainerStopTimeout) {
+			l.Printf("Raising StopTimeout from %ds to the minimum of %ds", timeout, r.MinContainerStopTimeout)
+			create["StopTimeout"] = int64(r.MinContainerStopTimeout)
+		}
+		return nil
+	}
+
+	timeout := r.ContainerStopTimeout
+	if timeout == 0 {
+		timeout = r.MinContainerStopTimeout
+	}
+	l.Printf("Setting StopTimeout to %ds", timeout)
+	create["StopTimeout"] = int64(timeout)
+	return nil
+}
+
+// requireContainerOwner checks the container a request is for is owned by us, writing an error
+// response if it isn't (or doesn't exist, see allowNotFound) and returning false
+func (r *RulesDirector) requireContainerOwner(l socketproxy.Logger, w http.ResponseWriter, req *http.Request) bool {
+	if ok, err := r.checkOwner(l, "containers", r.allowUnowned("containers", false), req); err == errInspectNotFound {
+		if !r.allowNotFound(l, "Container") {
+			r.writeDenied(w, req, "Container not found")
+			return false
+		}
+	} else if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return false
+	} else if !ok {
+		r.writeDenied(w, req, "Unauthorized access to container")
+		return false
+	}
+	return true
+}
+
+func (r *RulesDirector) handleContainerKill(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !r.requireContainerOwner(l, w, req) {
+			return
+		}
+
+		// Newer API versions also accept a signal on stop and restart
+		if signal := req.URL.Query().Get("signal"); !r.isKillSignalAllowed(signal) {
+			l.Printf("Denied signal %q", signal)
+			r.writeDenied(w, req, fmt.Sprintf("Signal %q is not allowed", signal))
+			return
+		}
+
+		upstream.ServeHTTP(w, req)
+	})
+}
+
+// handleContainerOwned handles the read-only wait, top, changes and export endpoints of owned
+// containers. Export responses are a tar of the whole container filesystem, which is streamed
+// through from the upstream socket rather than buffered.
+func (r *RulesDirector) handleContainerOwned(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !r.requireContainerOwner(l, w, req) {
+			return
+		}
+
+		switch path.Base(req.URL.Path) {
+		case "wait":
+			switch condition := req.URL.Query().Get("condition"); condition {
+			case "", "not-running", "next-exit", "removed":
+			default:
+				writeError(w, fmt.Sprintf("Invalid wait condition %q", condition), http.StatusBadRequest)
+				return
+			}
+		case "export":
+			l.Printf("Streaming container export")
+		}
+
+		upstream.ServeHTTP(w, req)
+	})
+}
+
+func (r *RulesDirector) handleContainerRename(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !r.requireContainerOwner(l, w, req) {
+			return
+		}
+
+		if r.DenyContainerNames {
+			l.Printf("Denied container rename to %q", req.URL.Query().Get("name"))
+			r.writeDenied(w, req, "Containers aren't allowed to be given names")
+			return
+		}
+
+		if q := req.URL.Query(); r.PrefixNames && q.Get("name") != "" {
+			q.Set("name", r.prefixName(q.Get("name")))
+			req.URL.RawQuery = q.Encode()
+		}
+
+		// Ownership is always checked by inspecting the container by the name or ID in the request,
+		// so there are no container names held here that need updating
+		l.Printf("Renaming container to %q", req.URL.Query().Get("name"))
+		upstream.ServeHTTP(w, req)
+	})
+}
+
+// checkArchivePath checks the path of an archive request against the denied paths for its
+// method. Paths above a denied path are also denied, as the archive would include it. Symlinks
+// are resolved by the daemon inside the container, so one created there bypasses the check.
+func (r *RulesDirector) checkArchivePath(l socketproxy.Logger, req *http.Request) error {
+	denied := r.DenyArchiveReadPaths
+	if req.Method == "PUT" {
+		denied = r.DenyArchiveWritePaths
+	}
+
+	p := path.Clean("/" + req.URL.Query().Get("path"))
+	for _, deniedPath := range denied {
+		deniedPath = path.Clean("/" + deniedPath)
+		if pathHasPrefix(p, deniedPath) || pathHasPrefix(deniedPath, p) {
+			l.Printf("Denied %s of container archive path %q, matches denied path %q", req.Method, p, deniedPath)
+			return fmt.Errorf("Container archive path %q is not allowed", p)
+		}
+	}
+	return nil
+}
+
+func (r *RulesDirector) handleContainerArchive(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !r.requireContainerOwner(l, w, req) {
+			return
+		}
+
+		if err := r.checkArchivePath(l, req); err != nil {
+			r.writeDenied(w, req, err.Error())
+			return
+		}
+
+		upstream.ServeHTTP(w, req)
+	})
+}
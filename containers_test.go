@@ -0,0 +1,321 @@
+package sockguard
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/sockguard/sockguardtest"
+)
+
+func TestHandleContainerRename(t *testing.T) {
+	l := mockLogger()
+
+	// Pre-populated simplified upstream state that "exists" before tests execute.
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"owned": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+			"foreign": sockguardtest.Container{
+				Owner: "adifferentowner",
+			},
+		},
+	}
+	r := mockRulesDirectorWithUpstreamState(&us)
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// "Rename" the container
+		m := identifierPatterns[0].FindStringSubmatch(versionRegex.ReplaceAllString(req.URL.Path, ""))
+		us.Containers[req.URL.Query().Get("name")] = us.Containers[m[1]]
+		delete(us.Containers, m[1])
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := map[string]int{
+		"/v1.37/containers/foreign/rename?name=stolen": 401,
+		"/v1.37/containers/owned/rename?name=renamed":  204,
+	}
+
+	for k, v := range tests {
+		req, err := http.NewRequest("POST", k, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != v {
+			t.Errorf("%s : handler returned wrong status code: got %v want %v", k, status, v)
+		}
+	}
+
+	// Lookups by the new name still resolve ownership
+	if ok, err := r.checkIdentifierOwner(l, "containers", "renamed", false); err != nil || !ok {
+		t.Errorf("Expected renamed container to be owned, got %t, %v", ok, err)
+	}
+	if _, err := r.checkIdentifierOwner(l, "containers", "owned", false); err != errInspectNotFound {
+		t.Errorf("Expected old name to be gone, got %v", err)
+	}
+	if ok, _ := r.checkIdentifierOwner(l, "containers", "foreign", false); ok {
+		t.Errorf("Expected foreign container not to be owned")
+	}
+}
+
+func TestDenyContainerNames(t *testing.T) {
+	l := mockLogger()
+
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"owned": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+			"my-app": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+		},
+	}
+	r := mockRulesDirectorWithUpstreamState(&us)
+	r.DenyContainerNames = true
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		url    string
+		body   string
+		status int
+	}{
+		{"/v1.37/containers/create", `{"Image":"alpine","HostConfig":{}}`, 200},
+		{"/v1.37/containers/create?name=", `{"Image":"alpine","HostConfig":{}}`, 200},
+		{"/v1.37/containers/create?name=web", `{"Image":"alpine","HostConfig":{}}`, 401},
+		{"/v1.37/containers/owned/rename?name=web", "", 401},
+		{"/v1.37/containers/my-app/rename?name=web", "", 401},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", test.url, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("%s : handler returned wrong status code: got %v want %v", test.url, status, test.status)
+		}
+	}
+}
+
+func TestContainerCreateBodies(t *testing.T) {
+	l := mockLogger()
+	r := mockRulesDirector()
+	r.ContainerResourceLimits = map[string]int64{"Memory": 1024}
+
+	tests := []struct {
+		body     string
+		status   int
+		expected string
+	}{
+		// no HostConfig at all, limits still need to be applied
+		{`{"Image":"alpine"}`, 200, `{"Image":"alpine","HostConfig":{"Memory":1024}}`},
+		// field names are matched case insensitively, as the daemon does
+		{`{"Image":"alpine","hostconfig":{"privileged":true}}`, 401, ""},
+		{`{"Image":"alpine","HostConfig":{"Binds":[1]}}`, 400, ""},
+		// stop signals are limited like kill signals
+		{`{"Image":"alpine","StopSignal":"SIGTERM"}`, 200, `{"Image":"alpine","StopSignal":"SIGTERM","HostConfig":{"Memory":1024}}`},
+		{`{"Image":"alpine","StopSignal":"SIGUSR1"}`, 401, ""},
+		{`{"Image":"alpine","stopsignal":"10"}`, 401, ""},
+	}
+
+	for _, test := range tests {
+		var body string
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			b, _ := ioutil.ReadAll(req.Body)
+			body = string(b)
+			w.WriteHeader(http.StatusOK)
+		})
+
+		req, err := http.NewRequest("POST", "/v1.37/containers/create", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("%s : handler returned wrong status code: got %v want %v", test.body, status, test.status)
+		}
+		if body != test.expected {
+			t.Errorf("%s : expected upstream body %s, got %s", test.body, test.expected, body)
+		}
+	}
+}
+
+func TestHandleContainerArchive(t *testing.T) {
+	l := mockLogger()
+
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"owned": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+			"foreign": sockguardtest.Container{
+				Owner: "adifferentowner",
+			},
+			"my-app": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+		},
+	}
+	r := mockRulesDirectorWithUpstreamState(&us)
+	r.DenyArchiveWritePaths = []string{"/etc"}
+	r.DenyArchiveReadPaths = []string{"/root"}
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		method string
+		url    string
+		status int
+	}{
+		{"GET", "/v1.37/containers/foreign/archive?path=/tmp", 401},
+		{"HEAD", "/v1.37/containers/foreign/archive?path=/tmp", 401},
+		{"GET", "/v1.37/containers/owned/archive?path=/tmp", 200},
+		{"HEAD", "/v1.37/containers/owned/archive?path=/etc/passwd", 200},
+		{"HEAD", "/v1.37/containers/owned/archive?path=/root/.ssh", 401},
+		{"GET", "/v1.37/containers/owned/archive?path=/root/../root", 401},
+		{"GET", "/v1.37/containers/owned/archive?path=/", 401},
+		{"PUT", "/v1.37/containers/owned/archive?path=/tmp", 200},
+		{"PUT", "/v1.37/containers/owned/archive?path=/root", 200},
+		{"PUT", "/v1.37/containers/owned/archive?path=/etc/cron.d", 401},
+		{"PUT", "/v1.37/containers/my-app/archive?path=/etc", 401},
+		{"GET", "/v1.37/containers/my-app/archive?path=/root", 401},
+		{"PUT", "/v1.37/containers/my-app/archive?path=/tmp", 200},
+		{"PUT", "/v1.37/containers/owned/archive?path=/", 401},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.url, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("%s %s : handler returned wrong status code: got %v want %v", test.method, test.url, status, test.status)
+		}
+	}
+}
+
+func TestHandleContainerKill(t *testing.T) {
+	l := mockLogger()
+
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"owned": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+			"foreign": sockguardtest.Container{
+				Owner: "adifferentowner",
+			},
+			// names can have dashes and dots, e.g. docker-compose's proj-web-1
+			"my-app": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+		},
+	}
+	r := mockRulesDirectorWithUpstreamState(&us)
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := map[string]int{
+		"/v1.37/containers/foreign/kill":              401,
+		"/v1.37/containers/owned/kill":                204,
+		"/v1.37/containers/owned/kill?signal=SIGTERM": 204,
+		"/v1.37/containers/owned/kill?signal=hup":     204,
+		"/v1.37/containers/owned/kill?signal=9":       204,
+		"/v1.37/containers/owned/kill?signal=USR1":    401,
+		"/v1.37/containers/owned/kill?signal=19":      401,
+		"/v1.42/containers/owned/stop?signal=SIGSTOP": 401,
+		"/v1.42/containers/owned/restart?signal=INT":  204,
+		"/v1.37/containers/my-app/kill?signal=SEGV":   401,
+		"/v1.37/containers/my-app/kill?signal=TERM":   204,
+	}
+
+	for k, v := range tests {
+		req, err := http.NewRequest("POST", k, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != v {
+			t.Errorf("%s : handler returned wrong status code: got %v want %v", k, status, v)
+		}
+	}
+}
+
+func TestHandleContainerOwned(t *testing.T) {
+	l := mockLogger()
+
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"owned": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+			"foreign": sockguardtest.Container{
+				Owner: "adifferentowner",
+			},
+			"my-app": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+		},
+	}
+	r := mockRulesDirectorWithUpstreamState(&us)
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		method string
+		url    string
+		status int
+	}{
+		{"POST", "/v1.37/containers/foreign/wait", 401},
+		{"POST", "/v1.37/containers/owned/wait", 200},
+		{"POST", "/v1.37/containers/owned/wait?condition=removed", 200},
+		{"POST", "/v1.37/containers/owned/wait?condition=forever", 400},
+		{"POST", "/v1.37/containers/my-app/wait?condition=forever", 400},
+		{"GET", "/v1.37/containers/my-app/top", 200},
+		{"GET", "/v1.37/containers/foreign/top", 401},
+		{"GET", "/v1.37/containers/owned/top?ps_args=aux", 200},
+		{"GET", "/v1.37/containers/foreign/changes", 401},
+		{"GET", "/v1.37/containers/owned/changes", 200},
+		{"GET", "/v1.37/containers/foreign/export", 401},
+		{"GET", "/v1.37/containers/owned/export", 200},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.url, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("%s %s : handler returned wrong status code: got %v want %v", test.method, test.url, status, test.status)
+		}
+	}
+}
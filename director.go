@@ -1,41 +1,308 @@
 package sockguard
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	"os"
 	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/buildkite/sockguard/dockerapi"
 	"github.com/buildkite/sockguard/socketproxy"
 )
 
 const (
 	apiVersion = "1.32"
 	ownerKey   = "com.buildkite.sockguard.owner"
+
+	// Header a trusted front proxy sets to the owner of a request, see TrustOwnerHeader
+	ownerHeader = "X-Sockguard-Owner"
+
+	// The most RulesDirectors kept for different API versions, see forAPIVersion
+	maxAPIVersionDirectors = 32
 )
 
 var (
 	versionRegex = regexp.MustCompile(`^/v\d\.\d+\b`)
+
+	// Host paths that are never allowed to be bound, regardless of AllowBinds
+	defaultDenyBinds = []string{"/var/run/docker.sock", "/run/docker.sock", "/proc", "/sys", "/etc"}
 )
 
 type RulesDirector struct {
-	Client                  *http.Client
-	Owner                   string
-	AllowBinds              []string
+	Client     *http.Client
+	Owner      string
+	AllowBinds []string
+	// Named volume patterns (see path.Match) that can be mounted without being owned
+	AllowVolumes []string
+	// Network patterns (see path.Match) that containers can attach to without them being owned
+	AllowNetworks []string
+	// Image repository patterns (e.g. registry.example.com/*) that can be pulled or run
+	AllowImages []string
+	// Platforms (e.g. linux/amd64) that images can be pulled and containers created for
+	AllowPlatforms []string
+	// Image repository patterns that can be pushed without being owned
+	AllowPushImages []string
+	// Rewrite rules applied to image pulls, e.g. to pull through an internal mirror
+	ImageRewrites []ImageRewrite
+	// Require images to be referenced by digest (repo@sha256:...) on pulls and container creates
+	RequireImageDigest bool
+	// Deny images referenced by the latest tag (or no tag) on pulls and container creates
+	DenyLatestImageTag bool
+	// Verifies image signatures before pulls, and container creates for images not present locally
+	ImageVerifier ImageVerifier
+	// Force the network used by RUN steps in image builds
+	BuildNetwork string
+	// Deny remote build contexts (git repositories or URLs), or only allow those matching patterns
+	DenyBuildRemotes  bool
+	AllowBuildRemotes []string
+	// A digest pinned moby/buildkit image that can be run privileged, for buildx builders
+	BuildkitImage string
+	// Allow containers to run privileged (e.g. docker:dind sidecars), only for the digest pinned
+	// AllowPrivilegedImages if any are set
+	AllowPrivileged       bool
+	AllowPrivilegedImages []string
+	// Defaults and limits for build resource parameters (memory, memswap, cpuperiod, cpuquota, cpushares)
+	BuildResourceDefaults map[string]int64
+	BuildResourceLimits   map[string]int64
+	// Dockerfile instructions to deny in builds, BuildKit and remote context builds are denied if set
+	DenyDockerfilePatterns []*regexp.Regexp
+	// Maximum bytes of build cache that builds we proxied can create before further builds are denied
+	BuildCacheQuota int64
+	// Allow pruning dangling build cache, which isn't scoped to an owner
+	AllowBuildPrune bool
+	// Deny BuildKit builds from using secrets (--secret) or ssh forwarding (--ssh)
+	DenyBuildSecrets bool
+	DenyBuildSSH     bool
+	// Registry credentials injected into pulls and builds, so jobs don't need to hold them
+	RegistryAuth RegistryAuth
+	// Additional host paths to deny binds of, on top of defaultDenyBinds
+	DenyBinds               []string
 	AllowHostModeNetworking bool
-	ContainerCgroupParent   string
-	// TODOLATER: some enforcement at the struct level to ensure DockerLink + JoinNetwork are mutually exclusive (pick one)
+	// Allow services, tasks, secrets, configs and read-only node endpoints, with services, secrets
+	// and configs given the owner label.
+	// Swarm management (/swarm) is always denied.
+	AllowSwarm bool
+	// Deny swarm configs, even with AllowSwarm
+	DenyConfigs bool
+	// Allow the experimental container checkpoint endpoints, with custom checkpoint directories
+	// limited to under AllowCheckpointDirs
+	AllowCheckpoints    bool
+	AllowCheckpointDirs []string
+	// The newest API version clients can use, /version and /_ping responses are capped to it so
+	// clients negotiate down to it
+	MaxAPIVersion string
+	// Remove host details from /info responses, keeping only the fields clients need
+	ScrubInfo bool
+	// Env var names (or patterns, e.g. *_TOKEN) to redact the values of in container inspects
+	RedactInspectEnv []string
+	// Redact host paths (binds, mount sources, log and storage paths) from container inspects
+	RedactInspectHostPaths bool
+	// Deny containers being given names (on create or rename), so they all get generated names
+	DenyContainerNames bool
+	// Prefix the names of created containers, networks and volumes with the owner, so parallel jobs
+	// don't collide, resolving names in requests to prefixed names and stripping it from responses
+	PrefixNames bool
+	// Remove entries not owned by us from container, image and network list responses, as well as
+	// filtering the requests by label
+	FilterListResponses bool
+	// Signals that can be sent to containers by name or number, defaults to TERM, KILL, INT, HUP and QUIT
+	AllowKillSignals []string
+	// Container paths to deny copying files into (PUT), and out of or stat-ing (GET and HEAD),
+	// via /containers/{id}/archive
+	DenyArchiveWritePaths []string
+	DenyArchiveReadPaths  []string
+	// Maximums for container HostConfig resources (Memory, MemorySwap, NanoCpus, CpuShares, CpuPeriod,
+	// CpuQuota and PidsLimit), applied on create and update
+	ContainerResourceLimits map[string]int64
+	// Deny image pulls and builds when the daemon's data-root has less than this many bytes free
+	MinFreeDiskSpace uint64
+	// The path of the daemon's data-root on this host, defaults to the DockerRootDir in /info
+	DataRoot string
+	// Bytes per second that the image pull and build streams of each owner are throttled to, in total
+	MaxStreamRate int64
+	// How long the labels of inspected resources (other than images) are cached for, zero disables
+	// caching. Removing or renaming resources via the proxy invalidates the cache.
+	InspectCacheTTL time.Duration
+	// Maximum durations that streams (attach, logs, events, stats or exec) can stay open for
+	MaxStreamDurations map[string]time.Duration
+	// Budgets for the total Memory and NanoCpus of all of our containers, checked on create
+	OwnerQuota map[string]int64
+	// Deny custom /etc/hosts entries (--add-host) on containers and builds
+	DenyExtraHosts bool
+	// Deny setting ulimits (--ulimit) on containers and builds
+	DenyUlimits bool
+	// Isolation technologies (e.g. process, hyperv) containers and builds can use besides the default
+	AllowIsolation []string
+	// OCI runtimes (e.g. nvidia, kata or sysbox) containers can use besides the default. If none are
+	// set, any runtime can be used, unless Strict is set.
+	AllowRuntimes []string
+	// Deny squashing image build layers (--squash)
+	DenyBuildSquash       bool
+	ContainerCgroupParent string
+	// Resolve symlinks in host bind paths (where they exist) before checking AllowBinds
+	ResolveBindSymlinks bool
+	// Allow shared/rshared propagation on binds and bind mounts, which can leak mounts back to the host
+	AllowSharedBindPropagation bool
+	// A container to link to new containers (name-or-id or name-or-id:alias), or to connect to new
+	// networks, only one can be set (see Validate)
 	ContainerDockerLink       string
 	ContainerJoinNetwork      string
 	ContainerJoinNetworkAlias string
 	User                      string
+	// Run an init process (--init) in all containers, which reaps zombie processes
+	ForceInit bool
+	// The StopTimeout in seconds of containers that don't set one, and the minimum containers can set,
+	// e.g. for graceful database shutdowns. Zero leaves them to the daemon's default (10s).
+	ContainerStopTimeout    int
+	MinContainerStopTimeout int
+	// Whether resources without an owner label can be accessed, by kind (containers, images, networks or
+	// volumes). Kinds that aren't set use the defaults, which only deny unowned containers.
+	AllowUnowned map[string]bool
+	// Other owners whose resources can be accessed as if they were owned (new resources are still given Owner)
+	AlsoAllowOwners []string
+	// Use the owner in the X-Sockguard-Owner header set by a trusted front proxy, if present
+	TrustOwnerHeader bool
+	// The status code of responses to denied requests, defaults to 401. Some clients handle 403 better.
+	DenyStatusCode int
+	// The message of responses to denied requests, with {reason}, {endpoint} and {owner} replaced,
+	// e.g. to link to a runbook. Defaults to the reason.
+	DenyMessage string
+	// Deny anything the rules don't explicitly recognize and allow, rather than passing it on: unknown
+	// HostConfig fields, runtimes other than AllowRuntimes, volume driver options, non-bridge network
+	// drivers, image imports, OPTIONS requests and requests for resources that don't exist
+	Strict bool
+	// The only endpoints that can be used, as methods and paths without the API version where * matches
+	// a path segment and ** one or more, e.g. "GET /containers/*/logs". Pings are always allowed.
+	AllowEndpoints []string
+	// The log driver containers are forced to use (json-file or local), with options like max-size and
+	// max-file that override the container's. Other drivers are denied.
+	ContainerLogDriver  string
+	ContainerLogOptions map[string]string
+	// The size in bytes of the writable layer of containers that don't set one (StorageOpt size, on
+	// storage drivers that support it), and the maximum containers can set. Containers get the
+	// maximum if there is no default.
+	ContainerStorageSize    int64
+	MaxContainerStorageSize int64
+
+	// The API version of the client's requests, used for internal calls, see forAPIVersion
+	clientAPIVersion string
+	state            *directorState
+	// Labels inspected ahead of checks within a request, keyed by kind/id, see withPrefetchedLabels
+	prefetched map[string]labelsResult
+	// The context of the request being directed, internal calls are made with it, see DirectContext
+	ctx context.Context
+}
+
+// directorState is the mutable state of a RulesDirector. It's held by pointer, so a RulesDirector
+// can be copied for another owner (see TrustOwnerHeader).
+type directorState struct {
+	mu sync.Mutex
+	// Images that can't be labelled (e.g. loaded via /images/load) are tracked here
+	ownedImages map[string]bool
+	// Build cache records created by our builds, which can't be labelled either
+	ownedBuildCache map[string]bool
+	// RulesDirectors for owners given in X-Sockguard-Owner
+	tenants map[string]*RulesDirector
+	// RulesDirectors for the API versions clients use, which share this state
+	versions map[string]*RulesDirector
+	// Paces our pull and build streams to MaxStreamRate
+	streamLimiter *rateLimiter
+	// Labels from inspects, keyed by kind/id, see InspectCacheTTL
+	inspectCache map[string]inspectCacheEntry
+	// Held while checking OwnerQuota until the create or update is done, see lockOwnerQuota
+	quotaMu sync.Mutex
+	// Held while a build is measured for BuildCacheQuota, see lockBuildCache
+	buildCacheMu sync.Mutex
+}
+
+var directorStateMu sync.Mutex
+
+// lockState returns the locked state of the RulesDirector, creating it if needed. The caller
+// must unlock it.
+func (r *RulesDirector) lockState() *directorState {
+	directorStateMu.Lock()
+	if r.state == nil {
+		r.state = &directorState{
+			ownedImages:     map[string]bool{},
+			ownedBuildCache: map[string]bool{},
+			tenants:         map[string]*RulesDirector{},
+			versions:        map[string]*RulesDirector{},
+			inspectCache:    map[string]inspectCacheEntry{},
+		}
+	}
+	s := r.state
+	directorStateMu.Unlock()
+
+	s.mu.Lock()
+	return s
+}
+
+// forOwner returns a RulesDirector with the same config for another owner, with its own state
+func (r *RulesDirector) forOwner(owner string) *RulesDirector {
+	s := r.lockState()
+	defer s.mu.Unlock()
+
+	if tenant, ok := s.tenants[owner]; ok {
+		return tenant
+	}
+	tenant := *r
+	tenant.Owner = owner
+	tenant.TrustOwnerHeader = false
+	tenant.state = nil
+	tenant.ctx = nil
+	s.tenants[owner] = &tenant
+	return &tenant
+}
+
+// forAPIVersion returns a RulesDirector with the same config and state that makes internal calls
+// with the API version a client uses, so inspects behave the same as the client's requests.
+// Versions older than apiVersion use it instead, as they lack fields we rely on, and newer than
+// MaxAPIVersion use that. Clients pick any version, so only so many are kept.
+func (r *RulesDirector) forAPIVersion(version string) *RulesDirector {
+	if compareAPIVersions(version, apiVersion) < 0 {
+		version = apiVersion
+	}
+	version = r.capAPIVersion(version)
+	if version == r.internalAPIVersion() {
+		return r
+	}
+
+	s := r.lockState()
+	defer s.mu.Unlock()
+
+	if versioned, ok := s.versions[version]; ok {
+		return versioned
+	}
+	versioned := *r
+	versioned.clientAPIVersion = version
+	versioned.ctx = nil
+	if len(s.versions) < maxAPIVersionDirectors {
+		s.versions[version] = &versioned
+	}
+	return &versioned
+}
+
+// internalAPIVersion returns the API version to make internal calls with
+func (r *RulesDirector) internalAPIVersion() string {
+	if r.clientAPIVersion != "" {
+		return r.clientAPIVersion
+	}
+	return apiVersion
 }
 
 func writeError(w http.ResponseWriter, msg string, code int) {
@@ -46,7 +313,103 @@ func writeError(w http.ResponseWriter, msg string, code int) {
 	})
 }
 
+// writeDenied writes the response to a request denied by the rules, see DenyStatusCode and DenyMessage
+func (r *RulesDirector) writeDenied(w http.ResponseWriter, req *http.Request, reason string) {
+	code := http.StatusUnauthorized
+	if r.DenyStatusCode != 0 {
+		code = r.DenyStatusCode
+	}
+
+	msg := reason
+	if r.DenyMessage != "" {
+		path := versionRegex.ReplaceAllString(req.URL.Path, "")
+		msg = strings.NewReplacer(
+			"{reason}", reason,
+			"{endpoint}", req.Method+" "+path,
+			"{owner}", r.Owner,
+		).Replace(r.DenyMessage)
+	}
+
+	writeError(w, msg, code)
+}
+
+// Direct implements socketproxy.Director, making internal calls with the request's context
 func (r *RulesDirector) Direct(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return r.DirectContext(req.Context(), l, req, upstream)
+}
+
+// DirectContext implements socketproxy.ContextDirector. Internal calls made while checking the
+// request, e.g. inspecting the resources it refers to, are made with ctx so they're cancelled when
+// the client goes away.
+func (r *RulesDirector) DirectContext(ctx context.Context, l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return r.withContext(ctx).direct(l, req, upstream)
+}
+
+// withContext returns a copy of r that makes internal calls with ctx
+func (r *RulesDirector) withContext(ctx context.Context) *RulesDirector {
+	// the copy shares r's state, so it must exist before copying
+	r.lockState().mu.Unlock()
+
+	withCtx := *r
+	withCtx.ctx = ctx
+	return &withCtx
+}
+
+// requestContext returns the context to make internal calls with
+func (r *RulesDirector) requestContext() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// newRequest returns a request for an internal call, made with the context of the request being directed
+func (r *RulesDirector) newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	return http.NewRequestWithContext(r.requestContext(), method, url, body)
+}
+
+// doUpstream makes req to the daemon with Client, rather than passing it to the upstream handler,
+// for handlers that need to act on the response before or while it's relayed
+func (r *RulesDirector) doUpstream(req *http.Request) (*http.Response, error) {
+	upstreamReq, err := r.newRequest(req.Method, "http://docker"+req.URL.RequestURI(), req.Body)
+	if err != nil {
+		return nil, err
+	}
+	upstreamReq.Header = req.Header.Clone()
+	upstreamReq.ContentLength = req.ContentLength
+	return r.Client.Do(upstreamReq)
+}
+
+// relayResponse writes a response from doUpstream to w, passing each line of the body to observe
+// (if set) as it's relayed. Lines are flushed as they're written, so progress streams still stream.
+func relayResponse(w http.ResponseWriter, resp *http.Response, observe func(line []byte)) {
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	flusher, _ := w.(http.Flusher)
+	br := bufio.NewReader(resp.Body)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			if _, err := w.Write(line); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			if observe != nil {
+				observe(line)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *RulesDirector) direct(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
 	var match = func(method string, pattern string) bool {
 		if method != "*" && method != req.Method {
 			return false
@@ -67,9 +430,79 @@ func (r *RulesDirector) Direct(l socketproxy.Logger, req *http.Request, upstream
 		})
 	}
 
+	var deniedHandler = func(reason string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			l.Printf("Handler returned error %q", reason)
+			r.writeDenied(w, req, reason)
+		})
+	}
+
+	if err := decompressRequestBody(l, req); err != nil {
+		return errorHandler(err.Error(), http.StatusBadRequest)
+	}
+
+	if !r.isEndpointAllowed(req) {
+		return deniedHandler(fmt.Sprintf("Endpoint %s %s isn't allowed", req.Method, versionRegex.ReplaceAllString(req.URL.Path, "")))
+	}
+
+	if r.TrustOwnerHeader {
+		if owner := req.Header.Get(ownerHeader); owner != "" {
+			l.Printf("Using owner %q from %s", owner, ownerHeader)
+			req.Header.Del(ownerHeader)
+			return r.forOwner(owner).DirectContext(r.ctx, l, req, upstream)
+		}
+	}
+
+	// Requests for newer API versions might use request shapes that we don't inspect, and requests
+	// without a version would get the daemon's latest
+	if r.MaxAPIVersion != "" {
+		if v := requestAPIVersion(req); v == "" {
+			req.URL.Path = "/v" + r.MaxAPIVersion + req.URL.Path
+		} else if compareAPIVersions(v, r.MaxAPIVersion) > 0 {
+			return errorHandler(fmt.Sprintf("client version %s is too new. Maximum supported API version is %s", v, r.MaxAPIVersion), http.StatusBadRequest)
+		}
+	}
+
+	if v := requestAPIVersion(req); v != "" {
+		if versioned := r.forAPIVersion(v); versioned != r {
+			return versioned.DirectContext(r.ctx, l, req, upstream)
+		}
+	}
+
+	if r.PrefixNames {
+		if err := r.resolveRequestPath(l, req); err != nil {
+			return errorHandler(err.Error(), http.StatusInternalServerError)
+		}
+	}
+
+	if len(r.MaxStreamDurations) > 0 {
+		upstream = r.limitStreamDuration(l, req, upstream)
+	}
+
+	if r.InspectCacheTTL > 0 {
+		upstream = r.invalidatingInspectCache(l, req, upstream)
+	}
+
 	switch {
+	case match(`GET`, `^/version$`) && r.MaxAPIVersion != "":
+		return r.responseFilter(l, func(body json.RawMessage) (interface{}, error) {
+			return r.capVersionResponse(l, body)
+		})
+	case (match(`GET`, `^/_ping$`) || match(`HEAD`, `^/_ping$`)) && r.MaxAPIVersion != "":
+		return r.handlePing(l, req, upstream)
+	case match(`GET`, `^/info$`) && r.ScrubInfo:
+		return r.responseFilter(l, func(body json.RawMessage) (interface{}, error) {
+			return scrubInfo(l, body)
+		})
 	case match(`GET`, `^/(_ping|version|info)$`):
 		return upstream
+	case match(`GET`, `^/_sockguard/version$`):
+		return r.handleBuildInfo(l, req, upstream)
+	case match(`HEAD`, `^/_ping$`):
+		return upstream
+	// The daemon answers OPTIONS itself with CORS headers, without running the endpoint
+	case match(`OPTIONS`, `^/`) && !r.Strict:
+		return upstream
 	case match(`GET`, `^/events$`):
 		return r.addLabelsToQueryStringFilters(l, req, upstream)
 
@@ -79,45 +512,83 @@ func (r *RulesDirector) Direct(l socketproxy.Logger, req *http.Request, upstream
 	case match(`POST`, `^/containers/prune$`):
 		return r.addLabelsToQueryStringFilters(l, req, upstream)
 	case match(`GET`, `^/containers/json$`):
-		return r.addLabelsToQueryStringFilters(l, req, upstream)
-	case match(`*`, `^/(containers|exec)/(\w+)\b`):
-		if ok, err := r.checkOwner(l, "containers", false, req); ok {
+		return r.addLabelsToQueryStringFilters(l, req, r.filterListResponse(l, upstream))
+	case match(`POST`, `^/containers/([^/]+)/rename$`):
+		return r.handleContainerRename(l, req, upstream)
+	case match(`POST`, `^/containers/([^/]+)/update$`):
+		return r.handleContainerUpdate(l, req, upstream)
+	case match(`GET`, `^/containers/([^/]+)/json$`) && (len(r.RedactInspectEnv) > 0 || r.RedactInspectHostPaths || r.PrefixNames):
+		return r.handleContainerInspect(l, req, upstream)
+	case match(`POST`, `^/containers/([^/]+)/wait$`),
+		match(`GET`, `^/containers/([^/]+)/(top|changes|export)$`):
+		return r.handleContainerOwned(l, req, upstream)
+	case match(`*`, `^/containers/([^/]+)/checkpoints(/[^/]+)?$`),
+		match(`POST`, `^/containers/([^/]+)/start$`):
+		return r.handleContainerCheckpoint(l, req, upstream)
+	case match(`POST`, `^/containers/([^/]+)/(kill|stop|restart)$`):
+		return r.handleContainerKill(l, req, upstream)
+	case match(`GET`, `^/containers/([^/]+)/archive$`),
+		match(`HEAD`, `^/containers/([^/]+)/archive$`),
+		match(`PUT`, `^/containers/([^/]+)/archive$`):
+		return r.handleContainerArchive(l, req, upstream)
+	case match(`POST`, `^/containers/([^/]+)/exec$`):
+		return r.handleExecCreate(l, req, upstream)
+	case match(`*`, `^/exec/(\w+)/(start|resize|json)$`):
+		return r.handleExec(l, req, upstream)
+	case match(`*`, `^/containers/(\w+)\b`):
+		if ok, err := r.checkOwner(l, "containers", r.allowUnowned("containers", false), req); ok {
 			return upstream
 		} else if err == errInspectNotFound {
-			l.Printf("Container not found, allowing")
-			return upstream
+			return r.notFoundHandler(l, "Container", upstream)
 		} else if err != nil {
 			return errorHandler(err.Error(), http.StatusInternalServerError)
 		}
-		return errorHandler("Unauthorized access to container", http.StatusUnauthorized)
+		return deniedHandler("Unauthorized access to container")
 
 	// Build related endpoints
 	case match(`POST`, `^/build$`):
-		return r.handleBuild(l, req, upstream)
+		return r.throttleStream(l, r.requireFreeDiskSpace(l, r.handleBuild(l, req, upstream)))
+	case match(`POST`, `^/build/prune$`):
+		return r.handleBuildPrune(l, req, upstream)
+	case match(`POST`, `^/session$`):
+		return r.handleSession(l, req, upstream)
 
 	// Image related endpoints
+	case match(`POST`, `^/commit$`):
+		return r.handleCommit(l, req, upstream)
 	case match(`GET`, `^/images/json$`):
-		return r.addLabelsToQueryStringFilters(l, req, upstream)
+		return r.addLabelsToQueryStringFilters(l, req, r.filterListResponse(l, upstream))
 	case match(`POST`, `^/images/create$`):
-		return upstream
-	case match(`POST`, `^/images/(create|search|get|load)$`):
+		return r.throttleStream(l, r.requireFreeDiskSpace(l, r.handleImageCreate(l, req, upstream)))
+	case match(`GET`, `^/images/get$`):
+		return r.handleImageGet(l, req, upstream)
+	case match(`POST`, `^/images/load$`):
+		return r.handleImageLoad(l, req, upstream)
+	case match(`*`, `^/images/(search|get|load)$`):
 		break
+	case match(`POST`, `^/images/(.+)/push$`):
+		return r.handleImagePush(l, req, upstream)
+	case match(`POST`, `^/images/(.+)/tag$`):
+		return r.handleImageTag(l, req, upstream)
+	case match(`DELETE`, `^/images/(.+)$`):
+		return r.handleImageDelete(l, req, upstream)
 	case match(`POST`, `^/images/prune$`):
 		return r.addLabelsToQueryStringFilters(l, req, upstream)
+	case match(`GET`, `^/distribution/(.+)/json$`):
+		return r.handleDistribution(l, req, upstream)
 	case match(`*`, `^/images/(\w+)\b`):
-		if ok, err := r.checkOwner(l, "images", true, req); ok {
+		if ok, err := r.checkOwner(l, "images", r.allowUnowned("images", true), req); ok {
 			return upstream
 		} else if err == errInspectNotFound {
-			l.Printf("Image not found, allowing")
-			return upstream
+			return r.notFoundHandler(l, "Image", upstream)
 		} else if err != nil {
 			return errorHandler(err.Error(), http.StatusInternalServerError)
 		}
-		return errorHandler("Unauthorized access to image", http.StatusUnauthorized)
+		return deniedHandler("Unauthorized access to image")
 
 	// Network related endpoints
 	case match(`GET`, `^/networks$`):
-		return r.addLabelsToQueryStringFilters(l, req, upstream)
+		return r.addLabelsToQueryStringFilters(l, req, r.filterListResponse(l, upstream))
 	case match(`POST`, `^/networks/create$`):
 		return r.handleNetworkCreate(l, req, upstream)
 	case match(`POST`, `^/networks/prune$`):
@@ -126,34 +597,90 @@ func (r *RulesDirector) Direct(l socketproxy.Logger, req *http.Request, upstream
 		return r.handleNetworkDelete(l, req, upstream)
 	case match(`GET`, `^/networks/(.+)$`),
 		match(`POST`, `^/networks/(.+)/(connect|disconnect)$`):
-		if ok, err := r.checkOwner(l, "networks", true, req); ok {
-			return upstream
+		if ok, err := r.checkOwner(l, "networks", r.allowUnowned("networks", true), req); ok {
+			return r.unprefixedResponse(l, req, upstream)
 		} else if err == errInspectNotFound {
-			l.Printf("Network not found, allowing")
-			return upstream
+			return r.notFoundHandler(l, "Network", upstream)
 		} else if err != nil {
 			return errorHandler(err.Error(), http.StatusInternalServerError)
 		}
-		return errorHandler("Unauthorized access to network", http.StatusUnauthorized)
+		return deniedHandler("Unauthorized access to network")
 
 	// Volumes related endpoints
 	case match(`GET`, `^/volumes$`):
-		return r.addLabelsToQueryStringFilters(l, req, upstream)
+		// Volume lists are always filtered, as clients (e.g. compose) send filters in formats
+		// that the label filter can't be reliably added to
+		return r.addLabelsToQueryStringFilters(l, req, r.listResponseFilter(l, "Volumes"))
 	case match(`POST`, `^/volumes/create$`):
-		return r.addLabelsToBody(l, req, upstream)
+		return r.strictVolumeCreate(l, r.addLabelsToBody(l, req, r.prefixBodyName(l, upstream)))
 	case match(`POST`, `^/volumes/prune$`):
 		return r.addLabelsToQueryStringFilters(l, req, upstream)
 	case match(`GET`, `^/volumes/([-\w]+)$`), match(`DELETE`, `^/volumes/(-\w+)$`):
-		if ok, err := r.checkOwner(l, "volumes", true, req); ok {
+		if ok, err := r.checkOwner(l, "volumes", r.allowUnowned("volumes", true), req); ok {
+			return r.unprefixedResponse(l, req, upstream)
+		} else if err == errInspectNotFound {
+			return r.notFoundHandler(l, "Volume", upstream)
+		} else if err != nil {
+			return errorHandler(err.Error(), http.StatusInternalServerError)
+		}
+		return deniedHandler("Unauthorized access to volume")
+
+	// Swarm related endpoints
+	case match(`*`, `^/(swarm|services|nodes|tasks|secrets|configs)\b`) && !r.AllowSwarm:
+		return deniedHandler("Swarm endpoints are not allowed")
+	case match(`*`, `^/swarm\b`):
+		return deniedHandler("Swarm management endpoints are not allowed")
+	case match(`GET`, `^/nodes(/[^/]+)?$`):
+		return upstream
+	case match(`*`, `^/nodes\b`):
+		return deniedHandler("Node management endpoints are not allowed")
+	case match(`GET`, `^/services$`):
+		return r.addLabelsToQueryStringFilters(l, req, upstream)
+	case match(`POST`, `^/services/create$`):
+		return r.handleServiceCreate(l, req, upstream)
+	case match(`POST`, `^/services/([^/]+)/update$`):
+		return r.handleServiceUpdate(l, req, upstream)
+	case match(`GET`, `^/services/([^/]+)(/logs)?$`), match(`DELETE`, `^/services/([^/]+)$`):
+		if ok, err := r.checkOwner(l, "services", r.allowUnowned("services", false), req); ok {
 			return upstream
 		} else if err == errInspectNotFound {
-			l.Printf("Volume not found, allowing")
+			return r.notFoundHandler(l, "Service", upstream)
+		} else if err != nil {
+			return errorHandler(err.Error(), http.StatusInternalServerError)
+		}
+		return deniedHandler("Unauthorized access to service")
+	case match(`GET`, `^/secrets$`):
+		return r.addLabelsToQueryStringFilters(l, req, upstream)
+	case match(`POST`, `^/secrets/create$`), match(`POST`, `^/secrets/([^/]+)/update$`):
+		return r.handleSpecLabels(l, "secrets", req, upstream)
+	case match(`GET`, `^/secrets/([^/]+)$`), match(`DELETE`, `^/secrets/([^/]+)$`):
+		if ok, err := r.checkOwner(l, "secrets", r.allowUnowned("secrets", false), req); ok {
 			return upstream
+		} else if err == errInspectNotFound {
+			return r.notFoundHandler(l, "Secret", upstream)
 		} else if err != nil {
 			return errorHandler(err.Error(), http.StatusInternalServerError)
 		}
-		return errorHandler("Unauthorized access to volume", http.StatusUnauthorized)
-
+		return deniedHandler("Unauthorized access to secret")
+	case match(`*`, `^/configs\b`) && r.DenyConfigs:
+		return deniedHandler("Swarm configs are not allowed")
+	case match(`GET`, `^/configs$`):
+		return r.addLabelsToQueryStringFilters(l, req, upstream)
+	case match(`POST`, `^/configs/create$`), match(`POST`, `^/configs/([^/]+)/update$`):
+		return r.handleSpecLabels(l, "configs", req, upstream)
+	case match(`GET`, `^/configs/([^/]+)$`), match(`DELETE`, `^/configs/([^/]+)$`):
+		if ok, err := r.checkOwner(l, "configs", r.allowUnowned("configs", false), req); ok {
+			return upstream
+		} else if err == errInspectNotFound {
+			return r.notFoundHandler(l, "Config", upstream)
+		} else if err != nil {
+			return errorHandler(err.Error(), http.StatusInternalServerError)
+		}
+		return deniedHandler("Unauthorized access to config")
+	case match(`GET`, `^/tasks$`):
+		return r.addLabelsToQueryStringFilters(l, req, upstream)
+	case match(`GET`, `^/tasks/([^/]+)(/logs)?$`):
+		return r.handleTask(l, req, upstream)
 	}
 
 	return errorHandler(req.Method+" "+req.URL.Path+" not implemented yet", http.StatusNotImplemented)
@@ -166,8 +693,11 @@ var identifierPatterns = []*regexp.Regexp{
 	regexp.MustCompile(`^/images/(.+?)/(?:json|history|push|tag)$`),
 	regexp.MustCompile(`^/images/([^/]+)$`),
 	regexp.MustCompile(`^/images/(\w+/[^/]+)$`),
+	regexp.MustCompile(`^/(?:services|secrets|configs)/([^/]+?)(?:/\w+)?$`),
 }
 
+var taskRegex = regexp.MustCompile(`^/tasks/([^/]+?)(?:/\w+)?$`)
+
 // Check owner takes a request for /vx.x/{kind}/{id} and uses inspect to see if it's
 // got the correct owner label.
 func (r *RulesDirector) checkOwner(l socketproxy.Logger, kind string, allowEmpty bool, req *http.Request) (bool, error) {
@@ -192,10 +722,34 @@ func (r *RulesDirector) checkOwner(l socketproxy.Logger, kind string, allowEmpty
 	return r.checkIdentifierOwner(l, kind, identifier, allowEmpty)
 }
 
+// allowUnowned returns whether resources of kind without an owner label can be accessed, from
+// AllowUnowned if it's set for kind, otherwise the default for the endpoint
+func (r *RulesDirector) allowUnowned(kind string, defaultAllow bool) bool {
+	if allow, ok := r.AllowUnowned[kind]; ok {
+		return allow
+	}
+	return defaultAllow
+}
+
+// isAlsoAllowedOwner checks whether owner is one of AlsoAllowOwners
+func (r *RulesDirector) isAlsoAllowedOwner(owner string) bool {
+	for _, allowed := range r.AlsoAllowOwners {
+		if owner == allowed {
+			return true
+		}
+	}
+	return false
+}
+
 func (r *RulesDirector) checkIdentifierOwner(l socketproxy.Logger, kind string, identifier string, allowEmpty bool) (bool, error) {
 
 	l.Printf("Looking up identifier %q", identifier)
 
+	if kind == "images" && r.isOwnedImage(identifier) {
+		l.Printf("Allow, %s/%s is tracked as owned by %q", kind, identifier, r.Owner)
+		return true, nil
+	}
+
 	labels, err := r.inspectLabels(kind, identifier)
 	if err != nil {
 		return false, err
@@ -206,6 +760,9 @@ func (r *RulesDirector) checkIdentifierOwner(l socketproxy.Logger, kind string,
 	if val, exists := labels[ownerKey]; exists && val == r.Owner {
 		l.Printf("Allow, %s/%s matches owner %q", kind, identifier, r.Owner)
 		return true, nil
+	} else if exists && r.isAlsoAllowedOwner(val) {
+		l.Printf("Allow, %s/%s matches also allowed owner %q", kind, identifier, val)
+		return true, nil
 	} else if !exists && allowEmpty {
 		l.Printf("Allow, %s/%s has no owner", kind, identifier)
 		return true, nil
@@ -215,99 +772,404 @@ func (r *RulesDirector) checkIdentifierOwner(l socketproxy.Logger, kind string,
 	}
 }
 
+// isBuildkitImage checks whether an image is the digest pinned BuildKitImage
+func (r *RulesDirector) isBuildkitImage(image string) bool {
+	if r.BuildkitImage == "" {
+		return false
+	}
+	ref, allowed := parseImageReference(image), parseImageReference(r.BuildkitImage)
+	return ref.Digest != "" && ref.Name() == allowed.Name() && ref.Digest == allowed.Digest
+}
+
+// isBuildkitContainer checks whether a container create is for a buildx builder, which runs the
+// BuildKitImage privileged with the image's entrypoint (buildkitd), only buildkitd flags as the
+// command and its state in a volume. Anything else could run other commands, or reach the host
+// through binds and devices, with the privileges.
+func (r *RulesDirector) isBuildkitContainer(l socketproxy.Logger, create *dockerapi.ContainerCreate) bool {
+	if !r.isBuildkitImage(create.Image) {
+		return false
+	}
+
+	// an empty string entrypoint resets it rather than using the image's
+	if entrypoint, ok := create.Extra["Entrypoint"].([]interface{}); create.Extra["Entrypoint"] != nil && (!ok || len(entrypoint) > 0) {
+		l.Printf("BuildKit container overrides the entrypoint with %v", create.Extra["Entrypoint"])
+		return false
+	}
+	if cmd := create.Extra["Cmd"]; cmd != nil {
+		args, ok := cmd.([]interface{})
+		if !ok {
+			l.Printf("BuildKit container has a command of %v rather than buildkitd flags", cmd)
+			return false
+		}
+		for _, arg := range args {
+			if s, ok := arg.(string); !ok || !strings.HasPrefix(s, "--") {
+				l.Printf("BuildKit container has a command of %v rather than buildkitd flags", cmd)
+				return false
+			}
+		}
+	}
+
+	hostConfig := &create.HostConfig
+	if len(hostConfig.Binds) > 0 || len(hostConfig.VolumesFrom) > 0 {
+		l.Printf("BuildKit container has binds %v or volumes from %v", hostConfig.Binds, hostConfig.VolumesFrom)
+		return false
+	}
+	for _, mount := range hostConfig.Mounts {
+		if mount.Type != "volume" {
+			l.Printf("BuildKit container has a %s mount of %q", mount.Type, mount.Source)
+			return false
+		}
+	}
+	for _, field := range []string{"Devices", "DeviceCgroupRules", "DeviceRequests"} {
+		if !isUnsetJSON(hostConfig.Extra[field]) {
+			l.Printf("BuildKit container has HostConfig.%s %v", field, hostConfig.Extra[field])
+			return false
+		}
+	}
+	return true
+}
+
+// isPrivilegedAllowed checks whether a container of an image can run privileged, with
+// AllowPrivileged and the image being one of the digest pinned AllowPrivilegedImages if any are
+// set. Only digests are matched, as anyone can tag a local image with an allowed name.
+func (r *RulesDirector) isPrivilegedAllowed(l socketproxy.Logger, image string) bool {
+	if !r.AllowPrivileged {
+		return false
+	}
+	if len(r.AllowPrivilegedImages) == 0 {
+		return true
+	}
+
+	ref := parseImageReference(image)
+	for _, pinned := range r.AllowPrivilegedImages {
+		allowed := parseImageReference(pinned)
+		if ref.Digest != "" && ref.Name() == allowed.Name() && ref.Digest == allowed.Digest {
+			return true
+		}
+	}
+	l.Printf("Image %q isn't one of the digest pinned images allowed to run privileged %v", image, r.AllowPrivilegedImages)
+	return false
+}
+
+// isRuntimeAllowed checks an OCI runtime against AllowRuntimes, the default is always allowed
+func (r *RulesDirector) isRuntimeAllowed(runtime string) bool {
+	if runtime == "" {
+		return true
+	}
+	if len(r.AllowRuntimes) == 0 {
+		return !r.Strict
+	}
+	for _, allowed := range r.AllowRuntimes {
+		if runtime == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// isIsolationAllowed checks an isolation technology against AllowIsolation, the default is always allowed
+func (r *RulesDirector) isIsolationAllowed(isolation string) bool {
+	if isolation == "" || isolation == "default" {
+		return true
+	}
+	for _, allowed := range r.AllowIsolation {
+		if isolation == allowed {
+			return true
+		}
+	}
+	return false
+}
+
 func (r *RulesDirector) handleContainerCreate(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		var decoded map[string]interface{}
+		var create dockerapi.ContainerCreate
 
-		if err := json.NewDecoder(req.Body).Decode(&decoded); err != nil {
+		if err := decodeJSON(req.Body, &create); err != nil {
 			writeError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		hostConfig := &create.HostConfig
 
 		// first we add our labels
-		addLabel(ownerKey, r.Owner, decoded["Labels"])
+		if create.Labels != nil {
+			create.Labels[ownerKey] = r.Owner
+		}
+
+		// names can collide with, or squat on, those of other jobs
+		if name := req.URL.Query().Get("name"); r.DenyContainerNames && name != "" {
+			l.Printf("Denied container name %q on container create", name)
+			r.writeDenied(w, req, "Containers aren't allowed to be given names")
+			return
+		}
 
-		l.Printf("Labels: %#v", decoded["Labels"])
+		// prefix the container name and resolve the names it references, if configured
+		if r.PrefixNames {
+			if err := r.prefixContainerCreate(l, req, &create); err != nil {
+				writeError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
 
-		// prevent privileged mode
-		privileged, ok := decoded["HostConfig"].(map[string]interface{})["Privileged"].(bool)
-		if ok && privileged {
+		l.Printf("Labels: %#v", create.Labels)
+
+		// inspect the containers, networks and volumes referenced concurrently, rather than one by
+		// one in the checks below
+		r := r.withPrefetchedLabels(l, containerCreateReferences(&create))
+
+		// prevent privileged mode, except for the buildx builders of the BuildKit image and images
+		// allowed to with AllowPrivileged
+		if hostConfig.Privileged && r.isBuildkitContainer(l, &create) {
+			l.Printf("Allowing privileged on container create for BuildKit image %q", create.Image)
+		} else if hostConfig.Privileged && r.isPrivilegedAllowed(l, create.Image) {
+			l.Printf("Allowing privileged on container create for image %q", create.Image)
+		} else if hostConfig.Privileged {
 			l.Printf("Denied privileged on container create")
-			writeError(w, "Containers aren't allowed to run as privileged", http.StatusUnauthorized)
+			r.writeDenied(w, req, "Containers aren't allowed to run as privileged")
 			return
 		}
 
+		// only allow platforms matching AllowPlatforms, foreign architectures run under emulation
+		if platform := req.URL.Query().Get("platform"); !r.isPlatformAllowed(platform) {
+			l.Printf("Denied platform %q on container create", platform)
+			r.writeDenied(w, req, fmt.Sprintf("Containers aren't allowed to use platform %q", platform))
+			return
+		}
+
+		if image := create.Image; image != "" {
+			// only allow images matching AllowImages
+			if ok, err := r.isImageAllowed(l, image); err != nil {
+				writeError(w, err.Error(), http.StatusInternalServerError)
+				return
+			} else if !ok {
+				l.Printf("Denied image %q on container create", image)
+				r.writeDenied(w, req, fmt.Sprintf("Image %q isn't allowed", image))
+				return
+			}
+
+			// require images to be pinned to a digest or non-latest tag, if configured
+			if err := r.checkImagePinning(image); err != nil {
+				l.Printf("Denied image on container create: %s", err.Error())
+				r.writeDenied(w, req, err.Error())
+				return
+			}
+
+			// verify the signature of images that will be pulled by this create, using the
+			// digest that was verified
+			verified, err := r.verifyImageIfMissing(l, image)
+			if err != nil {
+				l.Printf("Denied image on container create: %s", err.Error())
+				r.writeDenied(w, req, err.Error())
+				return
+			}
+			create.Image = verified
+		}
+
 		// filter binds, don't allow host binds
-		binds, ok := decoded["HostConfig"].(map[string]interface{})["Binds"].([]interface{})
-		if ok {
-			for _, bind := range binds {
-				isAllowed, err := r.isBindAllowed(l, bind.(string), r.AllowBinds, req)
-				if err != nil {
-					writeError(w, err.Error(), http.StatusBadRequest)
+		for _, bind := range hostConfig.Binds {
+			if !r.AllowSharedBindPropagation && isSharedPropagation(bindPropagation(bind)) {
+				l.Printf("Denied shared propagation on host bind %q", bind)
+				r.writeDenied(w, req, "Shared bind propagation isn't allowed")
+				return
+			}
+			isAllowed, err := r.isBindAllowed(l, bind, r.AllowBinds, req)
+			if err != nil {
+				writeError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !isAllowed {
+				l.Printf("Denied host bind %q", bind)
+				r.writeDenied(w, req, "Host binds aren't allowed")
+				return
+			}
+		}
+
+		// apply the same policy to mounts, which newer docker clients use instead of binds
+		for _, m := range hostConfig.Mounts {
+			if m.BindOptions != nil && !r.AllowSharedBindPropagation && isSharedPropagation(m.BindOptions.Propagation) {
+				l.Printf("Denied shared propagation on mount %+v", m)
+				r.writeDenied(w, req, "Shared bind propagation isn't allowed")
+				return
+			}
+			isAllowed, err := r.isMountAllowed(l, m.Type, m.Source, r.AllowBinds)
+			if err != nil {
+				writeError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !isAllowed {
+				l.Printf("Denied mount %+v", m)
+				r.writeDenied(w, req, fmt.Sprintf("Mounts of type %v with source %q aren't allowed", m.Type, m.Source))
+				return
+			}
+		}
+
+		// prevent host and container network mode
+		if hostConfig.NetworkMode == "host" && (!r.AllowHostModeNetworking) {
+			l.Printf("Denied host network mode on container create")
+			r.writeDenied(w, req, "Containers aren't allowed to use host networking")
+			return
+		}
+
+		// only allow attaching to owned or allowed networks, by NetworkMode or EndpointsConfig
+		networks := []string{hostConfig.NetworkMode}
+		for network := range create.NetworkingConfig.EndpointsConfig {
+			networks = append(networks, network)
+		}
+		for _, network := range networks {
+			isAllowed, err := r.isNetworkAllowed(l, network)
+			if err != nil {
+				writeError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !isAllowed {
+				l.Printf("Denied attaching to network %q on container create", network)
+				r.writeDenied(w, req, fmt.Sprintf("Containers aren't allowed to attach to network %q", network))
+				return
+			}
+		}
+
+		// only allow linking to (--link) and using volumes from (--volumes-from) owned containers
+		for flag, refs := range map[string][]string{"--link": hostConfig.Links, "--volumes-from": hostConfig.VolumesFrom} {
+			for _, ref := range refs {
+				name := referenceName(ref)
+				isAllowed, err := r.checkIdentifierOwner(l, "containers", name, r.allowUnowned("containers", false))
+				if err == errInspectNotFound {
+					// The daemon will fail the create
+					continue
+				} else if err != nil {
+					writeError(w, err.Error(), http.StatusInternalServerError)
 					return
 				}
 				if !isAllowed {
-					l.Printf("Denied host bind %q", bind)
-					writeError(w, "Host binds aren't allowed", http.StatusUnauthorized)
+					l.Printf("Denied %s %q on container create", flag, ref)
+					r.writeDenied(w, req, fmt.Sprintf("Containers aren't allowed to use %s with container %q", flag, name))
 					return
 				}
 			}
 		}
 
-		// prevent host and container network mode
-		networkMode, ok := decoded["HostConfig"].(map[string]interface{})["NetworkMode"].(string)
-		if ok && networkMode == "host" && (!r.AllowHostModeNetworking) {
-			l.Printf("Denied host network mode on container create")
-			writeError(w, "Containers aren't allowed to use host networking", http.StatusUnauthorized)
+		// deny the HostConfig fields the rules don't know about in strict mode
+		if r.Strict {
+			if err := checkStrictHostConfig(l, hostConfig.Extra); err != nil {
+				r.writeDenied(w, req, err.Error())
+				return
+			}
+		}
+
+		// resources aren't typed, limits are applied to them even if there was no HostConfig
+		if hostConfig.Extra == nil {
+			hostConfig.Extra = map[string]interface{}{}
+		}
+
+		// apply resource limits, if configured
+		if err := r.applyContainerResourceLimits(l, hostConfig.Extra, true); err != nil {
+			r.writeDenied(w, req, err.Error())
+			return
+		}
+
+		// force the log driver and its rotation options, if configured
+		if err := r.applyContainerLogConfig(l, hostConfig.Extra); err != nil {
+			r.writeDenied(w, req, err.Error())
+			return
+		}
+
+		// set or cap the size of the container's writable layer, if configured
+		if err := r.applyContainerStorageSize(l, hostConfig.Extra); err != nil {
+			r.writeDenied(w, req, err.Error())
+			return
+		}
+
+		// check resources fit in what's left of the owner's quota, if configured
+		if len(r.OwnerQuota) > 0 {
+			unlock := r.lockOwnerQuota()
+			defer unlock()
+
+			used, err := r.ownedContainerResources("")
+			if err != nil {
+				writeError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := r.checkOwnerQuota(l, hostConfig.Extra, used, true); err != nil {
+				r.writeDenied(w, req, err.Error())
+				return
+			}
+		}
+
+		// prevent custom /etc/hosts entries, if configured
+		if len(hostConfig.ExtraHosts) > 0 && r.DenyExtraHosts {
+			l.Printf("Denied extra hosts %v on container create", hostConfig.ExtraHosts)
+			r.writeDenied(w, req, "Containers aren't allowed to add hosts")
+			return
+		}
+
+		// prevent raising ulimits, if configured
+		if len(hostConfig.Ulimits) > 0 && r.DenyUlimits {
+			l.Printf("Denied ulimits %v on container create", hostConfig.Ulimits)
+			r.writeDenied(w, req, "Containers aren't allowed to set ulimits")
+			return
+		}
+
+		// only allow the default runtime, or those in AllowRuntimes if any are set
+		if !r.isRuntimeAllowed(hostConfig.Runtime) {
+			l.Printf("Denied runtime %q on container create", hostConfig.Runtime)
+			r.writeDenied(w, req, fmt.Sprintf("Containers aren't allowed to use runtime %q", hostConfig.Runtime))
+			return
+		}
+
+		// only allow the default isolation, or those in AllowIsolation
+		if !r.isIsolationAllowed(hostConfig.Isolation) {
+			l.Printf("Denied isolation %q on container create", hostConfig.Isolation)
+			r.writeDenied(w, req, fmt.Sprintf("Containers aren't allowed to use isolation %q", hostConfig.Isolation))
 			return
 		}
 
 		if r.ContainerCgroupParent == "" {
-			// Flag is disable,d prevent setting a user defined CgroupParent for host safety
-			cgroupParent, ok := decoded["HostConfig"].(map[string]interface{})["CgroupParent"].(string)
-			if ok == true && cgroupParent != "" {
+			// Flag is disabled, prevent setting a user defined CgroupParent for host safety
+			if cgroupParent := hostConfig.CgroupParent; cgroupParent != "" {
 				l.Printf("Denied requested CgroupParent '%s' on container create (flag disabled)", cgroupParent)
-				writeError(w, fmt.Sprintf("Containers aren't allowed to set their own CgroupParent (received '%s')", cgroupParent), http.StatusUnauthorized)
+				r.writeDenied(w, req, fmt.Sprintf("Containers aren't allowed to set their own CgroupParent (received '%s')", cgroupParent))
 				return
 			}
 		} else {
 			// Apply the specified CgroupParent, flag enabled
 			l.Printf("Applied CgroupParent '%s'", r.ContainerCgroupParent)
-			decoded["HostConfig"].(map[string]interface{})["CgroupParent"] = r.ContainerCgroupParent
+			hostConfig.CgroupParent = r.ContainerCgroupParent
 		}
 
 		// apply ContainerDockerLink if enabled
 		if r.ContainerDockerLink != "" {
-			// NOTE: The way Links are parsed out is not elegant, but doing it in two phases was the only answer
-			// I had to avoid nil panics in the end, while being able to iterate over non-nil slices of interfaces.
-			links, ok := decoded["HostConfig"].(map[string]interface{})["Links"]
-			if ok {
-				// Need to populate this from the interface value
-				newLinks := []string{}
-				if links != nil {
-					useLinks := links.([]interface{})
-					newLinks = make([]string, len(useLinks))
-					for i, v := range useLinks {
-						newLinks[i] = fmt.Sprint(v)
-					}
-				}
-				l.Printf("Appending '%s' to Links for /containers/create", r.ContainerDockerLink)
-				newLinks = append(newLinks, r.ContainerDockerLink)
-				decoded["HostConfig"].(map[string]interface{})["Links"] = newLinks
-			} else {
-				l.Printf("Denied container create: unable to parse Links %+v", links)
-				writeError(w, fmt.Sprintf("Denied container create: unable to parse Links %+v", links), http.StatusBadRequest)
-				return
-			}
+			l.Printf("Appending '%s' to Links for /containers/create", r.ContainerDockerLink)
+			hostConfig.Links = append(hostConfig.Links, r.ContainerDockerLink)
+		}
+
+		// docker stop sends the container's stop signal, so it's limited like kill signals
+		if stopSignal, _ := create.Extra["StopSignal"].(string); !r.isKillSignalAllowed(stopSignal) {
+			l.Printf("Denied stop signal %q on container create", stopSignal)
+			r.writeDenied(w, req, fmt.Sprintf("Containers aren't allowed to use stop signal %q", stopSignal))
+			return
+		}
+
+		// set the time containers get to stop before they're killed, if configured
+		if create.Extra == nil {
+			create.Extra = map[string]interface{}{}
+		}
+		if err := r.applyContainerStopTimeout(l, create.Extra); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// force an init process
+		if r.ForceInit {
+			hostConfig.Extra["Init"] = true
+			l.Printf("Forcing init")
 		}
 
 		// force user
 		if r.User != "" {
-			decoded["User"] = r.User
+			create.User = r.User
 			l.Printf("Forcing user to '%s'", r.User)
 		}
 
-		encoded, err := json.Marshal(decoded)
+		encoded, err := json.Marshal(create)
 		if err != nil {
 			writeError(w, err.Error(), http.StatusBadRequest)
 			return
@@ -332,25 +1194,156 @@ func (r *RulesDirector) isBindAllowed(l socketproxy.Logger, bind string, allowed
 
 	// TODO: better heuristic for host-src vs volume-name
 	if strings.ContainsAny(chunks[0], ".\\/") {
-		hostSrc := filepath.FromSlash(path.Clean("/" + chunks[0]))
+		return r.isHostPathAllowed(l, chunks[0], allowed)
+	}
 
-		for _, allowedPath := range allowed {
-			if allowedPath == hostSrc || strings.HasPrefix(hostSrc, allowedPath+"/") {
-				return true, nil
-			}
+	// There is a request to bind volume, let's check the ownership
+	return r.isVolumeAllowed(l, chunks[0])
+}
+
+// isVolumeAllowed checks a named volume is either owned by us, or matches one of the
+// AllowVolumes patterns (e.g. shared build caches)
+func (r *RulesDirector) isVolumeAllowed(l socketproxy.Logger, volumeName string) (bool, error) {
+	for _, pattern := range r.AllowVolumes {
+		if matched, err := path.Match(pattern, volumeName); err != nil {
+			return false, fmt.Errorf("Invalid volume pattern %q: %s", pattern, err.Error())
+		} else if matched {
+			l.Printf("Allow, volume %q matches allowed pattern %q", volumeName, pattern)
+			return true, nil
 		}
+	}
 
-		return false, nil
+	return r.checkIdentifierOwner(l, "volumes", volumeName, false)
+}
+
+// isNetworkAllowed checks whether a container can attach to a network, which must be one of the
+// defaults, owned, or match an AllowNetworks pattern. Joining another container's network
+// (container:<id>) requires owning the container.
+func (r *RulesDirector) isNetworkAllowed(l socketproxy.Logger, network string) (bool, error) {
+	switch network {
+	case "", "default", "bridge", "none", "host":
+		// host networking is checked separately
+		return true, nil
 	}
 
-	// There is a request to bind volume, let's check the ownership
-	volumeName := chunks[0]
-	isOwner, err := r.checkIdentifierOwner(l, "volumes", volumeName, false)
-	if err != nil {
-		return false, err
+	if strings.HasPrefix(network, "container:") {
+		ok, err := r.checkIdentifierOwner(l, "containers", strings.TrimPrefix(network, "container:"), r.allowUnowned("containers", false))
+		if err == errInspectNotFound {
+			return true, nil
+		}
+		return ok, err
+	}
+
+	for _, pattern := range r.AllowNetworks {
+		if matched, err := path.Match(pattern, network); err != nil {
+			return false, fmt.Errorf("Invalid network pattern %q: %s", pattern, err.Error())
+		} else if matched {
+			l.Printf("Allow, network %q matches allowed pattern %q", network, pattern)
+			return true, nil
+		}
+	}
+
+	ok, err := r.checkIdentifierOwner(l, "networks", network, false)
+	if err == errInspectNotFound {
+		// The daemon will fail the create
+		return true, nil
+	}
+	return ok, err
+}
+
+// bindPropagation returns the propagation mode from a bind's options, if any
+func bindPropagation(bind string) string {
+	chunks := strings.Split(bind, ":")
+	if len(chunks) < 3 {
+		return ""
+	}
+	for _, opt := range strings.Split(chunks[2], ",") {
+		switch opt {
+		case "shared", "rshared", "slave", "rslave", "private", "rprivate":
+			return opt
+		}
+	}
+	return ""
+}
+
+func isSharedPropagation(propagation string) bool {
+	return propagation == "shared" || propagation == "rshared"
+}
+
+func (r *RulesDirector) isMountAllowed(l socketproxy.Logger, mountType, source string, allowed []string) (bool, error) {
+	switch mountType {
+	case "bind":
+		return r.isHostPathAllowed(l, source, allowed)
+	case "volume":
+		// Anonymous volumes are created fresh for the container
+		if source == "" {
+			return true, nil
+		}
+		return r.isVolumeAllowed(l, source)
+	case "tmpfs":
+		return true, nil
+	}
+
+	// npipe, cluster and anything newer we don't know how to check
+	return false, nil
+}
+
+// isHostPathAllowed checks a host path against the allowed path prefixes, resolving
+// symlinks first if ResolveBindSymlinks is set
+func (r *RulesDirector) isHostPathAllowed(l socketproxy.Logger, hostPath string, allowed []string) (bool, error) {
+	hostSrc := filepath.FromSlash(path.Clean("/" + hostPath))
+
+	if r.ResolveBindSymlinks {
+		resolved, err := resolveSymlinks(hostSrc)
+		if err != nil {
+			return false, err
+		}
+		if resolved != hostSrc {
+			l.Printf("Resolved host path %q to %q", hostSrc, resolved)
+		}
+		hostSrc = resolved
 	}
 
-	return isOwner, nil
+	// Deny binds of (or above) critical host paths, even if an allow-bind covers them
+	for _, deniedPath := range append(defaultDenyBinds, r.DenyBinds...) {
+		deniedPath = filepath.Clean(deniedPath)
+		if pathHasPrefix(hostSrc, deniedPath) || pathHasPrefix(deniedPath, hostSrc) {
+			l.Printf("Denied host path %q, matches denied path %q", hostSrc, deniedPath)
+			return false, nil
+		}
+	}
+
+	for _, allowedPath := range allowed {
+		if r.ResolveBindSymlinks {
+			resolved, err := resolveSymlinks(allowedPath)
+			if err != nil {
+				return false, err
+			}
+			allowedPath = resolved
+		}
+		if pathHasPrefix(hostSrc, allowedPath) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// pathHasPrefix returns whether p is prefix, or is a path underneath it
+func pathHasPrefix(p, prefix string) bool {
+	return p == prefix || strings.HasPrefix(p, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// resolveSymlinks evaluates any symlinks in p, returning p unchanged if it doesn't exist
+// on this host (e.g. sockguard is running in a container without the path mounted)
+func resolveSymlinks(p string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(p)
+	if os.IsNotExist(err) {
+		return p, nil
+	} else if err != nil {
+		return "", err
+	}
+	return resolved, nil
 }
 
 type containerDockerLink struct {
@@ -378,22 +1371,34 @@ func splitContainerDockerLink(input string) (*containerDockerLink, error) {
 func (r *RulesDirector) handleNetworkCreate(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		// Not using modifyRequestBody since we need the decoded network name further down, less duplication this way
-		var decoded map[string]interface{}
+		var create dockerapi.NetworkCreate
 
-		if err := json.NewDecoder(req.Body).Decode(&decoded); err != nil {
+		if err := decodeJSON(req.Body, &create); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 		// Get the newly created network name from original request, for use later (if ContainerDockerLink or ContainerJoinNetwork is enabled)
-		networkIdOrName, ok := decoded["Name"].(string)
-		if ok == false {
+		if create.Name == "" {
 			http.Error(w, "Failed to obtain network name from request", http.StatusBadRequest)
 			return
 		}
+		if r.PrefixNames {
+			create.Name = r.prefixName(create.Name)
+		}
+		networkIdOrName := create.Name
 
-		addLabel(ownerKey, r.Owner, decoded["Labels"])
+		// only allow drivers that don't attach to the host's interfaces in strict mode
+		if driver, _ := create.Extra["Driver"].(string); r.Strict && !strictNetworkDrivers[driver] {
+			l.Printf("Denied network driver %q in strict mode", driver)
+			r.writeDenied(w, req, fmt.Sprintf("Networks aren't allowed to use driver %q", driver))
+			return
+		}
 
-		encoded, err := json.Marshal(decoded)
+		if create.Labels != nil {
+			create.Labels[ownerKey] = r.Owner
+		}
+
+		encoded, err := json.Marshal(create)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
@@ -432,7 +1437,7 @@ func (r *RulesDirector) handleNetworkCreate(l socketproxy.Logger, req *http.Requ
 
 			// Do the container attach
 			attachJson := fmt.Sprintf("{\"Container\":\"%s\"%s}", useContainer, useContainerEndpointConfig)
-			attachReq, err := http.NewRequest("POST", fmt.Sprintf("http://unix/v%s/networks/%s/connect", apiVersion, networkIdOrName), strings.NewReader(attachJson))
+			attachReq, err := r.newRequest("POST", fmt.Sprintf("http://unix/v%s/networks/%s/connect", r.internalAPIVersion(), networkIdOrName), strings.NewReader(attachJson))
 			attachReq.Header.Set("Content-Type", "application/json")
 			//debugf("Network Connect Request: %+v\n", attachReq)
 			if err != nil {
@@ -456,14 +1461,14 @@ func (r *RulesDirector) handleNetworkCreate(l socketproxy.Logger, req *http.Requ
 
 func (r *RulesDirector) handleNetworkDelete(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		ok, err := r.checkOwner(l, "networks", true, req)
+		ok, err := r.checkOwner(l, "networks", r.allowUnowned("networks", true), req)
 		if ok == false {
 			errMsg := fmt.Sprintf("Deleting network denied, no error")
 			if err != nil {
 				errMsg = fmt.Sprintf("Deleting network denied: %s", err.Error())
 			}
-			l.Printf(errMsg)
-			http.Error(w, errMsg, http.StatusUnauthorized)
+			l.Printf("%s", errMsg)
+			r.writeDenied(w, req, errMsg)
 			return
 		}
 
@@ -492,7 +1497,7 @@ func (r *RulesDirector) handleNetworkDelete(l socketproxy.Logger, req *http.Requ
 
 			// Do the container detach (forced, so we can delete the network)
 			detachJson := fmt.Sprintf("{\"Container\":\"%s\",\"Force\":true}", useContainer)
-			detachReq, err := http.NewRequest("POST", fmt.Sprintf("http://unix/v%s/networks/%s/disconnect", apiVersion, networkIdOrName), strings.NewReader(detachJson))
+			detachReq, err := r.newRequest("POST", fmt.Sprintf("http://unix/v%s/networks/%s/disconnect", r.internalAPIVersion(), networkIdOrName), strings.NewReader(detachJson))
 			detachReq.Header.Set("Content-Type", "application/json")
 			//debugf("Network Disconnect Request: %+v\n", detachReq)
 			if err != nil {
@@ -506,7 +1511,7 @@ func (r *RulesDirector) handleNetworkDelete(l socketproxy.Logger, req *http.Requ
 			}
 			if detachResp.StatusCode != 200 {
 				errString := fmt.Sprintf("Expected 200 got %d when detaching Container ID/Name '%s' from Network '%s' (before deleting)", detachResp.StatusCode, useContainer, networkIdOrName)
-				l.Printf(errString)
+				l.Printf("%s", errString)
 				http.Error(w, errString, http.StatusBadRequest)
 				return
 			}
@@ -604,7 +1609,7 @@ func (r *RulesDirector) handleBuild(l socketproxy.Logger, req *http.Request, ups
 
 		// Owner label
 		l.Printf("Adding label %s=%s to querystring: %s %s",
-			ownerKey, r.Owner, req.URL.Path, req.URL.RawQuery)
+			ownerKey, r.Owner, req.URL.Path, socketproxy.RedactQuery(req.URL.RawQuery))
 		var labels = map[string]string{}
 		if encoded := q.Get("labels"); encoded != "" {
 			if err := json.NewDecoder(strings.NewReader(encoded)).Decode(&labels); err != nil {
@@ -625,7 +1630,7 @@ func (r *RulesDirector) handleBuild(l socketproxy.Logger, req *http.Request, ups
 		// Prevent setting a CgroupParent if flag is disabled, for host safety
 		if cgroupParent != "" {
 			l.Printf("Denied requested CgroupParent '%s' on build (flag disabled)", cgroupParent)
-			writeError(w, fmt.Sprintf("Image builds aren't allowed to set their own CgroupParent (received '%s')", cgroupParent), http.StatusUnauthorized)
+			r.writeDenied(w, req, fmt.Sprintf("Image builds aren't allowed to set their own CgroupParent (received '%s')", cgroupParent))
 			return
 		}
 		// Apply the specified CgroupParent, if flag enabled
@@ -634,19 +1639,99 @@ func (r *RulesDirector) handleBuild(l socketproxy.Logger, req *http.Request, ups
 			q.Set("cgroupparent", r.ContainerCgroupParent)
 		}
 
+		// Remote contexts are fetched by the daemon itself
+		if remote := q.Get("remote"); remote != "" {
+			if err := r.checkBuildRemote(l, remote, q.Get("version")); err != nil {
+				r.writeDenied(w, req, err.Error())
+				return
+			}
+		}
+
+		// ExtraHosts, Ulimits, Isolation and squash
+		if err := r.checkBuildParams(l, q); err != nil {
+			r.writeDenied(w, req, err.Error())
+			return
+		}
+
+		// Memory and CPU defaults and limits
+		if err := r.applyBuildResources(l, q); err != nil {
+			r.writeDenied(w, req, err.Error())
+			return
+		}
+
+		// NetworkMode, apply the same host networking policy as containers
+		networkMode := q.Get("networkmode")
+		if networkMode == "host" && !r.AllowHostModeNetworking {
+			l.Printf("Denied host network mode on build")
+			r.writeDenied(w, req, "Image builds aren't allowed to use host networking")
+			return
+		}
+		// Force RUN steps onto a specific network, if flag enabled
+		if r.BuildNetwork != "" {
+			l.Printf("Applied NetworkMode '%s' to image build (requested '%s')", r.BuildNetwork, networkMode)
+			q.Set("networkmode", r.BuildNetwork)
+		}
+
 		// Rebuild the query string ready to forward request
 		req.URL.RawQuery = q.Encode()
 
+		// Check the Dockerfile in the build context against the policy
+		if len(r.DenyDockerfilePatterns) > 0 {
+			if err := r.scanBuildDockerfile(l, req); err != nil {
+				r.writeDenied(w, req, err.Error())
+				return
+			}
+		}
+
+		// Registry credentials for pulling base images
+		if err := r.injectRegistryConfig(l, req); err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if r.BuildCacheQuota == 0 {
+			upstream.ServeHTTP(w, req)
+			return
+		}
+
+		// Our builds are measured one at a time, so they can't all start before the cache of the
+		// others counts towards the quota. Builds of other owners aren't held up, so their records
+		// can be attributed to us too if they overlap.
+		defer r.lockBuildCache()()
+
+		// Deny builds once the build cache created by our previous builds exceeds the quota
+		before, err := r.buildCacheRecords()
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if usage := r.ownedBuildCacheUsage(before); usage > r.BuildCacheQuota {
+			l.Printf("Denied build, build cache usage of %d bytes exceeds quota of %d bytes", usage, r.BuildCacheQuota)
+			r.writeDenied(w, req, fmt.Sprintf("Build cache usage of %d bytes exceeds quota of %d bytes, prune the build cache before building", usage, r.BuildCacheQuota))
+			return
+		}
+
 		upstream.ServeHTTP(w, req)
+
+		after, err := r.buildCacheRecords()
+		if err != nil {
+			l.Printf("Unable to record build cache usage: %s", err.Error())
+			return
+		}
+		r.recordOwnedBuildCache(before, after)
 	})
 }
 
 var errInspectNotFound = errors.New("Not found")
 
 func (r *RulesDirector) getInto(into interface{}, path string, arg ...interface{}) error {
-	u := fmt.Sprintf("http://docker/v%s%s", apiVersion, fmt.Sprintf(path, arg...))
+	u := fmt.Sprintf("http://docker/v%s%s", r.internalAPIVersion(), fmt.Sprintf(path, arg...))
 
-	resp, err := r.Client.Get(u)
+	req, err := r.newRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.Client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -661,39 +1746,185 @@ func (r *RulesDirector) getInto(into interface{}, path string, arg ...interface{
 	return json.NewDecoder(resp.Body).Decode(into)
 }
 
+// inspectLabels returns the labels of a resource, cached for InspectCacheTTL if set
 func (r *RulesDirector) inspectLabels(kind, id string) (map[string]string, error) {
+	if result, ok := r.prefetched[kind+"/"+id]; ok {
+		return result.labels, result.err
+	}
+	if labels, ok := r.cachedLabels(kind, id); ok {
+		return labels, nil
+	}
+	labels, resourceID, err := r.fetchLabelsAndID(kind, id)
+	if err != nil {
+		return nil, err
+	}
+	// names can be given to another resource, IDs can't, so only lookups by ID are cached
+	if resourceID == id {
+		r.cacheLabels(kind, id, labels)
+	}
+	return labels, nil
+}
+
+func (r *RulesDirector) fetchLabels(kind, id string) (map[string]string, error) {
+	labels, _, err := r.fetchLabelsAndID(kind, id)
+	return labels, err
+}
+
+// fetchLabelsAndID inspects a resource for its labels and full ID
+func (r *RulesDirector) fetchLabelsAndID(kind, id string) (map[string]string, string, error) {
 	switch kind {
 	case "containers", "images":
 		var result struct {
+			ID     string
 			Config struct {
 				Labels map[string]string
 			}
 		}
 
 		if err := r.getInto(&result, "/"+kind+"/%s/json", id); err != nil {
-			return nil, err
+			return nil, "", err
+		}
+
+		return result.Config.Labels, result.ID, nil
+	case "networks":
+		var result struct {
+			ID     string
+			Labels map[string]string
 		}
 
-		return result.Config.Labels, nil
-	case "networks", "volumes":
+		if err := r.getInto(&result, "/"+kind+"/%s", id); err != nil {
+			return nil, "", err
+		}
+
+		return result.Labels, result.ID, nil
+	case "volumes":
+		// volumes only have names, which can be reused
 		var result struct {
 			Labels map[string]string
 		}
 
 		if err := r.getInto(&result, "/"+kind+"/%s", id); err != nil {
-			return nil, err
+			return nil, "", err
+		}
+
+		return result.Labels, "", nil
+	case "services", "secrets", "configs":
+		var result struct {
+			ID   string
+			Spec struct {
+				Labels map[string]string
+			}
+		}
+
+		if err := r.getInto(&result, "/"+kind+"/%s", id); err != nil {
+			return nil, "", err
+		}
+
+		return result.Spec.Labels, result.ID, nil
+	}
+
+	return nil, "", fmt.Errorf("Unknown kind %q", kind)
+}
+
+// decodeJSON decodes JSON keeping numbers as json.Number, so bodies that are modified and encoded
+// again keep their numbers exactly (float64 loses precision above 2^53)
+func decodeJSON(r io.Reader, v interface{}) error {
+	d := json.NewDecoder(r)
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+// unmarshalJSON is json.Unmarshal with the number handling of decodeJSON
+func unmarshalJSON(data []byte, v interface{}) error {
+	return decodeJSON(bytes.NewReader(data), v)
+}
+
+// jsonInt64 returns the integer value of a decoded JSON number, or a number we've set
+func jsonInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		i, err := n.Int64()
+		return i, err == nil
+	case float64:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
+
+// canonicalJSONKeys renames the keys of a decoded JSON object that match one of names case
+// insensitively to that name, as encoding/json in the daemon matches them. Several keys matching
+// the same name are an error, as only one of them would be used.
+func canonicalJSONKeys(m map[string]interface{}, names ...string) error {
+	for _, name := range names {
+		var matched []string
+		for key := range m {
+			if strings.EqualFold(key, name) {
+				matched = append(matched, key)
+			}
+		}
+		if len(matched) > 1 {
+			return fmt.Errorf("Duplicate fields %q and %q", matched[0], matched[1])
 		}
+		if len(matched) == 1 && matched[0] != name {
+			m[name] = m[matched[0]]
+			delete(m, matched[0])
+		}
+	}
+	return nil
+}
+
+// maxDecompressedBodySize is the largest a gzipped request body can decompress to, JSON bodies are
+// small but a few KB of gzip can decompress to gigabytes
+var maxDecompressedBodySize int64 = 16 << 20
 
-		return result.Labels, nil
+// cappedReader reads from a reader limited to one more byte than max, failing if it gets that far
+type cappedReader struct {
+	r    io.Reader
+	max  int64
+	read int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += int64(n)
+	if c.read > c.max {
+		return 0, fmt.Errorf("Decompressed request body is larger than %d bytes", c.max)
 	}
+	return n, err
+}
 
-	return nil, fmt.Errorf("Unknown kind %q", kind)
+// decompressRequestBody decompresses gzipped JSON request bodies (as some SDKs send), so they can be
+// inspected and modified. The daemon doesn't decompress request bodies itself, so they're passed on
+// uncompressed.
+func decompressRequestBody(l socketproxy.Logger, req *http.Request) error {
+	if !strings.EqualFold(req.Header.Get("Content-Encoding"), "gzip") || req.Body == nil {
+		return nil
+	}
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType != "application/json" {
+		return nil
+	}
+
+	gz, err := gzip.NewReader(req.Body)
+	if err != nil {
+		return fmt.Errorf("Failed to decompress gzipped request body: %v", err)
+	}
+	l.Printf("Decompressing gzipped request body")
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{&cappedReader{r: io.LimitReader(gz, maxDecompressedBodySize+1), max: maxDecompressedBodySize}, req.Body}
+	req.Header.Del("Content-Encoding")
+	req.Header.Del("Content-Length")
+	req.ContentLength = -1
+	return nil
 }
 
 func modifyRequestBody(req *http.Request, f func(filters map[string]interface{})) error {
 	var decoded map[string]interface{}
 
-	if err := json.NewDecoder(req.Body).Decode(&decoded); err != nil {
+	if err := decodeJSON(req.Body, &decoded); err != nil {
 		return err
 	}
 
@@ -733,3 +1964,26 @@ func CheckContainerExists(client *http.Client, idOrName string) (bool, error) {
 		return false, fmt.Errorf("Unexpected response code %d received from Docker daemon when checking if Container '%s' exists", resp.StatusCode, idOrName)
 	}
 }
+
+// For startup pre-check, returns the upstream daemon's API version and whether it's at least the
+// oldest version we support (apiVersion), as older daemons fail obscurely on specific endpoints
+func CheckUpstreamAPIVersion(client *http.Client) (string, bool, error) {
+	resp, err := client.Get("http://unix/version")
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", false, fmt.Errorf("Unexpected response code %d received from Docker daemon when checking its version", resp.StatusCode)
+	}
+
+	var version struct {
+		ApiVersion string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&version); err != nil {
+		return "", false, err
+	}
+
+	return version.ApiVersion, compareAPIVersions(version.ApiVersion, apiVersion) >= 0, nil
+}
@@ -2,6 +2,8 @@ package sockguard
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -10,10 +12,12 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"testing"
 
+	"github.com/buildkite/sockguard/sockguardtest"
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -34,198 +38,35 @@ func mockRulesDirector() *RulesDirector {
 }
 
 // Reusable mock RulesDirector instance - with "state" management of mocked upstream Docker daemon
-// Just containers/networks initially
-func mockRulesDirectorWithUpstreamState(us *upstreamState) *RulesDirector {
+func mockRulesDirectorWithUpstreamState(us *sockguardtest.State) *RulesDirector {
 	rd := mockRulesDirector()
 	rd.Client = mockRulesDirectorHttpClientWithUpstreamState(us)
 	return rd
 }
 
-func mockRulesDirectorHttpClientWithUpstreamState(us *upstreamState) *http.Client {
-	return &http.Client{
-		Transport: roundTripFunc(func(req *http.Request) *http.Response {
-			resp := http.Response{
-				// Must be set to non-nil value or it panics
-				Header: make(http.Header),
-			}
-			re1 := regexp.MustCompile("^/v(.*)/containers/(.*)/json$")
-			// TODOLATER: adjust re2 to make /json suffix optional, for non-GET?
-			re2 := regexp.MustCompile("^/v(.*)/images/(.*)/json$")
-			// NOTE: this regex may not cover all name variations, but will cover enough to fulfil tests
-			re3 := regexp.MustCompile("^/v(.*)/networks/([A-Za-z0-9]+)(/connect|/disconnect)?$")
-			re4 := regexp.MustCompile("^/v(.*)/volumes/(.*)$")
-			switch {
-			case re1.MatchString(req.URL.Path):
-				if req.Method == "GET" {
-					// inspect container - /containers/{id}/json
-					parsePath := re1.FindStringSubmatch(req.URL.Path)
-					if len(parsePath) == 3 {
-						// Vary the response based on container ID (easiest option)
-						// Partial JSON result, enough to satisfy the inspectLabels() struct
-						if us.doesContainerExist(parsePath[2]) == false {
-							resp.StatusCode = 404
-							resp.Body = ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("{\"message\":\"No such container: %s\"}", parsePath[2])))
-						} else {
-							containerOwnerLabel := us.ownerLabelContent(us.getContainerOwner(parsePath[2]))
-							resp.StatusCode = 200
-							resp.Body = ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("{\"Id\":\"%s\",\"Config\":{\"Labels\":{%s}}}", parsePath[2], containerOwnerLabel)))
-						}
-					} else {
-						resp.StatusCode = 501
-						resp.Body = ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("Failure parsing container ID from path - %s\n", req.URL.Path)))
-					}
-				} else {
-					resp.StatusCode = 501
-					resp.Body = ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("Unsupported HTTP method %s for %s\n", req.Method, req.URL.Path)))
-				}
-			case re2.MatchString(req.URL.Path):
-				switch req.Method {
-				case "GET":
-					// inspect image - /images/{id}/json
-					parsePath := re2.FindStringSubmatch(req.URL.Path)
-					if len(parsePath) == 3 {
-						// Vary the response based on image ID (easiest option)
-						// Partial JSON result, enough to satisfy the inspectLabels() struct
-						if us.doesImageExist(parsePath[2]) == false {
-							resp.StatusCode = 404
-							resp.Body = ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("{\"message\":\"no such image: %s: No such image: %s:latest\"}", parsePath[2], parsePath[2])))
-						} else {
-							imageOwnerLabel := us.ownerLabelContent(us.getImageOwner(parsePath[2]))
-							resp.StatusCode = 200
-							resp.Body = ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("{\"Id\":\"%s\",\"Config\":{\"Labels\":{%s}}}", parsePath[2], imageOwnerLabel)))
-						}
-					} else {
-						resp.StatusCode = 501
-						resp.Body = ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("Failure parsing image ID from path - %s\n", req.URL.Path)))
-					}
-				default:
-					resp.StatusCode = 501
-					resp.Body = ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("Unsupported HTTP method %s for %s\n", req.Method, req.URL.Path)))
-				}
-			case re3.MatchString(req.URL.Path):
-				parsePath := re3.FindStringSubmatch(req.URL.Path)
-				if len(parsePath) != 4 {
-					resp.StatusCode = 501
-					resp.Body = ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("Failure parsing network ID/target from path - %s\n", req.URL.Path)))
-					return &resp
-				}
-				switch req.Method {
-				case "GET":
-					// inspect network - /networks/{id}
-					// Vary the response based on network ID (easiest option)
-					// Partial JSON result, enough to satisfy the inspectLabels() struct
-					if us.doesNetworkExist(parsePath[2]) == false {
-						resp.StatusCode = 404
-						resp.Body = ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("{\"message\":\"network %s not found\"}", parsePath[2])))
-					} else {
-						networkOwnerLabel := us.ownerLabelContent(us.getNetworkOwner(parsePath[2]))
-						resp.StatusCode = 200
-						resp.Body = ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("{\"Id\":\"%s\",\"Labels\":{%s}}", parsePath[2], networkOwnerLabel)))
-					}
-				case "POST":
-					switch parsePath[3] {
-					case "/connect", "/disconnect":
-						// connect container to network - /networks/{id}/connect
-						// disconnect container to network - /networks/{id}/disconnect
-						// Verify the Content-Type = application/json, will 400 without it on Docker daemon
-						contentType := req.Header.Get("Content-Type")
-						if contentType != "application/json" {
-							resp.StatusCode = 400
-							resp.Body = ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("{\"message\":\"Content-Type specified (%s) must be 'application/json'\"}", contentType)))
-							return &resp
-						}
-						// Parse out the Container from request body
-						var decoded map[string]interface{}
-						if err := json.NewDecoder(req.Body).Decode(&decoded); err != nil {
-							resp.StatusCode = 500
-							resp.Body = ioutil.NopCloser(bytes.NewBufferString(err.Error()))
-							return &resp
-						}
-						useContainer := decoded["Container"].(string)
-						// Bare minimum response format here, mostly response code
-						if us.doesNetworkExist(parsePath[2]) == false {
-							resp.StatusCode = 404
-							resp.Body = ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("{\"message\":\"network %s not found\"}", parsePath[2])))
-						} else {
-							var err error
-							if parsePath[3] == "/connect" {
-								useContainerAliases := []string{}
-								// If there are Aliases specified, pass them in.
-								parseContainerEndpointConfig, ok := decoded["EndpointConfig"]
-								if ok {
-									parseContainerAliases, ok2 := parseContainerEndpointConfig.(map[string]interface{})["Aliases"].([]interface{})
-									if ok2 {
-										for _, parseContainerAlias := range parseContainerAliases {
-											parsedContainerAlias := parseContainerAlias.(string)
-											if parsedContainerAlias != "" {
-												useContainerAliases = append(useContainerAliases, parsedContainerAlias)
-											}
-										}
-									}
-								}
-								err = us.connectContainerToNetwork(useContainer, parsePath[2], useContainerAliases)
-							} else if parsePath[3] == "/disconnect" {
-								err = us.disconnectContainerToNetwork(useContainer, parsePath[2])
-							}
-							if err != nil {
-								resp.StatusCode = 500
-								resp.Body = ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("{\"message\":\"error %sing container '%s' to/from network '%s': %s\"}", parsePath[3], useContainer, parsePath[2], err.Error())))
-								return &resp
-							}
-							resp.StatusCode = 200
-							resp.Body = ioutil.NopCloser(bytes.NewBufferString("OK"))
-						}
-					default:
-						// unknown
-						resp.StatusCode = 501
-						resp.Body = ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("POST not supported for %s\n", req.URL.Path)))
-					}
-				case "DELETE":
-					// delete network - /networks/{id}
-					// Bare minimum response format here, mostly response code
-					if us.doesNetworkExist(parsePath[2]) == false {
-						resp.StatusCode = 404
-						resp.Body = ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("{\"message\":\"network %s not found\"}", parsePath[2])))
-					} else {
-						us.deleteNetwork(parsePath[2])
-						resp.StatusCode = 200
-						resp.Body = ioutil.NopCloser(bytes.NewBufferString("OK"))
-					}
-				default:
-					resp.StatusCode = 501
-					resp.Body = ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("Unsupported HTTP method %s for %s\n", req.Method, req.URL.Path)))
-				}
-			case re4.MatchString(req.URL.Path):
-				switch req.Method {
-				case "GET":
-					// inspect volume - /volume/{name}
-					parsePath := re4.FindStringSubmatch(req.URL.Path)
-					if len(parsePath) == 3 {
-						// Vary the response based on volume name (easiest option)
-						// Partial JSON result, enough to satisfy the inspectLabels() struct
-						if us.doesVolumeExist(parsePath[2]) == false {
-							resp.StatusCode = 404
-							resp.Body = ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("{\"message\":\"get %s: no such volume\"}", parsePath[2])))
-						} else {
-							volumeOwnerLabel := us.ownerLabelContent(us.getVolumeOwner(parsePath[2]))
-							resp.StatusCode = 200
-							resp.Body = ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("{\"Name\":\"%s\",\"Labels\":{%s}}", parsePath[2], volumeOwnerLabel)))
-						}
-					} else {
-						resp.StatusCode = 501
-						resp.Body = ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("Failure parsing volume name from path - %s\n", req.URL.Path)))
-					}
-				default:
-					resp.StatusCode = 501
-					resp.Body = ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("Unsupported HTTP method %s for %s\n", req.Method, req.URL.Path)))
-				}
-			default:
-				resp.StatusCode = 501
-				resp.Body = ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("Path %s not implemented\n", req.URL.Path)))
-			}
-			return &resp
-		}),
-	}
+func mockRulesDirectorHttpClientWithUpstreamState(us *sockguardtest.State) *http.Client {
+	return us.Client()
+}
+
+// relayedPathRegex matches the requests handlers make to the daemon themselves with doUpstream,
+// instead of passing them to the upstream handler
+var relayedPathRegex = regexp.MustCompile(`^/v[\d.]+/(commit|images/load|images/.+/tag)$`)
+
+// mockClientWithUpstream answers the requests handlers relay with doUpstream with upstream, and
+// the rest from the upstream state
+func mockClientWithUpstream(us *sockguardtest.State, upstream http.Handler) *http.Client {
+	client := us.Client()
+	transport := client.Transport
+	client.Transport = roundTripFunc(func(req *http.Request) *http.Response {
+		if !relayedPathRegex.MatchString(req.URL.Path) {
+			resp, _ := transport.RoundTrip(req)
+			return resp
+		}
+		rr := httptest.NewRecorder()
+		upstream.ServeHTTP(rr, req)
+		return rr.Result()
+	})
+	return client
 }
 
 // Reusable mock log.Logger instance
@@ -233,6 +74,113 @@ func mockLogger() *log.Logger {
 	return log.New(os.Stderr, "MOCK: ", log.Ltime|log.Lmicroseconds)
 }
 
+func TestDirectPing(t *testing.T) {
+	l := mockLogger()
+	r := mockRulesDirector()
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		method string
+		url    string
+		status int
+	}{
+		{"GET", "/_ping", 200},
+		{"HEAD", "/_ping", 200},
+		{"HEAD", "/v1.40/_ping", 200},
+		{"OPTIONS", "/v1.40/containers/create", 200},
+		{"HEAD", "/version", 501},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("%s %s : handler returned wrong status code: got %v want %v", test.method, test.url, status, test.status)
+		}
+	}
+}
+
+func TestDirectGzippedRequestBody(t *testing.T) {
+	l := mockLogger()
+	r := mockRulesDirector()
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if enc := req.Header.Get("Content-Encoding"); enc != "" {
+			t.Errorf("Expected Content-Encoding to be removed, got %q", enc)
+		}
+		var decoded map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&decoded); err != nil {
+			t.Fatal(err)
+		}
+		if owner := decoded["Labels"].(map[string]interface{})["com.buildkite.sockguard.owner"]; owner != "test-owner" {
+			t.Errorf("Expected owner label to be added, got %v", decoded["Labels"])
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	gz.Write([]byte(`{"Image":"alpine","Labels":{},"HostConfig":{}}`))
+	gz.Close()
+
+	req, err := http.NewRequest("POST", "/v1.37/containers/create", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	// bodies that aren't gzipped are a bad request
+	req, err = http.NewRequest("POST", "/v1.37/containers/create", strings.NewReader(`{"Image":"alpine"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	// nor are bodies that decompress to more than maxDecompressedBodySize
+	defer func(max int64) { maxDecompressedBodySize = max }(maxDecompressedBodySize)
+	maxDecompressedBodySize = 1024
+
+	body.Reset()
+	gz = gzip.NewWriter(&body)
+	gz.Write([]byte(`{"Image":"alpine","Labels":{},"Env":["` + strings.Repeat("A", 4096) + `"]}`))
+	gz.Close()
+
+	req, err = http.NewRequest("POST", "/v1.37/containers/create", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code for an oversized body: got %v want %v", status, http.StatusBadRequest)
+	}
+}
+
 func TestAddLabelsToQueryStringFilters(t *testing.T) {
 	l := mockLogger()
 	r := mockRulesDirector()
@@ -315,6 +263,37 @@ type handleCreateTests struct {
 func TestHandleContainerCreate(t *testing.T) {
 	l := mockLogger()
 
+	// Pre-populated simplified upstream state that "exists" before tests execute.
+	us := sockguardtest.State{
+		Volumes: map[string]sockguardtest.Volume{
+			"foreignvolume": sockguardtest.Volume{
+				Owner: "adifferentowner",
+			},
+		},
+		Networks: map[string]sockguardtest.Network{
+			"somenetwork": sockguardtest.Network{
+				Owner: "sockguard-pid-1",
+			},
+			"foreignnetwork": sockguardtest.Network{
+				Owner: "adifferentowner",
+			},
+			"cinetwork": sockguardtest.Network{
+				Owner: "adifferentowner",
+			},
+		},
+		Containers: map[string]sockguardtest.Container{
+			"foreigncontainer": sockguardtest.Container{
+				Owner: "adifferentowner",
+			},
+			"ownedcontainer": sockguardtest.Container{
+				Owner: "sockguard-pid-1",
+			},
+			"xxxx": sockguardtest.Container{
+				Owner: "sockguard-pid-1",
+			},
+		},
+	}
+
 	// For each of the tests below, there will be 2 files in the fixtures/ dir:
 	// - <key>_in.json - the client request sent to the director
 	// - <key>_expected.json - the expected request sent to the upstream
@@ -366,91 +345,507 @@ func TestHandleContainerCreate(t *testing.T) {
 			},
 			esc: 401,
 		},
-		// Defaults + Host Mode Networking + request with NetworkMode=host (should pass)
-		"containers_create_6": handleCreateTests{
+		// Defaults + Host Mode Networking + request with NetworkMode=host (should pass)
+		"containers_create_6": handleCreateTests{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner:                   "sockguard-pid-1",
+				AllowHostModeNetworking: true,
+			},
+			esc: 200,
+		},
+		// Defaults + Host Mode Networking disabled + request with NetworkMode=host (should fail)
+		"containers_create_7": handleCreateTests{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner:                   "sockguard-pid-1",
+				AllowHostModeNetworking: false,
+			},
+			esc: 401,
+		},
+		// Defaults + Cgroup Parent
+		"containers_create_8": handleCreateTests{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner:                 "sockguard-pid-1",
+				ContainerCgroupParent: "some-cgroup",
+			},
+			esc: 200,
+		},
+		// Defaults + Force User
+		"containers_create_9": handleCreateTests{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner: "sockguard-pid-1",
+				User:  "someuser",
+			},
+			esc: 200,
+		},
+		// Defaults + a custom label on request
+		"containers_create_10": handleCreateTests{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner: "sockguard-pid-1",
+			},
+			esc: 200,
+		},
+		// Defaults + -docker-link sockguard + requesting default bridge network
+		"containers_create_11": handleCreateTests{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner:               "sockguard-pid-1",
+				ContainerDockerLink: "asdf:zzzz",
+			},
+			esc: 200,
+		},
+		// Defaults + -docker-link sockguard flag + requesting a user defined bridge network
+		"containers_create_12": handleCreateTests{
+			rd: &RulesDirector{
+				Client: mockRulesDirectorHttpClientWithUpstreamState(&us),
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner:               "sockguard-pid-1",
+				ContainerDockerLink: "asdf:zzzz",
+			},
+			esc: 200,
+		},
+		// Defaults + try set a CgroupParent (should fail, only permitted if sockguard started with -cgroup-parent)
+		"containers_create_13": handleCreateTests{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner: "sockguard-pid-1",
+			},
+			esc: 401,
+		},
+		// Defaults + -docker-link sockguard flag + requesting default bridge network + another arbitrary --link from client
+		"containers_create_14": handleCreateTests{
+			rd: &RulesDirector{
+				Client: mockRulesDirectorHttpClientWithUpstreamState(&us),
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner:               "sockguard-pid-1",
+				ContainerDockerLink: "cccc:dddd",
+			},
+			esc: 200,
+		},
+		// Defaults + Binds enabled + bind/tmpfs/anonymous volume mounts (should pass)
+		"containers_create_15": handleCreateTests{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner:      "sockguard-pid-1",
+				AllowBinds: []string{"/tmp"},
+			},
+			esc: 200,
+		},
+		// Defaults + Binds enabled + a non-matching bind mount (should fail)
+		"containers_create_16": handleCreateTests{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner:      "sockguard-pid-1",
+				AllowBinds: []string{"/tmp"},
+			},
+			esc: 401,
+		},
+		// Defaults + a volume mount of a volume we don't own (should fail)
+		"containers_create_17": handleCreateTests{
+			rd: &RulesDirector{
+				Client: mockRulesDirectorHttpClientWithUpstreamState(&us),
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner: "sockguard-pid-1",
+			},
+			esc: 401,
+		},
+		// Defaults + Binds enabled + a matching bind with rshared propagation (should fail)
+		"containers_create_18": handleCreateTests{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner:      "sockguard-pid-1",
+				AllowBinds: []string{"/tmp"},
+			},
+			esc: 401,
+		},
+		// Defaults + Binds enabled + shared propagation enabled + a matching bind mount with shared propagation (should pass)
+		"containers_create_19": handleCreateTests{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner:                      "sockguard-pid-1",
+				AllowBinds:                 []string{"/tmp"},
+				AllowSharedBindPropagation: true,
+			},
+			esc: 200,
+		},
+		// Defaults + an image allowlist that doesn't include the requested image (should fail)
+		"containers_create_20": handleCreateTests{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner:       "sockguard-pid-1",
+				AllowImages: []string{"registry.example.com/*"},
+			},
+			esc: 401,
+		},
+		// Defaults + deny extra hosts + an extra host in API request (should fail)
+		"containers_create_21": handleCreateTests{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner:          "sockguard-pid-1",
+				DenyExtraHosts: true,
+			},
+			esc: 401,
+		},
+		// Defaults + deny ulimits + a ulimit in API request (should fail)
+		"containers_create_22": handleCreateTests{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner:       "sockguard-pid-1",
+				DenyUlimits: true,
+			},
+			esc: 401,
+		},
+		// Defaults + hyperv isolation in API request (should fail)
+		"containers_create_23": handleCreateTests{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner: "sockguard-pid-1",
+			},
+			esc: 401,
+		},
+		// Defaults + BuildKit image + privileged BuildKit container pinned to the same digest (should pass)
+		"containers_create_24": handleCreateTests{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner:         "sockguard-pid-1",
+				BuildkitImage: "moby/buildkit@sha256:2d1f8d0bfe2e5ec7bb8b6d3bd3d0e5ff3d0a3f1b51f1e0f29c7f8e1e4bb7c1a1",
+			},
+			esc: 200,
+		},
+		// Defaults + BuildKit image + privileged BuildKit container by tag (should fail)
+		"containers_create_25": handleCreateTests{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner:         "sockguard-pid-1",
+				BuildkitImage: "moby/buildkit@sha256:2d1f8d0bfe2e5ec7bb8b6d3bd3d0e5ff3d0a3f1b51f1e0f29c7f8e1e4bb7c1a1",
+			},
+			esc: 401,
+		},
+		// Defaults + BuildKit image + privileged BuildKit container with an overridden entrypoint (should fail)
+		"containers_create_57": handleCreateTests{
+			rd: &RulesDirector{
+				Client:        &http.Client{},
+				Owner:         "sockguard-pid-1",
+				BuildkitImage: "moby/buildkit@sha256:2d1f8d0bfe2e5ec7bb8b6d3bd3d0e5ff3d0a3f1b51f1e0f29c7f8e1e4bb7c1a1",
+			},
+			esc: 401,
+		},
+		// Defaults + BuildKit image + privileged BuildKit container with a bind of the host root (should fail)
+		"containers_create_58": handleCreateTests{
+			rd: &RulesDirector{
+				Client:        &http.Client{},
+				Owner:         "sockguard-pid-1",
+				BuildkitImage: "moby/buildkit@sha256:2d1f8d0bfe2e5ec7bb8b6d3bd3d0e5ff3d0a3f1b51f1e0f29c7f8e1e4bb7c1a1",
+			},
+			esc: 401,
+		},
+		// Defaults + container limits + more memory than the limit in API request (should fail)
+		"containers_create_26": handleCreateTests{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner:                   "sockguard-pid-1",
+				ContainerResourceLimits: map[string]int64{"Memory": 4294967296},
+			},
+			esc: 401,
+		},
+		// Defaults + container limits + unset memory and CPUs within the limit in API request (should pass)
+		"containers_create_27": handleCreateTests{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner:                   "sockguard-pid-1",
+				ContainerResourceLimits: map[string]int64{"Memory": 4294967296, "NanoCpus": 2000000000},
+			},
+			esc: 200,
+		},
+		// Attaching to a foreign network (should fail)
+		"containers_create_28": handleCreateTests{
+			rd: &RulesDirector{
+				Client: mockRulesDirectorHttpClientWithUpstreamState(&us),
+				Owner:  "sockguard-pid-1",
+			},
+			esc: 401,
+		},
+		// Attaching to a foreign network matching -allow-networks
+		"containers_create_29": handleCreateTests{
+			rd: &RulesDirector{
+				Client:        mockRulesDirectorHttpClientWithUpstreamState(&us),
+				Owner:         "sockguard-pid-1",
+				AllowNetworks: []string{"ci*"},
+			},
+			esc: 200,
+		},
+		// Joining the network of a foreign container (should fail)
+		"containers_create_30": handleCreateTests{
+			rd: &RulesDirector{
+				Client: mockRulesDirectorHttpClientWithUpstreamState(&us),
+				Owner:  "sockguard-pid-1",
+			},
+			esc: 401,
+		},
+		// Linking to a foreign container (should fail)
+		"containers_create_31": handleCreateTests{
+			rd: &RulesDirector{
+				Client: mockRulesDirectorHttpClientWithUpstreamState(&us),
+				Owner:  "sockguard-pid-1",
+			},
+			esc: 401,
+		},
+		// Using volumes from a foreign container (should fail)
+		"containers_create_32": handleCreateTests{
+			rd: &RulesDirector{
+				Client: mockRulesDirectorHttpClientWithUpstreamState(&us),
+				Owner:  "sockguard-pid-1",
+			},
+			esc: 401,
+		},
+		// Linking to and using volumes from an owned container
+		"containers_create_33": handleCreateTests{
+			rd: &RulesDirector{
+				Client: mockRulesDirectorHttpClientWithUpstreamState(&us),
+				Owner:  "sockguard-pid-1",
+			},
+			esc: 200,
+		},
+		// Defaults + privileged allowed for a pinned docker image + privileged dind container of that digest (should pass)
+		"containers_create_34": handleCreateTests{
+			rd: &RulesDirector{
+				Client:                &http.Client{},
+				Owner:                 "sockguard-pid-1",
+				AllowPrivileged:       true,
+				AllowPrivilegedImages: []string{"docker.io/library/docker@sha256:52bf9b1c2d46521bfc80cda0da9caa1378e15e17ea2e8add41d8e21f5e31f0fb"},
+			},
+			esc: 200,
+		},
+		// Defaults + privileged allowed for a pinned docker image + privileged alpine container (should fail)
+		"containers_create_35": handleCreateTests{
+			rd: &RulesDirector{
+				Client:                &http.Client{},
+				Owner:                 "sockguard-pid-1",
+				AllowPrivileged:       true,
+				AllowPrivilegedImages: []string{"docker.io/library/docker@sha256:52bf9b1c2d46521bfc80cda0da9caa1378e15e17ea2e8add41d8e21f5e31f0fb"},
+			},
+			esc: 401,
+		},
+		// Defaults + strict + the zero values clients send (should pass)
+		"containers_create_36": handleCreateTests{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				Owner:  "sockguard-pid-1",
+				Strict: true,
+			},
+			esc: 200,
+		},
+		// Defaults + strict + CapAdd (should fail)
+		"containers_create_37": handleCreateTests{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				Owner:  "sockguard-pid-1",
+				Strict: true,
+			},
+			esc: 401,
+		},
+		// Defaults + strict + empty MaskedPaths, which unmask /proc (should fail)
+		"containers_create_38": handleCreateTests{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				Owner:  "sockguard-pid-1",
+				Strict: true,
+			},
+			esc: 401,
+		},
+		// Defaults + privileged allowed for a pinned docker image + privileged container of a local docker tag (should fail)
+		"containers_create_56": handleCreateTests{
+			rd: &RulesDirector{
+				Client:                &http.Client{},
+				Owner:                 "sockguard-pid-1",
+				AllowPrivileged:       true,
+				AllowPrivilegedImages: []string{"docker.io/library/docker@sha256:52bf9b1c2d46521bfc80cda0da9caa1378e15e17ea2e8add41d8e21f5e31f0fb"},
+			},
+			esc: 401,
+		},
+		// Defaults + forced json-file log driver + the default driver (should pass, with the driver forced)
+		"containers_create_39": handleCreateTests{
+			rd: &RulesDirector{
+				Client:              &http.Client{},
+				Owner:               "sockguard-pid-1",
+				ContainerLogDriver:  "json-file",
+				ContainerLogOptions: map[string]string{"max-size": "10m", "max-file": "3"},
+			},
+			esc: 200,
+		},
+		// Defaults + forced json-file log driver + journald (should fail)
+		"containers_create_40": handleCreateTests{
+			rd: &RulesDirector{
+				Client:              &http.Client{},
+				Owner:               "sockguard-pid-1",
+				ContainerLogDriver:  "json-file",
+				ContainerLogOptions: map[string]string{"max-size": "10m", "max-file": "3"},
+			},
+			esc: 401,
+		},
+		// Defaults + forced json-file log driver + json-file with a larger max-size (should pass, with the options overridden)
+		"containers_create_41": handleCreateTests{
+			rd: &RulesDirector{
+				Client:              &http.Client{},
+				Owner:               "sockguard-pid-1",
+				ContainerLogDriver:  "json-file",
+				ContainerLogOptions: map[string]string{"max-size": "10m", "max-file": "3"},
+			},
+			esc: 200,
+		},
+		// Defaults + forced json-file log driver + journald with lowercase keys (should fail)
+		"containers_create_52": handleCreateTests{
+			rd: &RulesDirector{
+				Client:              &http.Client{},
+				Owner:               "sockguard-pid-1",
+				ContainerLogDriver:  "json-file",
+				ContainerLogOptions: map[string]string{"max-size": "10m", "max-file": "3"},
+			},
+			esc: 401,
+		},
+		// Defaults + forced json-file log driver + json-file with lowercase keys and an uppercase max-size (should pass, with the options overridden)
+		"containers_create_53": handleCreateTests{
+			rd: &RulesDirector{
+				Client:              &http.Client{},
+				Owner:               "sockguard-pid-1",
+				ContainerLogDriver:  "json-file",
+				ContainerLogOptions: map[string]string{"max-size": "10m", "max-file": "3"},
+			},
+			esc: 200,
+		},
+		// Defaults + storage size + no size (should pass, with the default size)
+		"containers_create_42": handleCreateTests{
+			rd: &RulesDirector{
+				Client:                  &http.Client{},
+				Owner:                   "sockguard-pid-1",
+				ContainerStorageSize:    20 << 30,
+				MaxContainerStorageSize: 50 << 30,
+			},
+			esc: 200,
+		},
+		// Defaults + storage size + a size above the maximum (should fail)
+		"containers_create_43": handleCreateTests{
+			rd: &RulesDirector{
+				Client:                  &http.Client{},
+				Owner:                   "sockguard-pid-1",
+				ContainerStorageSize:    20 << 30,
+				MaxContainerStorageSize: 50 << 30,
+			},
+			esc: 401,
+		},
+		// Defaults + storage size + a size below the maximum (should pass)
+		"containers_create_44": handleCreateTests{
 			rd: &RulesDirector{
-				Client: &http.Client{},
-				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Client:                  &http.Client{},
 				Owner:                   "sockguard-pid-1",
-				AllowHostModeNetworking: true,
+				ContainerStorageSize:    20 << 30,
+				MaxContainerStorageSize: 50 << 30,
 			},
 			esc: 200,
 		},
-		// Defaults + Host Mode Networking disabled + request with NetworkMode=host (should fail)
-		"containers_create_7": handleCreateTests{
+		// Defaults + storage size + an uppercase size above the maximum (should fail)
+		"containers_create_54": handleCreateTests{
 			rd: &RulesDirector{
-				Client: &http.Client{},
-				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Client:                  &http.Client{},
 				Owner:                   "sockguard-pid-1",
-				AllowHostModeNetworking: false,
+				ContainerStorageSize:    20 << 30,
+				MaxContainerStorageSize: 50 << 30,
 			},
 			esc: 401,
 		},
-		// Defaults + Cgroup Parent
-		"containers_create_8": handleCreateTests{
+		// Defaults + storage size + sizes differing in case (should fail)
+		"containers_create_55": handleCreateTests{
 			rd: &RulesDirector{
-				Client: &http.Client{},
-				// This is what's set in main() as the default, assuming running in a container so PID 1
-				Owner:                 "sockguard-pid-1",
-				ContainerCgroupParent: "some-cgroup",
+				Client:                  &http.Client{},
+				Owner:                   "sockguard-pid-1",
+				ContainerStorageSize:    20 << 30,
+				MaxContainerStorageSize: 50 << 30,
 			},
-			esc: 200,
+			esc: 401,
 		},
-		// Defaults + Force User
-		"containers_create_9": handleCreateTests{
+		// Defaults + nvidia runtime allowed + nvidia runtime (should pass)
+		"containers_create_45": handleCreateTests{
 			rd: &RulesDirector{
-				Client: &http.Client{},
-				// This is what's set in main() as the default, assuming running in a container so PID 1
-				Owner: "sockguard-pid-1",
-				User:  "someuser",
+				Client:        &http.Client{},
+				Owner:         "sockguard-pid-1",
+				AllowRuntimes: []string{"nvidia"},
 			},
 			esc: 200,
 		},
-		// Defaults + a custom label on request
-		"containers_create_10": handleCreateTests{
+		// Defaults + nvidia runtime allowed + kata runtime (should fail)
+		"containers_create_46": handleCreateTests{
 			rd: &RulesDirector{
-				Client: &http.Client{},
-				// This is what's set in main() as the default, assuming running in a container so PID 1
-				Owner: "sockguard-pid-1",
+				Client:        &http.Client{},
+				Owner:         "sockguard-pid-1",
+				AllowRuntimes: []string{"nvidia"},
 			},
-			esc: 200,
+			esc: 401,
 		},
-		// Defaults + -docker-link sockguard + requesting default bridge network
-		"containers_create_11": handleCreateTests{
+		// Defaults + strict + nvidia runtime without any allowed (should fail)
+		"containers_create_47": handleCreateTests{
 			rd: &RulesDirector{
 				Client: &http.Client{},
-				// This is what's set in main() as the default, assuming running in a container so PID 1
-				Owner:               "sockguard-pid-1",
-				ContainerDockerLink: "asdf:zzzz",
+				Owner:  "sockguard-pid-1",
+				Strict: true,
+			},
+			esc: 401,
+		},
+		// Defaults + force init (should pass, with Init set)
+		"containers_create_48": handleCreateTests{
+			rd: &RulesDirector{
+				Client:    &http.Client{},
+				Owner:     "sockguard-pid-1",
+				ForceInit: true,
 			},
 			esc: 200,
 		},
-		// Defaults + -docker-link sockguard flag + requesting a user defined bridge network
-		"containers_create_12": handleCreateTests{
+		// Defaults + stop timeout (should pass, with the default timeout)
+		"containers_create_49": handleCreateTests{
 			rd: &RulesDirector{
-				Client: &http.Client{},
-				// This is what's set in main() as the default, assuming running in a container so PID 1
-				Owner:               "sockguard-pid-1",
-				ContainerDockerLink: "asdf:zzzz",
+				Client:               &http.Client{},
+				Owner:                "sockguard-pid-1",
+				ContainerStopTimeout: 2,
 			},
 			esc: 200,
 		},
-		// Defaults + try set a CgroupParent (should fail, only permitted if sockguard started with -cgroup-parent)
-		"containers_create_13": handleCreateTests{
+		// Defaults + minimum stop timeout + a shorter timeout (should pass, with the minimum)
+		"containers_create_50": handleCreateTests{
 			rd: &RulesDirector{
-				Client: &http.Client{},
-				// This is what's set in main() as the default, assuming running in a container so PID 1
-				Owner: "sockguard-pid-1",
+				Client:                  &http.Client{},
+				Owner:                   "sockguard-pid-1",
+				MinContainerStopTimeout: 30,
 			},
-			esc: 401,
+			esc: 200,
 		},
-		// Defaults + -docker-link sockguard flag + requesting default bridge network + another arbitrary --link from client
-		"containers_create_14": handleCreateTests{
+		// Defaults + minimum stop timeout + a longer timeout (should pass, unchanged)
+		"containers_create_51": handleCreateTests{
 			rd: &RulesDirector{
-				Client: &http.Client{},
-				// This is what's set in main() as the default, assuming running in a container so PID 1
-				Owner:               "sockguard-pid-1",
-				ContainerDockerLink: "cccc:dddd",
+				Client:                  &http.Client{},
+				Owner:                   "sockguard-pid-1",
+				MinContainerStopTimeout: 30,
 			},
 			esc: 200,
 		},
@@ -562,16 +957,16 @@ func TestHandleNetworkCreate(t *testing.T) {
 	l := mockLogger()
 
 	// Pre-populated simplified upstream state that "exists" before tests execute.
-	us := upstreamState{
-		containers: map[string]upstreamStateContainer{
-			"ciagentcontainer": upstreamStateContainer{
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"ciagentcontainer": sockguardtest.Container{
 				// No ownership checking at this level (intentionally), due to chicken-and-egg situation
 				// (CI container is a sibling/sidecar of sockguard itself, not a child)
-				owner:            "foreign",
-				attachedNetworks: []upstreamStateContainerAttachedNetwork{},
+				Owner:    "foreign",
+				Networks: []sockguardtest.AttachedNetwork{},
 			},
 		},
-		networks: map[string]upstreamStateNetwork{},
+		Networks: map[string]sockguardtest.Network{},
 	}
 
 	// For each of the tests below, there will be 2 files in the fixtures/ dir:
@@ -660,10 +1055,10 @@ func TestHandleNetworkCreate(t *testing.T) {
 			default:
 				t.Fatal("Error: Cannot parse Labels from request JSON on network create")
 			}
-			if us.doesNetworkExist(newNetworkName) == true {
+			if us.NetworkExists(newNetworkName) == true {
 				t.Fatalf("Network '%s' already exists", newNetworkName)
 			}
-			us.createNetwork(newNetworkName, newNetworkOwner)
+			us.CreateNetwork(newNetworkName, newNetworkOwner)
 
 			// Return empty JSON, the request is whats important not the response
 			fmt.Fprintf(w, `{}`)
@@ -707,25 +1102,25 @@ func TestHandleNetworkCreate(t *testing.T) {
 			}
 		}
 
-		// Verify the network was added to upstreamState
-		if rr.Code == 200 && us.doesNetworkExist(inNewNetworkName) == false {
+		// Verify the network was added to the upstream state
+		if rr.Code == 200 && us.NetworkExists(inNewNetworkName) == false {
 			t.Errorf("%s : %d response code, but network '%s' does not exist, should have been created in mock upstream state", k, rr.Code, inNewNetworkName)
-		} else if rr.Code != 200 && us.doesNetworkExist(inNewNetworkName) == true {
+		} else if rr.Code != 200 && us.NetworkExists(inNewNetworkName) == true {
 			t.Errorf("%s : %d response code, but network '%s' exists, should not have been created", k, rr.Code, inNewNetworkName)
 		}
 
 		// Verify the ciagentcontainer was connected to the new network (if applicable)
 		if v.rd.ContainerDockerLink != "" || v.rd.ContainerJoinNetwork != "" {
-			ciAgentAttachedNetworks := us.getContainerAttachedNetworks("ciagentcontainer")
+			ciAgentAttachedNetworks := us.ContainerNetworks("ciagentcontainer")
 			ciAgentAttachedToNetwork := false
 			ciAgentAttachedToNetworkWithAlias := false
 			for _, vn := range ciAgentAttachedNetworks {
-				if vn.name == inNewNetworkName {
+				if vn.Name == inNewNetworkName {
 					ciAgentAttachedToNetwork = true
 					if v.rd.ContainerJoinNetworkAlias == "" {
 						// No alias set, consider this a success
 						ciAgentAttachedToNetworkWithAlias = true
-					} else if cmp.Equal(vn.aliases, []string{v.rd.ContainerJoinNetworkAlias}) == true {
+					} else if cmp.Equal(vn.Aliases, []string{v.rd.ContainerJoinNetworkAlias}) == true {
 						// Should also have the correct alias set
 						ciAgentAttachedToNetworkWithAlias = true
 					}
@@ -748,41 +1143,41 @@ func TestHandleNetworkDelete(t *testing.T) {
 	l := mockLogger()
 
 	// Pre-populated simplified upstream state that "exists" before tests execute.
-	us := upstreamState{
-		containers: map[string]upstreamStateContainer{
-			"ciagentcontainer": upstreamStateContainer{
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"ciagentcontainer": sockguardtest.Container{
 				// No ownership checking at this level (intentionally), due to chicken-and-egg situation
 				// (CI container is a sibling/sidecar of sockguard itself, not a child)
-				owner: "foreign",
-				attachedNetworks: []upstreamStateContainerAttachedNetwork{
-					upstreamStateContainerAttachedNetwork{
-						name: "whatevernetwork",
+				Owner: "foreign",
+				Networks: []sockguardtest.AttachedNetwork{
+					sockguardtest.AttachedNetwork{
+						Name: "whatevernetwork",
 					},
-					upstreamStateContainerAttachedNetwork{
-						name: "alwaysjoinnetwork",
+					sockguardtest.AttachedNetwork{
+						Name: "alwaysjoinnetwork",
 					},
-					upstreamStateContainerAttachedNetwork{
-						name:    "alwaysjoinnetworkwithalias",
-						aliases: []string{"ciagentalias"},
+					sockguardtest.AttachedNetwork{
+						Name:    "alwaysjoinnetworkwithalias",
+						Aliases: []string{"ciagentalias"},
 					},
 				},
 			},
 		},
-		networks: map[string]upstreamStateNetwork{
-			"somenetwork": upstreamStateNetwork{
-				owner: "sockguard-pid-1",
+		Networks: map[string]sockguardtest.Network{
+			"somenetwork": sockguardtest.Network{
+				Owner: "sockguard-pid-1",
 			},
-			"anothernetwork": upstreamStateNetwork{
-				owner: "adifferentowner",
+			"anothernetwork": sockguardtest.Network{
+				Owner: "adifferentowner",
 			},
-			"whatevernetwork": upstreamStateNetwork{
-				owner: "sockguard-pid-1",
+			"whatevernetwork": sockguardtest.Network{
+				Owner: "sockguard-pid-1",
 			},
-			"alwaysjoinnetwork": upstreamStateNetwork{
-				owner: "sockguard-pid-1",
+			"alwaysjoinnetwork": sockguardtest.Network{
+				Owner: "sockguard-pid-1",
 			},
-			"alwaysjoinnetworkwithalias": upstreamStateNetwork{
-				owner: "sockguard-pid-1",
+			"alwaysjoinnetworkwithalias": sockguardtest.Network{
+				Owner: "sockguard-pid-1",
 			},
 		},
 	}
@@ -869,7 +1264,7 @@ func TestHandleNetworkDelete(t *testing.T) {
 			}
 
 			// "Delete" the network (from mocked upstream state)
-			err := us.deleteNetwork(parsePath[2])
+			err := us.DeleteNetwork(parsePath[2])
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -905,9 +1300,9 @@ func TestHandleNetworkDelete(t *testing.T) {
 		}
 
 		// Verify the network was deleted from mock upstream state (or not deleted on error)
-		if rr.Code == 200 && us.doesNetworkExist(k) == true {
+		if rr.Code == 200 && us.NetworkExists(k) == true {
 			t.Errorf("%s : %d response code, but network still exists, should have been deleted from mock upstream state", k, rr.Code)
-		} else if rr.Code != 200 && us.doesNetworkExist(k) == false {
+		} else if rr.Code != 200 && us.NetworkExists(k) == false {
 			t.Errorf("%s : %d response code, but network does not exist, should not have been deleted", k, rr.Code)
 		}
 
@@ -921,44 +1316,44 @@ func TestCheckOwner(t *testing.T) {
 	l := mockLogger()
 
 	// Pre-populated simplified upstream state that "exists" before tests execute.
-	us := upstreamState{
-		containers: map[string]upstreamStateContainer{
-			"idwithnolabel": upstreamStateContainer{
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"idwithnolabel": sockguardtest.Container{
 				// Empty owner = no label
-				owner: "",
+				Owner: "",
 			},
-			"idwithlabel1": upstreamStateContainer{
-				owner: "test-owner",
+			"idwithlabel1": sockguardtest.Container{
+				Owner: "test-owner",
 			},
 		},
-		images: map[string]upstreamStateImage{
-			"idwithnolabel": upstreamStateImage{
+		Images: map[string]sockguardtest.Image{
+			"idwithnolabel": sockguardtest.Image{
 				// Empty owner = no label
-				owner: "",
+				Owner: "",
 			},
-			"idwithlabel1": upstreamStateImage{
-				owner: "test-owner",
+			"idwithlabel1": sockguardtest.Image{
+				Owner: "test-owner",
 			},
 		},
-		networks: map[string]upstreamStateNetwork{
-			"idwithnolabel": upstreamStateNetwork{
+		Networks: map[string]sockguardtest.Network{
+			"idwithnolabel": sockguardtest.Network{
 				// Empty owner = no label
-				owner: "",
+				Owner: "",
 			},
-			"idwithlabel1": upstreamStateNetwork{
-				owner: "test-owner",
+			"idwithlabel1": sockguardtest.Network{
+				Owner: "test-owner",
 			},
 		},
-		volumes: map[string]upstreamStateVolume{
-			"namewithnolabel": upstreamStateVolume{
+		Volumes: map[string]sockguardtest.Volume{
+			"namewithnolabel": sockguardtest.Volume{
 				// Empty owner = no label
-				owner: "",
+				Owner: "",
 			},
-			"namewithlabel1": upstreamStateVolume{
-				owner: "test-owner",
+			"namewithlabel1": sockguardtest.Volume{
+				Owner: "test-owner",
 			},
-			"name-with-label2": upstreamStateVolume{
-				owner: "test-owner",
+			"name-with-label2": sockguardtest.Volume{
+				Owner: "test-owner",
 			},
 		},
 	}
@@ -1004,6 +1399,252 @@ func TestCheckOwner(t *testing.T) {
 	}
 }
 
+func TestTrustOwnerHeader(t *testing.T) {
+	l := mockLogger()
+
+	// Pre-populated simplified upstream state that "exists" before tests execute.
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"owneddefault": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+			"ownedtenant": sockguardtest.Container{
+				Owner: "tenant-a",
+			},
+		},
+	}
+
+	tests := []struct {
+		trust  bool
+		header string
+		path   string
+		esc    int
+	}{
+		{false, "", "/v1.37/containers/owneddefault/logs", 200},
+		{false, "tenant-a", "/v1.37/containers/ownedtenant/logs", 401},
+		{true, "tenant-a", "/v1.37/containers/ownedtenant/logs", 200},
+		{true, "tenant-a", "/v1.37/containers/owneddefault/logs", 401},
+		{true, "tenant-b", "/v1.37/containers/ownedtenant/logs", 401},
+		{true, "", "/v1.37/containers/owneddefault/logs", 200},
+	}
+
+	for _, test := range tests {
+		r := mockRulesDirectorWithUpstreamState(&us)
+		r.TrustOwnerHeader = test.trust
+
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("X-Sockguard-Owner") != "" && test.trust {
+				t.Errorf("%s : Expected owner header to be removed", test.path)
+			}
+		})
+
+		req, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.header != "" {
+			req.Header.Set("X-Sockguard-Owner", test.header)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.esc {
+			t.Errorf("%s (owner %q) : handler returned wrong status code: got %v want %v", test.path, test.header, status, test.esc)
+		}
+	}
+}
+
+func TestDirectContext(t *testing.T) {
+	l := mockLogger()
+
+	type ctxKey struct{}
+
+	var inspected []string
+	r := mockRulesDirector()
+	r.Client = &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) *http.Response {
+			if err := req.Context().Err(); err != nil {
+				inspected = append(inspected, err.Error())
+			} else {
+				inspected = append(inspected, fmt.Sprintf("%v", req.Context().Value(ctxKey{})))
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     make(http.Header),
+				Body:       ioutil.NopCloser(strings.NewReader(`{"Config":{"Labels":{"com.buildkite.sockguard.owner":"test-owner"}}}`)),
+			}
+		}),
+	}
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// Direct makes internal calls with the request's context
+	req := httptest.NewRequest("GET", "/v1.37/containers/owned/logs", nil)
+	req = req.WithContext(context.WithValue(req.Context(), ctxKey{}, "request"))
+	r.Direct(l, req, upstream).ServeHTTP(httptest.NewRecorder(), req)
+
+	// DirectContext makes them with the context it's given
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "connection"))
+	req = httptest.NewRequest("GET", "/v1.37/containers/owned/logs", nil)
+	r.DirectContext(ctx, l, req, upstream).ServeHTTP(httptest.NewRecorder(), req)
+
+	cancel()
+	req = httptest.NewRequest("GET", "/v1.37/containers/owned/logs", nil)
+	r.DirectContext(ctx, l, req, upstream).ServeHTTP(httptest.NewRecorder(), req)
+
+	expected := []string{"request", "connection", context.Canceled.Error()}
+	if diff := cmp.Diff(expected, inspected); diff != "" {
+		t.Errorf("Unexpected internal call contexts (-want +got):\n%s", diff)
+	}
+
+	if r.ctx != nil {
+		t.Errorf("Expected the director's context to be left unset, got %v", r.ctx)
+	}
+}
+
+func TestDenyStatusCodeAndMessage(t *testing.T) {
+	l := mockLogger()
+
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"unowned": sockguardtest.Container{
+				Owner: "someone-else",
+			},
+		},
+	}
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("Expected %s to be denied", req.URL.Path)
+	})
+
+	tests := []struct {
+		code     int
+		message  string
+		expected string
+		esc      int
+	}{
+		{0, "", "Unauthorized access to container", 401},
+		{403, "", "Unauthorized access to container", 403},
+		{403, "{reason} ({endpoint} as {owner}), see https://example.com/runbook", "Unauthorized access to container (DELETE /containers/unowned as test-owner), see https://example.com/runbook", 403},
+	}
+
+	for _, test := range tests {
+		r := mockRulesDirectorWithUpstreamState(&us)
+		r.DenyStatusCode = test.code
+		r.DenyMessage = test.message
+
+		req := httptest.NewRequest("DELETE", "/v1.37/containers/unowned", nil)
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if rr.Code != test.esc {
+			t.Errorf("%q : Expected status %d, got %d", test.message, test.esc, rr.Code)
+		}
+		var body struct {
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Message != test.expected {
+			t.Errorf("%q : Expected message %q, got %q", test.message, test.expected, body.Message)
+		}
+	}
+}
+
+func TestCheckOwnerAlsoAllowOwners(t *testing.T) {
+	l := mockLogger()
+
+	// Pre-populated simplified upstream state that "exists" before tests execute.
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"owned": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+			"cachewarmer": sockguardtest.Container{
+				Owner: "shared",
+			},
+			"foreign": sockguardtest.Container{
+				Owner: "adifferentowner",
+			},
+		},
+	}
+
+	r := mockRulesDirectorWithUpstreamState(&us)
+	r.AlsoAllowOwners = []string{"team-x", "shared"}
+
+	tests := map[string]bool{
+		"owned":       true,
+		"cachewarmer": true,
+		"foreign":     false,
+	}
+
+	for k, v := range tests {
+		ok, err := r.checkIdentifierOwner(l, "containers", k, false)
+		if err != nil {
+			t.Errorf("%s : Error - %s", k, err.Error())
+		}
+		if ok != v {
+			t.Errorf("%s : Expected %t, got %t", k, v, ok)
+		}
+	}
+}
+
+func TestCheckOwnerAllowUnowned(t *testing.T) {
+	l := mockLogger()
+
+	// Pre-populated simplified upstream state that "exists" before tests execute.
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"idwithnolabel": sockguardtest.Container{},
+		},
+		Images: map[string]sockguardtest.Image{
+			"idwithnolabel": sockguardtest.Image{},
+		},
+		Networks: map[string]sockguardtest.Network{
+			"idwithnolabel": sockguardtest.Network{},
+		},
+	}
+
+	tests := []struct {
+		allowUnowned map[string]bool
+		path         string
+		esc          int
+	}{
+		// Defaults
+		{nil, "/v1.37/containers/idwithnolabel/json", 401},
+		{nil, "/v1.37/images/idwithnolabel/json", 200},
+		{nil, "/v1.37/networks/idwithnolabel", 200},
+		// Lenient containers
+		{map[string]bool{"containers": true}, "/v1.37/containers/idwithnolabel/json", 200},
+		// Strict images and networks
+		{map[string]bool{"images": false, "networks": false}, "/v1.37/images/idwithnolabel/json", 401},
+		{map[string]bool{"images": false, "networks": false}, "/v1.37/networks/idwithnolabel", 401},
+	}
+
+	for _, test := range tests {
+		r := mockRulesDirectorWithUpstreamState(&us)
+		r.AllowUnowned = test.allowUnowned
+
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// Return empty body, the request is whats important not the response
+		})
+
+		req, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.esc {
+			t.Errorf("%s %v : handler returned wrong status code: got %v want %v", test.path, test.allowUnowned, status, test.esc)
+		}
+	}
+}
+
 type handleBuildTest struct {
 	rd *RulesDirector
 	// Expected StatusCode
@@ -1062,6 +1703,41 @@ func TestHandleBuild(t *testing.T) {
 			inQueryString:       `buildargs={}&cachefrom=[]&cgroupparent=anothercgroup&cpuperiod=0&cpuquota=0&cpusetcpus=&cpusetmems=&cpushares=0&dockerfile=Dockerfile&labels={}&memory=0&memswap=0&networkmode=default&rm=1&shmsize=0&target=&ulimits=null&version=1`,
 			expectedQueryString: `<should fail and never get here>`,
 		},
+		// Defaults + host networking in API request (should fail)
+		handleBuildTest{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner: "sockguard-pid-1",
+			},
+			esc:                 401,
+			inQueryString:       `buildargs={}&cachefrom=[]&cgroupparent=&cpuperiod=0&cpuquota=0&cpusetcpus=&cpusetmems=&cpushares=0&dockerfile=Dockerfile&labels={}&memory=0&memswap=0&networkmode=host&rm=1&shmsize=0&target=&ulimits=null&version=1`,
+			expectedQueryString: `<should fail and never get here>`,
+		},
+		// Defaults + Host Mode Networking + host networking in API request (should pass)
+		handleBuildTest{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner:                   "sockguard-pid-1",
+				AllowHostModeNetworking: true,
+			},
+			esc:                 200,
+			inQueryString:       `buildargs={}&cachefrom=[]&cgroupparent=&cpuperiod=0&cpuquota=0&cpusetcpus=&cpusetmems=&cpushares=0&dockerfile=Dockerfile&labels={}&memory=0&memswap=0&networkmode=host&rm=1&shmsize=0&target=&ulimits=null&version=1`,
+			expectedQueryString: `buildargs={}&cachefrom=[]&cgroupparent=&cpuperiod=0&cpuquota=0&cpusetcpus=&cpusetmems=&cpushares=0&dockerfile=Dockerfile&labels={"com.buildkite.sockguard.owner":"sockguard-pid-1"}&memory=0&memswap=0&networkmode=host&rm=1&shmsize=0&target=&ulimits=null&version=1`,
+		},
+		// Defaults + BuildNetwork in config (should pass)
+		handleBuildTest{
+			rd: &RulesDirector{
+				Client: &http.Client{},
+				// This is what's set in main() as the default, assuming running in a container so PID 1
+				Owner:        "sockguard-pid-1",
+				BuildNetwork: "buildnetwork",
+			},
+			esc:                 200,
+			inQueryString:       `buildargs={}&cachefrom=[]&cgroupparent=&cpuperiod=0&cpuquota=0&cpusetcpus=&cpusetmems=&cpushares=0&dockerfile=Dockerfile&labels={}&memory=0&memswap=0&networkmode=default&rm=1&shmsize=0&target=&ulimits=null&version=1`,
+			expectedQueryString: `buildargs={}&cachefrom=[]&cgroupparent=&cpuperiod=0&cpuquota=0&cpusetcpus=&cpusetmems=&cpushares=0&dockerfile=Dockerfile&labels={"com.buildkite.sockguard.owner":"sockguard-pid-1"}&memory=0&memswap=0&networkmode=buildnetwork&rm=1&shmsize=0&target=&ulimits=null&version=1`,
+		},
 	}
 	reqUrlPath := "/v1.37/build"
 	expectedUrlPath := "/v1.37/build"
@@ -1113,3 +1789,112 @@ func TestHandleBuild(t *testing.T) {
 		// Don't bother checking the response, it's not relevant in mocked context. The request side is more important here.
 	}
 }
+
+func TestIsBindAllowedResolvesSymlinks(t *testing.T) {
+	l := mockLogger()
+
+	dir, err := ioutil.TempDir("", "sockguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Symlink("/", filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "real"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		resolve bool
+		bind    string
+		allowed bool
+	}{
+		"symlink not resolved":         {false, dir + "/escape/etc:/x", true},
+		"symlink resolved":             {true, dir + "/escape/etc:/x", false},
+		"real dir resolved":            {true, dir + "/real:/x", true},
+		"nonexistent path resolved":    {true, dir + "/doesnotexist:/x", true},
+		"outside allowed not resolved": {false, "/etc:/x", false},
+	}
+
+	for k, v := range tests {
+		r := mockRulesDirector()
+		r.ResolveBindSymlinks = v.resolve
+		allowed, err := r.isBindAllowed(l, v.bind, []string{dir}, nil)
+		if err != nil {
+			t.Errorf("%s : Error - %s", k, err.Error())
+		}
+		if allowed != v.allowed {
+			t.Errorf("%s : Expected %t, got %t", k, v.allowed, allowed)
+		}
+	}
+}
+
+func TestIsBindAllowedDenyBinds(t *testing.T) {
+	l := mockLogger()
+
+	tests := map[string]bool{
+		"/var/run/docker.sock:/var/run/docker.sock": false,
+		"/proc/1/root:/host":                        false,
+		"/sys:/sys:ro":                              false,
+		"/etc/passwd:/etc/passwd":                   false,
+		"/:/host":                                   false,
+		"/var/run:/var/run":                         false,
+		"/srv/secrets:/secrets":                     false,
+		"/home/build:/build":                        true,
+		"/etcetera:/etcetera":                       true,
+	}
+
+	r := mockRulesDirector()
+	r.DenyBinds = []string{"/srv/secrets"}
+
+	for bind, expected := range tests {
+		allowed, err := r.isBindAllowed(l, bind, []string{"/"}, nil)
+		if err != nil {
+			t.Errorf("%s : Error - %s", bind, err.Error())
+		}
+		if allowed != expected {
+			t.Errorf("%s : Expected %t, got %t", bind, expected, allowed)
+		}
+	}
+}
+
+func TestIsBindAllowedAllowVolumes(t *testing.T) {
+	l := mockLogger()
+
+	// Pre-populated simplified upstream state that "exists" before tests execute.
+	us := sockguardtest.State{
+		Volumes: map[string]sockguardtest.Volume{
+			"ownedvolume": sockguardtest.Volume{
+				Owner: "test-owner",
+			},
+			"foreignvolume": sockguardtest.Volume{
+				Owner: "adifferentowner",
+			},
+			"cache-gomod": sockguardtest.Volume{
+				Owner: "adifferentowner",
+			},
+		},
+	}
+
+	r := mockRulesDirectorWithUpstreamState(&us)
+	r.AllowVolumes = []string{"cache-*"}
+
+	tests := map[string]bool{
+		"ownedvolume:/data":        true,
+		"foreignvolume:/data":      false,
+		"cache-gomod:/go/pkg/mod":  true,
+		"cache-unknown:/some/path": true,
+	}
+
+	for bind, expected := range tests {
+		allowed, err := r.isBindAllowed(l, bind, nil, nil)
+		if err != nil {
+			t.Errorf("%s : Error - %s", bind, err.Error())
+		}
+		if allowed != expected {
+			t.Errorf("%s : Expected %t, got %t", bind, expected, allowed)
+		}
+	}
+}
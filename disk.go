@@ -0,0 +1,52 @@
+package sockguard
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// dataRoot returns the filesystem path to check the free space of, DataRoot or the daemon's
+// DockerRootDir (sockguard runs on the same host as the daemon's socket)
+func (r *RulesDirector) dataRoot() (string, error) {
+	if r.DataRoot != "" {
+		return r.DataRoot, nil
+	}
+	var info struct {
+		DockerRootDir string
+	}
+	if err := r.getInto(&info, "/info"); err != nil {
+		return "", err
+	}
+	if info.DockerRootDir == "" {
+		return "", fmt.Errorf("Failed to find the docker daemon's data-root, set it with -data-root")
+	}
+	return info.DockerRootDir, nil
+}
+
+// requireFreeDiskSpace denies requests with a 507 when the daemon's data-root has less than
+// MinFreeDiskSpace free, so pulls and builds fail up front rather than part way through
+func (r *RulesDirector) requireFreeDiskSpace(l socketproxy.Logger, upstream http.Handler) http.Handler {
+	if r.MinFreeDiskSpace == 0 {
+		return upstream
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		root, err := r.dataRoot()
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		free, err := freeDiskSpace(root)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if free < r.MinFreeDiskSpace {
+			l.Printf("Denied %s, %d bytes free on %s is below the minimum of %d", req.URL.Path, free, root, r.MinFreeDiskSpace)
+			writeError(w, fmt.Sprintf("The docker host is low on disk space (%d bytes free on %s, %d required), try again later", free, root, r.MinFreeDiskSpace), http.StatusInsufficientStorage)
+			return
+		}
+		upstream.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,62 @@
+package sockguard
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestRequireFreeDiskSpace(t *testing.T) {
+	l := mockLogger()
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		minFree  uint64
+		dataRoot string
+		status   int
+	}{
+		{0, "", 200},
+		{1, os.TempDir(), 200},
+		{1 << 62, os.TempDir(), 507},
+		// found from the DockerRootDir in /info
+		{1 << 62, "", 507},
+		{1, "", 200},
+	}
+
+	for _, test := range tests {
+		r := mockRulesDirector()
+		r.MinFreeDiskSpace = test.minFree
+		r.DataRoot = test.dataRoot
+		r.Client = &http.Client{
+			Transport: roundTripFunc(func(req *http.Request) *http.Response {
+				if req.URL.Path != "/v1.37/info" {
+					t.Errorf("Unexpected request to %s", req.URL.Path)
+				}
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{},
+					Body:       ioutil.NopCloser(bytes.NewBufferString(`{"DockerRootDir":"` + os.TempDir() + `"}`)),
+				}
+			}),
+		}
+
+		for _, path := range []string{"/v1.37/build", "/v1.37/images/create?fromImage=alpine&tag=3"} {
+			req, err := http.NewRequest("POST", path, http.NoBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+			if status := rr.Code; status != test.status {
+				t.Errorf("%s (min %d, data-root %q) : handler returned wrong status code: got %v want %v", path, test.minFree, test.dataRoot, status, test.status)
+			}
+		}
+	}
+}
@@ -0,0 +1,7 @@
+package sockguard
+
+import "fmt"
+
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, fmt.Errorf("Checking free disk space isn't supported on windows")
+}
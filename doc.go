@@ -0,0 +1,17 @@
+// Package sockguard provides a RulesDirector, which restricts what can be
+// done over a proxied docker socket to the resources owned by the proxy.
+//
+// The sockguard command is a thin wrapper around this package, so other
+// programs can embed the same guard by serving a socketproxy.SocketProxy
+// that uses a RulesDirector:
+//
+//	director, err := sockguard.NewDirector(
+//		sockguard.WithClient(client),
+//		sockguard.WithOwner("my-job"),
+//	)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	proxy := socketproxy.New("/var/run/docker.sock", director)
+//	http.Serve(listener, proxy)
+package sockguard
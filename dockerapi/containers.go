@@ -0,0 +1,296 @@
+package dockerapi
+
+// ContainerCreate is the body of a POST /containers/create request
+type ContainerCreate struct {
+	Image            string
+	User             string
+	Labels           map[string]string
+	HostConfig       HostConfig
+	NetworkingConfig NetworkingConfig
+
+	// Extra holds the fields that aren't typed
+	Extra   map[string]interface{} `json:"-"`
+	decoded []decodedField
+}
+
+// containerCreateFields are the untyped fields of a container create the daemon knows about
+var containerCreateFields = []string{
+	"AttachStderr",
+	"AttachStdin",
+	"AttachStdout",
+	"ArgsEscaped",
+	"Cmd",
+	"Domainname",
+	"Entrypoint",
+	"Env",
+	"ExposedPorts",
+	"Healthcheck",
+	"Hostname",
+	"MacAddress",
+	"NetworkDisabled",
+	"OnBuild",
+	"OpenStdin",
+	"Shell",
+	"StdinOnce",
+	"StopSignal",
+	"StopTimeout",
+	"Tty",
+	"Volumes",
+	"WorkingDir",
+}
+
+func (c *ContainerCreate) UnmarshalJSON(data []byte) error {
+	type plain ContainerCreate
+	return unmarshalFields(data, (*plain)(c), containerCreateFields, &c.Extra, &c.decoded)
+}
+
+func (c ContainerCreate) MarshalJSON() ([]byte, error) {
+	type plain ContainerCreate
+	return marshalFields(plain(c), c.Extra, c.decoded)
+}
+
+// HostConfig is the host specific configuration of a container
+type HostConfig struct {
+	Privileged   bool
+	Binds        []string
+	Mounts       []Mount
+	NetworkMode  string
+	Links        []string
+	VolumesFrom  []string
+	ExtraHosts   []string
+	Ulimits      []Ulimit
+	Isolation    string
+	CgroupParent string
+	Runtime      string
+
+	// Extra holds the fields that aren't typed, including resources like Memory and NanoCpus
+	Extra   map[string]interface{} `json:"-"`
+	decoded []decodedField
+}
+
+// hostConfigFields are the untyped fields of a host config the daemon knows about
+var hostConfigFields = []string{
+	"Annotations",
+	"AutoRemove",
+	"BlkioDeviceReadBps",
+	"BlkioDeviceReadIOps",
+	"BlkioDeviceWriteBps",
+	"BlkioDeviceWriteIOps",
+	"BlkioWeight",
+	"BlkioWeightDevice",
+	"CapAdd",
+	"CapDrop",
+	"Cgroup",
+	"CgroupnsMode",
+	"ConsoleSize",
+	"ContainerIDFile",
+	"CpuCount",
+	"CpuPercent",
+	"CpuPeriod",
+	"CpuQuota",
+	"CpuRealtimePeriod",
+	"CpuRealtimeRuntime",
+	"CpuShares",
+	"CpusetCpus",
+	"CpusetMems",
+	"DeviceCgroupRules",
+	"DeviceRequests",
+	"Devices",
+	"DiskQuota",
+	"Dns",
+	"DnsOptions",
+	"DnsSearch",
+	"GroupAdd",
+	"IOMaximumBandwidth",
+	"IOMaximumIOps",
+	"Init",
+	"IpcMode",
+	"KernelMemory",
+	"KernelMemoryTCP",
+	"LogConfig",
+	"MaskedPaths",
+	"Memory",
+	"MemoryReservation",
+	"MemorySwap",
+	"MemorySwappiness",
+	"NanoCpus",
+	"OomKillDisable",
+	"OomScoreAdj",
+	"PidMode",
+	"PidsLimit",
+	"PortBindings",
+	"PublishAllPorts",
+	"ReadonlyPaths",
+	"ReadonlyRootfs",
+	"RestartPolicy",
+	"SecurityOpt",
+	"ShmSize",
+	"StorageOpt",
+	"Sysctls",
+	"Tmpfs",
+	"UTSMode",
+	"UsernsMode",
+	"VolumeDriver",
+}
+
+func (h *HostConfig) UnmarshalJSON(data []byte) error {
+	type plain HostConfig
+	return unmarshalFields(data, (*plain)(h), hostConfigFields, &h.Extra, &h.decoded)
+}
+
+func (h HostConfig) MarshalJSON() ([]byte, error) {
+	type plain HostConfig
+	return marshalFields(plain(h), h.Extra, h.decoded)
+}
+
+// ContainerUpdate is the body of a POST /containers/{id}/update request, the resources and
+// restart policy of a HostConfig
+type ContainerUpdate struct {
+	// Extra holds the fields, none are typed
+	Extra   map[string]interface{} `json:"-"`
+	decoded []decodedField
+}
+
+func (u *ContainerUpdate) UnmarshalJSON(data []byte) error {
+	type plain ContainerUpdate
+	return unmarshalFields(data, (*plain)(u), hostConfigFields, &u.Extra, &u.decoded)
+}
+
+func (u ContainerUpdate) MarshalJSON() ([]byte, error) {
+	type plain ContainerUpdate
+	return marshalFields(plain(u), u.Extra, u.decoded)
+}
+
+// Mount is a mount of a bind, volume or tmpfs into a container
+type Mount struct {
+	Type        string
+	Source      string
+	BindOptions *BindOptions
+
+	// Extra holds the fields that aren't typed
+	Extra   map[string]interface{} `json:"-"`
+	decoded []decodedField
+}
+
+// mountFields are the untyped fields of a mount the daemon knows about
+var mountFields = []string{
+	"Consistency",
+	"ReadOnly",
+	"Target",
+	"TmpfsOptions",
+	"VolumeOptions",
+}
+
+func (m *Mount) UnmarshalJSON(data []byte) error {
+	type plain Mount
+	return unmarshalFields(data, (*plain)(m), mountFields, &m.Extra, &m.decoded)
+}
+
+func (m Mount) MarshalJSON() ([]byte, error) {
+	type plain Mount
+	return marshalFields(plain(m), m.Extra, m.decoded)
+}
+
+// BindOptions are the options of a bind mount
+type BindOptions struct {
+	Propagation string
+
+	// Extra holds the fields that aren't typed
+	Extra   map[string]interface{} `json:"-"`
+	decoded []decodedField
+}
+
+// bindOptionsFields are the untyped fields of bind options the daemon knows about
+var bindOptionsFields = []string{
+	"CreateMountpoint",
+	"NonRecursive",
+	"ReadOnlyForceRecursive",
+	"ReadOnlyNonRecursive",
+}
+
+func (b *BindOptions) UnmarshalJSON(data []byte) error {
+	type plain BindOptions
+	return unmarshalFields(data, (*plain)(b), bindOptionsFields, &b.Extra, &b.decoded)
+}
+
+func (b BindOptions) MarshalJSON() ([]byte, error) {
+	type plain BindOptions
+	return marshalFields(plain(b), b.Extra, b.decoded)
+}
+
+// Ulimit is a resource limit for processes in a container
+type Ulimit struct {
+	Name string
+	Soft int64
+	Hard int64
+
+	// Extra holds the fields that aren't typed
+	Extra   map[string]interface{} `json:"-"`
+	decoded []decodedField
+}
+
+func (u *Ulimit) UnmarshalJSON(data []byte) error {
+	type plain Ulimit
+	return unmarshalFields(data, (*plain)(u), nil, &u.Extra, &u.decoded)
+}
+
+func (u Ulimit) MarshalJSON() ([]byte, error) {
+	type plain Ulimit
+	return marshalFields(plain(u), u.Extra, u.decoded)
+}
+
+// NetworkingConfig is the networks a container is attached to when it's created
+type NetworkingConfig struct {
+	EndpointsConfig map[string]*EndpointSettings
+
+	// Extra holds the fields that aren't typed
+	Extra   map[string]interface{} `json:"-"`
+	decoded []decodedField
+}
+
+func (n *NetworkingConfig) UnmarshalJSON(data []byte) error {
+	type plain NetworkingConfig
+	return unmarshalFields(data, (*plain)(n), nil, &n.Extra, &n.decoded)
+}
+
+func (n NetworkingConfig) MarshalJSON() ([]byte, error) {
+	type plain NetworkingConfig
+	return marshalFields(plain(n), n.Extra, n.decoded)
+}
+
+// EndpointSettings is the configuration of a container on a network
+type EndpointSettings struct {
+	Aliases []string
+
+	// Extra holds the fields that aren't typed
+	Extra   map[string]interface{} `json:"-"`
+	decoded []decodedField
+}
+
+// endpointSettingsFields are the untyped fields of endpoint settings the daemon knows about
+var endpointSettingsFields = []string{
+	"DNSNames",
+	"DriverOpts",
+	"EndpointID",
+	"Gateway",
+	"GlobalIPv6Address",
+	"GlobalIPv6PrefixLen",
+	"GwPriority",
+	"IPAMConfig",
+	"IPAddress",
+	"IPPrefixLen",
+	"IPv6Gateway",
+	"Links",
+	"MacAddress",
+	"NetworkID",
+}
+
+func (e *EndpointSettings) UnmarshalJSON(data []byte) error {
+	type plain EndpointSettings
+	return unmarshalFields(data, (*plain)(e), endpointSettingsFields, &e.Extra, &e.decoded)
+}
+
+func (e EndpointSettings) MarshalJSON() ([]byte, error) {
+	type plain EndpointSettings
+	return marshalFields(plain(e), e.Extra, e.decoded)
+}
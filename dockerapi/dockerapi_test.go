@@ -0,0 +1,131 @@
+package dockerapi
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestContainerCreateRoundTrip(t *testing.T) {
+	for _, body := range []string{
+		`{}`,
+		`{"Cmd":["true"],"HostConfig":{"Binds":null,"Memory":9007199254740993,"Privileged":false},"Image":"alpine","Labels":{}}`,
+		`{"HostConfig":{"Mounts":[{"BindOptions":{"NonRecursive":true,"Propagation":"rprivate"},"Source":"/tmp","Target":"/tmp","Type":"bind"}],"Ulimits":[{"Hard":1024,"Name":"nofile","Soft":1024}]}}`,
+		`{"NetworkingConfig":{"EndpointsConfig":{"a":{"Aliases":["b"],"IPAMConfig":null},"c":null}}}`,
+	} {
+		var create ContainerCreate
+		if err := json.Unmarshal([]byte(body), &create); err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := json.Marshal(create)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(encoded) != body {
+			t.Errorf("Expected %s, got %s", body, encoded)
+		}
+	}
+}
+
+func TestContainerCreateTypedFields(t *testing.T) {
+	var create ContainerCreate
+	body := `{"hostconfig":{"privileged":true,"Links":["a:b"]},"Labels":{"a":"b"}}`
+	if err := json.Unmarshal([]byte(body), &create); err != nil {
+		t.Fatal(err)
+	}
+
+	if !create.HostConfig.Privileged {
+		t.Errorf("Expected Privileged to be decoded case insensitively")
+	}
+
+	create.Labels["c"] = "d"
+	create.HostConfig.Links = append(create.HostConfig.Links, "e")
+	create.HostConfig.CgroupParent = "parent"
+	create.User = "nobody"
+
+	encoded, err := json.Marshal(create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"HostConfig":{"Privileged":true,"Links":["a:b","e"],"CgroupParent":"parent"},"Labels":{"a":"b","c":"d"},"User":"nobody"}`
+	if string(encoded) != expected {
+		t.Errorf("Expected %s, got %s", expected, encoded)
+	}
+}
+
+func TestContainerCreateUnchangedFields(t *testing.T) {
+	var create ContainerCreate
+	body := `{"Image":"alpine","Env":["A=\u00e9"],"HostConfig":{"NanoCpus":1.0e9,"Links":["a:b"],"Memory":1024},"Labels":{"z":"1","a":"2"}}`
+	if err := json.Unmarshal([]byte(body), &create); err != nil {
+		t.Fatal(err)
+	}
+
+	create.HostConfig.Links = append(create.HostConfig.Links, "c")
+	create.HostConfig.Extra["Init"] = true
+
+	encoded, err := json.Marshal(create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"Image":"alpine","Env":["A=\u00e9"],"HostConfig":{"NanoCpus":1.0e9,"Links":["a:b","c"],"Memory":1024,"Init":true},"Labels":{"z":"1","a":"2"}}`
+	if string(encoded) != expected {
+		t.Errorf("Expected %s, got %s", expected, encoded)
+	}
+}
+
+func TestContainerCreateInvalidField(t *testing.T) {
+	var create ContainerCreate
+	if err := json.Unmarshal([]byte(`{"HostConfig":{"Binds":[1]}}`), &create); err == nil {
+		t.Fatal("Expected an error decoding a bind that isn't a string")
+	}
+}
+
+func TestNetworkCreateRoundTrip(t *testing.T) {
+	body := `{"Driver":"bridge","Labels":{"a":"b"},"Name":"net","Options":{}}`
+
+	var create NetworkCreate
+	if err := json.Unmarshal([]byte(body), &create); err != nil {
+		t.Fatal(err)
+	}
+	if create.Name != "net" {
+		t.Errorf("Expected name %q, got %q", "net", create.Name)
+	}
+
+	encoded, err := json.Marshal(create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(encoded) != body {
+		t.Errorf("Expected %s, got %s", body, encoded)
+	}
+}
+
+func TestContainerCreateCanonicalFields(t *testing.T) {
+	var create ContainerCreate
+	body := `{"stoptimeout":1,"HostConfig":{"memory":99999999,"INIT":false,"futurefield":true}}`
+	if err := json.Unmarshal([]byte(body), &create); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := create.Extra["StopTimeout"]; !ok {
+		t.Errorf("Expected StopTimeout to be canonicalised, got %v", create.Extra)
+	}
+	for _, field := range []string{"Memory", "Init", "futurefield"} {
+		if _, ok := create.HostConfig.Extra[field]; !ok {
+			t.Errorf("Expected HostConfig.%s, got %v", field, create.HostConfig.Extra)
+		}
+	}
+}
+
+func TestContainerCreateDuplicateFields(t *testing.T) {
+	for _, body := range []string{
+		`{"HostConfig":{"Memory":1,"memory":99999999}}`,
+		`{"HostConfig":{"Privileged":false,"privileged":true}}`,
+		`{"Image":"alpine","image":"evil"}`,
+		`{"HostConfig":{"FutureField":1,"futurefield":2}}`,
+	} {
+		var create ContainerCreate
+		if err := json.Unmarshal([]byte(body), &create); err == nil {
+			t.Errorf("%s : Expected an error decoding fields differing only in case", body)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package dockerapi
+
+// ExecCreate is the body of a POST /containers/{id}/exec request
+type ExecCreate struct {
+	Privileged bool
+	User       string
+
+	// Extra holds the fields that aren't typed
+	Extra   map[string]interface{} `json:"-"`
+	decoded []decodedField
+}
+
+// execCreateFields are the untyped fields of an exec create the daemon knows about
+var execCreateFields = []string{
+	"AttachStderr",
+	"AttachStdin",
+	"AttachStdout",
+	"Cmd",
+	"ConsoleSize",
+	"DetachKeys",
+	"Env",
+	"Tty",
+	"WorkingDir",
+}
+
+func (e *ExecCreate) UnmarshalJSON(data []byte) error {
+	type plain ExecCreate
+	return unmarshalFields(data, (*plain)(e), execCreateFields, &e.Extra, &e.decoded)
+}
+
+func (e ExecCreate) MarshalJSON() ([]byte, error) {
+	type plain ExecCreate
+	return marshalFields(plain(e), e.Extra, e.decoded)
+}
@@ -0,0 +1,218 @@
+// Package dockerapi provides typed versions of the Docker Engine API requests that sockguard
+// checks and modifies.
+//
+// Only the fields sockguard cares about are typed. Every other field of a request is kept in
+// Extra, and the fields of a decoded request that aren't changed are encoded back as they were
+// in the same order, so only the changes made to it are re-encoded.
+package dockerapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// decodedField is a field of the JSON object a value was decoded from
+type decodedField struct {
+	// name is the field's key, canonicalised to the typed or known field name
+	name string
+	// raw is the field's value as it was decoded
+	raw json.RawMessage
+	// encoded is the field's value encoded again once decoded, to tell if it has been changed
+	encoded []byte
+}
+
+// unmarshalFields decodes data into the typed fields of v, a pointer to a struct, and the
+// remaining fields into extra. The fields found in data are recorded in decoded, in order, so
+// that typed fields are encoded again even if empty, and fields that aren't changed are
+// encoded as they were. Keys of extra matching one of the known daemon field names are
+// canonicalised to it.
+func unmarshalFields(data []byte, v interface{}, known []string, extra *map[string]interface{}, decoded *[]decodedField) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+
+	// read the fields in order, as the typed decode above would have failed on anything but an
+	// object or null
+	*decoded = nil
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if t, err := dec.Token(); err != nil {
+		return err
+	} else if t == nil {
+		*extra = map[string]interface{}{}
+		return nil
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		key := t.(string)
+
+		// the daemon would only use one of several keys differing in case, so don't guess which
+		for _, f := range *decoded {
+			if strings.EqualFold(key, f.name) {
+				return fmt.Errorf("Duplicate fields %q and %q", f.name, key)
+			}
+		}
+		*decoded = append(*decoded, decodedField{name: key, raw: raw})
+	}
+
+	rv := reflect.ValueOf(v).Elem()
+	typed := fieldNames(rv.Type())
+	fields := map[string]interface{}{}
+	for i := range *decoded {
+		f := &(*decoded)[i]
+
+		// encoding/json matches field names case insensitively, so the docker daemon does too
+		var value interface{}
+		if index := indexFold(typed, f.name); index >= 0 {
+			f.name = typed[index]
+			value = rv.Field(index).Interface()
+		} else {
+			if index := indexFold(known, f.name); index >= 0 {
+				f.name = known[index]
+			}
+
+			// numbers are kept as json.Number, so they're encoded again exactly
+			dec := json.NewDecoder(bytes.NewReader(f.raw))
+			dec.UseNumber()
+			if err := dec.Decode(&value); err != nil {
+				return err
+			}
+			fields[f.name] = value
+		}
+
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		f.encoded = encoded
+	}
+	*extra = fields
+
+	return nil
+}
+
+// marshalFields encodes the typed fields of v, a struct, along with extra. Fields are encoded in
+// the order they were decoded, as they were unless they've been changed, followed by any new
+// fields. Typed fields are left out if they're empty and weren't present when decoded.
+func marshalFields(v interface{}, extra map[string]interface{}, decoded []decodedField) ([]byte, error) {
+	fields := make(map[string]interface{}, len(extra))
+	for key, value := range extra {
+		fields[key] = value
+	}
+
+	rv := reflect.ValueOf(v)
+	for i, name := range fieldNames(rv.Type()) {
+		if name == "" {
+			continue
+		}
+		if fv := rv.Field(i); isDecoded(decoded, name) || !isEmpty(fv) {
+			fields[name] = fv.Interface()
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	writeField := func(name string, value []byte) {
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(name)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+
+	for _, f := range decoded {
+		value, ok := fields[f.name]
+		if !ok {
+			continue
+		}
+		delete(fields, f.name)
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(encoded, f.encoded) {
+			encoded = f.raw
+		}
+		writeField(f.name, encoded)
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		encoded, err := json.Marshal(fields[name])
+		if err != nil {
+			return nil, err
+		}
+		writeField(name, encoded)
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+// isDecoded returns whether a field named name was decoded
+func isDecoded(decoded []decodedField, name string) bool {
+	for _, f := range decoded {
+		if f.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// indexFold returns the index of the first of names equal to name under case folding, or -1
+func indexFold(names []string, name string) int {
+	for i, n := range names {
+		if n != "" && strings.EqualFold(n, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// fieldNames returns the JSON names of the typed fields of t, indexed by field, with an
+// empty name for fields that aren't encoded
+func fieldNames(t reflect.Type) []string {
+	names := make([]string, t.NumField())
+	for i := range names {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Tag.Get("json") == "-" {
+			continue
+		}
+		names[i] = f.Name
+	}
+	return names
+}
+
+// isEmpty returns whether a value has nothing worth encoding
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" && !isEmpty(v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return v.IsZero()
+}
@@ -0,0 +1,37 @@
+package dockerapi
+
+// NetworkCreate is the body of a POST /networks/create request
+type NetworkCreate struct {
+	Name   string
+	Labels map[string]string
+
+	// Extra holds the fields that aren't typed
+	Extra   map[string]interface{} `json:"-"`
+	decoded []decodedField
+}
+
+// networkCreateFields are the untyped fields of a network create the daemon knows about
+var networkCreateFields = []string{
+	"Attachable",
+	"CheckDuplicate",
+	"ConfigFrom",
+	"ConfigOnly",
+	"Driver",
+	"EnableIPv4",
+	"EnableIPv6",
+	"IPAM",
+	"Ingress",
+	"Internal",
+	"Options",
+	"Scope",
+}
+
+func (n *NetworkCreate) UnmarshalJSON(data []byte) error {
+	type plain NetworkCreate
+	return unmarshalFields(data, (*plain)(n), networkCreateFields, &n.Extra, &n.decoded)
+}
+
+func (n NetworkCreate) MarshalJSON() ([]byte, error) {
+	type plain NetworkCreate
+	return marshalFields(plain(n), n.Extra, n.decoded)
+}
@@ -0,0 +1,187 @@
+package sockguard
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// LoadDockerfilePolicyFile reads a file of regular expressions, one per line, matching Dockerfile
+// instructions to deny. Blank lines and lines starting with # are ignored.
+func LoadDockerfilePolicyFile(filename string) ([]*regexp.Regexp, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []*regexp.Regexp
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		re, err := regexp.Compile(line)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Dockerfile policy pattern %q: %v", line, err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, scanner.Err()
+}
+
+var (
+	// maxBuildContextScanSize is how much of a build context is held while looking for the
+	// Dockerfile, contexts with it further in than this are denied
+	maxBuildContextScanSize int64 = 64 << 20
+	// maxDockerfileSize is the largest Dockerfile that's read to check
+	maxDockerfileSize int64 = 1 << 20
+
+	// dockerfileDirectiveRegex matches a parser directive, e.g. # escape=`
+	dockerfileDirectiveRegex = regexp.MustCompile(`^#[ \t]*([a-zA-Z][a-zA-Z0-9]*)[ \t]*=[ \t]*(.+?)[ \t]*$`)
+)
+
+// dockerfileEscape returns the escape character of a Dockerfile, which can be changed from \ with
+// an escape parser directive. Directives are only read from the lines at the start.
+func dockerfileEscape(lines []string) (string, error) {
+	escape := "\\"
+	for _, line := range lines {
+		m := dockerfileDirectiveRegex.FindStringSubmatch(strings.TrimRight(line, "\r"))
+		if m == nil {
+			break
+		}
+		if strings.EqualFold(m[1], "escape") {
+			if m[2] != "\\" && m[2] != "`" {
+				return "", fmt.Errorf("Invalid Dockerfile escape character %q", m[2])
+			}
+			escape = m[2]
+		}
+	}
+	return escape, nil
+}
+
+// checkDockerfile matches each instruction in a Dockerfile (with line continuations joined)
+// against DenyDockerfilePatterns
+func (r *RulesDirector) checkDockerfile(l socketproxy.Logger, dockerfile []byte) error {
+	lines := strings.Split(string(dockerfile), "\n")
+	escape, err := dockerfileEscape(lines)
+	if err != nil {
+		return err
+	}
+	// the escape character continues a line even with whitespace after it
+	continuation := regexp.MustCompile(regexp.QuoteMeta(escape) + `[ \t]*$`)
+
+	var instruction string
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if continuation.MatchString(line) {
+			instruction += continuation.ReplaceAllString(line, "") + " "
+			continue
+		}
+		instruction += line
+		for _, re := range r.DenyDockerfilePatterns {
+			if re.MatchString(instruction) {
+				l.Printf("Denied Dockerfile instruction %q, matches %q", instruction, re.String())
+				return fmt.Errorf("Dockerfile instruction %q isn't allowed", strings.TrimSpace(instruction))
+			}
+		}
+		instruction = ""
+	}
+	return nil
+}
+
+// readContextDockerfile reads a Dockerfile out of a (possibly compressed) build context tar
+func readContextDockerfile(r io.Reader, name string) ([]byte, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(3)
+
+	var tr *tar.Reader
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		tr = tar.NewReader(gr)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		tr = tar.NewReader(bzip2.NewReader(br))
+	default:
+		tr = tar.NewReader(br)
+	}
+
+	name = path.Clean(strings.TrimPrefix(name, "./"))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("No %s found in build context", name)
+		} else if err != nil {
+			return nil, err
+		}
+		if path.Clean(strings.TrimPrefix(hdr.Name, "./")) == name {
+			if hdr.Size > maxDockerfileSize {
+				return nil, fmt.Errorf("%s is larger than %d bytes", name, maxDockerfileSize)
+			}
+			return ioutil.ReadAll(io.LimitReader(tr, maxDockerfileSize))
+		}
+	}
+}
+
+// cappedBuffer is a buffer that fails writes beyond maxBuildContextScanSize
+type cappedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if int64(b.Len()+len(p)) > maxBuildContextScanSize {
+		return 0, fmt.Errorf("The Dockerfile must be in the first %d bytes of the build context to be checked", maxBuildContextScanSize)
+	}
+	return b.Buffer.Write(p)
+}
+
+// scanBuildDockerfile reads the Dockerfile out of the build context in the request body and checks
+// it against DenyDockerfilePatterns. The context read up to the Dockerfile (at most
+// maxBuildContextScanSize) is held and replayed upstream, the rest is streamed.
+func (r *RulesDirector) scanBuildDockerfile(l socketproxy.Logger, req *http.Request) error {
+	q := req.URL.Query()
+
+	// BuildKit sends the Dockerfile over the session, and remote contexts are fetched by the
+	// daemon, so neither can be scanned
+	if q.Get("version") == "2" {
+		l.Printf("Denied BuildKit build, the Dockerfile can't be checked against the policy")
+		return fmt.Errorf("BuildKit builds aren't allowed when a Dockerfile policy is configured")
+	}
+	if q.Get("remote") != "" {
+		l.Printf("Denied remote context build, the Dockerfile can't be checked against the policy")
+		return fmt.Errorf("Image builds from remote contexts aren't allowed when a Dockerfile policy is configured")
+	}
+
+	name := q.Get("dockerfile")
+	if name == "" {
+		name = "Dockerfile"
+	}
+
+	var buffered cappedBuffer
+	dockerfile, err := readContextDockerfile(io.TeeReader(req.Body, &buffered), name)
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(&buffered, req.Body), req.Body}
+	if err != nil {
+		return err
+	}
+
+	return r.checkDockerfile(l, dockerfile)
+}
@@ -0,0 +1,115 @@
+package sockguard
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// mockBuildContext builds a build context tar containing a Dockerfile
+func mockBuildContext(t *testing.T, name string, dockerfile string, compress bool) []byte {
+	return mockBuildContextFiles(t, compress, "main.go", "package main", name, dockerfile)
+}
+
+// mockBuildContextFiles builds a build context tar of name, body pairs
+func mockBuildContextFiles(t *testing.T, compress bool, files ...string) []byte {
+	var buf bytes.Buffer
+	var tw *tar.Writer
+	var gw *gzip.Writer
+	if compress {
+		gw = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gw)
+	} else {
+		tw = tar.NewWriter(&buf)
+	}
+	for i := 0; i < len(files); i += 2 {
+		name, body := files[i], files[i+1]
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gw != nil {
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestHandleBuildDockerfilePolicy(t *testing.T) {
+	l := mockLogger()
+
+	r := &RulesDirector{
+		Client:                 &http.Client{},
+		Owner:                  "test-owner",
+		DenyDockerfilePatterns: []*regexp.Regexp{regexp.MustCompile(`^RUN .*--security=insecure`)},
+	}
+
+	allowed := "FROM alpine\nRUN apk add --no-cache git\n"
+	insecure := "FROM alpine\nRUN --mount=type=cache,target=/root \\\n  --security=insecure echo hi\n"
+	insecureTrailingSpace := "FROM alpine\nRUN --mount=type=cache,target=/root \\ \t\n  --security=insecure echo hi\n"
+	insecureEscape := "# escape=`\nFROM alpine\nRUN --mount=type=cache,target=/root `\n  --security=insecure echo hi\n"
+	invalidEscape := "# escape=x\nFROM alpine\n"
+
+	tests := []struct {
+		name    string
+		query   string
+		context []byte
+		esc     int
+	}{
+		{"allowed", "", mockBuildContext(t, "Dockerfile", allowed, false), 200},
+		{"allowed gzipped", "", mockBuildContext(t, "Dockerfile", allowed, true), 200},
+		{"insecure", "", mockBuildContext(t, "Dockerfile", insecure, false), 401},
+		{"insecure gzipped", "", mockBuildContext(t, "Dockerfile", insecure, true), 401},
+		{"insecure custom dockerfile", "dockerfile=build/Dockerfile.ci", mockBuildContext(t, "build/Dockerfile.ci", insecure, false), 401},
+		{"missing dockerfile", "", mockBuildContext(t, "Dockerfile.other", allowed, false), 401},
+		{"insecure trailing whitespace", "", mockBuildContext(t, "Dockerfile", insecureTrailingSpace, false), 401},
+		{"insecure escape directive", "", mockBuildContext(t, "Dockerfile", insecureEscape, false), 401},
+		{"invalid escape directive", "", mockBuildContext(t, "Dockerfile", invalidEscape, false), 401},
+		{"large dockerfile", "", mockBuildContext(t, "Dockerfile", allowed+strings.Repeat("#\n", 1024), false), 401},
+		{"dockerfile past the scan limit", "", mockBuildContextFiles(t, false, "Assets/large.bin", strings.Repeat("x", 8192), "Dockerfile", allowed), 401},
+		{"dockerfile within the scan limit compressed", "", mockBuildContextFiles(t, true, "Assets/large.bin", strings.Repeat("x", 8192), "Dockerfile", allowed), 200},
+		{"buildkit", "version=2", nil, 401},
+		{"remote", "remote=https://github.com/example/repo.git", nil, 401},
+	}
+
+	defer func(scanSize, dockerfileSize int64) {
+		maxBuildContextScanSize, maxDockerfileSize = scanSize, dockerfileSize
+	}(maxBuildContextScanSize, maxDockerfileSize)
+	maxBuildContextScanSize, maxDockerfileSize = 4096, 1024
+
+	for _, test := range tests {
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(body, test.context) {
+				t.Errorf("%s : Expected build context to be passed upstream unmodified", test.name)
+			}
+		})
+
+		req, err := http.NewRequest("POST", "/v1.37/build?"+test.query, bytes.NewReader(test.context))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.handleBuild(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.esc {
+			t.Errorf("%s : handler returned wrong status code: got %v want %v", test.name, status, test.esc)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package sockguard
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// parseEndpointPattern splits an AllowEndpoints pattern like "GET /containers/*/logs" into its
+// method and path segments
+func parseEndpointPattern(pattern string) (string, []string, error) {
+	fields := strings.Fields(pattern)
+	if len(fields) != 2 || !strings.HasPrefix(fields[1], "/") {
+		return "", nil, fmt.Errorf("Endpoint %q must be a method and a path, e.g. 'GET /containers/*/logs'", pattern)
+	}
+	method := strings.ToUpper(fields[0])
+	if method != "*" && strings.Trim(method, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+		return "", nil, fmt.Errorf("Endpoint %q has an invalid method %q", pattern, fields[0])
+	}
+	return method, strings.Split(strings.Trim(fields[1], "/"), "/"), nil
+}
+
+// matchEndpointSegments matches the segments of a path against those of a pattern, where *
+// matches any one segment and ** any number of them (at least one)
+func matchEndpointSegments(pattern, path []string) bool {
+	for i, segment := range pattern {
+		if segment == "**" {
+			for j := i + 1; j <= len(path); j++ {
+				if matchEndpointSegments(pattern[i+1:], path[j:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if i >= len(path) || (segment != "*" && segment != path[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(path)
+}
+
+// isEndpointAllowed checks a request against AllowEndpoints, if any are set. Pings are always
+// allowed, as clients need them to negotiate the API version.
+func (r *RulesDirector) isEndpointAllowed(req *http.Request) bool {
+	if len(r.AllowEndpoints) == 0 {
+		return true
+	}
+
+	path := strings.Trim(versionRegex.ReplaceAllString(req.URL.Path, ""), "/")
+	if path == "_ping" && (req.Method == "GET" || req.Method == "HEAD") {
+		return true
+	}
+
+	segments := strings.Split(path, "/")
+	for _, pattern := range r.AllowEndpoints {
+		method, patternSegments, err := parseEndpointPattern(pattern)
+		if err != nil {
+			continue
+		}
+		if (method == "*" || method == req.Method) && matchEndpointSegments(patternSegments, segments) {
+			return true
+		}
+	}
+	return false
+}
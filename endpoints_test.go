@@ -0,0 +1,66 @@
+package sockguard
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowEndpoints(t *testing.T) {
+	l := mockLogger()
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	allowEndpoints := []string{
+		"POST /containers/create",
+		"get /containers/*/logs",
+		"* /images/**/json",
+	}
+
+	tests := []struct {
+		method string
+		url    string
+		status int
+	}{
+		{"HEAD", "/_ping", 200},
+		{"GET", "/v1.37/_ping", 200},
+		{"GET", "/v1.37/version", 401},
+		{"GET", "/v1.37/containers/abc/logs", 200},
+		{"GET", "/v1.37/containers/abc/logs/", 200},
+		{"POST", "/v1.37/containers/abc/logs", 401},
+		{"GET", "/v1.37/containers/abc/json", 401},
+		{"GET", "/v1.37/containers/abc/def/logs", 401},
+		{"GET", "/v1.37/images/alpine/json", 200},
+		{"GET", "/v1.37/images/library/alpine/json", 200},
+		{"GET", "/v1.37/images/json", 401},
+		{"DELETE", "/v1.37/images/alpine", 401},
+	}
+
+	for _, test := range tests {
+		r := mockRulesDirector()
+		r.AllowEndpoints = allowEndpoints
+		r.AllowUnowned = map[string]bool{"containers": true}
+
+		req, err := http.NewRequest(test.method, test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		// Allowed endpoints may still fail other checks, but only denied ones get a 401 here
+		if status := rr.Code; (status == 401) != (test.status == 401) {
+			t.Errorf("%s %s : handler returned wrong status code: got %v want %v", test.method, test.url, status, test.status)
+		}
+	}
+}
+
+func TestParseEndpointPattern(t *testing.T) {
+	for _, pattern := range []string{"/containers/json", "GET containers/json", "GET /a /b", "G3T /containers/json"} {
+		if _, _, err := parseEndpointPattern(pattern); err == nil {
+			t.Errorf("%q : expected an error", pattern)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package sockguard
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+
+	"github.com/buildkite/sockguard/dockerapi"
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// handleExecCreate checks the container is owned, and applies the same privileged and user
+// policies as container create to the exec
+func (r *RulesDirector) handleExecCreate(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !r.requireContainerOwner(l, w, req) {
+			return
+		}
+
+		var create dockerapi.ExecCreate
+		if err := decodeJSON(req.Body, &create); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// prevent privileged mode
+		if create.Privileged {
+			l.Printf("Denied privileged on exec create")
+			r.writeDenied(w, req, "Execs aren't allowed to run as privileged")
+			return
+		}
+
+		// force user
+		if r.User != "" {
+			create.User = r.User
+			l.Printf("Forcing exec user to '%s'", r.User)
+		}
+
+		encoded, err := json.Marshal(create)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// reset it so that upstream can read it again
+		req.ContentLength = int64(len(encoded))
+		req.Body = ioutil.NopCloser(bytes.NewReader(encoded))
+
+		upstream.ServeHTTP(w, req)
+	})
+}
+
+var execRegex = regexp.MustCompile(`^/exec/(\w+)/(?:start|resize|json)$`)
+
+// handleExec resolves an exec instance to the container it runs in, and checks that
+// container is owned
+func (r *RulesDirector) handleExec(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		m := execRegex.FindStringSubmatch(versionRegex.ReplaceAllString(req.URL.Path, ""))
+		if m == nil {
+			writeError(w, "Unable to find an exec ID in "+req.URL.Path, http.StatusBadRequest)
+			return
+		}
+
+		var exec struct {
+			ContainerID string
+		}
+		if err := r.getInto(&exec, "/exec/%s/json", m[1]); err == errInspectNotFound {
+			if !r.allowNotFound(l, "Exec") {
+				r.writeDenied(w, req, "Exec not found")
+				return
+			}
+			upstream.ServeHTTP(w, req)
+			return
+		} else if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		l.Printf("Exec %s is in container %s", m[1], exec.ContainerID)
+		if ok, err := r.checkIdentifierOwner(l, "containers", exec.ContainerID, r.allowUnowned("containers", false)); err == errInspectNotFound {
+			if !r.allowNotFound(l, "Container") {
+				r.writeDenied(w, req, "Container not found")
+				return
+			}
+		} else if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if !ok {
+			r.writeDenied(w, req, "Unauthorized access to exec")
+			return
+		}
+
+		upstream.ServeHTTP(w, req)
+	})
+}
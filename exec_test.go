@@ -0,0 +1,123 @@
+package sockguard
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/sockguard/sockguardtest"
+)
+
+func TestHandleExec(t *testing.T) {
+	l := mockLogger()
+
+	// Pre-populated simplified upstream state that "exists" before tests execute.
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"owned": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+			"foreign": sockguardtest.Container{
+				Owner: "adifferentowner",
+			},
+		},
+		Execs: map[string]string{
+			"execinowned":   "owned",
+			"execinforeign": "foreign",
+		},
+	}
+	r := mockRulesDirectorWithUpstreamState(&us)
+
+	tests := map[string]struct {
+		method string
+		esc    int
+	}{
+		"/v1.37/exec/execinowned/start":   {"POST", 200},
+		"/v1.37/exec/execinowned/resize":  {"POST", 200},
+		"/v1.37/exec/execinowned/json":    {"GET", 200},
+		"/v1.37/exec/execinforeign/start": {"POST", 401},
+		"/v1.37/exec/execinforeign/json":  {"GET", 401},
+		"/v1.37/exec/doesnotexist/start":  {"POST", 200},
+		"/v1.37/containers/foreign/exec":  {"POST", 401},
+		"/v1.37/containers/owned/exec":    {"POST", 200},
+	}
+
+	for k, v := range tests {
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// Return empty body, the request is whats important not the response
+		})
+
+		req, err := http.NewRequest(v.method, k, strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != v.esc {
+			t.Errorf("%s %s : handler returned wrong status code: got %v want %v", v.method, k, status, v.esc)
+		}
+	}
+}
+
+func TestHandleExecCreate(t *testing.T) {
+	l := mockLogger()
+
+	// Pre-populated simplified upstream state that "exists" before tests execute.
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"owned": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+			"my-app": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+		},
+	}
+
+	tests := []struct {
+		user     string
+		body     string
+		esc      int
+		expected string
+	}{
+		{"", `{"Cmd":["sh"]}`, 200, `{"Cmd":["sh"]}`},
+		{"", `{"Cmd":["sh"],"Privileged":true}`, 401, ""},
+		{"", `{"Cmd":["sh"],"Privileged":false,"User":"root"}`, 200, `{"Cmd":["sh"],"Privileged":false,"User":"root"}`},
+		{"1000", `{"Cmd":["sh"],"User":"root"}`, 200, `{"Cmd":["sh"],"User":"1000"}`},
+		{"", `{"cmd":["sh"],"privileged":true}`, 401, ""},
+		{"1000", `{"cmd":["sh"],"user":"root"}`, 200, `{"Cmd":["sh"],"User":"1000"}`},
+		{"1000", `{"Cmd":["sh"],"User":"1000","user":"root"}`, 400, ""},
+	}
+
+	// names can have dashes and dots, e.g. docker-compose's proj-web-1
+	for _, container := range []string{"owned", "my-app"} {
+		for _, test := range tests {
+			r := mockRulesDirectorWithUpstreamState(&us)
+			r.User = test.user
+
+			upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				body, err := ioutil.ReadAll(req.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(body) != test.expected {
+					t.Errorf("%s : Expected request body %s, got %s", test.body, test.expected, body)
+				}
+			})
+
+			req, err := http.NewRequest("POST", "/v1.37/containers/"+container+"/exec", strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+			if status := rr.Code; status != test.esc {
+				t.Errorf("%s %s : handler returned wrong status code: got %v want %v", container, test.body, status, test.esc)
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package sockguard
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// Response headers from the daemon that are copied to filtered responses
+var filteredResponseHeaders = []string{"Api-Version", "Docker-Experimental", "Ostype", "Server"}
+
+// isOwnedListEntry returns whether an entry of a list response has our owner label
+func (r *RulesDirector) isOwnedListEntry(entry json.RawMessage) (bool, error) {
+	var decoded struct {
+		Labels map[string]string
+	}
+	if err := unmarshalJSON(entry, &decoded); err != nil {
+		return false, err
+	}
+	return decoded.Labels[ownerKey] == r.Owner, nil
+}
+
+// unprefixListEntry strips our name prefix from the names of an entry of a list response
+func (r *RulesDirector) unprefixListEntry(entry json.RawMessage) (json.RawMessage, error) {
+	var decoded map[string]interface{}
+	if err := unmarshalJSON(entry, &decoded); err != nil {
+		return nil, err
+	}
+	r.unprefixNames(decoded)
+	return json.Marshal(decoded)
+}
+
+// filterListEntries returns the entries of a list response that are owned by us
+func (r *RulesDirector) filterListEntries(l socketproxy.Logger, entries []json.RawMessage) ([]json.RawMessage, error) {
+	filtered := []json.RawMessage{}
+	for _, entry := range entries {
+		owned, err := r.isOwnedListEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		if !owned {
+			continue
+		}
+		if r.PrefixNames {
+			if entry, err = r.unprefixListEntry(entry); err != nil {
+				return nil, err
+			}
+		}
+		filtered = append(filtered, entry)
+	}
+	if removed := len(entries) - len(filtered); removed > 0 {
+		l.Printf("Removed %d unowned entries from list response", removed)
+	}
+	return filtered, nil
+}
+
+// filterListResponse removes entries not owned by us from a list response, for daemons that ignore
+// or partially apply the label filters added to the request, and strips name prefixes. It passes
+// through to upstream unless FilterListResponses or PrefixNames is set.
+func (r *RulesDirector) filterListResponse(l socketproxy.Logger, upstream http.Handler) http.Handler {
+	if !r.FilterListResponses && !r.PrefixNames {
+		return upstream
+	}
+	return r.listResponseFilter(l, "")
+}
+
+// listResponseFilter makes a list request to the daemon itself, removing any entries not owned by
+// us from the response. The entries are the response itself, or under key of a response object
+// (e.g. Volumes).
+func (r *RulesDirector) listResponseFilter(l socketproxy.Logger, key string) http.Handler {
+	return r.responseFilter(l, func(body json.RawMessage) (interface{}, error) {
+		return r.filterListBody(l, body, key)
+	})
+}
+
+// responseFilter makes a request to the daemon itself, passing successful JSON responses through
+// f before returning them to the client. Unsuccessful responses are passed through unchanged.
+func (r *RulesDirector) responseFilter(l socketproxy.Logger, f func(body json.RawMessage) (interface{}, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		filterReq, err := r.newRequest("GET", "http://docker"+req.URL.RequestURI(), nil)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp, err := r.Client.Do(filterReq)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		for _, h := range filteredResponseHeaders {
+			if v := resp.Header.Get(h); v != "" {
+				w.Header().Set(h, v)
+			}
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+			w.WriteHeader(resp.StatusCode)
+			_, _ = io.Copy(w, resp.Body)
+			return
+		}
+
+		var body json.RawMessage
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			writeError(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		filtered, err := f(body)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(filtered)
+	})
+}
+
+// filterListBody filters the entries of a list response body, either the body itself or under key
+// of the body, keeping any other fields of the body
+func (r *RulesDirector) filterListBody(l socketproxy.Logger, body json.RawMessage, key string) (interface{}, error) {
+	if key == "" {
+		var entries []json.RawMessage
+		if err := json.Unmarshal(body, &entries); err != nil {
+			return nil, err
+		}
+		return r.filterListEntries(l, entries)
+	}
+
+	var decoded map[string]json.RawMessage
+	if err := unmarshalJSON(body, &decoded); err != nil {
+		return nil, err
+	}
+	var entries []json.RawMessage
+	if raw, ok := decoded[key]; ok {
+		if err := json.Unmarshal(raw, &entries); err != nil {
+			return nil, err
+		}
+	}
+	filtered, err := r.filterListEntries(l, entries)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(filtered)
+	if err != nil {
+		return nil, err
+	}
+	decoded[key] = encoded
+	return decoded, nil
+}
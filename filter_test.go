@@ -0,0 +1,124 @@
+package sockguard
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFilterListResponse(t *testing.T) {
+	l := mockLogger()
+
+	// The daemon ignores the label filters, and returns everything
+	lists := map[string]string{
+		"/v1.37/containers/json": `[{"Id":"c1","Labels":{"com.buildkite.sockguard.owner":"test-owner"}},{"Id":"c2","Labels":{"com.buildkite.sockguard.owner":"adifferentowner"}},{"Id":"c3","Labels":{}}]`,
+		"/v1.37/images/json":     `[{"Id":"sha256:i1","Labels":null},{"Id":"sha256:i2","Labels":{"com.buildkite.sockguard.owner":"test-owner"}}]`,
+		"/v1.37/networks":        `[{"Id":"n1","Labels":{"com.buildkite.sockguard.owner":"adifferentowner"}}]`,
+	}
+	expected := map[string][]string{
+		"/v1.37/containers/json": []string{"c1"},
+		"/v1.37/images/json":     []string{"sha256:i2"},
+		"/v1.37/networks":        []string{},
+	}
+
+	r := mockRulesDirector()
+	r.FilterListResponses = true
+	r.Client = &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) *http.Response {
+			if !strings.Contains(req.URL.Query().Get("filters"), `com.buildkite.sockguard.owner=test-owner`) {
+				t.Errorf("Expected %s to be filtered by owner, got %q", req.URL.Path, req.URL.RawQuery)
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Api-Version": []string{"1.37"}},
+				Body:       ioutil.NopCloser(bytes.NewBufferString(lists[req.URL.Path])),
+			}
+		}),
+	}
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("%s shouldn't have been passed upstream", req.URL.Path)
+	})
+
+	for path, ids := range expected {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s : handler returned wrong status code: got %v want %v", path, rr.Code, http.StatusOK)
+		}
+		if v := rr.Header().Get("Api-Version"); v != "1.37" {
+			t.Errorf("%s : Expected Api-Version header to be copied, got %q", path, v)
+		}
+
+		var entries []struct {
+			Id string
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&entries); err != nil {
+			t.Fatal(err)
+		}
+		actual := []string{}
+		for _, e := range entries {
+			actual = append(actual, e.Id)
+		}
+		if !reflect.DeepEqual(actual, ids) {
+			t.Errorf("%s : Expected %v, got %v", path, ids, actual)
+		}
+	}
+}
+
+func TestFilterVolumeListResponse(t *testing.T) {
+	l := mockLogger()
+
+	r := mockRulesDirector()
+	r.Client = &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) *http.Response {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     make(http.Header),
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"Volumes":[{"Name":"v1","Labels":{"com.buildkite.sockguard.owner":"test-owner"}},{"Name":"v2","Labels":{"com.buildkite.sockguard.owner":"adifferentowner"}},{"Name":"v3","Labels":null}],"Warnings":["a warning"]}`)),
+			}
+		}),
+	}
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("%s shouldn't have been passed upstream", req.URL.Path)
+	})
+
+	// compose sends filters in the key=value: true format
+	req, err := http.NewRequest("GET", `/v1.37/volumes?filters=%7B%22label%22%3A%7B%22com.docker.compose.project%3Dblah%22%3Atrue%7D%7D`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var decoded struct {
+		Volumes []struct {
+			Name string
+		}
+		Warnings []string
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Volumes) != 1 || decoded.Volumes[0].Name != "v1" {
+		t.Errorf("Expected only v1, got %+v", decoded.Volumes)
+	}
+	if !reflect.DeepEqual(decoded.Warnings, []string{"a warning"}) {
+		t.Errorf("Expected warnings to be kept, got %v", decoded.Warnings)
+	}
+}
@@ -0,0 +1,293 @@
+// Package guard runs a guarded docker socket in process, for supervisors (like the
+// buildkite-agent) that run one per job rather than running the sockguard command:
+//
+//	err := guard.Run(ctx, guard.Config{
+//		Listen:   "/tmp/job-123/docker.sock",
+//		Upstream: "/var/run/docker.sock",
+//		Rules: []sockguard.Option{
+//			sockguard.WithOwner("job-123"),
+//			sockguard.WithAllowBinds([]string{"/tmp/job-123"}),
+//		},
+//		Cleanup: true,
+//	})
+package guard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/buildkite/sockguard"
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+const defaultUpstream = "/var/run/docker.sock"
+
+// Config is the configuration of a guarded socket
+type Config struct {
+	// The path of the guarded socket to create
+	Listen string
+	// The path of the docker socket to guard, defaults to /var/run/docker.sock
+	Upstream string
+	// Options for the RulesDirector that checks requests, see sockguard.NewDirector. The client
+	// defaults to one for Upstream.
+	Rules []sockguard.Option
+
+	// Permissions of the guarded socket, defaults to 0600
+	Mode os.FileMode
+	// The UID and GID to change the owner of the guarded socket to, zero leaves the process's
+	UID, GID int
+
+	// Limits on in-flight requests and load shedding, see socketproxy.SocketProxy
+	MaxRequests          int64
+	MaxStreamingRequests int64
+	ShedLatency          time.Duration
+	// Notified of requests as they're handled, e.g. for metrics
+	Observer socketproxy.Observer
+
+	// Remove owned resources when stopping, forcing removal of running containers and images in
+	// use if CleanupForce is set
+	Cleanup      bool
+	CleanupForce bool
+	// Periodically remove owned resources older than this that aren't in use, every ReapInterval
+	// (defaults to 10 minutes). Zero never reaps.
+	ReapAfter    time.Duration
+	ReapInterval time.Duration
+
+	// Also stop on SIGINT and SIGTERM, as well as when the context is done. On SIGHUP, the socket
+	// is handed off to a new process (the same executable and arguments, e.g. after upgrading it)
+	// that keeps serving it, and Run returns once in-flight requests finish, without cleaning up.
+	HandleSignals bool
+	// Called once the guarded socket is listening, before requests are served
+	Ready func()
+	// Logger for cleanup and reaping, defaults to stderr
+	Logger socketproxy.Logger
+}
+
+// Run serves a guarded socket until ctx is done (or a signal is received, with HandleSignals),
+// then closes it, ending any streams still open, and cleans up if configured. It returns an error
+// if the configuration is invalid, the socket can't be created or serving fails.
+func Run(ctx context.Context, config Config) error {
+	if config.Listen == "" {
+		return fmt.Errorf("A path to listen on is required")
+	}
+	upstream := config.Upstream
+	if upstream == "" {
+		upstream = defaultUpstream
+	}
+	mode := config.Mode
+	if mode == 0 {
+		mode = 0600
+	}
+	l := config.Logger
+	if l == nil {
+		l = log.New(os.Stderr, "sockguard ", log.Ltime|log.Lmicroseconds)
+	}
+
+	rules := append([]sockguard.Option{sockguard.WithClient(&http.Client{Transport: socketproxy.NewTransport(upstream)})}, config.Rules...)
+	// a process handed the socket by an upgrade keeps the owner of the process it replaces
+	if owner := inheritedOwner(); owner != "" {
+		rules = append(rules, sockguard.WithOwner(owner))
+	}
+	director, err := sockguard.NewDirector(rules...)
+	if err != nil {
+		return err
+	}
+
+	proxy := socketproxy.New(upstream, director)
+	// share connections to upstream between proxied requests and internal calls
+	if director.Client.Transport != nil {
+		proxy.Transport = director.Client.Transport
+	}
+	proxy.MaxRequests = config.MaxRequests
+	proxy.MaxStreamingRequests = config.MaxStreamingRequests
+	proxy.ShedLatency = config.ShedLatency
+	proxy.Observer = config.Observer
+
+	listener, err := inheritedListener()
+	if err != nil {
+		return err
+	}
+	if listener != nil {
+		l.Printf("Took over %s from the previous process", listener.Addr())
+	} else if listener, err = listen(config.Listen, mode, config.UID, config.GID); err != nil {
+		return err
+	}
+
+	handoff := make(chan os.Signal, 1)
+	if config.HandleSignals {
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		signal.Notify(handoff, syscall.SIGHUP)
+		defer signal.Stop(handoff)
+	}
+
+	// requests get the context, so streams are ended when it's done. They're counted so that
+	// after a handoff, streams can be drained before exiting.
+	var inFlight sync.WaitGroup
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			inFlight.Add(1)
+			defer inFlight.Done()
+			proxy.ServeHTTP(w, req)
+		}),
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+
+	if config.ReapAfter > 0 {
+		go reap(ctx, l, director, config.ReapAfter, config.ReapInterval)
+	}
+
+	if err := notifyHandedOffReady(); err != nil {
+		l.Printf("Unable to tell the previous process we're ready: %v", err)
+	}
+	if config.Ready != nil {
+		config.Ready()
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	for stopped := false; !stopped; {
+		select {
+		case err := <-serveErr:
+			return err
+		case <-ctx.Done():
+			stopped = true
+		case <-handoff:
+			if err := handOff(l, listener, director.Owner); err != nil {
+				l.Printf("Unable to hand off %s, still serving it: %v", config.Listen, err)
+				continue
+			}
+			return drain(ctx, l, server, listener, &inFlight)
+		}
+	}
+
+	// closing the server removes the socket
+	if err := server.Close(); err != nil {
+		return err
+	}
+
+	if config.Cleanup {
+		if err := director.RemoveOwnedResources(l, config.CleanupForce); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// drain stops accepting connections on a listener that's been handed off, without removing the
+// socket, and waits for in-flight requests (including streams) to finish. Owned resources are
+// left for the new process.
+func drain(ctx context.Context, l socketproxy.Logger, server *http.Server, listener net.Listener, inFlight *sync.WaitGroup) error {
+	if unixListener, ok := listener.(*net.UnixListener); ok {
+		unixListener.SetUnlinkOnClose(false)
+	}
+
+	l.Printf("Draining in-flight requests")
+	if err := server.Shutdown(ctx); err != nil {
+		// ctx is done, which ends the streams still open
+		_ = server.Close()
+	}
+	inFlight.Wait()
+	l.Printf("Drained, exiting")
+	return nil
+}
+
+// listen creates the guarded socket with the given permissions and owner, creating its directory
+// if needed, and replacing a stale socket left behind by a process that crashed
+func listen(path string, mode os.FileMode, uid, gid int) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if uid > 0 || gid > 0 {
+		if err := os.Chown(path, unchangedIfZero(uid), unchangedIfZero(gid)); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// removeStaleSocket removes the socket at path if nothing is listening on it. Other files, and
+// sockets another process is listening on, are left alone and returned as an error.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s already exists and isn't a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("Another process is already listening on %s", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("Unable to tell if %s is stale: %v", path, err)
+	}
+
+	return os.Remove(path)
+}
+
+// unchangedIfZero returns the ID to pass to os.Chown, with -1 leaving it unchanged
+func unchangedIfZero(id int) int {
+	if id == 0 {
+		return -1
+	}
+	return id
+}
+
+// reap removes old owned resources every interval until ctx is done
+func reap(ctx context.Context, l socketproxy.Logger, director *sockguard.RulesDirector, olderThan, interval time.Duration) {
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := director.ReapOwnedResources(l, olderThan); err != nil {
+				l.Printf("Error reaping: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
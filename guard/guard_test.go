@@ -0,0 +1,158 @@
+package guard
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/sockguard"
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sockguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstreamPath, listenPath := filepath.Join(dir, "docker.sock"), filepath.Join(dir, "guarded.sock")
+
+	ln, err := net.Listen("unix", upstreamPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("OK"))
+		}),
+	}
+	go upstream.Serve(ln)
+	defer upstream.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ready, done := make(chan struct{}), make(chan error)
+	go func() {
+		done <- Run(ctx, Config{
+			Listen:   listenPath,
+			Upstream: upstreamPath,
+			Rules:    []sockguard.Option{sockguard.WithOwner("test-owner")},
+			Mode:     0660,
+			Ready: func() {
+				close(ready)
+			},
+		})
+	}()
+
+	select {
+	case <-ready:
+	case err := <-done:
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(listenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0660 {
+		t.Errorf("Expected socket permissions 0660, got %v", info.Mode().Perm())
+	}
+
+	client := &http.Client{Transport: socketproxy.NewTransport(listenPath)}
+	resp, err := client.Get("http://docker/v1.37/_ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "OK" {
+		t.Errorf("Unexpected response %s %q", resp.Status, body)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Run to return when the context is done")
+	}
+
+	if _, err := os.Stat(listenPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket to be removed, got %v", err)
+	}
+}
+
+func TestRunInvalidConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sockguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	listenPath := filepath.Join(dir, "guarded.sock")
+
+	for name, config := range map[string]Config{
+		"no listen path": {Rules: []sockguard.Option{sockguard.WithOwner("test-owner")}},
+		"no owner":       {Listen: listenPath},
+	} {
+		if err := Run(context.Background(), config); err == nil {
+			t.Errorf("%s : expected an error", name)
+		}
+	}
+
+	if _, err := os.Stat(listenPath); !os.IsNotExist(err) {
+		t.Errorf("Expected no socket to be created, got %v", err)
+	}
+}
+
+func TestListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sockguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// missing directories are created
+	path := filepath.Join(dir, "job-123", "docker.sock")
+	ln, err := listen(path, 0600, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a socket something is listening on isn't replaced
+	if _, err := listen(path, 0600, 0, 0); err == nil || !strings.Contains(err.Error(), "already listening") {
+		t.Errorf("Expected an error listening on a live socket, got %v", err)
+	}
+
+	// a socket left behind by a crashed process is
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected a stale socket, got %v", err)
+	}
+	ln, err = listen(path, 0600, 0, 0)
+	if err != nil {
+		t.Fatalf("Expected the stale socket to be replaced, got %v", err)
+	}
+	ln.Close()
+
+	// other files aren't
+	filePath := filepath.Join(dir, "not-a-socket")
+	if err := ioutil.WriteFile(filePath, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen(filePath, 0600, 0, 0); err == nil {
+		t.Error("Expected an error listening on a regular file")
+	}
+	if _, err := os.Stat(filePath); err != nil {
+		t.Errorf("Expected the file to be left alone, got %v", err)
+	}
+}
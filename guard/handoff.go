@@ -0,0 +1,150 @@
+package guard
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// Environment variables a process started by handOff finds what it's handed in
+const (
+	listenerFDEnv = "SOCKGUARD_LISTENER_FD"
+	readyFDEnv    = "SOCKGUARD_READY_FD"
+	ownerEnv      = "SOCKGUARD_HANDOFF_OWNER"
+)
+
+// How long a new process has to start serving before a handoff is abandoned
+var handoffTimeout = 30 * time.Second
+
+// handOff starts a new sockguard process (the current executable, with the same arguments) that
+// takes over listener, and waits for it to be ready. The new process inherits the owner, so it
+// can access resources created before the handoff. If it fails to start, this process carries on.
+func handOff(l socketproxy.Logger, listener net.Listener, owner string) error {
+	unixListener, ok := listener.(*net.UnixListener)
+	if !ok {
+		return fmt.Errorf("Can't hand off a %T", listener)
+	}
+	listenerFile, err := unixListener.File()
+	if err != nil {
+		return err
+	}
+	defer listenerFile.Close()
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyReader.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		readyWriter.Close()
+		return err
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// ExtraFiles start at fd 3
+	cmd.ExtraFiles = []*os.File{listenerFile, readyWriter}
+	cmd.Env = append(os.Environ(), listenerFDEnv+"=3", readyFDEnv+"=4", ownerEnv+"="+owner)
+
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	// the new process writes to the pipe once it's ready, it's closed without a write if it exits first
+	ready := make(chan error, 1)
+	go func() {
+		n, _ := readyReader.Read(make([]byte, 1))
+		if n == 0 {
+			ready <- errors.New("New process exited before it was ready")
+			return
+		}
+		ready <- nil
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			_ = cmd.Wait()
+			return err
+		}
+	case <-time.After(handoffTimeout):
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("New process wasn't ready within %v", handoffTimeout)
+	}
+
+	l.Printf("Handed off %s to process %d", listener.Addr(), cmd.Process.Pid)
+	return cmd.Process.Release()
+}
+
+// inheritedListener returns the listener handed off by a previous process, or nil if there isn't
+// one. The socket is removed when it's closed, as if this process had created it.
+func inheritedListener() (net.Listener, error) {
+	env := os.Getenv(listenerFDEnv)
+	if env == "" {
+		return nil, nil
+	}
+	// so processes we start don't think they've been handed it too
+	os.Unsetenv(listenerFDEnv)
+
+	fd, err := strconv.Atoi(env)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid $%s %q: %v", listenerFDEnv, env, err)
+	}
+	file := os.NewFile(uintptr(fd), "inherited listener")
+	defer file.Close()
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, err
+	}
+	unixListener, ok := listener.(*net.UnixListener)
+	if !ok {
+		listener.Close()
+		return nil, fmt.Errorf("Inherited listener is a %T, not a unix socket", listener)
+	}
+	unixListener.SetUnlinkOnClose(true)
+	return unixListener, nil
+}
+
+// inheritedOwner returns the owner of the previous process that handed off its listener, if any.
+// The owner is only taken with the listener (so before inheritedListener), rather than from an
+// environment that happens to set it.
+func inheritedOwner() string {
+	owner := os.Getenv(ownerEnv)
+	os.Unsetenv(ownerEnv)
+	if os.Getenv(listenerFDEnv) == "" {
+		return ""
+	}
+	return owner
+}
+
+// notifyHandedOffReady tells the previous process that handed off its listener, if any, that
+// this process is ready to serve
+func notifyHandedOffReady() error {
+	env := os.Getenv(readyFDEnv)
+	if env == "" {
+		return nil
+	}
+	os.Unsetenv(readyFDEnv)
+
+	fd, err := strconv.Atoi(env)
+	if err != nil {
+		return fmt.Errorf("Invalid $%s %q: %v", readyFDEnv, env, err)
+	}
+	file := os.NewFile(uintptr(fd), "handoff ready")
+	defer file.Close()
+	_, err = file.Write([]byte{1})
+	return err
+}
@@ -0,0 +1,139 @@
+//go:build !windows
+// +build !windows
+
+package guard
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/buildkite/sockguard"
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+func TestRunInheritedListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sockguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstreamPath, listenPath := filepath.Join(dir, "docker.sock"), filepath.Join(dir, "guarded.sock")
+
+	ln, err := net.Listen("unix", upstreamPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := make(chan map[string]string, 1)
+	upstream := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var create struct {
+				Labels map[string]string
+			}
+			_ = json.NewDecoder(req.Body).Decode(&create)
+			labels <- create.Labels
+			w.Write([]byte("{}"))
+		}),
+	}
+	go upstream.Serve(ln)
+	defer upstream.Close()
+
+	// the socket a previous process listened on and handed off
+	previous, err := net.Listen("unix", listenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous.(*net.UnixListener).SetUnlinkOnClose(false)
+	file, err := previous.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Run takes ownership of the fd it's handed, so hand it a copy
+	fd, err := syscall.Dup(int(file.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	previous.Close()
+
+	os.Setenv(listenerFDEnv, strconv.Itoa(fd))
+	os.Setenv(ownerEnv, "previous-owner")
+	defer os.Unsetenv(listenerFDEnv)
+	defer os.Unsetenv(ownerEnv)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ready, done := make(chan struct{}), make(chan error)
+	go func() {
+		done <- Run(ctx, Config{
+			Listen:   listenPath,
+			Upstream: upstreamPath,
+			Rules:    []sockguard.Option{sockguard.WithOwner("pid-owner")},
+			Ready: func() {
+				close(ready)
+			},
+		})
+	}()
+
+	select {
+	case <-ready:
+	case err := <-done:
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: socketproxy.NewTransport(listenPath)}
+	resp, err := client.Post("http://docker/v1.37/containers/create", "application/json", strings.NewReader(`{"Image":"alpine","Labels":{}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected response %s", resp.Status)
+	}
+	if owner := (<-labels)["com.buildkite.sockguard.owner"]; owner != "previous-owner" {
+		t.Errorf("Expected the owner of the previous process, got %q", owner)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Run to return when the context is done")
+	}
+
+	if _, err := os.Stat(listenPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the inherited socket to be removed, got %v", err)
+	}
+}
+
+func TestInheritedOwnerRequiresListener(t *testing.T) {
+	os.Setenv(ownerEnv, "previous-owner")
+	defer os.Unsetenv(ownerEnv)
+
+	if owner := inheritedOwner(); owner != "" {
+		t.Errorf("Expected the owner to be ignored without a handed off listener, got %q", owner)
+	}
+
+	os.Setenv(ownerEnv, "previous-owner")
+	os.Setenv(listenerFDEnv, "3")
+	defer os.Unsetenv(listenerFDEnv)
+
+	if owner := inheritedOwner(); owner != "previous-owner" {
+		t.Errorf("Expected the owner handed off with the listener, got %q", owner)
+	}
+	if env := os.Getenv(ownerEnv); env != "" {
+		t.Errorf("Expected $%s to be unset, got %q", ownerEnv, env)
+	}
+}
@@ -0,0 +1,177 @@
+package sockguard
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// imageArchiveManifest is an entry in the manifest.json of a docker save archive
+type imageArchiveManifest struct {
+	Config   string
+	RepoTags []string
+}
+
+// archivedImage is an image in a docker save archive, with its tags
+type archivedImage struct {
+	ID   string
+	Tags []string
+}
+
+// readImageArchiveManifest reads the manifest.json from a docker save archive, returning
+// the images it contains
+func readImageArchiveManifest(r io.Reader) ([]archivedImage, error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("No manifest.json found in image archive")
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr.Name != "manifest.json" {
+			continue
+		}
+
+		var manifest []imageArchiveManifest
+		if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+			return nil, err
+		}
+
+		var images []archivedImage
+		for _, m := range manifest {
+			// Config is either <id>.json or blobs/sha256/<id>
+			id := strings.TrimSuffix(m.Config, ".json")
+			if idx := strings.LastIndex(id, "/"); idx >= 0 {
+				id = id[idx+1:]
+			}
+			image := archivedImage{ID: "sha256:" + id}
+			for _, tag := range m.RepoTags {
+				image.Tags = append(image.Tags, taggedImageReference(tag))
+			}
+			images = append(images, image)
+		}
+		return images, nil
+	}
+}
+
+// loadedImageRegex matches the lines of a load response for each image loaded, by tag or by ID
+// for untagged images
+var loadedImageRegex = regexp.MustCompile(`^Loaded image( ID)?: (\S+)$`)
+
+// readLoadedImage returns the tag or ID of the image a line of a load response reports as loaded,
+// if any. The lines are usually JSON messages, but plain text is accepted too.
+func readLoadedImage(line []byte) string {
+	var message struct {
+		Stream string
+	}
+	text := string(line)
+	if err := json.Unmarshal(line, &message); err == nil {
+		text = message.Stream
+	}
+	m := loadedImageRegex.FindStringSubmatch(strings.TrimSpace(text))
+	if m == nil {
+		return ""
+	}
+	if m[1] != "" {
+		return m[2]
+	}
+	return taggedImageReference(m[2])
+}
+
+func (r *RulesDirector) handleImageLoad(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Read the manifest out of the archive as it's streamed upstream
+		pr, pw := io.Pipe()
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(req.Body, pw), req.Body}
+
+		type result struct {
+			images []archivedImage
+			err    error
+		}
+		done := make(chan result)
+		go func() {
+			images, err := readImageArchiveManifest(pr)
+			// Keep draining so the upstream copy never blocks on us
+			_, _ = io.Copy(ioutil.Discard, pr)
+			done <- result{images, err}
+		}()
+
+		// The response reports which images were loaded, so the request is made here
+		resp, err := r.doUpstream(req)
+		if err != nil {
+			_ = pw.Close()
+			<-done
+			writeError(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		// The daemon responds as it loads, so the archive has only been read once it's done
+		loaded := map[string]bool{}
+		relayResponse(w, resp, func(line []byte) {
+			if image := readLoadedImage(line); image != "" {
+				loaded[image] = true
+			}
+		})
+		_ = pw.Close()
+		res := <-done
+
+		if resp.StatusCode/100 != 2 {
+			return
+		}
+		if res.err != nil {
+			l.Printf("Unable to read loaded images from archive: %s", res.err.Error())
+			return
+		}
+
+		// Only the images in the archive the daemon loaded are owned, an image loaded by tag is
+		// owned by ID too
+		var owned []string
+		for _, image := range res.images {
+			var tags []string
+			for _, tag := range image.Tags {
+				if loaded[tag] {
+					tags = append(tags, tag)
+				}
+			}
+			if len(tags) > 0 || loaded[image.ID] {
+				owned = append(owned, image.ID)
+				owned = append(owned, tags...)
+			}
+		}
+
+		l.Printf("Recording loaded images %v as owned by %q", owned, r.Owner)
+		r.recordOwnedImages(owned)
+	})
+}
+
+func (r *RulesDirector) handleImageGet(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, name := range req.URL.Query()["names"] {
+			ok, err := r.checkIdentifierOwner(l, "images", name, r.allowUnowned("images", true))
+			if err == errInspectNotFound {
+				// the daemon will return the appropriate error
+				continue
+			} else if err != nil {
+				writeError(w, err.Error(), http.StatusInternalServerError)
+				return
+			} else if !ok {
+				r.writeDenied(w, req, fmt.Sprintf("Unauthorized access to image %q", name))
+				return
+			}
+		}
+
+		upstream.ServeHTTP(w, req)
+	})
+}
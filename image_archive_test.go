@@ -0,0 +1,379 @@
+package sockguard
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/sockguard/sockguardtest"
+)
+
+// mockImageArchive builds a minimal docker save style archive
+func mockImageArchive(t *testing.T, manifest string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	files := []struct {
+		name, body string
+	}{
+		{"e2e8b7e7b9f1.json", `{}`},
+		{"manifest.json", manifest},
+	}
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.body))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestHandleImageLoad(t *testing.T) {
+	l := mockLogger()
+
+	// Pre-populated simplified upstream state that "exists" before tests execute.
+	us := sockguardtest.State{
+		Images: map[string]sockguardtest.Image{
+			// An image that was saved from another owners build, then loaded by us
+			"loaded": sockguardtest.Image{
+				Owner: "adifferentowner",
+			},
+			"notloaded": sockguardtest.Image{
+				Owner: "adifferentowner",
+			},
+			"skipped": sockguardtest.Image{
+				Owner: "adifferentowner",
+			},
+		},
+	}
+
+	// The daemon only reports the first image as loaded, e.g. as the second failed
+	archive := mockImageArchive(t, `[{"Config":"e2e8b7e7b9f1.json","RepoTags":["loaded:latest"],"Layers":[]},{"Config":"0123456789ab.json","RepoTags":["skipped:latest"],"Layers":[]}]`)
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, archive) {
+			t.Errorf("Expected archive to be passed upstream unmodified")
+		}
+		fmt.Fprintf(w, "{\"stream\":\"Loaded image: loaded:latest\\n\"}\n")
+		fmt.Fprintf(w, "{\"errorDetail\":{\"message\":\"failed to load skipped:latest\"}}\n")
+	})
+
+	r := mockRulesDirectorWithUpstreamState(&us)
+	r.Client = mockClientWithUpstream(&us, upstream)
+
+	req, err := http.NewRequest("POST", "/v1.37/images/load", bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	r.handleImageLoad(l, req, http.NotFoundHandler()).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if !strings.Contains(rr.Body.String(), "Loaded image: loaded:latest") {
+		t.Errorf("Expected the load response to be relayed, got %s", rr.Body.String())
+	}
+
+	tests := map[string]bool{
+		"loaded":                   true,
+		"docker.io/library/loaded": true,
+		"e2e8b7e7b9f1":             true,
+		"sha256:e2e8b7e7b9f1":      true,
+		"notloaded":                false,
+		"skipped":                  false,
+		"0123456789ab":             false,
+	}
+	for k, v := range tests {
+		ok, err := r.checkIdentifierOwner(l, "images", k, false)
+		if err != nil && err != errInspectNotFound {
+			t.Errorf("%s : Error - %s", k, err.Error())
+		}
+		if ok != v {
+			t.Errorf("%s : Expected %t, got %t", k, v, ok)
+		}
+	}
+}
+
+func TestHandleImageLoadFailed(t *testing.T) {
+	l := mockLogger()
+
+	archive := mockImageArchive(t, `[{"Config":"e2e8b7e7b9f1.json","RepoTags":["loaded:latest"],"Layers":[]}]`)
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = ioutil.ReadAll(req.Body)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "{\"message\":\"Loaded image: loaded:latest\"}\n")
+	})
+
+	us := sockguardtest.State{}
+	r := mockRulesDirectorWithUpstreamState(&us)
+	r.Client = mockClientWithUpstream(&us, upstream)
+
+	req, err := http.NewRequest("POST", "/v1.37/images/load", bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	r.handleImageLoad(l, req, http.NotFoundHandler()).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusInternalServerError)
+	}
+	if r.isOwnedImage("loaded") || r.isOwnedImage("e2e8b7e7b9f1") {
+		t.Errorf("Expected images of a failed load not to be owned")
+	}
+}
+
+func TestReadLoadedImage(t *testing.T) {
+	tests := map[string]string{
+		`{"stream":"Loaded image: alpine:3.8\n"}`:             "docker.io/library/alpine:3.8",
+		`{"stream":"Loaded image ID: sha256:e2e8b7e7b9f1\n"}`: "sha256:e2e8b7e7b9f1",
+		"Loaded image: registry.example.com/app:1.0\n":        "registry.example.com/app:1.0",
+		`{"status":"Loading layer","progress":"[===>  ]"}`:    "",
+		`{"stream":"Not Loaded image: alpine\n"}`:             "",
+	}
+	for line, expected := range tests {
+		if image := readLoadedImage([]byte(line)); image != expected {
+			t.Errorf("%s : Expected %q, got %q", line, expected, image)
+		}
+	}
+}
+
+func TestHandleImageGet(t *testing.T) {
+	l := mockLogger()
+
+	// Pre-populated simplified upstream state that "exists" before tests execute.
+	us := sockguardtest.State{
+		Images: map[string]sockguardtest.Image{
+			"owned": sockguardtest.Image{
+				Owner: "test-owner",
+			},
+			"unowned": sockguardtest.Image{},
+			"foreign": sockguardtest.Image{
+				Owner: "adifferentowner",
+			},
+		},
+	}
+	r := mockRulesDirectorWithUpstreamState(&us)
+
+	tests := map[string]int{
+		"/v1.37/images/get?names=owned":               200,
+		"/v1.37/images/get?names=owned&names=unowned": 200,
+		"/v1.37/images/get?names=owned&names=foreign": 401,
+		"/v1.37/images/get?names=foreign":             401,
+		"/v1.37/images/get?names=doesnotexist":        200,
+	}
+
+	for k, v := range tests {
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// Return empty body, the request is whats important not the response
+		})
+
+		req, err := http.NewRequest("GET", k, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.handleImageGet(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != v {
+			t.Errorf("%s : handler returned wrong status code: got %v want %v", k, status, v)
+		}
+	}
+}
+
+func TestHandleImageTag(t *testing.T) {
+	l := mockLogger()
+
+	// Pre-populated simplified upstream state that "exists" before tests execute.
+	us := sockguardtest.State{
+		Images: map[string]sockguardtest.Image{
+			"owned": sockguardtest.Image{
+				Owner: "test-owner",
+			},
+			"loaded": sockguardtest.Image{
+				Owner: "adifferentowner",
+			},
+			"foreign": sockguardtest.Image{
+				Owner: "adifferentowner",
+			},
+			"unowned": sockguardtest.Image{},
+		},
+	}
+
+	// "Tag" an image, failing for the failedtag repo
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("repo") == "failedtag" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	r := mockRulesDirectorWithUpstreamState(&us)
+	r.Client = mockClientWithUpstream(&us, upstream)
+	r.recordOwnedImages([]string{taggedImageReference("loaded")})
+
+	tests := map[string]int{
+		"/v1.37/images/owned/tag?repo=newtag&tag=1.0":   201,
+		"/v1.37/images/loaded/tag?repo=loadedtag":       201,
+		"/v1.37/images/loaded/tag?repo=failedtag":       500,
+		"/v1.37/images/foreign/tag?repo=stolentag":      401,
+		"/v1.37/images/owned/tag?repo=foreign&tag=":     401,
+		"/v1.37/images/owned/tag?repo=unowned":          401,
+		"/v1.37/images/owned/tag?repo=foreign&tag=next": 201,
+	}
+
+	for k, v := range tests {
+		req, err := http.NewRequest("POST", k, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.handleImageTag(l, req, http.NotFoundHandler()).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != v {
+			t.Errorf("%s : handler returned wrong status code: got %v want %v", k, status, v)
+		}
+	}
+
+	// The tag of the loaded image should now be owned, but not the tag of the labelled image, or
+	// a tag that failed
+	if !r.isOwnedImage("loadedtag:latest") {
+		t.Errorf("Expected tag of loaded image to be owned")
+	}
+	if r.isOwnedImage("newtag:1.0") {
+		t.Errorf("Expected tag of labelled image not to be tracked")
+	}
+	if r.isOwnedImage("failedtag:latest") {
+		t.Errorf("Expected failed tag not to be tracked")
+	}
+}
+
+// mockImageID returns a fake image ID for a reference
+func mockImageID(ref string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(ref)))
+}
+
+func TestHandleCommit(t *testing.T) {
+	l := mockLogger()
+
+	// Pre-populated simplified upstream state that "exists" before tests execute.
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"owned": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+			"foreign": sockguardtest.Container{
+				Owner: "adifferentowner",
+			},
+		},
+		Images: map[string]sockguardtest.Image{
+			"foreigntag": sockguardtest.Image{
+				Owner: "adifferentowner",
+			},
+			"unownedtag": sockguardtest.Image{},
+			"ownedtag": sockguardtest.Image{
+				Owner: "test-owner",
+			},
+		},
+	}
+
+	// "Commit" an image with the labels of the request body
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var config struct {
+			Labels map[string]string
+		}
+		if err := json.NewDecoder(req.Body).Decode(&config); err != nil {
+			t.Fatal(err)
+		}
+		if owner := config.Labels[sockguardtest.OwnerLabel]; owner != "test-owner" {
+			t.Errorf("Expected the owner label to be added to the config, got %v", config.Labels)
+		}
+
+		ref := req.URL.Query().Get("repo")
+		if tag := req.URL.Query().Get("tag"); tag != "" {
+			ref += ":" + tag
+		}
+		if ref == "fails" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// LABEL changes are applied after the config, with escapes removed
+		owner := config.Labels[sockguardtest.OwnerLabel]
+		for _, change := range req.URL.Query()["changes"] {
+			if label := strings.Replace(change, `\`, "", -1); strings.HasPrefix(label, "LABEL "+sockguardtest.OwnerLabel+"=") {
+				owner = strings.TrimPrefix(label, "LABEL "+sockguardtest.OwnerLabel+"=")
+			}
+		}
+
+		_ = us.DeleteImage(ref)
+		if err := us.CreateImage(ref, owner); err != nil {
+			t.Fatal(err)
+		}
+		if err := us.CreateImage(mockImageID(ref), owner); err != nil {
+			t.Fatal(err)
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"Id":%q}`, mockImageID(ref))
+	})
+
+	r := mockRulesDirectorWithUpstreamState(&us)
+	r.Client = mockClientWithUpstream(&us, upstream)
+
+	tests := map[string]int{
+		"/v1.37/commit?container=owned&repo=committed&tag=1.0":                                              201,
+		"/v1.37/commit?container=owned&repo=ownedtag":                                                       201,
+		"/v1.37/commit?container=owned&repo=fails":                                                          500,
+		"/v1.37/commit?container=foreign&repo=stolen":                                                       401,
+		"/v1.37/commit?container=missing&repo=missing":                                                      401,
+		"/v1.37/commit?container=owned&repo=foreigntag":                                                     401,
+		"/v1.37/commit?container=owned&repo=unownedtag":                                                     401,
+		"/v1.37/commit?container=owned&repo=relabelled&changes=LABEL+com.buildkite.sockguard.owner%3Dother": 401,
+		"/v1.37/commit?container=owned&repo=escaped&changes=LABEL+com.buildkite.sockguard%5C.owner%3Dother": 401,
+	}
+
+	for k, v := range tests {
+		req, err := http.NewRequest("POST", k, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.handleCommit(l, req, http.NotFoundHandler()).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != v {
+			t.Errorf("%s : handler returned wrong status code: got %v want %v", k, status, v)
+		}
+	}
+
+	// The committed image should be tracked by the ID the daemon returned, but not failed commits
+	if !r.isOwnedImage(mockImageID("committed:1.0")) {
+		t.Errorf("Expected committed image to be owned")
+	}
+	if r.isOwnedImage(mockImageID("fails")) {
+		t.Errorf("Expected failed commit not to be tracked")
+	}
+	if us.ImageExists(mockImageID("escaped")) || r.isOwnedImage(mockImageID("escaped")) {
+		t.Errorf("Expected image committed with a changed owner label to be removed")
+	}
+	if r.isOwnedImage(mockImageID("foreigntag")) {
+		t.Errorf("Expected foreign tag not to be committed over")
+	}
+}
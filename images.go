@@ -0,0 +1,742 @@
+package sockguard
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+const (
+	defaultImageDomain = "docker.io"
+	officialImagesPath = "library"
+)
+
+// imageReference is a parsed image reference, e.g. registry.example.com/team/app:1.0
+type imageReference struct {
+	Domain string
+	Path   string
+	Tag    string
+	Digest string
+}
+
+// parseImageReference splits an image reference into its parts, normalizing it the
+// same way the docker daemon does (alpine:3.8 => docker.io/library/alpine:3.8)
+func parseImageReference(ref string) imageReference {
+	var i imageReference
+
+	if idx := strings.Index(ref, "@"); idx >= 0 {
+		ref, i.Digest = ref[:idx], ref[idx+1:]
+	}
+	if idx := strings.LastIndex(ref, ":"); idx >= 0 && !strings.Contains(ref[idx:], "/") {
+		ref, i.Tag = ref[:idx], ref[idx+1:]
+	}
+
+	chunks := strings.SplitN(ref, "/", 2)
+	if len(chunks) == 2 && (strings.ContainsAny(chunks[0], ".:") || chunks[0] == "localhost") {
+		i.Domain, i.Path = chunks[0], chunks[1]
+	} else {
+		i.Domain, i.Path = defaultImageDomain, ref
+	}
+	if i.Domain == "index.docker.io" {
+		i.Domain = defaultImageDomain
+	}
+	if i.Domain == defaultImageDomain && !strings.Contains(i.Path, "/") {
+		i.Path = officialImagesPath + "/" + i.Path
+	}
+
+	return i
+}
+
+// Name returns the fully qualified repository name, without any tag or digest
+func (i imageReference) Name() string {
+	return i.Domain + "/" + i.Path
+}
+
+func (i imageReference) String() string {
+	s := i.Name()
+	if i.Tag != "" {
+		s += ":" + i.Tag
+	}
+	if i.Digest != "" {
+		s += "@" + i.Digest
+	}
+	return s
+}
+
+// matchImagePattern matches a fully qualified repository name against a pattern, where
+// * matches any sequence of characters (including /)
+func matchImagePattern(pattern, name string) bool {
+	re := "^" + strings.Replace(regexp.QuoteMeta(pattern), `\*`, `.*`, -1) + "$"
+	return regexp.MustCompile(re).MatchString(name)
+}
+
+// isImageAllowed checks an image reference against AllowImages, if any are set. Image IDs are
+// resolved to the repositories they're tagged in, one of which must be allowed.
+func (r *RulesDirector) isImageAllowed(l socketproxy.Logger, ref string) (bool, error) {
+	if len(r.AllowImages) == 0 {
+		return true, nil
+	}
+
+	if !isImageID(ref) {
+		return r.matchAllowedImages(l, ref), nil
+	}
+
+	var image struct {
+		RepoTags []string
+	}
+	if err := r.getInto(&image, "/images/%s/json", ref); err == errInspectNotFound {
+		l.Printf("Deny, image %q not found to check against allowed patterns", ref)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	for _, tag := range image.RepoTags {
+		if r.matchAllowedImages(l, tag) {
+			return true, nil
+		}
+	}
+
+	l.Printf("Deny, image %q has no tags matching allowed patterns %v", ref, r.AllowImages)
+	return false, nil
+}
+
+// matchAllowedImages matches an image reference against AllowImages
+func (r *RulesDirector) matchAllowedImages(l socketproxy.Logger, ref string) bool {
+	name := parseImageReference(ref).Name()
+	for _, pattern := range r.AllowImages {
+		if matchImagePattern(pattern, name) {
+			l.Printf("Allow, image %q matches allowed pattern %q", name, pattern)
+			return true
+		}
+	}
+
+	l.Printf("Deny, image %q doesn't match any allowed patterns %v", name, r.AllowImages)
+	return false
+}
+
+var imageIDRegex = regexp.MustCompile(`^(sha256:)?[a-f0-9]{12,64}$`)
+
+// isImageID returns whether ref is an image ID rather than a repository reference
+func isImageID(ref string) bool {
+	return imageIDRegex.MatchString(ref)
+}
+
+// checkImagePinning returns an error if ref isn't pinned as required by RequireImageDigest
+// or DenyLatestImageTag
+func (r *RulesDirector) checkImagePinning(ref string) error {
+	if isImageID(ref) {
+		return nil
+	}
+
+	parsed := parseImageReference(ref)
+	if parsed.Digest != "" {
+		return nil
+	}
+	if r.RequireImageDigest {
+		return fmt.Errorf("Image %q must be referenced by digest (e.g. %s@sha256:...)", ref, parsed.Name())
+	}
+	if r.DenyLatestImageTag && (parsed.Tag == "" || parsed.Tag == "latest") {
+		return fmt.Errorf("Image %q must be referenced by a tag other than latest, or by digest", ref)
+	}
+
+	return nil
+}
+
+// recordOwnedImages records images as owned by us, for images that can't be labelled
+// (e.g. loaded images, or tags of them)
+func (r *RulesDirector) recordOwnedImages(images []string) {
+	s := r.lockState()
+	defer s.mu.Unlock()
+
+	for _, image := range images {
+		s.ownedImages[image] = true
+	}
+}
+
+// isOwnedImage returns whether identifier refers to an image recorded by recordOwnedImages,
+// either by name, full ID or short ID
+func (r *RulesDirector) isOwnedImage(identifier string) bool {
+	s := r.lockState()
+	defer s.mu.Unlock()
+
+	if isImageID(identifier) {
+		for image := range s.ownedImages {
+			if strings.HasPrefix(image, "sha256:"+strings.TrimPrefix(identifier, "sha256:")) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return s.ownedImages[taggedImageReference(identifier)]
+}
+
+// ownedImageRefs returns the images recorded by recordOwnedImages, tags before IDs so an image's
+// tags are removed before it is
+func (r *RulesDirector) ownedImageRefs() []string {
+	s := r.lockState()
+	defer s.mu.Unlock()
+
+	var tags, ids []string
+	for image := range s.ownedImages {
+		if strings.HasPrefix(image, "sha256:") {
+			ids = append(ids, image)
+		} else {
+			tags = append(tags, image)
+		}
+	}
+	sort.Strings(tags)
+	sort.Strings(ids)
+	return append(tags, ids...)
+}
+
+// taggedImageReference normalizes ref, defaulting to the latest tag like the daemon does
+func taggedImageReference(ref string) string {
+	parsed := parseImageReference(ref)
+	if parsed.Tag == "" && parsed.Digest == "" {
+		parsed.Tag = "latest"
+	}
+	return parsed.String()
+}
+
+// isPlatformAllowed checks a requested platform (e.g. linux/arm64/v8) against AllowPlatforms,
+// if any are set. An empty platform is the daemons native platform, so is always allowed.
+func (r *RulesDirector) isPlatformAllowed(platform string) bool {
+	if platform == "" || len(r.AllowPlatforms) == 0 {
+		return true
+	}
+	platform = strings.ToLower(platform)
+	for _, allowed := range r.AllowPlatforms {
+		if pathHasPrefix(platform, strings.ToLower(allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// imageCreateReference returns the image reference being pulled by /images/create, combining
+// the fromImage and tag query parameters
+func imageCreateReference(req *http.Request) string {
+	q := req.URL.Query()
+	ref := q.Get("fromImage")
+	if ref == "" {
+		return ""
+	}
+
+	parsed := parseImageReference(ref)
+	if tag := q.Get("tag"); tag != "" && parsed.Tag == "" && parsed.Digest == "" {
+		if strings.HasPrefix(tag, "sha256:") {
+			ref += "@" + tag
+		} else {
+			ref += ":" + tag
+		}
+	}
+
+	return ref
+}
+
+// ImageRewrite rewrites image references matching From to To when they are pulled, where
+// each * in From matches any sequence of characters, and is substituted into the
+// corresponding * in To (e.g. docker.io/* => mirror.example.com/*)
+type ImageRewrite struct {
+	From string
+	To   string
+}
+
+// ParseImageRewrite parses an ImageRewrite from a from=to string
+func ParseImageRewrite(s string) (ImageRewrite, error) {
+	chunks := strings.Split(s, "=")
+	if len(chunks) != 2 || chunks[0] == "" || chunks[1] == "" {
+		return ImageRewrite{}, fmt.Errorf("Unable to parse image rewrite %q, expected from=to", s)
+	}
+	if strings.Count(chunks[0], "*") != strings.Count(chunks[1], "*") {
+		return ImageRewrite{}, fmt.Errorf("Unable to parse image rewrite %q, expected the same number of * in from and to", s)
+	}
+	return ImageRewrite{From: chunks[0], To: chunks[1]}, nil
+}
+
+// rewriteImage applies the first matching ImageRewrite to ref, keeping any tag or digest
+func (r *RulesDirector) rewriteImage(ref string) (string, bool) {
+	parsed := parseImageReference(ref)
+	name := parsed.Name()
+
+	for _, rewrite := range r.ImageRewrites {
+		re := "^" + strings.Replace(regexp.QuoteMeta(rewrite.From), `\*`, `(.*)`, -1) + "$"
+		m := regexp.MustCompile(re).FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+		rewritten := rewrite.To
+		for _, group := range m[1:] {
+			rewritten = strings.Replace(rewritten, "*", group, 1)
+		}
+		result := parseImageReference(rewritten)
+		result.Tag, result.Digest = parsed.Tag, parsed.Digest
+		return result.String(), true
+	}
+
+	return ref, false
+}
+
+// tagImage tags an existing image with ref
+func (r *RulesDirector) tagImage(l socketproxy.Logger, source string, ref string) error {
+	parsed := parseImageReference(ref)
+	tag := parsed.Tag
+	if tag == "" {
+		tag = "latest"
+	}
+
+	q := url.Values{}
+	q.Set("repo", parsed.Name())
+	q.Set("tag", tag)
+
+	u := fmt.Sprintf("http://docker/v%s/images/%s/tag?%s", r.internalAPIVersion(), source, q.Encode())
+	req, err := r.newRequest("POST", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Request to %q failed: %s", u, resp.Status)
+	}
+
+	l.Printf("Tagged image %q as %s:%s", source, parsed.Name(), tag)
+	return nil
+}
+
+func (r *RulesDirector) handleImageCreate(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if platform := req.URL.Query().Get("platform"); !r.isPlatformAllowed(platform) {
+			l.Printf("Denied pulling image for platform %q", platform)
+			r.writeDenied(w, req, fmt.Sprintf("Pulling images for platform %q isn't allowed", platform))
+			return
+		}
+
+		var original, rewritten string
+
+		if ref := imageCreateReference(req); ref != "" {
+			// rewrite pulls to mirrors, which then get tagged back to the original name below
+			if rewrittenRef, ok := r.rewriteImage(ref); ok {
+				rewritten = rewrittenRef
+				l.Printf("Rewriting pull of image %q to %q", ref, rewritten)
+				parsed := parseImageReference(rewritten)
+				q := req.URL.Query()
+				q.Set("fromImage", parsed.Name())
+				if parsed.Digest != "" {
+					q.Set("tag", parsed.Digest)
+				} else {
+					q.Set("tag", parsed.Tag)
+				}
+				req.URL.RawQuery = q.Encode()
+				original, ref = ref, rewritten
+			}
+
+			if ok, err := r.isImageAllowed(l, ref); err != nil {
+				writeError(w, err.Error(), http.StatusInternalServerError)
+				return
+			} else if !ok {
+				r.writeDenied(w, req, fmt.Sprintf("Pulling image %q isn't allowed", ref))
+				return
+			}
+			if err := r.checkImagePinning(ref); err != nil {
+				l.Printf("Denied pulling image: %s", err.Error())
+				r.writeDenied(w, req, err.Error())
+				return
+			}
+			if err := r.injectRegistryAuth(l, req, ref); err != nil {
+				writeError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			// pull the digest that was verified, which gets tagged back to the original name below,
+			// rather than whatever the tag points to by the time it's pulled
+			pinned, err := r.verifyImage(l, ref, req.Header.Get("X-Registry-Auth"))
+			if err != nil {
+				l.Printf("Denied pulling image: %s", err.Error())
+				r.writeDenied(w, req, err.Error())
+				return
+			}
+			if pinned != ref {
+				l.Printf("Pinning pull of image %q to verified %q", ref, pinned)
+				parsed := parseImageReference(pinned)
+				q := req.URL.Query()
+				q.Set("fromImage", parsed.Name())
+				q.Set("tag", parsed.Digest)
+				req.URL.RawQuery = q.Encode()
+				if original == "" {
+					original = ref
+				}
+				rewritten, ref = pinned, pinned
+			}
+
+			// can't tag with a digest, so digest pulls will only be available under the rewritten name
+			if original != "" && parseImageReference(original).Digest != "" {
+				original = ""
+			}
+		} else if req.URL.Query().Get("fromSrc") != "" && (len(r.AllowImages) > 0 || r.Strict) {
+			// Imports don't come from a registry, so can't be checked against the allowed images, or
+			// at all in strict mode
+			l.Printf("Denied image import, only allowed or verifiable images can be used")
+			r.writeDenied(w, req, "Importing images isn't allowed")
+			return
+		}
+
+		upstream.ServeHTTP(w, req)
+
+		if original != "" {
+			if err := r.tagImage(l, rewritten, original); err != nil {
+				l.Printf("Error tagging rewritten image as %q: %s", original, err.Error())
+			}
+		}
+	})
+}
+
+var imagePushRegex = regexp.MustCompile(`^/images/(.+)/push$`)
+
+func (r *RulesDirector) handleImagePush(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		m := imagePushRegex.FindStringSubmatch(versionRegex.ReplaceAllString(req.URL.Path, ""))
+		if m == nil {
+			writeError(w, fmt.Sprintf("Unable to find an image name in %s", req.URL.Path), http.StatusBadRequest)
+			return
+		}
+		name := m[1]
+
+		// The tag being pushed is given separately, and is what needs to be owned
+		parsed := parseImageReference(name)
+		if tag := req.URL.Query().Get("tag"); tag != "" && parsed.Tag == "" && parsed.Digest == "" {
+			name += ":" + tag
+		}
+
+		allowed := false
+		for _, pattern := range r.AllowPushImages {
+			if matchImagePattern(pattern, parsed.Name()) {
+				l.Printf("Allow, image %q matches allowed push pattern %q", name, pattern)
+				allowed = true
+				break
+			}
+		}
+
+		// Unlike other image operations, unlabelled images can't be pushed
+		if !allowed {
+			ok, err := r.checkIdentifierOwner(l, "images", name, false)
+			if err == errInspectNotFound {
+				if !r.allowNotFound(l, "Image") {
+					r.writeDenied(w, req, "Image not found")
+					return
+				}
+			} else if err != nil {
+				writeError(w, err.Error(), http.StatusInternalServerError)
+				return
+			} else if !ok {
+				r.writeDenied(w, req, fmt.Sprintf("Pushing image %q isn't allowed, only images built by this owner can be pushed", name))
+				return
+			}
+		}
+
+		if err := r.injectRegistryAuth(l, req, name); err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		upstream.ServeHTTP(w, req)
+	})
+}
+
+var distributionRegex = regexp.MustCompile(`^/distribution/(.+)/json$`)
+
+// handleDistribution forwards registry manifest lookups (used by compose and buildx to resolve
+// digests), applying the allowed images and injecting registry credentials
+func (r *RulesDirector) handleDistribution(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		m := distributionRegex.FindStringSubmatch(versionRegex.ReplaceAllString(req.URL.Path, ""))
+		if m == nil {
+			writeError(w, fmt.Sprintf("Unable to find an image name in %s", req.URL.Path), http.StatusBadRequest)
+			return
+		}
+		name := m[1]
+
+		if ok, err := r.isImageAllowed(l, name); err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if !ok {
+			r.writeDenied(w, req, fmt.Sprintf("Image %q isn't allowed", name))
+			return
+		}
+
+		if err := r.injectRegistryAuth(l, req, name); err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		upstream.ServeHTTP(w, req)
+	})
+}
+
+var imageTagRegex = regexp.MustCompile(`^/images/(.+)/tag$`)
+
+func (r *RulesDirector) handleImageTag(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		m := imageTagRegex.FindStringSubmatch(versionRegex.ReplaceAllString(req.URL.Path, ""))
+		if m == nil {
+			writeError(w, fmt.Sprintf("Unable to find an image name in %s", req.URL.Path), http.StatusBadRequest)
+			return
+		}
+		name := m[1]
+
+		if ok, err := r.checkIdentifierOwner(l, "images", name, r.allowUnowned("images", true)); err == errInspectNotFound {
+			if !r.allowNotFound(l, "Image") {
+				r.writeDenied(w, req, "Image not found")
+				return
+			}
+		} else if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if !ok {
+			r.writeDenied(w, req, "Unauthorized access to image")
+			return
+		}
+
+		// Don't allow moving a tag away from an image belonging to another owner, or an unowned one
+		target := req.URL.Query().Get("repo")
+		if tag := req.URL.Query().Get("tag"); tag != "" {
+			target += ":" + tag
+		}
+		if ok, err := r.checkIdentifierOwner(l, "images", target, false); err != nil && err != errInspectNotFound {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if err == nil && !ok {
+			r.writeDenied(w, req, fmt.Sprintf("Tag %q belongs to an image with a different owner", target))
+			return
+		}
+
+		// The response is needed to know whether the tag was created, so the request is made here
+		resp, err := r.doUpstream(req)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		// Tags of images we track ownership of need tracking too, as they have no label
+		if resp.StatusCode/100 == 2 && r.isOwnedImage(name) {
+			l.Printf("Recording tag %q of owned image %q", target, name)
+			r.recordOwnedImages([]string{taggedImageReference(target)})
+		}
+
+		relayResponse(w, resp, nil)
+	})
+}
+
+func (r *RulesDirector) handleCommit(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+
+		// Images can only be committed from owned containers. The daemon would fail commits of
+		// missing containers, but they could be created in between without our checks.
+		container := q.Get("container")
+		if ok, err := r.checkIdentifierOwner(l, "containers", container, r.allowUnowned("containers", false)); err == errInspectNotFound {
+			r.writeDenied(w, req, "Container not found")
+			return
+		} else if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if !ok {
+			r.writeDenied(w, req, "Unauthorized access to container")
+			return
+		}
+
+		// Don't allow moving a tag away from an image belonging to another owner, or an unowned one
+		var ref string
+		if repo := q.Get("repo"); repo != "" {
+			ref = repo
+			if tag := q.Get("tag"); tag != "" {
+				ref += ":" + tag
+			}
+			if ok, err := r.checkIdentifierOwner(l, "images", ref, false); err != nil && err != errInspectNotFound {
+				writeError(w, err.Error(), http.StatusInternalServerError)
+				return
+			} else if err == nil && !ok {
+				r.writeDenied(w, req, fmt.Sprintf("Tag %q belongs to an image with a different owner", ref))
+				return
+			}
+		}
+
+		// Don't allow the owner label to be changed with a LABEL instruction. Instructions can be
+		// written in ways this doesn't catch (e.g. with escapes), so the label of the committed
+		// image is checked too.
+		for _, change := range q["changes"] {
+			if strings.Contains(change, ownerKey) {
+				l.Printf("Denied commit changing the owner label (%q)", change)
+				r.writeDenied(w, req, "Commits aren't allowed to change the owner label")
+				return
+			}
+		}
+
+		// Add the owner label to the config of the committed image, which may be empty
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		decoded := map[string]interface{}{}
+		if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && !bytes.Equal(trimmed, []byte("null")) {
+			if err := unmarshalJSON(body, &decoded); err != nil {
+				writeError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		labels, ok := decoded["Labels"].(map[string]interface{})
+		if !ok {
+			labels = map[string]interface{}{}
+			decoded["Labels"] = labels
+		}
+		addLabel(ownerKey, r.Owner, labels)
+		l.Printf("Labels: %#v", labels)
+
+		encoded, err := json.Marshal(decoded)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// reset it so that upstream can read it again
+		req.ContentLength = int64(len(encoded))
+		req.Body = ioutil.NopCloser(bytes.NewReader(encoded))
+		req.Header.Set("Content-Type", "application/json")
+
+		// The response is needed to find the committed image, so the request is made here
+		resp, err := r.doUpstream(req)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		respBody, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+
+		if resp.StatusCode/100 != 2 {
+			relayResponse(w, resp, nil)
+			return
+		}
+
+		var committed struct {
+			Id string
+		}
+		if err := json.Unmarshal(respBody, &committed); err != nil || committed.Id == "" {
+			writeError(w, fmt.Sprintf("Unable to find the ID of the committed image in %q", respBody), http.StatusBadGateway)
+			return
+		}
+
+		committedLabels, err := r.fetchLabels("images", committed.Id)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if owner := committedLabels[ownerKey]; owner != r.Owner {
+			l.Printf("Removing committed image %s, its owner label was changed to %q", committed.Id, owner)
+			if err := r.remove("images", committed.Id, true); err != nil {
+				l.Printf("Error removing committed image %s: %s", committed.Id, err.Error())
+			}
+			r.writeDenied(w, req, "Commits aren't allowed to change the owner label")
+			return
+		}
+
+		// The committed image derives from an owned container, so track it as owned
+		l.Printf("Recording committed image %s as owned by %q", committed.Id, r.Owner)
+		r.recordOwnedImages([]string{committed.Id})
+
+		relayResponse(w, resp, nil)
+	})
+}
+
+var imageDeleteRegex = regexp.MustCompile(`^/images/(.+)$`)
+
+func (r *RulesDirector) handleImageDelete(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		m := imageDeleteRegex.FindStringSubmatch(versionRegex.ReplaceAllString(req.URL.Path, ""))
+		if m == nil {
+			writeError(w, fmt.Sprintf("Unable to find an image name in %s", req.URL.Path), http.StatusBadRequest)
+			return
+		}
+		name := m[1]
+
+		if ok, err := r.checkIdentifierOwner(l, "images", name, r.allowUnowned("images", true)); err == errInspectNotFound {
+			if !r.allowNotFound(l, "Image") {
+				r.writeDenied(w, req, "Image not found")
+				return
+			}
+			upstream.ServeHTTP(w, req)
+			return
+		} else if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if !ok {
+			r.writeDenied(w, req, "Unauthorized access to image")
+			return
+		}
+
+		// Only pass through the parameters we understand
+		q := req.URL.Query()
+		params := url.Values{}
+		for _, param := range []string{"force", "noprune"} {
+			if v := q.Get(param); v != "" {
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					writeError(w, fmt.Sprintf("Invalid value %q for %s", v, param), http.StatusBadRequest)
+					return
+				}
+				params.Set(param, strconv.FormatBool(b))
+			}
+		}
+		req.URL.RawQuery = params.Encode()
+
+		// Force removal untags images out from under running containers, which can't be allowed
+		// if those containers belong to someone else
+		if params.Get("force") == "true" {
+			filters, err := json.Marshal(map[string][]string{"ancestor": []string{name}})
+			if err != nil {
+				writeError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			var containers []struct {
+				Id     string
+				Labels map[string]string
+			}
+			if err := r.getInto(&containers, "/containers/json?all=1&filters=%s", url.QueryEscape(string(filters))); err != nil {
+				writeError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, c := range containers {
+				if c.Labels[ownerKey] != r.Owner && !r.isAlsoAllowedOwner(c.Labels[ownerKey]) {
+					l.Printf("Denied force removal of image %q, used by container %s with owner %q", name, c.Id, c.Labels[ownerKey])
+					r.writeDenied(w, req, fmt.Sprintf("Image %q is in use by containers belonging to another owner, and can't be force removed", name))
+					return
+				}
+			}
+		}
+
+		l.Printf("Removing image %q (%s)", name, req.URL.RawQuery)
+		upstream.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,484 @@
+package sockguard
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/sockguard/sockguardtest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseImageReference(t *testing.T) {
+	tests := map[string]imageReference{
+		"alpine":                         imageReference{Domain: "docker.io", Path: "library/alpine"},
+		"alpine:3.8":                     imageReference{Domain: "docker.io", Path: "library/alpine", Tag: "3.8"},
+		"buildkite/agent:3":              imageReference{Domain: "docker.io", Path: "buildkite/agent", Tag: "3"},
+		"index.docker.io/library/alpine": imageReference{Domain: "docker.io", Path: "library/alpine"},
+		"localhost/app":                  imageReference{Domain: "localhost", Path: "app"},
+		"localhost:5000/team/app:1.0":    imageReference{Domain: "localhost:5000", Path: "team/app", Tag: "1.0"},
+		"registry.example.com/app@sha256:abcd": imageReference{
+			Domain: "registry.example.com", Path: "app", Digest: "sha256:abcd",
+		},
+		"registry.example.com/app:1.0@sha256:abcd": imageReference{
+			Domain: "registry.example.com", Path: "app", Tag: "1.0", Digest: "sha256:abcd",
+		},
+	}
+
+	for k, v := range tests {
+		result := parseImageReference(k)
+		if cmp.Equal(result, v) != true {
+			t.Errorf("'%s' : Expected %+v, got %+v\n", k, v, result)
+		}
+	}
+}
+
+func TestIsImageAllowed(t *testing.T) {
+	l := mockLogger()
+	r := mockRulesDirector()
+	r.AllowImages = []string{"docker.io/library/*", "registry.example.com/team/*"}
+
+	// Image IDs are resolved to their tags
+	repoTags := map[string]string{
+		"/v1.32/images/sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa/json": `["evil.com/app:1.0","alpine:3.8"]`,
+		"/v1.32/images/bbbbbbbbbbbb/json": `["evil.com/app:1.0"]`,
+	}
+	r.Client = &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) *http.Response {
+			tags, ok := repoTags[req.URL.Path]
+			if !ok {
+				return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(strings.NewReader(`{"message":"No such image"}`)), Header: make(http.Header)}
+			}
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(`{"RepoTags":` + tags + `}`)), Header: make(http.Header)}
+		}),
+	}
+
+	tests := map[string]bool{
+		"alpine:3.8":                                true,
+		"docker.io/library/golang":                  true,
+		"buildkite/agent:3":                         false,
+		"registry.example.com/team/app:1.0":         true,
+		"registry.example.com/team/nested/app:1.0":  true,
+		"registry.example.com/otherteam/app:1.0":    false,
+		"registry.example.com.evil.com/team/app":    false,
+		"evil.com/registry.example.com/team/app:10": false,
+		"sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa": true,
+		"bbbbbbbbbbbb": false,
+		"cccccccccccc": false,
+	}
+
+	for k, v := range tests {
+		result, err := r.isImageAllowed(l, k)
+		if err != nil {
+			t.Errorf("%s : Error - %s", k, err.Error())
+		} else if result != v {
+			t.Errorf("%s : Expected %t, got %t", k, v, result)
+		}
+	}
+
+	r.AllowImages = nil
+	if result, _ := r.isImageAllowed(l, "anything/at:all"); result != true {
+		t.Errorf("Expected all images to be allowed with no AllowImages set")
+	}
+}
+
+func TestHandleImageCreate(t *testing.T) {
+	l := mockLogger()
+	r := mockRulesDirector()
+	r.AllowImages = []string{"docker.io/library/*"}
+
+	tests := map[string]int{
+		"/v1.37/images/create?fromImage=alpine&tag=3.8":                  200,
+		"/v1.37/images/create?fromImage=docker.io%2Flibrary%2Fgolang":    200,
+		"/v1.37/images/create?fromImage=buildkite%2Fagent&tag=3":         401,
+		"/v1.37/images/create?fromImage=evil.com%2Falpine&tag=latest":    401,
+		"/v1.37/images/create?fromSrc=http%3A%2F%2Fevil.com%2Fimage.tar": 401,
+	}
+
+	for k, v := range tests {
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// Return empty JSON, the request is whats important not the response
+			fmt.Fprintf(w, `{}`)
+		})
+
+		req, err := http.NewRequest("POST", k, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.handleImageCreate(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != v {
+			respBody, _ := ioutil.ReadAll(rr.Body)
+			t.Errorf("%s : handler returned wrong status code: got %v want %v. Response body: %s", k, status, v, string(respBody))
+		}
+	}
+}
+
+func TestCheckImagePinning(t *testing.T) {
+	r := mockRulesDirector()
+
+	tests := []struct {
+		requireDigest bool
+		denyLatest    bool
+		ref           string
+		allowed       bool
+	}{
+		{false, false, "alpine", true},
+		{false, true, "alpine", false},
+		{false, true, "alpine:latest", false},
+		{false, true, "alpine:3.8", true},
+		{false, true, "alpine@sha256:e2e8b7e7b9f1d5e0b38d0b3b8c5c7b7f6f3c6e1d5a0c2b9b6b1a7c3d2e1f0a9b", true},
+		{true, false, "alpine:3.8", false},
+		{true, false, "registry.example.com/app:1.0@sha256:e2e8b7e7b9f1d5e0b38d0b3b8c5c7b7f6f3c6e1d5a0c2b9b6b1a7c3d2e1f0a9b", true},
+		{true, false, "sha256:e2e8b7e7b9f1d5e0b38d0b3b8c5c7b7f6f3c6e1d5a0c2b9b6b1a7c3d2e1f0a9b", true},
+		{true, false, "e2e8b7e7b9f1", true},
+	}
+
+	for _, v := range tests {
+		r.RequireImageDigest = v.requireDigest
+		r.DenyLatestImageTag = v.denyLatest
+		err := r.checkImagePinning(v.ref)
+		if v.allowed && err != nil {
+			t.Errorf("%s : Expected allowed, got error %s", v.ref, err.Error())
+		} else if !v.allowed && err == nil {
+			t.Errorf("%s : Expected error, got nil", v.ref)
+		}
+	}
+}
+
+func TestVerifyImageIfMissing(t *testing.T) {
+	l := mockLogger()
+
+	// Pre-populated simplified upstream state that "exists" before tests execute.
+	us := sockguardtest.State{
+		Images: map[string]sockguardtest.Image{
+			"localimage": sockguardtest.Image{},
+		},
+	}
+
+	var verified []string
+	r := mockRulesDirectorWithUpstreamState(&us)
+	r.ImageVerifier = ImageVerifierFunc(func(ref string) error {
+		verified = append(verified, ref)
+		if strings.Contains(ref, "unsigned") {
+			return fmt.Errorf("no signatures found")
+		}
+		return nil
+	})
+
+	if ref, err := r.verifyImageIfMissing(l, "localimage"); err != nil {
+		t.Errorf("localimage : Error - %s", err.Error())
+	} else if ref != "localimage" {
+		t.Errorf("localimage : Expected the local image to be used as is, got %q", ref)
+	}
+	signed := "docker.io/library/signed@" + sockguardtest.Digest("signed")
+	if ref, err := r.verifyImageIfMissing(l, "signed"); err != nil {
+		t.Errorf("signed : Error - %s", err.Error())
+	} else if ref != signed {
+		t.Errorf("signed : Expected the verified digest %q, got %q", signed, ref)
+	}
+	if _, err := r.verifyImageIfMissing(l, "unsigned"); err == nil {
+		t.Errorf("unsigned : Expected error, got nil")
+	}
+	if !cmp.Equal(verified, []string{signed, "docker.io/library/unsigned@" + sockguardtest.Digest("unsigned")}) {
+		t.Errorf("Expected only missing images to be verified by digest, got %v", verified)
+	}
+}
+
+func TestHandleImageCreateVerified(t *testing.T) {
+	l := mockLogger()
+
+	us := sockguardtest.State{}
+	var tagged []string
+	r := mockRulesDirector()
+	r.Client = &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) *http.Response {
+			if strings.HasSuffix(req.URL.Path, "/tag") {
+				tagged = append(tagged, req.URL.RequestURI())
+				return &http.Response{
+					StatusCode: http.StatusCreated,
+					Header:     make(http.Header),
+					Body:       ioutil.NopCloser(strings.NewReader("")),
+				}
+			}
+			resp, _ := us.RoundTrip(req)
+			return resp
+		}),
+	}
+	var verified []string
+	r.ImageVerifier = ImageVerifierFunc(func(ref string) error {
+		verified = append(verified, ref)
+		return nil
+	})
+
+	digest := sockguardtest.Digest("alpine:3.8")
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		expected := "/v1.37/images/create?fromImage=docker.io%2Flibrary%2Falpine&tag=" + url.QueryEscape(digest)
+		if req.URL.RequestURI() != expected {
+			t.Errorf("Expected the verified digest to be pulled with %s, got %s", expected, req.URL.RequestURI())
+		}
+		fmt.Fprintf(w, `{}`)
+	})
+
+	req, err := http.NewRequest("POST", "/v1.37/images/create?fromImage=alpine&tag=3.8", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	r.handleImageCreate(l, req, upstream).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if !cmp.Equal(verified, []string{"docker.io/library/alpine@" + digest}) {
+		t.Errorf("Expected the digest to be verified, got %v", verified)
+	}
+	expectedTag := "/v1.32/images/docker.io/library/alpine@" + digest + "/tag?repo=docker.io%2Flibrary%2Falpine&tag=3.8"
+	if !cmp.Equal(tagged, []string{expectedTag}) {
+		t.Errorf("Expected the pulled digest to be tagged back with %s, got %v", expectedTag, tagged)
+	}
+}
+
+func TestRewriteImage(t *testing.T) {
+	r := mockRulesDirector()
+	r.ImageRewrites = []ImageRewrite{
+		ImageRewrite{From: "docker.io/library/*", To: "mirror.example.com/dockerhub/*"},
+		ImageRewrite{From: "docker.io/*", To: "mirror.example.com/*"},
+	}
+
+	tests := map[string]string{
+		"alpine:3.8":                   "mirror.example.com/dockerhub/alpine:3.8",
+		"buildkite/agent":              "mirror.example.com/buildkite/agent",
+		"buildkite/agent@sha256:abcd":  "mirror.example.com/buildkite/agent@sha256:abcd",
+		"registry.example.com/app:1.0": "registry.example.com/app:1.0",
+		"localhost:5000/team/app:1.0":  "localhost:5000/team/app:1.0",
+	}
+
+	for k, v := range tests {
+		if result, _ := r.rewriteImage(k); result != v {
+			t.Errorf("%s : Expected %q, got %q", k, v, result)
+		}
+	}
+}
+
+func TestHandleImageCreateRewrite(t *testing.T) {
+	l := mockLogger()
+
+	var tagged []string
+	r := mockRulesDirector()
+	r.Client = &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) *http.Response {
+			tagged = append(tagged, req.URL.RequestURI())
+			return &http.Response{
+				StatusCode: http.StatusCreated,
+				Header:     make(http.Header),
+				Body:       ioutil.NopCloser(strings.NewReader("")),
+			}
+		}),
+	}
+	r.ImageRewrites = []ImageRewrite{
+		ImageRewrite{From: "docker.io/*", To: "mirror.example.com/*"},
+	}
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		expected := "/v1.37/images/create?fromImage=mirror.example.com%2Flibrary%2Falpine&tag=3.8"
+		if req.URL.RequestURI() != expected {
+			t.Errorf("Expected URL %s got %s", expected, req.URL.RequestURI())
+		}
+		fmt.Fprintf(w, `{}`)
+	})
+
+	req, err := http.NewRequest("POST", "/v1.37/images/create?fromImage=alpine&tag=3.8", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	r.handleImageCreate(l, req, upstream).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	expectedTagged := []string{"/v1.32/images/mirror.example.com/library/alpine:3.8/tag?repo=docker.io%2Flibrary%2Falpine&tag=3.8"}
+	if !cmp.Equal(tagged, expectedTagged) {
+		t.Errorf("Expected tag requests %v, got %v", expectedTagged, tagged)
+	}
+}
+
+func TestHandleImagePush(t *testing.T) {
+	l := mockLogger()
+
+	// Pre-populated simplified upstream state that "exists" before tests execute.
+	us := sockguardtest.State{
+		Images: map[string]sockguardtest.Image{
+			"registry.example.com/owned:1.0": sockguardtest.Image{
+				Owner: "test-owner",
+			},
+			"registry.example.com/owned:foreign": sockguardtest.Image{
+				Owner: "adifferentowner",
+			},
+			"registry.example.com/unowned:1.0": sockguardtest.Image{},
+			"registry.example.com/foreign:1.0": sockguardtest.Image{
+				Owner: "adifferentowner",
+			},
+			"registry.example.com/shared/foreign:1.0": sockguardtest.Image{
+				Owner: "adifferentowner",
+			},
+		},
+	}
+	r := mockRulesDirectorWithUpstreamState(&us)
+	r.AllowPushImages = []string{"registry.example.com/shared/*"}
+
+	tests := map[string]int{
+		"/v1.37/images/registry.example.com/owned/push?tag=1.0":          200,
+		"/v1.37/images/registry.example.com/owned/push?tag=foreign":      401,
+		"/v1.37/images/registry.example.com/owned:1.0/push":              200,
+		"/v1.37/images/registry.example.com/unowned/push?tag=1.0":        401,
+		"/v1.37/images/registry.example.com/foreign/push?tag=1.0":        401,
+		"/v1.37/images/registry.example.com/shared/foreign/push?tag=1.0": 200,
+	}
+
+	for k, v := range tests {
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprintf(w, `{}`)
+		})
+
+		req, err := http.NewRequest("POST", k, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.handleImagePush(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != v {
+			respBody, _ := ioutil.ReadAll(rr.Body)
+			t.Errorf("%s : handler returned wrong status code: got %v want %v. Response body: %s", k, status, v, string(respBody))
+		}
+	}
+}
+
+func TestHandleImageDelete(t *testing.T) {
+	l := mockLogger()
+
+	// Pre-populated simplified upstream state that "exists" before tests execute.
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"ownedcontainer": sockguardtest.Container{
+				Owner: "test-owner",
+				Image: "owned",
+			},
+			"foreigncontainer": sockguardtest.Container{
+				Owner: "adifferentowner",
+				Image: "shared",
+			},
+		},
+		Images: map[string]sockguardtest.Image{
+			"owned": sockguardtest.Image{
+				Owner: "test-owner",
+			},
+			"shared": sockguardtest.Image{},
+			"foreign": sockguardtest.Image{
+				Owner: "adifferentowner",
+			},
+		},
+	}
+	r := mockRulesDirectorWithUpstreamState(&us)
+
+	tests := []struct {
+		url         string
+		esc         int
+		expectedUrl string
+	}{
+		{"/v1.37/images/owned", 200, "/v1.37/images/owned"},
+		{"/v1.37/images/owned?force=1&noprune=0&other=x", 200, "/v1.37/images/owned?force=true&noprune=false"},
+		{"/v1.37/images/shared", 200, "/v1.37/images/shared"},
+		{"/v1.37/images/shared?force=true", 401, ""},
+		{"/v1.37/images/foreign", 401, ""},
+		{"/v1.37/images/owned?force=yes", 400, ""},
+	}
+
+	for _, v := range tests {
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.RequestURI() != v.expectedUrl {
+				t.Errorf("%s : Expected URL %s got %s", v.url, v.expectedUrl, req.URL.RequestURI())
+			}
+			fmt.Fprintf(w, `[]`)
+		})
+
+		req, err := http.NewRequest("DELETE", v.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.handleImageDelete(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != v.esc {
+			respBody, _ := ioutil.ReadAll(rr.Body)
+			t.Errorf("%s : handler returned wrong status code: got %v want %v. Response body: %s", v.url, status, v.esc, string(respBody))
+		}
+	}
+}
+
+func TestIsPlatformAllowed(t *testing.T) {
+	r := mockRulesDirector()
+	r.AllowPlatforms = []string{"linux/amd64", "linux/arm64"}
+
+	tests := map[string]bool{
+		"":               true,
+		"linux/amd64":    true,
+		"Linux/AMD64":    true,
+		"linux/arm64/v8": true,
+		"linux/arm/v7":   false,
+		"linux/amd6":     false,
+		"windows/amd64":  false,
+	}
+
+	for k, v := range tests {
+		if result := r.isPlatformAllowed(k); result != v {
+			t.Errorf("%q : Expected %t, got %t", k, v, result)
+		}
+	}
+}
+
+func TestHandleDistribution(t *testing.T) {
+	l := mockLogger()
+	r := mockRulesDirector()
+	r.AllowImages = []string{"registry.example.com/*"}
+	r.RegistryAuth = RegistryAuth{
+		"registry.example.com": RegistryCredentials{
+			Username: "user", Password: "pass", ServerAddress: "registry.example.com",
+		},
+	}
+
+	tests := map[string]int{
+		"/v1.37/distribution/registry.example.com/app:1.0/json":                                                                     200,
+		"/v1.37/distribution/registry.example.com/app@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef/json": 200,
+		"/v1.37/distribution/alpine:3.8/json":                                                                                       401,
+	}
+
+	for k, v := range tests {
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("X-Registry-Auth") == "" {
+				t.Errorf("%s : Expected X-Registry-Auth to be injected", k)
+			}
+			fmt.Fprintf(w, `{}`)
+		})
+
+		req, err := http.NewRequest("GET", k, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != v {
+			respBody, _ := ioutil.ReadAll(rr.Body)
+			t.Errorf("%s : handler returned wrong status code: got %v want %v. Response body: %s", k, status, v, string(respBody))
+		}
+	}
+}
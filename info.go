@@ -0,0 +1,64 @@
+package sockguard
+
+import (
+	"encoding/json"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// Fields of /info responses kept by ScrubInfo, which clients use to pick platforms, drivers and
+// registries. Everything else (e.g. registry config, labels, security options, paths and
+// resource counts of other owners) is removed.
+var infoFields = []string{
+	"Architecture",
+	"CgroupDriver",
+	"CgroupVersion",
+	"DefaultRuntime",
+	"Driver",
+	"Experimental",
+	"IndexServerAddress",
+	"Isolation",
+	"KernelVersion",
+	"LoggingDriver",
+	"MemTotal",
+	"NCPU",
+	"OSType",
+	"OSVersion",
+	"OperatingSystem",
+	"ServerVersion",
+}
+
+// Fields of the Swarm section of /info responses kept by ScrubInfo
+var infoSwarmFields = []string{"LocalNodeState", "ControlAvailable"}
+
+// scrubInfo removes all but the infoFields from an /info response body
+func scrubInfo(l socketproxy.Logger, body json.RawMessage) (interface{}, error) {
+	var info map[string]json.RawMessage
+	if err := unmarshalJSON(body, &info); err != nil {
+		return nil, err
+	}
+
+	scrubbed := map[string]interface{}{}
+	for _, field := range infoFields {
+		if v, ok := info[field]; ok {
+			scrubbed[field] = v
+		}
+	}
+
+	if raw, ok := info["Swarm"]; ok {
+		var swarm map[string]json.RawMessage
+		if err := unmarshalJSON(raw, &swarm); err != nil {
+			return nil, err
+		}
+		scrubbedSwarm := map[string]json.RawMessage{}
+		for _, field := range infoSwarmFields {
+			if v, ok := swarm[field]; ok {
+				scrubbedSwarm[field] = v
+			}
+		}
+		scrubbed["Swarm"] = scrubbedSwarm
+	}
+
+	l.Printf("Scrubbed %d fields from info response", len(info)-len(scrubbed))
+	return scrubbed, nil
+}
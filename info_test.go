@@ -0,0 +1,67 @@
+package sockguard
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestScrubInfo(t *testing.T) {
+	l := mockLogger()
+
+	r := mockRulesDirector()
+	r.ScrubInfo = true
+	r.Client = &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) *http.Response {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     make(http.Header),
+				Body: ioutil.NopCloser(bytes.NewBufferString(`{
+					"ID": "7TRN:IPZB",
+					"Containers": 14,
+					"OSType": "linux",
+					"Architecture": "x86_64",
+					"ServerVersion": "20.10.7",
+					"DockerRootDir": "/var/lib/docker",
+					"Labels": ["secret=label"],
+					"SecurityOptions": ["name=seccomp,profile=default"],
+					"RegistryConfig": {"InsecureRegistryCIDRs": ["10.0.0.0/8"]},
+					"Swarm": {"LocalNodeState": "active", "ControlAvailable": false, "RemoteManagers": [{"Addr": "10.0.0.1:2377"}]}
+				}`)),
+			}
+		}),
+	}
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("%s shouldn't have been passed upstream", req.URL.Path)
+	})
+
+	req, err := http.NewRequest("GET", "/v1.37/info", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+	var actual map[string]interface{}
+	if err := json.NewDecoder(rr.Body).Decode(&actual); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"OSType":        "linux",
+		"Architecture":  "x86_64",
+		"ServerVersion": "20.10.7",
+		"Swarm": map[string]interface{}{
+			"LocalNodeState":   "active",
+			"ControlAvailable": false,
+		},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+}
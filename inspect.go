@@ -0,0 +1,111 @@
+package sockguard
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+const redactedValue = "<redacted>"
+
+// Top level fields of container inspects that are paths on the host
+var inspectHostPathFields = []string{"ResolvConfPath", "HostnamePath", "HostsPath", "LogPath"}
+
+// isRedactedEnv returns whether the value of an env var (NAME=value) should be redacted, by
+// matching its name against RedactInspectEnv
+func (r *RulesDirector) isRedactedEnv(env string) bool {
+	name := strings.SplitN(env, "=", 2)[0]
+	for _, pattern := range r.RedactInspectEnv {
+		if matchImagePattern(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// scrubContainerInspect redacts env vars and host paths from a container inspect response body,
+// and strips any name prefix
+func (r *RulesDirector) scrubContainerInspect(l socketproxy.Logger, body json.RawMessage) (interface{}, error) {
+	var decoded map[string]interface{}
+	if err := unmarshalJSON(body, &decoded); err != nil {
+		return nil, err
+	}
+
+	if r.PrefixNames {
+		r.unprefixNames(decoded)
+	}
+
+	if config, ok := decoded["Config"].(map[string]interface{}); ok {
+		env, _ := config["Env"].([]interface{})
+		for i, e := range env {
+			if s, ok := e.(string); ok && r.isRedactedEnv(s) {
+				env[i] = strings.SplitN(s, "=", 2)[0] + "=" + redactedValue
+			}
+		}
+	}
+
+	if !r.RedactInspectHostPaths {
+		return decoded, nil
+	}
+
+	for _, field := range inspectHostPathFields {
+		if _, ok := decoded[field]; ok {
+			decoded[field] = redactedValue
+		}
+	}
+
+	// Storage driver data is all host paths (e.g. overlay2 LowerDir)
+	if graphDriver, ok := decoded["GraphDriver"].(map[string]interface{}); ok {
+		data, _ := graphDriver["Data"].(map[string]interface{})
+		for k := range data {
+			data[k] = redactedValue
+		}
+	}
+
+	if hostConfig, ok := decoded["HostConfig"].(map[string]interface{}); ok {
+		binds, _ := hostConfig["Binds"].([]interface{})
+		for i, b := range binds {
+			s, ok := b.(string)
+			if !ok {
+				continue
+			}
+			// Only the source of host binds is a host path, named volumes are kept
+			if parts := strings.SplitN(s, ":", 2); len(parts) == 2 && strings.HasPrefix(parts[0], "/") {
+				binds[i] = redactedValue + ":" + parts[1]
+			}
+		}
+		mounts, _ := hostConfig["Mounts"].([]interface{})
+		for _, m := range mounts {
+			if mount, ok := m.(map[string]interface{}); ok && mount["Type"] == "bind" {
+				mount["Source"] = redactedValue
+			}
+		}
+	}
+
+	// Volume mount sources are paths in the daemon's data root
+	mounts, _ := decoded["Mounts"].([]interface{})
+	for _, m := range mounts {
+		if mount, ok := m.(map[string]interface{}); ok {
+			if _, ok := mount["Source"]; ok {
+				mount["Source"] = redactedValue
+			}
+		}
+	}
+
+	l.Printf("Redacted host paths from container inspect")
+	return decoded, nil
+}
+
+func (r *RulesDirector) handleContainerInspect(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !r.requireContainerOwner(l, w, req) {
+			return
+		}
+
+		r.responseFilter(l, func(body json.RawMessage) (interface{}, error) {
+			return r.scrubContainerInspect(l, body)
+		}).ServeHTTP(w, req)
+	})
+}
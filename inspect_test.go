@@ -0,0 +1,92 @@
+package sockguard
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestScrubContainerInspect(t *testing.T) {
+	l := mockLogger()
+
+	r := mockRulesDirector()
+	r.RedactInspectEnv = []string{"AWS_*", "GITHUB_TOKEN"}
+	r.RedactInspectHostPaths = true
+	r.Client = &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) *http.Response {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     make(http.Header),
+				Body: ioutil.NopCloser(bytes.NewBufferString(`{
+					"Id": "owned",
+					"LogPath": "/var/lib/docker/containers/owned/owned-json.log",
+					"Config": {
+						"Labels": {"com.buildkite.sockguard.owner": "test-owner"},
+						"Env": ["PATH=/usr/bin", "AWS_SECRET_ACCESS_KEY=abc", "GITHUB_TOKEN=def", "GITHUB_USER=ghi"]
+					},
+					"HostConfig": {
+						"Binds": ["/home/agent/builds:/workdir:ro", "cache:/cache"],
+						"Mounts": [{"Type": "bind", "Source": "/tmp/x", "Target": "/x"}, {"Type": "tmpfs", "Target": "/tmp"}]
+					},
+					"GraphDriver": {"Name": "overlay2", "Data": {"LowerDir": "/var/lib/docker/overlay2/l/ABC"}},
+					"Mounts": [{"Type": "volume", "Name": "cache", "Source": "/var/lib/docker/volumes/cache/_data", "Destination": "/cache"}]
+				}`)),
+			}
+		}),
+	}
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("%s shouldn't have been passed upstream", req.URL.Path)
+	})
+
+	// by name, which can have dashes and dots (e.g. docker-compose's proj-web-1)
+	req, err := http.NewRequest("GET", "/v1.37/containers/proj-web-1/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var actual struct {
+		LogPath string
+		Config  struct {
+			Env []string
+		}
+		HostConfig struct {
+			Binds  []string
+			Mounts []map[string]string
+		}
+		GraphDriver struct {
+			Name string
+			Data map[string]string
+		}
+		Mounts []map[string]string
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&actual); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"PATH=/usr/bin", "AWS_SECRET_ACCESS_KEY=<redacted>", "GITHUB_TOKEN=<redacted>", "GITHUB_USER=ghi"}; !reflect.DeepEqual(actual.Config.Env, expected) {
+		t.Errorf("Expected env %v, got %v", expected, actual.Config.Env)
+	}
+	if expected := []string{"<redacted>:/workdir:ro", "cache:/cache"}; !reflect.DeepEqual(actual.HostConfig.Binds, expected) {
+		t.Errorf("Expected binds %v, got %v", expected, actual.HostConfig.Binds)
+	}
+	if actual.LogPath != "<redacted>" || actual.GraphDriver.Data["LowerDir"] != "<redacted>" || actual.GraphDriver.Name != "overlay2" {
+		t.Errorf("Expected log and storage paths to be redacted, got %q, %+v", actual.LogPath, actual.GraphDriver)
+	}
+	if actual.HostConfig.Mounts[0]["Source"] != "<redacted>" || actual.HostConfig.Mounts[1]["Target"] != "/tmp" {
+		t.Errorf("Expected bind mount sources to be redacted, got %v", actual.HostConfig.Mounts)
+	}
+	if actual.Mounts[0]["Source"] != "<redacted>" || actual.Mounts[0]["Name"] != "cache" {
+		t.Errorf("Expected mount sources to be redacted, got %v", actual.Mounts)
+	}
+}
@@ -0,0 +1,75 @@
+package sockguard
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// The log drivers that can be forced on containers, which write to files in the daemon's
+// data-root that can be rotated, rather than to host facilities like journald or syslog
+var containerLogDrivers = []string{"json-file", "local"}
+
+// ParseLogOptions parses a comma separated list of key=value log driver options, e.g.
+// max-size=10m,max-file=3
+func ParseLogOptions(s string) (map[string]string, error) {
+	options := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		chunks := strings.SplitN(pair, "=", 2)
+		if len(chunks) != 2 || chunks[0] == "" {
+			return nil, fmt.Errorf("Invalid log option %q, expected key=value", pair)
+		}
+		options[chunks[0]] = chunks[1]
+	}
+	return options, nil
+}
+
+// applyContainerLogConfig forces ContainerLogDriver, with ContainerLogOptions, on the LogConfig of
+// a container's HostConfig. Containers that ask for the daemon's default driver get it instead,
+// other drivers are denied.
+func (r *RulesDirector) applyContainerLogConfig(l socketproxy.Logger, hostConfig map[string]interface{}) error {
+	if r.ContainerLogDriver == "" {
+		return nil
+	}
+
+	logConfig, _ := hostConfig["LogConfig"].(map[string]interface{})
+	if logConfig == nil {
+		logConfig = map[string]interface{}{}
+	}
+	if err := canonicalJSONKeys(logConfig, "Type", "Config"); err != nil {
+		return err
+	}
+
+	if driver, _ := logConfig["Type"].(string); driver != "" && driver != r.ContainerLogDriver {
+		l.Printf("Denied log driver %q on container create", driver)
+		return fmt.Errorf("Containers aren't allowed to use log driver %q, only %q", driver, r.ContainerLogDriver)
+	}
+	logConfig["Type"] = r.ContainerLogDriver
+
+	config, _ := logConfig["Config"].(map[string]interface{})
+	if config == nil {
+		config = map[string]interface{}{}
+	}
+	// the daemon matches option keys exactly, but other variants of the forced ones are removed
+	// so they can't be confused with them
+	for key := range r.ContainerLogOptions {
+		for existing := range config {
+			if existing != key && strings.EqualFold(existing, key) {
+				l.Printf("Removing log option %s, in favour of %s", existing, key)
+				delete(config, existing)
+			}
+		}
+	}
+	for key, value := range r.ContainerLogOptions {
+		if existing, ok := config[key]; ok && existing != value {
+			l.Printf("Overriding log option %s=%v with %q", key, existing, value)
+		}
+		config[key] = value
+	}
+	logConfig["Config"] = config
+
+	hostConfig["LogConfig"] = logConfig
+	l.Printf("Forcing log driver %q with options %v", r.ContainerLogDriver, r.ContainerLogOptions)
+	return nil
+}
@@ -0,0 +1,210 @@
+package sockguard
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/buildkite/sockguard/dockerapi"
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+var (
+	// Paths with a container, network or volume name, e.g. /containers/{name}/start
+	namedPathRegex = regexp.MustCompile(`^/(containers|networks|volumes)/([^/]+)(.*)$`)
+
+	// Path segments in the place of names that aren't names, e.g. /containers/json
+	reservedPathNames = map[string]bool{"create": true, "json": true, "prune": true}
+)
+
+// namePrefix returns the prefix given to names of containers, networks and volumes with
+// PrefixNames. Docker allows dots and dashes in names, but some of our routes only match word
+// characters, so other characters (and underscores) in the owner are escaped as _ and their hex
+// code, e.g. sockguard-pid-1 becomes sockguard_2dpid_2d1. Names must start with a letter or digit,
+// so an owner starting with anything else (or z) has its first character escaped after a z, e.g.
+// -job becomes z_2djob. An escaped owner never contains two underscores in a row, so the prefix
+// ends with them, and the prefixes of different owners can't collide.
+func (r *RulesDirector) namePrefix() string {
+	var prefix strings.Builder
+	for i, b := range []byte(r.Owner) {
+		isAlphanumeric := b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9'
+		if i == 0 && (!isAlphanumeric || b == 'z') {
+			fmt.Fprintf(&prefix, "z_%02x", b)
+		} else if isAlphanumeric {
+			prefix.WriteByte(b)
+		} else {
+			fmt.Fprintf(&prefix, "_%02x", b)
+		}
+	}
+	return prefix.String() + "__"
+}
+
+// prefixName returns name with our prefix, if it doesn't have it already
+func (r *RulesDirector) prefixName(name string) string {
+	if name == "" || strings.HasPrefix(strings.TrimPrefix(name, "/"), r.namePrefix()) {
+		return name
+	}
+	if strings.HasPrefix(name, "/") {
+		return "/" + r.namePrefix() + name[1:]
+	}
+	return r.namePrefix() + name
+}
+
+// unprefixName returns name without our prefix, keeping a leading slash (as container names have)
+func (r *RulesDirector) unprefixName(name string) string {
+	if strings.HasPrefix(name, "/") {
+		return "/" + strings.TrimPrefix(name[1:], r.namePrefix())
+	}
+	return strings.TrimPrefix(name, r.namePrefix())
+}
+
+// resolveName returns the prefixed name of a resource of kind if one exists, otherwise name
+// unchanged (e.g. it's an ID, or a resource created before PrefixNames was set)
+func (r *RulesDirector) resolveName(l socketproxy.Logger, kind, name string) (string, error) {
+	if !r.PrefixNames || name == "" || strings.HasPrefix(name, r.namePrefix()) {
+		return name, nil
+	}
+	prefixed := r.prefixName(name)
+	if _, err := r.inspectLabels(kind, prefixed); err == errInspectNotFound {
+		return name, nil
+	} else if err != nil {
+		return "", err
+	}
+	l.Printf("Resolved %s/%s to %s", kind, name, prefixed)
+	return prefixed, nil
+}
+
+// resolveRequestPath rewrites the container, network or volume name in a request path to its
+// prefixed name, if one exists
+func (r *RulesDirector) resolveRequestPath(l socketproxy.Logger, req *http.Request) error {
+	version := versionRegex.FindString(req.URL.Path)
+	m := namedPathRegex.FindStringSubmatch(strings.TrimPrefix(req.URL.Path, version))
+	if m == nil || reservedPathNames[m[2]] {
+		return nil
+	}
+
+	resolved, err := r.resolveName(l, m[1], m[2])
+	if err != nil {
+		return err
+	}
+	req.URL.Path = version + "/" + m[1] + "/" + resolved + m[3]
+	req.URL.RawPath = ""
+	return nil
+}
+
+// prefixContainerCreate prefixes the name of a container being created, and resolves the names of
+// the networks and volumes it references
+func (r *RulesDirector) prefixContainerCreate(l socketproxy.Logger, req *http.Request, create *dockerapi.ContainerCreate) error {
+	q := req.URL.Query()
+	if name := q.Get("name"); name != "" {
+		q.Set("name", r.prefixName(name))
+		req.URL.RawQuery = q.Encode()
+	}
+
+	hostConfig := &create.HostConfig
+
+	switch networkMode := hostConfig.NetworkMode; {
+	case networkMode == "" || networkMode == "default" || networkMode == "bridge" || networkMode == "none" || networkMode == "host":
+	case strings.HasPrefix(networkMode, "container:"):
+		resolved, err := r.resolveName(l, "containers", strings.TrimPrefix(networkMode, "container:"))
+		if err != nil {
+			return err
+		}
+		hostConfig.NetworkMode = "container:" + resolved
+	default:
+		resolved, err := r.resolveName(l, "networks", networkMode)
+		if err != nil {
+			return err
+		}
+		hostConfig.NetworkMode = resolved
+	}
+
+	if endpoints := create.NetworkingConfig.EndpointsConfig; endpoints != nil {
+		resolvedEndpoints := map[string]*dockerapi.EndpointSettings{}
+		for network, config := range endpoints {
+			resolved, err := r.resolveName(l, "networks", network)
+			if err != nil {
+				return err
+			}
+			resolvedEndpoints[resolved] = config
+		}
+		create.NetworkingConfig.EndpointsConfig = resolvedEndpoints
+	}
+
+	// Binds of named volumes (rather than host paths)
+	for i, bind := range hostConfig.Binds {
+		if strings.HasPrefix(bind, "/") {
+			continue
+		}
+		chunks := strings.SplitN(bind, ":", 2)
+		resolved, err := r.resolveName(l, "volumes", chunks[0])
+		if err != nil {
+			return err
+		}
+		chunks[0] = resolved
+		hostConfig.Binds[i] = strings.Join(chunks, ":")
+	}
+
+	for i, mount := range hostConfig.Mounts {
+		if mount.Type != "volume" || mount.Source == "" {
+			continue
+		}
+		resolved, err := r.resolveName(l, "volumes", mount.Source)
+		if err != nil {
+			return err
+		}
+		hostConfig.Mounts[i].Source = resolved
+	}
+
+	return nil
+}
+
+// prefixBodyName prefixes the Name in a create request body (e.g. for volumes) with PrefixNames
+func (r *RulesDirector) prefixBodyName(l socketproxy.Logger, upstream http.Handler) http.Handler {
+	if !r.PrefixNames {
+		return upstream
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		err := modifyRequestBody(req, func(decoded map[string]interface{}) {
+			if name, ok := decoded["Name"].(string); ok && name != "" {
+				decoded["Name"] = r.prefixName(name)
+				l.Printf("Prefixed name %q to %q", name, decoded["Name"])
+			}
+		})
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		upstream.ServeHTTP(w, req)
+	})
+}
+
+// unprefixNames strips our prefix from the Name and Names fields of a decoded response
+func (r *RulesDirector) unprefixNames(decoded map[string]interface{}) {
+	if name, ok := decoded["Name"].(string); ok {
+		decoded["Name"] = r.unprefixName(name)
+	}
+	names, _ := decoded["Names"].([]interface{})
+	for i, n := range names {
+		if name, ok := n.(string); ok {
+			names[i] = r.unprefixName(name)
+		}
+	}
+}
+
+// unprefixedResponse strips our prefix from the name in inspect responses with PrefixNames
+func (r *RulesDirector) unprefixedResponse(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	if !r.PrefixNames || req.Method != "GET" {
+		return upstream
+	}
+	return r.responseFilter(l, func(body json.RawMessage) (interface{}, error) {
+		var decoded map[string]interface{}
+		if err := unmarshalJSON(body, &decoded); err != nil {
+			return nil, err
+		}
+		r.unprefixNames(decoded)
+		return decoded, nil
+	})
+}
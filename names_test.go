@@ -0,0 +1,177 @@
+package sockguard
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/sockguard/sockguardtest"
+)
+
+func TestPrefixName(t *testing.T) {
+	r := mockRulesDirector()
+	r.Owner = "sockguard-pid-1/job"
+
+	tests := []struct {
+		name     string
+		prefixed string
+	}{
+		{"web", "sockguard_2dpid_2d1_2fjob__web"},
+		{"/web", "/sockguard_2dpid_2d1_2fjob__web"},
+		{"sockguard_2dpid_2d1_2fjob__web", "sockguard_2dpid_2d1_2fjob__web"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if actual := r.prefixName(test.name); actual != test.prefixed {
+			t.Errorf("Expected %q to be prefixed to %q, got %q", test.name, test.prefixed, actual)
+		}
+		if actual := r.unprefixName(test.prefixed); actual != strings.TrimPrefix(test.name, "sockguard_2dpid_2d1_2fjob__") {
+			t.Errorf("Expected %q to be unprefixed to %q, got %q", test.prefixed, test.name, actual)
+		}
+	}
+}
+
+func TestNamePrefixesDontCollide(t *testing.T) {
+	owners := []string{"a.b", "a_b", "a-b", "a", "a_", "ab", "a__b", "-a", "_a", "za", "z_2da", "z"}
+
+	// the daemon's names must match [a-zA-Z0-9][a-zA-Z0-9_.-]+
+	validName := regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+	prefixes := map[string]string{}
+	for _, owner := range owners {
+		r := mockRulesDirector()
+		r.Owner = owner
+		prefix := r.namePrefix()
+		if !validName.MatchString(prefix + "web") {
+			t.Errorf("Expected the prefix of %q (%q) to make valid names", owner, prefix)
+		}
+		if other, ok := prefixes[prefix]; ok {
+			t.Errorf("Expected owners %q and %q to have different prefixes, both got %q", owner, other, prefix)
+		}
+		prefixes[prefix] = owner
+	}
+
+	// nor can one owner's prefix start another's, e.g. a's name b__x and a_b's name x
+	for prefix, owner := range prefixes {
+		for other, otherOwner := range prefixes {
+			if prefix != other && strings.HasPrefix(other, prefix) {
+				t.Errorf("Expected the prefix of %q (%q) not to start the prefix of %q (%q)", owner, prefix, otherOwner, other)
+			}
+		}
+	}
+}
+
+func TestPrefixNamesRequests(t *testing.T) {
+	l := mockLogger()
+
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"test_2downer__web": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+			"legacy": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+			"test_2downer__my-app": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+		},
+	}
+
+	tests := []struct {
+		method   string
+		url      string
+		body     string
+		expected string
+	}{
+		{"POST", "/v1.37/containers/web/start", "", "/v1.37/containers/test_2downer__web/start"},
+		{"POST", "/v1.37/containers/test_2downer__web/start", "", "/v1.37/containers/test_2downer__web/start"},
+		{"POST", "/v1.37/containers/legacy/start", "", "/v1.37/containers/legacy/start"},
+		{"POST", "/v1.37/containers/web/rename?name=app", "", "/v1.37/containers/test_2downer__web/rename?name=test_2downer__app"},
+		{"POST", "/v1.37/containers/my-app/rename?name=my-app.2", "", "/v1.37/containers/test_2downer__my-app/rename?name=test_2downer__my-app.2"},
+		{"POST", "/v1.37/containers/create?name=db", `{"Image":"postgres","HostConfig":{"NetworkMode":"container:web"}}`, "/v1.37/containers/create?name=test_2downer__db"},
+	}
+
+	for _, test := range tests {
+		r := mockRulesDirectorWithUpstreamState(&us)
+		r.PrefixNames = true
+
+		var upstreamBody map[string]interface{}
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if actual := req.URL.RequestURI(); actual != test.expected {
+				t.Errorf("%s %s : Expected upstream request for %s, got %s", test.method, test.url, test.expected, actual)
+			}
+			if test.body != "" {
+				if err := json.NewDecoder(req.Body).Decode(&upstreamBody); err != nil {
+					t.Fatal(err)
+				}
+			}
+			w.WriteHeader(http.StatusOK)
+		})
+
+		req, err := http.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s %s : handler returned wrong status code: got %v want %v", test.method, test.url, rr.Code, http.StatusOK)
+		}
+		if upstreamBody != nil {
+			if networkMode := upstreamBody["HostConfig"].(map[string]interface{})["NetworkMode"]; networkMode != "container:test_2downer__web" {
+				t.Errorf("%s %s : Expected NetworkMode to be resolved to container:test_2downer__web, got %v", test.method, test.url, networkMode)
+			}
+		}
+	}
+}
+
+func TestPrefixNamesListResponse(t *testing.T) {
+	l := mockLogger()
+
+	r := mockRulesDirector()
+	r.PrefixNames = true
+	r.Client = &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) *http.Response {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`[{"Id":"c1","Names":["/test_2downer__web"],"Labels":{"com.buildkite.sockguard.owner":"test-owner"}},{"Id":"c2","Names":["/web"],"Labels":{"com.buildkite.sockguard.owner":"adifferentowner"}}]`)),
+			}
+		}),
+	}
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("%s shouldn't have been passed upstream", req.URL.Path)
+	})
+
+	req, err := http.NewRequest("GET", "/v1.37/containers/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var entries []struct {
+		Id    string
+		Names []string
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Id != "c1" || !reflect.DeepEqual(entries[0].Names, []string{"/web"}) {
+		t.Errorf("Expected only c1 named /web, got %+v", entries)
+	}
+}
@@ -0,0 +1,568 @@
+package sockguard
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Option configures a RulesDirector created with NewDirector, each sets the RulesDirector field
+// of the same name
+type Option func(*RulesDirector)
+
+// NewDirector returns a RulesDirector configured with opts, or an error if the configuration
+// is invalid (see Validate)
+func NewDirector(opts ...Option) (*RulesDirector, error) {
+	r := &RulesDirector{}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+var apiVersionRegex = regexp.MustCompile(`^\d+\.\d+$`)
+
+// Validate checks that the RulesDirector has a Client and Owner, and that its options don't conflict
+func (r *RulesDirector) Validate() error {
+	if r.Client == nil {
+		return fmt.Errorf("A Client for the upstream docker daemon is required")
+	}
+	if r.Owner == "" {
+		return fmt.Errorf("An Owner is required")
+	}
+
+	// These should not be used together, one or the other
+	if r.ContainerDockerLink != "" && r.ContainerJoinNetwork != "" {
+		return fmt.Errorf("ContainerDockerLink and ContainerJoinNetwork can't be used together")
+	}
+	if r.ContainerDockerLink != "" {
+		if _, err := splitContainerDockerLink(r.ContainerDockerLink); err != nil {
+			return err
+		}
+	}
+	if r.ContainerJoinNetworkAlias != "" && r.ContainerJoinNetwork == "" {
+		return fmt.Errorf("ContainerJoinNetworkAlias requires ContainerJoinNetwork")
+	}
+
+	// The privileged BuildKit image must be pinned, so a tag can't be repointed at something else
+	if r.BuildkitImage != "" && !strings.Contains(r.BuildkitImage, "@sha256:") {
+		return fmt.Errorf("BuildkitImage must be pinned to a digest (e.g. moby/buildkit@sha256:...)")
+	}
+
+	if r.MaxAPIVersion != "" && !apiVersionRegex.MatchString(r.MaxAPIVersion) {
+		return fmt.Errorf("MaxAPIVersion must be a docker API version (e.g. 1.41), got %q", r.MaxAPIVersion)
+	}
+
+	if r.DenyStatusCode != 0 && (r.DenyStatusCode < 400 || r.DenyStatusCode > 599) {
+		return fmt.Errorf("DenyStatusCode must be an error status code (4xx or 5xx), got %d", r.DenyStatusCode)
+	}
+
+	if len(r.AllowPrivilegedImages) > 0 && !r.AllowPrivileged {
+		return fmt.Errorf("AllowPrivilegedImages requires AllowPrivileged")
+	}
+	for _, image := range r.AllowPrivilegedImages {
+		if parseImageReference(image).Digest == "" {
+			return fmt.Errorf("AllowPrivilegedImages must be pinned to digests (e.g. docker@sha256:...), got %q", image)
+		}
+	}
+
+	if r.ContainerLogDriver != "" {
+		isKnown := false
+		for _, known := range containerLogDrivers {
+			isKnown = isKnown || r.ContainerLogDriver == known
+		}
+		if !isKnown {
+			return fmt.Errorf("ContainerLogDriver must be one of %s, got %q", strings.Join(containerLogDrivers, ", "), r.ContainerLogDriver)
+		}
+	}
+	if len(r.ContainerLogOptions) > 0 && r.ContainerLogDriver == "" {
+		return fmt.Errorf("ContainerLogOptions requires ContainerLogDriver")
+	}
+
+	if r.ContainerStorageSize < 0 || r.MaxContainerStorageSize < 0 {
+		return fmt.Errorf("ContainerStorageSize and MaxContainerStorageSize can't be negative")
+	}
+	if r.MaxContainerStorageSize > 0 && r.ContainerStorageSize > r.MaxContainerStorageSize {
+		return fmt.Errorf("ContainerStorageSize can't be more than MaxContainerStorageSize")
+	}
+
+	if r.ContainerStopTimeout < 0 || r.MinContainerStopTimeout < 0 {
+		return fmt.Errorf("ContainerStopTimeout and MinContainerStopTimeout can't be negative")
+	}
+	if r.ContainerStopTimeout > 0 && r.ContainerStopTimeout < r.MinContainerStopTimeout {
+		return fmt.Errorf("ContainerStopTimeout can't be less than MinContainerStopTimeout")
+	}
+
+	for _, endpoint := range r.AllowEndpoints {
+		if _, _, err := parseEndpointPattern(endpoint); err != nil {
+			return err
+		}
+	}
+
+	for kind := range r.MaxStreamDurations {
+		isKnown := false
+		for _, known := range streamKinds {
+			isKnown = isKnown || kind == known
+		}
+		if !isKnown {
+			return fmt.Errorf("Unknown stream kind %q in MaxStreamDurations, expected one of %s", kind, strings.Join(streamKinds, ", "))
+		}
+	}
+
+	return nil
+}
+
+func WithClient(client *http.Client) Option {
+	return func(r *RulesDirector) {
+		r.Client = client
+	}
+}
+
+func WithOwner(owner string) Option {
+	return func(r *RulesDirector) {
+		r.Owner = owner
+	}
+}
+
+func WithAllowBinds(allowBinds []string) Option {
+	return func(r *RulesDirector) {
+		r.AllowBinds = allowBinds
+	}
+}
+
+func WithAllowVolumes(allowVolumes []string) Option {
+	return func(r *RulesDirector) {
+		r.AllowVolumes = allowVolumes
+	}
+}
+
+func WithAllowNetworks(allowNetworks []string) Option {
+	return func(r *RulesDirector) {
+		r.AllowNetworks = allowNetworks
+	}
+}
+
+func WithAllowImages(allowImages []string) Option {
+	return func(r *RulesDirector) {
+		r.AllowImages = allowImages
+	}
+}
+
+func WithAllowPlatforms(allowPlatforms []string) Option {
+	return func(r *RulesDirector) {
+		r.AllowPlatforms = allowPlatforms
+	}
+}
+
+func WithAllowPushImages(allowPushImages []string) Option {
+	return func(r *RulesDirector) {
+		r.AllowPushImages = allowPushImages
+	}
+}
+
+func WithImageRewrites(imageRewrites []ImageRewrite) Option {
+	return func(r *RulesDirector) {
+		r.ImageRewrites = imageRewrites
+	}
+}
+
+func WithRequireImageDigest(requireImageDigest bool) Option {
+	return func(r *RulesDirector) {
+		r.RequireImageDigest = requireImageDigest
+	}
+}
+
+func WithDenyLatestImageTag(denyLatestImageTag bool) Option {
+	return func(r *RulesDirector) {
+		r.DenyLatestImageTag = denyLatestImageTag
+	}
+}
+
+func WithImageVerifier(imageVerifier ImageVerifier) Option {
+	return func(r *RulesDirector) {
+		r.ImageVerifier = imageVerifier
+	}
+}
+
+func WithBuildNetwork(buildNetwork string) Option {
+	return func(r *RulesDirector) {
+		r.BuildNetwork = buildNetwork
+	}
+}
+
+func WithDenyBuildRemotes(denyBuildRemotes bool) Option {
+	return func(r *RulesDirector) {
+		r.DenyBuildRemotes = denyBuildRemotes
+	}
+}
+
+func WithAllowBuildRemotes(allowBuildRemotes []string) Option {
+	return func(r *RulesDirector) {
+		r.AllowBuildRemotes = allowBuildRemotes
+	}
+}
+
+func WithBuildkitImage(buildkitImage string) Option {
+	return func(r *RulesDirector) {
+		r.BuildkitImage = buildkitImage
+	}
+}
+
+func WithAllowPrivileged(allowPrivileged bool) Option {
+	return func(r *RulesDirector) {
+		r.AllowPrivileged = allowPrivileged
+	}
+}
+
+func WithAllowPrivilegedImages(allowPrivilegedImages []string) Option {
+	return func(r *RulesDirector) {
+		r.AllowPrivilegedImages = allowPrivilegedImages
+	}
+}
+
+func WithBuildResourceDefaults(buildResourceDefaults map[string]int64) Option {
+	return func(r *RulesDirector) {
+		r.BuildResourceDefaults = buildResourceDefaults
+	}
+}
+
+func WithBuildResourceLimits(buildResourceLimits map[string]int64) Option {
+	return func(r *RulesDirector) {
+		r.BuildResourceLimits = buildResourceLimits
+	}
+}
+
+func WithDenyDockerfilePatterns(denyDockerfilePatterns []*regexp.Regexp) Option {
+	return func(r *RulesDirector) {
+		r.DenyDockerfilePatterns = denyDockerfilePatterns
+	}
+}
+
+func WithBuildCacheQuota(buildCacheQuota int64) Option {
+	return func(r *RulesDirector) {
+		r.BuildCacheQuota = buildCacheQuota
+	}
+}
+
+func WithAllowBuildPrune(allowBuildPrune bool) Option {
+	return func(r *RulesDirector) {
+		r.AllowBuildPrune = allowBuildPrune
+	}
+}
+
+func WithDenyBuildSecrets(denyBuildSecrets bool) Option {
+	return func(r *RulesDirector) {
+		r.DenyBuildSecrets = denyBuildSecrets
+	}
+}
+
+func WithDenyBuildSSH(denyBuildSSH bool) Option {
+	return func(r *RulesDirector) {
+		r.DenyBuildSSH = denyBuildSSH
+	}
+}
+
+func WithRegistryAuth(registryAuth RegistryAuth) Option {
+	return func(r *RulesDirector) {
+		r.RegistryAuth = registryAuth
+	}
+}
+
+func WithDenyBinds(denyBinds []string) Option {
+	return func(r *RulesDirector) {
+		r.DenyBinds = denyBinds
+	}
+}
+
+func WithAllowHostModeNetworking(allowHostModeNetworking bool) Option {
+	return func(r *RulesDirector) {
+		r.AllowHostModeNetworking = allowHostModeNetworking
+	}
+}
+
+func WithAllowSwarm(allowSwarm bool) Option {
+	return func(r *RulesDirector) {
+		r.AllowSwarm = allowSwarm
+	}
+}
+
+func WithDenyConfigs(denyConfigs bool) Option {
+	return func(r *RulesDirector) {
+		r.DenyConfigs = denyConfigs
+	}
+}
+
+func WithAllowCheckpoints(allowCheckpoints bool) Option {
+	return func(r *RulesDirector) {
+		r.AllowCheckpoints = allowCheckpoints
+	}
+}
+
+func WithAllowCheckpointDirs(allowCheckpointDirs []string) Option {
+	return func(r *RulesDirector) {
+		r.AllowCheckpointDirs = allowCheckpointDirs
+	}
+}
+
+func WithMaxAPIVersion(maxAPIVersion string) Option {
+	return func(r *RulesDirector) {
+		r.MaxAPIVersion = maxAPIVersion
+	}
+}
+
+func WithScrubInfo(scrubInfo bool) Option {
+	return func(r *RulesDirector) {
+		r.ScrubInfo = scrubInfo
+	}
+}
+
+func WithRedactInspectEnv(redactInspectEnv []string) Option {
+	return func(r *RulesDirector) {
+		r.RedactInspectEnv = redactInspectEnv
+	}
+}
+
+func WithRedactInspectHostPaths(redactInspectHostPaths bool) Option {
+	return func(r *RulesDirector) {
+		r.RedactInspectHostPaths = redactInspectHostPaths
+	}
+}
+
+func WithDenyContainerNames(denyContainerNames bool) Option {
+	return func(r *RulesDirector) {
+		r.DenyContainerNames = denyContainerNames
+	}
+}
+
+func WithPrefixNames(prefixNames bool) Option {
+	return func(r *RulesDirector) {
+		r.PrefixNames = prefixNames
+	}
+}
+
+func WithFilterListResponses(filterListResponses bool) Option {
+	return func(r *RulesDirector) {
+		r.FilterListResponses = filterListResponses
+	}
+}
+
+func WithAllowKillSignals(allowKillSignals []string) Option {
+	return func(r *RulesDirector) {
+		r.AllowKillSignals = allowKillSignals
+	}
+}
+
+func WithDenyArchiveWritePaths(denyArchiveWritePaths []string) Option {
+	return func(r *RulesDirector) {
+		r.DenyArchiveWritePaths = denyArchiveWritePaths
+	}
+}
+
+func WithDenyArchiveReadPaths(denyArchiveReadPaths []string) Option {
+	return func(r *RulesDirector) {
+		r.DenyArchiveReadPaths = denyArchiveReadPaths
+	}
+}
+
+func WithContainerResourceLimits(containerResourceLimits map[string]int64) Option {
+	return func(r *RulesDirector) {
+		r.ContainerResourceLimits = containerResourceLimits
+	}
+}
+
+func WithMinFreeDiskSpace(minFreeDiskSpace uint64) Option {
+	return func(r *RulesDirector) {
+		r.MinFreeDiskSpace = minFreeDiskSpace
+	}
+}
+
+func WithDataRoot(dataRoot string) Option {
+	return func(r *RulesDirector) {
+		r.DataRoot = dataRoot
+	}
+}
+
+func WithMaxStreamRate(maxStreamRate int64) Option {
+	return func(r *RulesDirector) {
+		r.MaxStreamRate = maxStreamRate
+	}
+}
+
+func WithInspectCacheTTL(inspectCacheTTL time.Duration) Option {
+	return func(r *RulesDirector) {
+		r.InspectCacheTTL = inspectCacheTTL
+	}
+}
+
+func WithMaxStreamDurations(maxStreamDurations map[string]time.Duration) Option {
+	return func(r *RulesDirector) {
+		r.MaxStreamDurations = maxStreamDurations
+	}
+}
+
+func WithOwnerQuota(ownerQuota map[string]int64) Option {
+	return func(r *RulesDirector) {
+		r.OwnerQuota = ownerQuota
+	}
+}
+
+func WithDenyExtraHosts(denyExtraHosts bool) Option {
+	return func(r *RulesDirector) {
+		r.DenyExtraHosts = denyExtraHosts
+	}
+}
+
+func WithDenyUlimits(denyUlimits bool) Option {
+	return func(r *RulesDirector) {
+		r.DenyUlimits = denyUlimits
+	}
+}
+
+func WithAllowIsolation(allowIsolation []string) Option {
+	return func(r *RulesDirector) {
+		r.AllowIsolation = allowIsolation
+	}
+}
+
+func WithDenyBuildSquash(denyBuildSquash bool) Option {
+	return func(r *RulesDirector) {
+		r.DenyBuildSquash = denyBuildSquash
+	}
+}
+
+func WithContainerCgroupParent(containerCgroupParent string) Option {
+	return func(r *RulesDirector) {
+		r.ContainerCgroupParent = containerCgroupParent
+	}
+}
+
+func WithResolveBindSymlinks(resolveBindSymlinks bool) Option {
+	return func(r *RulesDirector) {
+		r.ResolveBindSymlinks = resolveBindSymlinks
+	}
+}
+
+func WithAllowSharedBindPropagation(allowSharedBindPropagation bool) Option {
+	return func(r *RulesDirector) {
+		r.AllowSharedBindPropagation = allowSharedBindPropagation
+	}
+}
+
+func WithContainerDockerLink(containerDockerLink string) Option {
+	return func(r *RulesDirector) {
+		r.ContainerDockerLink = containerDockerLink
+	}
+}
+
+func WithContainerJoinNetwork(containerJoinNetwork string) Option {
+	return func(r *RulesDirector) {
+		r.ContainerJoinNetwork = containerJoinNetwork
+	}
+}
+
+func WithContainerJoinNetworkAlias(containerJoinNetworkAlias string) Option {
+	return func(r *RulesDirector) {
+		r.ContainerJoinNetworkAlias = containerJoinNetworkAlias
+	}
+}
+
+func WithUser(user string) Option {
+	return func(r *RulesDirector) {
+		r.User = user
+	}
+}
+
+func WithAllowUnowned(allowUnowned map[string]bool) Option {
+	return func(r *RulesDirector) {
+		r.AllowUnowned = allowUnowned
+	}
+}
+
+func WithAlsoAllowOwners(alsoAllowOwners []string) Option {
+	return func(r *RulesDirector) {
+		r.AlsoAllowOwners = alsoAllowOwners
+	}
+}
+
+func WithTrustOwnerHeader(trustOwnerHeader bool) Option {
+	return func(r *RulesDirector) {
+		r.TrustOwnerHeader = trustOwnerHeader
+	}
+}
+
+func WithDenyStatusCode(denyStatusCode int) Option {
+	return func(r *RulesDirector) {
+		r.DenyStatusCode = denyStatusCode
+	}
+}
+
+func WithDenyMessage(denyMessage string) Option {
+	return func(r *RulesDirector) {
+		r.DenyMessage = denyMessage
+	}
+}
+
+func WithStrict(strict bool) Option {
+	return func(r *RulesDirector) {
+		r.Strict = strict
+	}
+}
+
+func WithAllowEndpoints(allowEndpoints []string) Option {
+	return func(r *RulesDirector) {
+		r.AllowEndpoints = allowEndpoints
+	}
+}
+
+func WithContainerLogDriver(containerLogDriver string) Option {
+	return func(r *RulesDirector) {
+		r.ContainerLogDriver = containerLogDriver
+	}
+}
+
+func WithContainerLogOptions(containerLogOptions map[string]string) Option {
+	return func(r *RulesDirector) {
+		r.ContainerLogOptions = containerLogOptions
+	}
+}
+
+func WithContainerStorageSize(containerStorageSize int64) Option {
+	return func(r *RulesDirector) {
+		r.ContainerStorageSize = containerStorageSize
+	}
+}
+
+func WithMaxContainerStorageSize(maxContainerStorageSize int64) Option {
+	return func(r *RulesDirector) {
+		r.MaxContainerStorageSize = maxContainerStorageSize
+	}
+}
+
+func WithAllowRuntimes(allowRuntimes []string) Option {
+	return func(r *RulesDirector) {
+		r.AllowRuntimes = allowRuntimes
+	}
+}
+
+func WithForceInit(forceInit bool) Option {
+	return func(r *RulesDirector) {
+		r.ForceInit = forceInit
+	}
+}
+
+func WithContainerStopTimeout(containerStopTimeout int) Option {
+	return func(r *RulesDirector) {
+		r.ContainerStopTimeout = containerStopTimeout
+	}
+}
+
+func WithMinContainerStopTimeout(minContainerStopTimeout int) Option {
+	return func(r *RulesDirector) {
+		r.MinContainerStopTimeout = minContainerStopTimeout
+	}
+}
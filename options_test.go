@@ -0,0 +1,52 @@
+package sockguard
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewDirector(t *testing.T) {
+	r, err := NewDirector(
+		WithClient(&http.Client{}),
+		WithOwner("test-owner"),
+		WithAllowBinds([]string{"/tmp"}),
+		WithContainerJoinNetwork("ciagent"),
+		WithContainerJoinNetworkAlias("agent"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Owner != "test-owner" || len(r.AllowBinds) != 1 || r.ContainerJoinNetworkAlias != "agent" {
+		t.Errorf("Expected options to be applied, got %+v", r)
+	}
+}
+
+func TestNewDirectorValidates(t *testing.T) {
+	base := []Option{WithClient(&http.Client{}), WithOwner("test-owner")}
+
+	tests := map[string][]Option{
+		"no client":               {WithOwner("test-owner")},
+		"no owner":                {WithClient(&http.Client{})},
+		"docker link and join":    append(base, WithContainerDockerLink("ciagent"), WithContainerJoinNetwork("ciagent")),
+		"invalid docker link":     append(base, WithContainerDockerLink("a:b:c")),
+		"alias without join":      append(base, WithContainerJoinNetworkAlias("agent")),
+		"unpinned buildkit image": append(base, WithBuildkitImage("moby/buildkit:latest")),
+		"invalid max api version": append(base, WithMaxAPIVersion("v1.41")),
+		"unknown stream kind":     append(base, WithMaxStreamDurations(map[string]time.Duration{"pull": time.Minute})),
+		"non-error deny status":   append(base, WithDenyStatusCode(http.StatusOK)),
+		"privileged images only":  append(base, WithAllowPrivilegedImages([]string{"docker@sha256:52bf9b1c2d46521bfc80cda0da9caa1378e15e17ea2e8add41d8e21f5e31f0fb"})),
+		"unpinned privileged":     append(base, WithAllowPrivileged(true), WithAllowPrivilegedImages([]string{"docker:24-dind"})),
+		"unknown log driver":      append(base, WithContainerLogDriver("journald")),
+		"log options only":        append(base, WithContainerLogOptions(map[string]string{"max-size": "10m"})),
+		"storage size over max":   append(base, WithContainerStorageSize(20<<30), WithMaxContainerStorageSize(10<<30)),
+		"negative stop timeout":   append(base, WithContainerStopTimeout(-1)),
+		"stop timeout under min":  append(base, WithContainerStopTimeout(5), WithMinContainerStopTimeout(30)),
+	}
+
+	for name, opts := range tests {
+		if _, err := NewDirector(opts...); err == nil {
+			t.Errorf("%s : expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package sockguard
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/buildkite/sockguard/dockerapi"
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// labelsResult is the result of inspecting the labels of a resource
+type labelsResult struct {
+	labels map[string]string
+	err    error
+}
+
+// referenceName returns the container, network or volume name from a reference with options, e.g.
+// the name from name:alias links, name:ro volumes from and name:/path binds
+func referenceName(ref string) string {
+	return strings.TrimPrefix(strings.SplitN(ref, ":", 2)[0], "/")
+}
+
+// containerCreateReferences returns the containers, networks and named volumes a container create
+// references, by kind
+func containerCreateReferences(create *dockerapi.ContainerCreate) map[string][]string {
+	refs := map[string][]string{}
+	hostConfig := create.HostConfig
+
+	for _, ref := range append(append([]string{}, hostConfig.Links...), hostConfig.VolumesFrom...) {
+		refs["containers"] = append(refs["containers"], referenceName(ref))
+	}
+
+	networks := []string{}
+	if strings.HasPrefix(hostConfig.NetworkMode, "container:") {
+		refs["containers"] = append(refs["containers"], strings.TrimPrefix(hostConfig.NetworkMode, "container:"))
+	} else {
+		networks = append(networks, hostConfig.NetworkMode)
+	}
+	for network := range create.NetworkingConfig.EndpointsConfig {
+		networks = append(networks, network)
+	}
+	for _, network := range networks {
+		switch network {
+		case "", "default", "bridge", "none", "host":
+		default:
+			refs["networks"] = append(refs["networks"], network)
+		}
+	}
+
+	for _, bind := range hostConfig.Binds {
+		if !strings.ContainsAny(strings.SplitN(bind, ":", 2)[0], ".\\/") {
+			refs["volumes"] = append(refs["volumes"], referenceName(bind))
+		}
+	}
+	for _, mount := range hostConfig.Mounts {
+		if mount.Type == "volume" && mount.Source != "" {
+			refs["volumes"] = append(refs["volumes"], mount.Source)
+		}
+	}
+
+	return refs
+}
+
+// withPrefetchedLabels returns a copy of the RulesDirector that has inspected the labels of refs
+// (by kind) concurrently in one pass, rather than one at a time as each is checked
+func (r *RulesDirector) withPrefetchedLabels(l socketproxy.Logger, refs map[string][]string) *RulesDirector {
+	type reference struct {
+		kind, id string
+	}
+	seen := map[string]bool{}
+	references := []reference{}
+	for kind, ids := range refs {
+		for _, id := range ids {
+			if key := kind + "/" + id; !seen[key] {
+				seen[key] = true
+				references = append(references, reference{kind, id})
+			}
+		}
+	}
+	if len(references) == 0 {
+		return r
+	}
+
+	// each inspect writes only its own result, so they don't need a lock
+	var wg sync.WaitGroup
+	results := make([]labelsResult, len(references))
+	for i, ref := range references {
+		wg.Add(1)
+		go func(i int, ref reference) {
+			defer wg.Done()
+			labels, err := r.inspectLabels(ref.kind, ref.id)
+			results[i] = labelsResult{labels: labels, err: err}
+		}(i, ref)
+	}
+	wg.Wait()
+
+	prefetched := make(map[string]labelsResult, len(references))
+	for i, ref := range references {
+		prefetched[ref.kind+"/"+ref.id] = results[i]
+	}
+	l.Printf("Prefetched labels of %d referenced resources", len(prefetched))
+	prefetching := *r
+	prefetching.prefetched = prefetched
+	return &prefetching
+}
@@ -0,0 +1,121 @@
+package sockguard
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/sockguard/dockerapi"
+	"github.com/buildkite/sockguard/sockguardtest"
+)
+
+func TestContainerCreateReferences(t *testing.T) {
+	create := &dockerapi.ContainerCreate{
+		HostConfig: dockerapi.HostConfig{
+			Links:       []string{"/db:database"},
+			VolumesFrom: []string{"data:ro"},
+			NetworkMode: "container:app",
+			Binds:       []string{"/tmp:/tmp", "cache:/cache"},
+			Mounts:      []dockerapi.Mount{{Type: "volume", Source: "logs"}},
+		},
+		NetworkingConfig: dockerapi.NetworkingConfig{
+			EndpointsConfig: map[string]*dockerapi.EndpointSettings{"bridge": nil, "backend": nil},
+		},
+	}
+	expected := map[string][]string{
+		"containers": {"db", "data", "app"},
+		"networks":   {"backend"},
+		"volumes":    {"cache", "logs"},
+	}
+	if actual := containerCreateReferences(create); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestContainerCreatePrefetchesReferences(t *testing.T) {
+	l := mockLogger()
+
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"db": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+		},
+	}
+
+	var mu sync.Mutex
+	inspects := map[string]int{}
+	client := mockRulesDirectorHttpClientWithUpstreamState(&us)
+	transport := client.Transport
+	client.Transport = roundTripFunc(func(req *http.Request) *http.Response {
+		mu.Lock()
+		inspects[req.URL.Path]++
+		mu.Unlock()
+		resp, _ := transport.RoundTrip(req)
+		return resp
+	})
+
+	r := mockRulesDirector()
+	r.Client = client
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	body := `{"Image":"alpine","Labels":{},"HostConfig":{"Links":["db:database"],"VolumesFrom":["db"],"NetworkMode":"container:db"}}`
+	req, err := http.NewRequest("POST", "/v1.37/containers/create", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if n := inspects["/v1.37/containers/db/json"]; n != 1 {
+		t.Errorf("Expected the referenced container to be inspected once, got %d", n)
+	}
+}
+
+func TestWithPrefetchedLabels(t *testing.T) {
+	l := mockLogger()
+
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"db":    sockguardtest.Container{Owner: "test-owner"},
+			"cache": sockguardtest.Container{Owner: "adifferentowner"},
+		},
+		Networks: map[string]sockguardtest.Network{
+			"net": sockguardtest.Network{Owner: "test-owner"},
+		},
+		Volumes: map[string]sockguardtest.Volume{
+			"data": sockguardtest.Volume{Owner: "test-owner"},
+		},
+	}
+	r := mockRulesDirectorWithUpstreamState(&us)
+
+	prefetching := r.withPrefetchedLabels(l, map[string][]string{
+		"containers": []string{"db", "cache", "db", "missing"},
+		"networks":   []string{"net", "net"},
+		"volumes":    []string{"data"},
+	})
+
+	if len(prefetching.prefetched) != 5 {
+		t.Fatalf("Expected 5 prefetched resources, got %v", prefetching.prefetched)
+	}
+	for key, owner := range map[string]string{"containers/db": "test-owner", "containers/cache": "adifferentowner", "networks/net": "test-owner", "volumes/data": "test-owner"} {
+		if result := prefetching.prefetched[key]; result.err != nil || result.labels[ownerKey] != owner {
+			t.Errorf("%s : expected owner %q, got %v (%v)", key, owner, result.labels, result.err)
+		}
+	}
+	if result := prefetching.prefetched["containers/missing"]; result.err != errInspectNotFound {
+		t.Errorf("Expected containers/missing to be not found, got %v", result.err)
+	}
+	if r.prefetched != nil {
+		t.Errorf("Expected the original RulesDirector to be unchanged")
+	}
+}
@@ -0,0 +1,139 @@
+package sockguard
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// RegistryCredentials are the credentials for a single registry, in the format the
+// docker daemon expects in X-Registry-Auth
+type RegistryCredentials struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	ServerAddress string `json:"serveraddress,omitempty"`
+}
+
+// RegistryAuth holds registry credentials, keyed by registry domain (e.g. docker.io)
+type RegistryAuth map[string]RegistryCredentials
+
+// ParseRegistryAuth parses registry credentials in the docker config.json format, e.g.
+// {"auths":{"registry.example.com":{"auth":"base64(username:password)"}}}
+func ParseRegistryAuth(data []byte) (RegistryAuth, error) {
+	var config struct {
+		Auths map[string]struct {
+			Auth          string `json:"auth"`
+			Username      string `json:"username"`
+			Password      string `json:"password"`
+			IdentityToken string `json:"identitytoken"`
+		} `json:"auths"`
+	}
+
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	auth := RegistryAuth{}
+	for server, v := range config.Auths {
+		creds := RegistryCredentials{
+			Username:      v.Username,
+			Password:      v.Password,
+			IdentityToken: v.IdentityToken,
+			ServerAddress: server,
+		}
+		if v.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(v.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to decode auth for registry %q: %s", server, err.Error())
+			}
+			userPass := strings.SplitN(string(decoded), ":", 2)
+			if len(userPass) != 2 {
+				return nil, fmt.Errorf("Expected auth for registry %q to be username:password", server)
+			}
+			creds.Username, creds.Password = userPass[0], userPass[1]
+		}
+		auth[registryDomain(server)] = creds
+	}
+
+	return auth, nil
+}
+
+// LoadRegistryAuthFile loads registry credentials from a docker config.json format file
+func LoadRegistryAuthFile(path string) (RegistryAuth, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRegistryAuth(data)
+}
+
+// registryDomain normalizes a registry server address (e.g. https://index.docker.io/v1/)
+// to the domain used in image references (e.g. docker.io)
+func registryDomain(server string) string {
+	if idx := strings.Index(server, "://"); idx >= 0 {
+		server = server[idx+3:]
+	}
+	server = strings.SplitN(server, "/", 2)[0]
+	if server == "index.docker.io" || server == "registry-1.docker.io" {
+		return defaultImageDomain
+	}
+	return server
+}
+
+func encodeRegistryHeader(v interface{}) (string, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(encoded), nil
+}
+
+// registryAuth returns the X-Registry-Auth header for the registry of ref, or an empty string if
+// we don't hold credentials for it
+func (r *RulesDirector) registryAuth(ref string) (string, error) {
+	creds, ok := r.RegistryAuth[parseImageReference(ref).Domain]
+	if !ok {
+		return "", nil
+	}
+	return encodeRegistryHeader(creds)
+}
+
+// injectRegistryAuth sets X-Registry-Auth for the registry ref is pulled from or pushed to,
+// if we hold credentials for it
+func (r *RulesDirector) injectRegistryAuth(l socketproxy.Logger, req *http.Request, ref string) error {
+	header, err := r.registryAuth(ref)
+	if err != nil || header == "" {
+		return err
+	}
+
+	l.Printf("Injecting X-Registry-Auth for registry %q", parseImageReference(ref).Domain)
+	req.Header.Set("X-Registry-Auth", header)
+	return nil
+}
+
+// injectRegistryConfig sets X-Registry-Config for builds to all the credentials we hold
+func (r *RulesDirector) injectRegistryConfig(l socketproxy.Logger, req *http.Request) error {
+	if len(r.RegistryAuth) == 0 {
+		return nil
+	}
+
+	config := map[string]RegistryCredentials{}
+	for _, creds := range r.RegistryAuth {
+		config[creds.ServerAddress] = creds
+	}
+
+	header, err := encodeRegistryHeader(config)
+	if err != nil {
+		return err
+	}
+
+	l.Printf("Injecting X-Registry-Config for %d registries", len(config))
+	req.Header.Set("X-Registry-Config", header)
+	return nil
+}
@@ -0,0 +1,90 @@
+package sockguard
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseRegistryAuth(t *testing.T) {
+	auth, err := ParseRegistryAuth([]byte(`{"auths":{
+		"https://index.docker.io/v1/":{"auth":"dXNlcjpwYXNzOndvcmQ="},
+		"registry.example.com":{"identitytoken":"token"}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := RegistryAuth{
+		"docker.io": RegistryCredentials{
+			Username: "user", Password: "pass:word", ServerAddress: "https://index.docker.io/v1/",
+		},
+		"registry.example.com": RegistryCredentials{
+			IdentityToken: "token", ServerAddress: "registry.example.com",
+		},
+	}
+	if !cmp.Equal(auth, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, auth)
+	}
+}
+
+func TestHandleImageCreateInjectsRegistryAuth(t *testing.T) {
+	l := mockLogger()
+	r := mockRulesDirector()
+	r.RegistryAuth = RegistryAuth{
+		"registry.example.com": RegistryCredentials{
+			Username: "user", Password: "pass", ServerAddress: "registry.example.com",
+		},
+	}
+
+	// key = image pulled, value = expected credentials sent upstream
+	tests := map[string]*RegistryCredentials{
+		"registry.example.com/app": &RegistryCredentials{Username: "user", Password: "pass", ServerAddress: "registry.example.com"},
+		"alpine":                   nil,
+	}
+
+	for k, v := range tests {
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			header := req.Header.Get("X-Registry-Auth")
+			if v == nil {
+				if header != "" {
+					t.Errorf("%s : Expected no X-Registry-Auth, got %q", k, header)
+				}
+			} else {
+				decoded, err := base64.URLEncoding.DecodeString(header)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var creds RegistryCredentials
+				if err := json.Unmarshal(decoded, &creds); err != nil {
+					t.Fatal(err)
+				}
+				if !cmp.Equal(creds, *v) {
+					t.Errorf("%s : Expected X-Registry-Auth %+v, got %+v", k, *v, creds)
+				}
+			}
+			fmt.Fprintf(w, `{}`)
+		})
+
+		req, err := http.NewRequest("POST", "/v1.37/images/create?fromImage="+k+"&tag=1.0", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Clients credentials should be replaced by ours
+		req.Header.Set("X-Registry-Auth", "e30=")
+		if v == nil {
+			req.Header.Del("X-Registry-Auth")
+		}
+		rr := httptest.NewRecorder()
+		r.handleImageCreate(l, req, upstream).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s : handler returned wrong status code: got %v want %v", k, rr.Code, http.StatusOK)
+		}
+	}
+}
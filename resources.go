@@ -0,0 +1,210 @@
+package sockguard
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/sockguard/dockerapi"
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// The HostConfig resources that limits can be applied to on container create and update
+var containerResourceParams = []string{"Memory", "MemorySwap", "NanoCpus", "CpuShares", "CpuPeriod", "CpuQuota", "PidsLimit"}
+
+// parseResources parses a comma separated list of param=value resources, where param is one of known
+func parseResources(s string, known []string) (map[string]int64, error) {
+	resources := map[string]int64{}
+	for _, pair := range strings.Split(s, ",") {
+		chunks := strings.SplitN(pair, "=", 2)
+		if len(chunks) != 2 {
+			return nil, fmt.Errorf("Invalid resource %q, expected param=value", pair)
+		}
+		isKnown := false
+		for _, param := range known {
+			isKnown = isKnown || chunks[0] == param
+		}
+		if !isKnown {
+			return nil, fmt.Errorf("Unknown resource %q, expected one of %s", chunks[0], strings.Join(known, ", "))
+		}
+		value, err := strconv.ParseInt(chunks[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for resource %q: %v", chunks[0], err)
+		}
+		resources[chunks[0]] = value
+	}
+	return resources, nil
+}
+
+// ParseContainerResources parses a comma separated list of param=value HostConfig resources for
+// containers, e.g. Memory=1073741824,NanoCpus=2000000000
+func ParseContainerResources(s string) (map[string]int64, error) {
+	return parseResources(s, containerResourceParams)
+}
+
+// The HostConfig resources that can be budgeted across all of an owner's containers
+var ownerQuotaParams = []string{"Memory", "NanoCpus"}
+
+// ParseOwnerQuota parses a comma separated list of param=value budgets for the total resources of
+// an owner's containers, e.g. Memory=8589934592,NanoCpus=4000000000
+func ParseOwnerQuota(s string) (map[string]int64, error) {
+	return parseResources(s, ownerQuotaParams)
+}
+
+// ownedContainerResources sums the OwnerQuota resources of our existing containers, other than
+// the one with ID exclude (e.g. one being updated). Stopped containers are included, as they can
+// be started again.
+func (r *RulesDirector) ownedContainerResources(exclude string) (map[string]int64, error) {
+	containers, err := r.listOwned("containers")
+	if err != nil {
+		return nil, err
+	}
+
+	used := map[string]int64{}
+	for _, c := range containers {
+		if c.ID == exclude {
+			continue
+		}
+		var result struct {
+			HostConfig map[string]interface{}
+		}
+		if err := r.getInto(&result, "/containers/%s/json", c.ID); err == errInspectNotFound {
+			// removed since it was listed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for param := range r.OwnerQuota {
+			if v, ok := jsonInt64(result.HostConfig[param]); ok {
+				used[param] += v
+			}
+		}
+	}
+	return used, nil
+}
+
+// lockOwnerQuota serialises the owner's quota checks along with the creates and updates they
+// allow, otherwise concurrent requests could each fit in what's left of the quota. The caller
+// must call the returned func to unlock it.
+func (r *RulesDirector) lockOwnerQuota() func() {
+	s := r.lockState()
+	s.mu.Unlock()
+	s.quotaMu.Lock()
+	return s.quotaMu.Unlock
+}
+
+// checkOwnerQuota checks the resources in a container create HostConfig or update body fit within
+// what's left of the OwnerQuota. Containers must set budgeted resources on create, otherwise they
+// would be unlimited, on update unset resources are left unchanged.
+func (r *RulesDirector) checkOwnerQuota(l socketproxy.Logger, resources map[string]interface{}, used map[string]int64, create bool) error {
+	for _, param := range ownerQuotaParams {
+		quota := r.OwnerQuota[param]
+		if quota == 0 {
+			continue
+		}
+		value, _ := jsonInt64(resources[param])
+		if value == 0 && !create {
+			continue
+		}
+		if value <= 0 {
+			l.Printf("Denied unset %s, owner has a quota of %d", param, quota)
+			return fmt.Errorf("Containers must set %s, as there is a quota of %d across all containers", param, quota)
+		}
+		if used[param]+value > quota {
+			l.Printf("Denied %s=%d, %d of the quota of %d is already used", param, value, used[param], quota)
+			return fmt.Errorf("Containers aren't allowed to set %s to %d, as %d of the quota of %d is already used", param, value, used[param], quota)
+		}
+	}
+	return nil
+}
+
+// applyContainerResourceLimits checks the resources in a container create HostConfig or update body
+// against ContainerResourceLimits. On create unset resources are unlimited, so the limit is applied
+// instead, on update they are left unchanged.
+func (r *RulesDirector) applyContainerResourceLimits(l socketproxy.Logger, resources map[string]interface{}, create bool) error {
+	for _, param := range containerResourceParams {
+		limit := r.ContainerResourceLimits[param]
+		if limit == 0 {
+			continue
+		}
+		var value int64
+		if v, ok := resources[param]; ok && v != nil {
+			if value, ok = jsonInt64(v); !ok {
+				return fmt.Errorf("Invalid value for %s: %v", param, v)
+			}
+		}
+		if value == 0 && create {
+			l.Printf("Applied limit %s=%d to container", param, limit)
+			resources[param] = limit
+		} else if value < 0 || value > limit {
+			l.Printf("Denied %s=%d, exceeds limit of %d", param, value, limit)
+			return fmt.Errorf("Containers aren't allowed to set %s above %d (received %d)", param, limit, value)
+		}
+	}
+	return nil
+}
+
+// handleContainerUpdate checks the container is owned, and the updated resources are within
+// ContainerResourceLimits and the OwnerQuota
+func (r *RulesDirector) handleContainerUpdate(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !r.requireContainerOwner(l, w, req) {
+			return
+		}
+
+		var update dockerapi.ContainerUpdate
+		if err := decodeJSON(req.Body, &update); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if update.Extra == nil {
+			update.Extra = map[string]interface{}{}
+		}
+
+		if err := r.applyContainerResourceLimits(l, update.Extra, false); err != nil {
+			r.writeDenied(w, req, err.Error())
+			return
+		}
+
+		// check the updated resources fit in what's left of the owner's quota with the container's
+		// current resources replaced, if configured
+		if len(r.OwnerQuota) > 0 {
+			unlock := r.lockOwnerQuota()
+			defer unlock()
+
+			var container struct {
+				Id string
+			}
+			m := identifierPatterns[0].FindStringSubmatch(versionRegex.ReplaceAllString(req.URL.Path, ""))
+			if err := r.getInto(&container, "/containers/%s/json", m[1]); err != nil && err != errInspectNotFound {
+				writeError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			used, err := r.ownedContainerResources(container.Id)
+			if err != nil {
+				writeError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := r.checkOwnerQuota(l, update.Extra, used, false); err != nil {
+				r.writeDenied(w, req, err.Error())
+				return
+			}
+		}
+
+		encoded, err := json.Marshal(update)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// reset it so that upstream can read it again
+		req.ContentLength = int64(len(encoded))
+		req.Body = ioutil.NopCloser(bytes.NewReader(encoded))
+
+		upstream.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,314 @@
+package sockguard
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buildkite/sockguard/sockguardtest"
+)
+
+func TestHandleContainerUpdate(t *testing.T) {
+	l := mockLogger()
+
+	// Pre-populated simplified upstream state that "exists" before tests execute.
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"owned": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+			"foreign": sockguardtest.Container{
+				Owner: "adifferentowner",
+			},
+			"my-app": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+		},
+	}
+	r := mockRulesDirectorWithUpstreamState(&us)
+	r.ContainerResourceLimits = map[string]int64{"Memory": 1000, "PidsLimit": 100}
+
+	tests := []struct {
+		container string
+		body      string
+		esc       int
+	}{
+		{"owned", `{"Memory":500}`, 200},
+		{"owned", `{"CpuShares":512,"RestartPolicy":{"Name":"always"}}`, 200},
+		{"owned", `{"Memory":2000}`, 401},
+		{"owned", `{"PidsLimit":-1}`, 401},
+		{"owned", `{"memory":2000}`, 401},
+		{"foreign", `{"Memory":500}`, 401},
+		{"my-app", `{"Memory":500}`, 200},
+		{"my-app", `{"Memory":99999999999}`, 401},
+	}
+
+	for _, test := range tests {
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != test.body {
+				t.Errorf("%s : Expected request body to be unchanged, got %s", test.body, body)
+			}
+		})
+
+		req, err := http.NewRequest("POST", "/v1.37/containers/"+test.container+"/update", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.esc {
+			t.Errorf("%s %s : handler returned wrong status code: got %v want %v", test.container, test.body, status, test.esc)
+		}
+	}
+}
+
+func TestOwnerQuota(t *testing.T) {
+	l := mockLogger()
+
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"owned1": sockguardtest.Container{
+				Owner:    "test-owner",
+				Memory:   1024,
+				NanoCpus: 1000,
+			},
+			"owned2": sockguardtest.Container{
+				Owner:  "test-owner",
+				Memory: 1024,
+			},
+			"foreign": sockguardtest.Container{
+				Owner:    "adifferentowner",
+				Memory:   8192,
+				NanoCpus: 8000,
+			},
+		},
+	}
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		limits map[string]int64
+		body   string
+		status int
+	}{
+		{nil, `{"Image":"alpine","HostConfig":{"Memory":2048,"NanoCpus":3000}}`, 200},
+		{nil, `{"Image":"alpine","HostConfig":{"Memory":2049,"NanoCpus":1000}}`, 401},
+		{nil, `{"Image":"alpine","HostConfig":{"Memory":1024,"NanoCpus":3001}}`, 401},
+		{nil, `{"Image":"alpine","HostConfig":{"Memory":1024}}`, 401},
+		{map[string]int64{"Memory": 1024, "NanoCpus": 1000}, `{"Image":"alpine","HostConfig":{}}`, 200},
+		{map[string]int64{"Memory": 4096, "NanoCpus": 1000}, `{"Image":"alpine","HostConfig":{}}`, 401},
+	}
+
+	for _, test := range tests {
+		r := mockRulesDirectorWithUpstreamState(&us)
+		r.OwnerQuota = map[string]int64{"Memory": 4096, "NanoCpus": 4000}
+		r.ContainerResourceLimits = test.limits
+
+		req, err := http.NewRequest("POST", "/v1.37/containers/create", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("%s : handler returned wrong status code: got %v want %v", test.body, status, test.status)
+		}
+	}
+}
+
+func TestOwnerQuotaUpdate(t *testing.T) {
+	l := mockLogger()
+
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"owned1": sockguardtest.Container{
+				Owner:    "test-owner",
+				Memory:   1024,
+				NanoCpus: 1000,
+			},
+			"owned2": sockguardtest.Container{
+				Owner:  "test-owner",
+				Memory: 1024,
+			},
+		},
+	}
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"Memory":3072}`, 200},
+		{`{"Memory":3073}`, 401},
+		{`{"NanoCpus":4000}`, 200},
+		{`{"NanoCpus":4001}`, 401},
+		{`{"memory":3073}`, 401},
+		{`{"Memory":0,"NanoCpus":0,"CpuShares":512}`, 200},
+		{`{"Memory":-1}`, 401},
+	}
+
+	for _, test := range tests {
+		r := mockRulesDirectorWithUpstreamState(&us)
+		r.OwnerQuota = map[string]int64{"Memory": 4096, "NanoCpus": 4000}
+
+		req, err := http.NewRequest("POST", "/v1.37/containers/owned1/update", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("%s : handler returned wrong status code: got %v want %v", test.body, status, test.status)
+		}
+	}
+}
+
+func TestOwnerQuotaSerialised(t *testing.T) {
+	l := mockLogger()
+	us := sockguardtest.State{}
+	r := mockRulesDirectorWithUpstreamState(&us)
+	r.OwnerQuota = map[string]int64{"Memory": 4096}
+
+	var inFlight, maxInFlight int32
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest("POST", "/v1.37/containers/create", strings.NewReader(`{"Image":"alpine","HostConfig":{"Memory":1024}}`))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			rr := httptest.NewRecorder()
+			r.Direct(l, req, upstream).ServeHTTP(rr, req)
+		}()
+	}
+	wg.Wait()
+
+	if maxInFlight != 1 {
+		t.Errorf("Expected creates checked against the quota to be serialised, got %d at once", maxInFlight)
+	}
+}
+
+func TestContainerCreatePreservesFields(t *testing.T) {
+	l := mockLogger()
+	r := mockRulesDirector()
+
+	// numbers beyond what float64 can represent exactly, and fields we don't know about, in an
+	// order that isn't sorted
+	body := `{"Image":"alpine","Labels":{"z":"1"},"HostConfig":{"MemorySwap":9007199254740993,"FutureField":{"Value":1.50,"A":"\u00e9"}}}`
+	expected := `{"Image":"alpine","Labels":{"com.buildkite.sockguard.owner":"test-owner","z":"1"},"HostConfig":{"MemorySwap":9007199254740993,"FutureField":{"Value":1.50,"A":"\u00e9"}}}`
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(received) != expected {
+			t.Errorf("Expected %s upstream, got %s", expected, received)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	req, err := http.NewRequest("POST", "/v1.37/containers/create", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+}
+
+func TestContainerCreateCaseInsensitiveFields(t *testing.T) {
+	l := mockLogger()
+
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"owned": sockguardtest.Container{
+				Owner:  "test-owner",
+				Memory: 1024,
+			},
+		},
+	}
+
+	tests := []struct {
+		body     string
+		status   int
+		expected []string
+	}{
+		{`{"Image":"alpine","HostConfig":{"memory":99999999,"nanocpus":1000}}`, 401, nil},
+		{`{"Image":"alpine","HostConfig":{"MEMORY":2048,"NanoCpus":1000}}`, 401, nil},
+		{`{"Image":"alpine","HostConfig":{"memory":1024,"nanocpus":1000,"init":false,"storageopt":{"size":"1G"},"logconfig":{"Type":"syslog"}}}`, 401, nil},
+		{`{"Image":"alpine","stoptimeout":1,"HostConfig":{"memory":1024,"nanocpus":1000,"init":false,"storageopt":{"size":"1G"}}}`, 200, []string{`"Init":true`, `"StopTimeout":30`, `"StorageOpt":{"size":"1G"}`, `"LogConfig":{"Config":{"max-size":"10m"},"Type":"json-file"}`}},
+		{`{"Image":"alpine","HostConfig":{"Memory":1024,"memory":1024,"NanoCpus":1000}}`, 400, nil},
+	}
+
+	for _, test := range tests {
+		r := mockRulesDirectorWithUpstreamState(&us)
+		r.ContainerResourceLimits = map[string]int64{"Memory": 2048}
+		r.OwnerQuota = map[string]int64{"Memory": 3000}
+		r.ContainerLogDriver = "json-file"
+		r.ContainerLogOptions = map[string]string{"max-size": "10m"}
+		r.MaxContainerStorageSize = 1 << 30
+		r.ForceInit = true
+		r.MinContainerStopTimeout = 30
+
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			received, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, expected := range test.expected {
+				if !strings.Contains(string(received), expected) {
+					t.Errorf("%s : Expected %s upstream, got %s", test.body, expected, received)
+				}
+			}
+			w.WriteHeader(http.StatusOK)
+		})
+
+		req, err := http.NewRequest("POST", "/v1.37/containers/create", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("%s : handler returned wrong status code: got %v want %v", test.body, status, test.status)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package sockguard
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/sockguard/sockguardtest"
+)
+
+func TestSecretEndpoints(t *testing.T) {
+	l := mockLogger()
+
+	us := sockguardtest.State{
+		Secrets: map[string]string{
+			"owned":   "test-owner",
+			"foreign": "adifferentowner",
+		},
+	}
+	r := mockRulesDirectorWithUpstreamState(&us)
+	r.AllowSwarm = true
+
+	tests := []struct {
+		method string
+		url    string
+		body   string
+		status int
+	}{
+		{"GET", "/v1.37/secrets", "", 200},
+		{"GET", "/v1.37/secrets/owned", "", 200},
+		{"GET", "/v1.37/secrets/foreign", "", 401},
+		{"DELETE", "/v1.37/secrets/owned", "", 200},
+		{"DELETE", "/v1.37/secrets/foreign", "", 401},
+		{"POST", "/v1.37/secrets/create", `{"Name":"token","Data":"c2VjcmV0"}`, 200},
+		{"POST", "/v1.37/secrets/create", `{"Name":"token","Labels":null,"Data":"c2VjcmV0"}`, 200},
+		{"POST", "/v1.37/secrets/owned/update?version=1", `{"Name":"owned","Labels":{}}`, 200},
+		{"POST", "/v1.37/secrets/foreign/update?version=1", `{"Name":"foreign","Labels":{}}`, 401},
+	}
+
+	for _, test := range tests {
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Method == "POST" {
+				var decoded struct {
+					Labels map[string]string
+				}
+				if err := json.NewDecoder(req.Body).Decode(&decoded); err != nil {
+					t.Fatal(err)
+				}
+				if decoded.Labels[ownerKey] != "test-owner" {
+					t.Errorf("%s : expected owner label, got %v", test.url, decoded.Labels)
+				}
+			}
+			w.WriteHeader(http.StatusOK)
+		})
+
+		req, err := http.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("%s %s : handler returned wrong status code: got %v want %v", test.method, test.url, status, test.status)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package sockguard
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+const (
+	// The header BuildKit clients use to list the gRPC services they expose to the daemon
+	sessionGrpcMethodHeader = "X-Docker-Expose-Session-Grpc-Method"
+
+	sessionSecretsService = "/moby.buildkit.secrets.v1.Secrets/"
+	sessionSSHService     = "/moby.sshforward.v1.SSH/"
+)
+
+// checkSessionMethods checks the gRPC methods a BuildKit session exposes against the build
+// secret and ssh forwarding policies. Secret and ssh IDs aren't checked, as the client maps each
+// ID to its own files and agents, so any secret could be exposed under an allowed ID.
+func (r *RulesDirector) checkSessionMethods(l socketproxy.Logger, req *http.Request) error {
+	for _, method := range req.Header[http.CanonicalHeaderKey(sessionGrpcMethodHeader)] {
+		switch {
+		case strings.HasPrefix(method, sessionSecretsService) && r.DenyBuildSecrets:
+			l.Printf("Denied session exposing build secrets (%s)", method)
+			return fmt.Errorf("Builds aren't allowed to use secrets (--secret)")
+		case strings.HasPrefix(method, sessionSSHService) && r.DenyBuildSSH:
+			l.Printf("Denied session exposing ssh forwarding (%s)", method)
+			return fmt.Errorf("Builds aren't allowed to use ssh forwarding (--ssh)")
+		}
+	}
+	return nil
+}
+
+func (r *RulesDirector) handleSession(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := r.checkSessionMethods(l, req); err != nil {
+			r.writeDenied(w, req, err.Error())
+			return
+		}
+
+		upstream.ServeHTTP(w, req)
+	})
+}
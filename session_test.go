@@ -0,0 +1,48 @@
+package sockguard
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleSession(t *testing.T) {
+	l := mockLogger()
+
+	tests := []struct {
+		denySecrets bool
+		denySSH     bool
+		methods     []string
+		esc         int
+	}{
+		{false, false, []string{"/moby.filesync.v1.FileSync/DiffCopy", "/moby.buildkit.secrets.v1.Secrets/GetSecret", "/moby.sshforward.v1.SSH/ForwardAgent"}, 200},
+		{true, false, []string{"/moby.filesync.v1.FileSync/DiffCopy"}, 200},
+		{true, false, []string{"/moby.filesync.v1.FileSync/DiffCopy", "/moby.buildkit.secrets.v1.Secrets/GetSecret"}, 401},
+		{true, false, []string{"/moby.sshforward.v1.SSH/ForwardAgent"}, 200},
+		{false, true, []string{"/moby.sshforward.v1.SSH/CheckAgent", "/moby.sshforward.v1.SSH/ForwardAgent"}, 401},
+	}
+
+	for _, v := range tests {
+		r := mockRulesDirector()
+		r.DenyBuildSecrets = v.denySecrets
+		r.DenyBuildSSH = v.denySSH
+
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// Return empty body, the request is whats important not the response
+		})
+
+		req, err := http.NewRequest("POST", "/v1.37/session", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, method := range v.methods {
+			req.Header.Add("X-Docker-Expose-Session-Grpc-Method", method)
+		}
+		rr := httptest.NewRecorder()
+		r.handleSession(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != v.esc {
+			t.Errorf("%v : handler returned wrong status code: got %v want %v", v.methods, status, v.esc)
+		}
+	}
+}
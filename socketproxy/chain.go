@@ -0,0 +1,30 @@
+package socketproxy
+
+import (
+	"context"
+	"net/http"
+)
+
+// ChainDirectors returns a Director that runs each of the provided directors in turn, with
+// the first being outermost. Each director's upstream is the next director in the chain and
+// the last director's upstream is the real upstream, so a director can deny a request by not
+// calling upstream, or modify the request before passing it on.
+func ChainDirectors(directors ...Director) Director {
+	return ContextDirectorFunc(func(ctx context.Context, l Logger, req *http.Request, upstream http.Handler) http.Handler {
+		return chainHandler(ctx, l, req, directors, upstream)
+	})
+}
+
+func chainHandler(ctx context.Context, l Logger, req *http.Request, directors []Director, upstream http.Handler) http.Handler {
+	if len(directors) == 0 {
+		return upstream
+	}
+
+	// later directors are only asked for a handler once the request reaches them, so they see
+	// any changes made to it by the earlier ones
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		chainHandler(ctx, l, req, directors[1:], upstream).ServeHTTP(w, req)
+	})
+
+	return direct(ctx, directors[0], l, req, next)
+}
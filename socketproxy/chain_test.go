@@ -0,0 +1,81 @@
+package socketproxy
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChainDirectors(t *testing.T) {
+	var order []string
+
+	record := func(name string) Director {
+		return DirectorFunc(func(l Logger, req *http.Request, upstream http.Handler) http.Handler {
+			order = append(order, name+":"+req.Header.Get("X-Seen"))
+			req.Header.Add("X-Seen", name)
+			return upstream
+		})
+	}
+
+	deny := DirectorFunc(func(l Logger, req *http.Request, upstream http.Handler) http.Handler {
+		if req.URL.Path == "/denied" {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				http.Error(w, "denied", http.StatusUnauthorized)
+			})
+		}
+		return upstream
+	})
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		order = append(order, "upstream")
+		w.WriteHeader(http.StatusOK)
+	})
+
+	l := log.New(ioutil.Discard, "", 0)
+	director := ChainDirectors(record("first"), deny, record("second"))
+
+	req := httptest.NewRequest("GET", "/allowed", nil)
+	w := httptest.NewRecorder()
+	director.Direct(l, req, upstream).ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	expected := []string{"first:", "second:first", "upstream"}
+	if len(order) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, order)
+		}
+	}
+
+	order = nil
+	req = httptest.NewRequest("GET", "/denied", nil)
+	w = httptest.NewRecorder()
+	director.Direct(l, req, upstream).ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401, got %d", w.Code)
+	}
+	if len(order) != 1 || order[0] != "first:" {
+		t.Fatalf("Expected only the first director to run, got %v", order)
+	}
+}
+
+func TestChainDirectorsEmpty(t *testing.T) {
+	called := false
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		called = true
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	ChainDirectors().Direct(log.New(ioutil.Discard, "", 0), req, upstream).ServeHTTP(httptest.NewRecorder(), req)
+
+	if !called {
+		t.Fatal("Expected an empty chain to pass through to upstream")
+	}
+}
@@ -0,0 +1,34 @@
+package socketproxy
+
+import (
+	"context"
+	"net/http"
+)
+
+// ContextDirector is a Director that's also given a context tied to the client connection, which
+// is cancelled when the client goes away or the proxy shuts down. Directors that make calls of
+// their own, e.g. inspecting resources upstream, can make them with ctx so they respect
+// cancellation and deadlines end to end. SocketProxy and ChainDirectors prefer DirectContext over
+// Direct when a director implements it.
+type ContextDirector interface {
+	Director
+	DirectContext(ctx context.Context, l Logger, req *http.Request, upstream http.Handler) http.Handler
+}
+
+type ContextDirectorFunc func(ctx context.Context, l Logger, req *http.Request, upstream http.Handler) http.Handler
+
+func (d ContextDirectorFunc) Direct(l Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return d(req.Context(), l, req, upstream)
+}
+
+func (d ContextDirectorFunc) DirectContext(ctx context.Context, l Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return d(ctx, l, req, upstream)
+}
+
+// direct asks d for a handler for req, passing ctx along if d is a ContextDirector
+func direct(ctx context.Context, d Director, l Logger, req *http.Request, upstream http.Handler) http.Handler {
+	if cd, ok := d.(ContextDirector); ok {
+		return cd.DirectContext(ctx, l, req, upstream)
+	}
+	return d.Direct(l, req, upstream)
+}
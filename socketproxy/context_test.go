@@ -0,0 +1,53 @@
+package socketproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type ctxKey struct{}
+
+func TestChainDirectorsPassesContext(t *testing.T) {
+	var seen []interface{}
+
+	record := ContextDirectorFunc(func(ctx context.Context, l Logger, req *http.Request, upstream http.Handler) http.Handler {
+		seen = append(seen, ctx.Value(ctxKey{}))
+		return upstream
+	})
+	plain := DirectorFunc(func(l Logger, req *http.Request, upstream http.Handler) http.Handler {
+		return upstream
+	})
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	director := ChainDirectors(record, plain, record).(ContextDirector)
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "connection")
+	req := httptest.NewRequest("GET", "/", nil)
+	director.DirectContext(ctx, log.New(ioutil.Discard, "", 0), req, upstream).ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(seen) != 2 || seen[0] != "connection" || seen[1] != "connection" {
+		t.Fatalf("Expected both context directors to be given the context, got %v", seen)
+	}
+}
+
+func TestContextDirectorFuncDirect(t *testing.T) {
+	var seen interface{}
+
+	director := ContextDirectorFunc(func(ctx context.Context, l Logger, req *http.Request, upstream http.Handler) http.Handler {
+		seen = ctx.Value(ctxKey{})
+		return upstream
+	})
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	req := httptest.NewRequest("GET", "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), ctxKey{}, "request"))
+	director.Direct(log.New(ioutil.Discard, "", 0), req, upstream).ServeHTTP(httptest.NewRecorder(), req)
+
+	if seen != "request" {
+		t.Fatalf("Expected Direct to use the request's context, got %v", seen)
+	}
+}
@@ -0,0 +1,39 @@
+package socketproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Buffers for copying streams, reused between streams rather than allocated for each copy
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 32*1024)
+		return &buf
+	},
+}
+
+// bufferPool adapts copyBufferPool to httputil.BufferPool, for the copies of responses proxied
+// via the transport
+type bufferPool struct{}
+
+func (bufferPool) Get() []byte {
+	return *copyBufferPool.Get().(*[]byte)
+}
+
+func (bufferPool) Put(buf []byte) {
+	copyBufferPool.Put(&buf)
+}
+
+// copyStream copies src to dst, and to debug unless it's discarded. The copy goes through a pooled
+// buffer, unless src implements io.WriterTo or dst io.ReaderFrom (e.g. a TCP connection), which
+// io.CopyBuffer uses instead.
+func copyStream(dst io.Writer, src io.Reader, debug io.Writer) (int64, error) {
+	if debug != ioutil.Discard {
+		dst = io.MultiWriter(dst, debug)
+	}
+	bufp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bufp)
+	return io.CopyBuffer(dst, src, *bufp)
+}
@@ -0,0 +1,95 @@
+package socketproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// pipeListener is an in-memory listener, connected to by its dial
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) dial(ctx context.Context) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	close(l.closed)
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "pipe", Net: "unix"}
+}
+
+func TestProxyWithDialer(t *testing.T) {
+	ln := newPipeListener()
+
+	var dials int64
+	dial := func(ctx context.Context) (net.Conn, error) {
+		atomic.AddInt64(&dials, 1)
+		return ln.dial(ctx)
+	}
+
+	upstream := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(req.URL.Path))
+		}),
+	}
+	go upstream.Serve(ln)
+	defer upstream.Close()
+
+	proxy := NewWithDialer(dial, DirectorFunc(func(l Logger, req *http.Request, upstream http.Handler) http.Handler {
+		return upstream
+	}))
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	// a regular request via the transport, and a streaming one via a dedicated connection
+	for _, path := range []string{"/v1.37/containers/json", "/v1.37/events"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || string(body) != path {
+			t.Errorf("%s : unexpected response %s %q", path, resp.Status, body)
+		}
+	}
+
+	if n := atomic.LoadInt64(&dials); n != 2 {
+		t.Errorf("Expected 2 connections to be dialed, got %d", n)
+	}
+}
@@ -0,0 +1,64 @@
+package socketproxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+)
+
+// The seconds clients are asked to wait before retrying a request denied by a concurrency limit
+const retryAfterSeconds = 1
+
+var (
+	versionPrefixRegex = regexp.MustCompile(`^/v\d+\.\d+`)
+
+	// Requests that stream until the client or daemon ends them, rather than returning a response
+	streamingPathRegex = regexp.MustCompile(`^/(events|build|session|images/create|images/get|images/.+/push|exec/[^/]+/start|containers/[^/]+/(attach|attach/ws|wait|export)|containers/[^/]+/(logs|stats)|(services|tasks)/[^/]+/logs)$`)
+)
+
+// IsStreaming returns whether req is for a long running streaming endpoint, e.g. attach or
+// events. Logs only stream when followed, and stats unless stream=false.
+func IsStreaming(req *http.Request) bool {
+	if isUpgrade(req) {
+		return true
+	}
+	path := versionPrefixRegex.ReplaceAllString(req.URL.Path, "")
+	m := streamingPathRegex.FindStringSubmatch(path)
+	if m == nil {
+		return false
+	}
+	switch {
+	case m[3] == "stats":
+		stream, err := strconv.ParseBool(req.URL.Query().Get("stream"))
+		return err != nil || stream
+	case m[3] == "logs" || m[4] != "":
+		follow, _ := strconv.ParseBool(req.URL.Query().Get("follow"))
+		return follow
+	}
+	return true
+}
+
+// acquire reserves one of limit in-flight requests tracked by counter, returning false if there are
+// none left. A limit of 0 is unlimited. Successful acquires must be released.
+func acquire(counter *int64, limit int64) bool {
+	if n := atomic.AddInt64(counter, 1); limit > 0 && n > limit {
+		atomic.AddInt64(counter, -1)
+		return false
+	}
+	return true
+}
+
+func release(counter *int64) {
+	atomic.AddInt64(counter, -1)
+}
+
+// writeTooManyRequests responds with a 503 and a Retry-After header, in the JSON format the
+// docker client shows errors from
+func writeTooManyRequests(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintf(w, "{%q:%q}\n", "message", msg)
+}
@@ -0,0 +1,190 @@
+package socketproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIsStreaming(t *testing.T) {
+	tests := []struct {
+		method   string
+		url      string
+		expected bool
+	}{
+		{"GET", "/v1.37/events", true},
+		{"POST", "/v1.37/containers/abc/attach?stream=1", true},
+		{"GET", "/v1.37/containers/abc/logs", false},
+		{"GET", "/v1.37/containers/abc/logs?follow=1", true},
+		{"GET", "/v1.37/containers/abc/stats", true},
+		{"GET", "/v1.37/containers/abc/stats?stream=false", false},
+		{"GET", "/v1.37/services/abc/logs?follow=true", true},
+		{"POST", "/v1.37/images/create?fromImage=alpine", true},
+		{"POST", "/v1.37/images/registry.example.com/app/push", true},
+		{"POST", "/build", true},
+		{"GET", "/v1.37/containers/json", false},
+		{"POST", "/v1.37/containers/create", false},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := IsStreaming(req); actual != test.expected {
+			t.Errorf("%s %s : Expected %t, got %t", test.method, test.url, test.expected, actual)
+		}
+	}
+}
+
+func TestProxyMaxRequests(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+
+	proxy := New("/nonexistent.sock", DirectorFunc(func(l Logger, req *http.Request, upstream http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Query().Get("block") != "" {
+				started <- struct{}{}
+				<-release
+			}
+			w.WriteHeader(http.StatusOK)
+		})
+	}))
+	proxy.MaxRequests = 1
+	proxy.MaxStreamingRequests = 1
+
+	serve := func(url string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, req)
+		return rr
+	}
+
+	done := make(chan struct{})
+	go func() {
+		serve("/v1.37/containers/json?block=1")
+		close(done)
+	}()
+	<-started
+
+	if rr := serve("/v1.37/images/json"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected request over the limit to return 503, got %d", rr.Code)
+	} else if rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected a Retry-After header")
+	}
+
+	// streaming requests have their own budget
+	if rr := serve("/v1.37/events"); rr.Code != http.StatusOK {
+		t.Errorf("Expected streaming request to return 200, got %d", rr.Code)
+	}
+
+	close(release)
+	<-done
+
+	if rr := serve("/v1.37/images/json"); rr.Code != http.StatusOK {
+		t.Errorf("Expected request after the in-flight one finished to return 200, got %d", rr.Code)
+	}
+}
+
+func TestIsLowPriority(t *testing.T) {
+	tests := []struct {
+		method   string
+		url      string
+		expected bool
+	}{
+		{"GET", "/v1.37/containers/json", true},
+		{"GET", "/images/json", true},
+		{"GET", "/v1.37/networks", true},
+		{"GET", "/v1.37/containers/abc/stats?stream=false", true},
+		{"GET", "/v1.37/containers/abc/json", false},
+		{"POST", "/v1.37/containers/create", false},
+		{"POST", "/v1.37/networks/create", false},
+		{"GET", "/v1.37/events", false},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := IsLowPriority(req); actual != test.expected {
+			t.Errorf("%s %s : Expected %t, got %t", test.method, test.url, test.expected, actual)
+		}
+	}
+}
+
+func TestIsLatencySample(t *testing.T) {
+	tests := []struct {
+		method   string
+		url      string
+		expected bool
+	}{
+		{"GET", "/v1.37/_ping", true},
+		{"HEAD", "/_ping", true},
+		{"GET", "/v1.37/containers/json", true},
+		{"GET", "/v1.37/containers/abc/json", true},
+		{"GET", "/v1.37/images/example.com/app:1/json", true},
+		{"GET", "/v1.37/networks/abc", true},
+		{"GET", "/v1.37/containers/abc/stats?stream=false", false},
+		{"GET", "/v1.37/system/df", false},
+		{"POST", "/v1.37/containers/abc/stop", false},
+		{"POST", "/v1.37/containers/abc/restart", false},
+		{"POST", "/v1.37/containers/prune", false},
+		{"POST", "/v1.37/commit?container=abc", false},
+		{"DELETE", "/v1.37/containers/abc?force=1", false},
+		{"GET", "/v1.37/events", false},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := isLatencySample(req); actual != test.expected {
+			t.Errorf("%s %s : Expected %t, got %t", test.method, test.url, test.expected, actual)
+		}
+	}
+}
+
+func TestProxyShedsLowPriorityRequests(t *testing.T) {
+	proxy := New("/nonexistent.sock", DirectorFunc(func(l Logger, req *http.Request, upstream http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+	}))
+	proxy.ShedLatency = time.Second
+	proxy.latency.record(5 * time.Second)
+
+	serve := func(method, url string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := serve("GET", "/v1.37/containers/json"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected list to be shed with a 503, got %d", rr.Code)
+	} else if rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected a Retry-After header")
+	}
+	if rr := serve("POST", "/v1.37/containers/create"); rr.Code != http.StatusOK {
+		t.Errorf("Expected create to be served, got %d", rr.Code)
+	}
+
+	// a probe is let through once the last sample is old enough
+	proxy.latency.lastSample = time.Now().Add(-2 * shedProbeInterval)
+	if rr := serve("GET", "/v1.37/containers/json"); rr.Code != http.StatusOK {
+		t.Errorf("Expected a probe to be served, got %d", rr.Code)
+	}
+
+	// and once latency recovers lists are served again
+	for i := 0; i < 20; i++ {
+		proxy.latency.record(10 * time.Millisecond)
+	}
+	if rr := serve("GET", "/v1.37/containers/json"); rr.Code != http.StatusOK {
+		t.Errorf("Expected list to be served once latency recovered, got %d", rr.Code)
+	}
+}
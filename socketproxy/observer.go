@@ -0,0 +1,101 @@
+package socketproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Observer is notified of the requests a SocketProxy handles, e.g. to record metrics. Methods are
+// called from the goroutines serving requests, so must be safe for concurrent use.
+type Observer interface {
+	// RequestStarted is called when a request is received, before it's passed to the director
+	RequestStarted(req *http.Request)
+	// RequestFinished is called once a request has been handled, with the status code of the
+	// response (zero if the connection was hijacked) and how long it took
+	RequestFinished(req *http.Request, status int, duration time.Duration)
+	// BytesCopied is called once a request has been proxied, with the bytes copied from the client
+	// to upstream, and from upstream back to the client
+	BytesCopied(req *http.Request, toUpstream, toClient int64)
+	// Hijacked is called when a request's connection is hijacked, to stream to a dedicated
+	// upstream connection
+	Hijacked(req *http.Request)
+	// Error is called when proxying a request fails
+	Error(req *http.Request, err error)
+}
+
+// NopObserver is an Observer that does nothing, which can be embedded to only implement some methods
+type NopObserver struct{}
+
+func (NopObserver) RequestStarted(req *http.Request)                                      {}
+func (NopObserver) RequestFinished(req *http.Request, status int, duration time.Duration) {}
+func (NopObserver) BytesCopied(req *http.Request, toUpstream, toClient int64)             {}
+func (NopObserver) Hijacked(req *http.Request)                                            {}
+func (NopObserver) Error(req *http.Request, err error)                                    {}
+
+func (s *SocketProxy) observer() Observer {
+	if s.Observer == nil {
+		return NopObserver{}
+	}
+	return s.Observer
+}
+
+// observedResponseWriter records the status code of a response for RequestFinished
+type observedResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *observedResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *observedResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *observedResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *observedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hj.Hijack()
+}
+
+func (w *observedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingReadCloser counts the bytes read through it
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func (c *countingReadCloser) count() int64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&c.n)
+}
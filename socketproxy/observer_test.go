@@ -0,0 +1,131 @@
+package socketproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) record(format string, v ...interface{}) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, fmt.Sprintf(format, v...))
+}
+
+func (o *recordingObserver) RequestStarted(req *http.Request) {
+	o.record("started %s", req.URL.Path)
+}
+
+func (o *recordingObserver) RequestFinished(req *http.Request, status int, duration time.Duration) {
+	o.record("finished %d", status)
+}
+
+func (o *recordingObserver) BytesCopied(req *http.Request, toUpstream, toClient int64) {
+	o.record("copied %d %d", toUpstream, toClient)
+}
+
+func (o *recordingObserver) Hijacked(req *http.Request) {
+	o.record("hijacked")
+}
+
+func (o *recordingObserver) Error(req *http.Request, err error) {
+	o.record("error")
+}
+
+func TestProxyObserver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sockguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sockPath := filepath.Join(dir, "docker.sock")
+	ln, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	upstream := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ioutil.ReadAll(req.Body)
+			w.Write([]byte(`{"Id":"abc"}`))
+		}),
+	}
+	go upstream.Serve(ln)
+	defer upstream.Close()
+
+	observer := &recordingObserver{}
+	proxy := New(sockPath, DirectorFunc(func(l Logger, req *http.Request, upstream http.Handler) http.Handler {
+		if req.URL.Path == "/v1.37/denied" {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				http.Error(w, "denied", http.StatusUnauthorized)
+			})
+		}
+		return upstream
+	}))
+	proxy.Observer = observer
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	tests := []struct {
+		method, path, body string
+		expected           []string
+	}{
+		{"POST", "/v1.37/containers/create", `{"Image":"alpine"}`, []string{"started /v1.37/containers/create", "copied 18 12", "finished 200"}},
+		{"GET", "/v1.37/denied", "", []string{"started /v1.37/denied", "finished 401"}},
+		{"GET", "/v1.37/events", "", []string{"started /v1.37/events", "hijacked", "copied 0 ", "finished 0"}},
+	}
+
+	for _, test := range tests {
+		observer.events = nil
+
+		req, err := http.NewRequest(test.method, server.URL+test.path, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		// the request is finished after the response is sent
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			observer.mu.Lock()
+			n := len(observer.events)
+			observer.mu.Unlock()
+			if n >= len(test.expected) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		observer.mu.Lock()
+		events := strings.Join(observer.events, ", ")
+		observer.mu.Unlock()
+		if strings.Contains(events, "error") {
+			t.Errorf("%s %s : expected no errors, got %s", test.method, test.path, events)
+		}
+		for _, expected := range test.expected {
+			if !strings.Contains(events, expected) {
+				t.Errorf("%s %s : expected %q in events, got %s", test.method, test.path, expected, events)
+			}
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package socketproxy
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -8,8 +9,10 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/kvz/logstreamer"
 )
@@ -19,10 +22,29 @@ var (
 )
 
 type SocketProxy struct {
-	path     string
-	sock     net.Conn
+	dial     DialFunc
 	counter  uint64
 	director Director
+
+	// The transport requests with regular responses are proxied via, see NewTransport. Streaming
+	// and upgraded requests hijack the connection, and get a dedicated upstream connection.
+	Transport http.RoundTripper
+
+	// Maximum in-flight requests, and streaming requests (see IsStreaming), beyond which requests
+	// are denied with a 503. Zero is unlimited.
+	MaxRequests          int64
+	MaxStreamingRequests int64
+
+	// Shed low priority requests (see IsLowPriority) with a 503 when the average time upstream takes
+	// to start responding is over this. Zero never sheds.
+	ShedLatency time.Duration
+
+	// Notified of requests as they're handled, e.g. for metrics. Nil observes nothing.
+	Observer Observer
+
+	inFlight          int64
+	inFlightStreaming int64
+	latency           latencyTracker
 }
 
 // Logger is a subset of log.Logger used in a Proxy request
@@ -44,9 +66,16 @@ func (d DirectorFunc) Direct(l Logger, req *http.Request, upstream http.Handler)
 
 // New returns a SocketProxy that proxies requests to the provided upstream unix socket
 func New(upstream string, director Director) *SocketProxy {
+	return NewWithDialer(UnixDialer(upstream), director)
+}
+
+// NewWithDialer returns a SocketProxy that proxies requests to the upstream connected to by dial,
+// e.g. a docker daemon listening on TCP or TLS, or an in-memory upstream in tests
+func NewWithDialer(dial DialFunc, director Director) *SocketProxy {
 	return &SocketProxy{
-		path:     upstream,
-		director: director,
+		dial:      dial,
+		director:  director,
+		Transport: NewTransportWithDialer(dial),
 	}
 }
 
@@ -55,17 +84,52 @@ func (s *SocketProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	path := req.URL.Path
 
 	if req.URL.RawQuery != "" {
-		path += "?" + req.URL.RawQuery
+		path += "?" + RedactQuery(req.URL.RawQuery)
 	}
 
 	l := log.New(os.Stderr, fmt.Sprintf("#%d ", requestID), log.Ltime|log.Lmicroseconds)
 	l.Printf("%s - %s - %db", req.Method, path, req.ContentLength)
 
+	if s.Observer != nil {
+		start, ow := time.Now(), &observedResponseWriter{ResponseWriter: w}
+		s.Observer.RequestStarted(req)
+		defer func() {
+			s.Observer.RequestFinished(req, ow.status, time.Since(start))
+		}()
+		w = ow
+	}
+
+	// streaming requests have their own budget, so they can't starve normal requests
+	counter, limit := &s.inFlight, s.MaxRequests
+	if IsStreaming(req) {
+		counter, limit = &s.inFlightStreaming, s.MaxStreamingRequests
+	}
+	if !acquire(counter, limit) {
+		l.Printf("Denied, %d in-flight requests of this kind already", limit)
+		writeTooManyRequests(w, fmt.Sprintf("Too many concurrent requests (limit %d), try again later", limit))
+		return
+	}
+	defer release(counter)
+
+	if s.ShedLatency > 0 && IsLowPriority(req) {
+		if shed, average := s.latency.shouldShed(s.ShedLatency); shed {
+			l.Printf("Shedding low priority request, upstream latency is %v", average)
+			writeTooManyRequests(w, fmt.Sprintf("The docker daemon is overloaded (responding in %v), try again later", average.Round(time.Millisecond)))
+			return
+		}
+	}
+
+	// Streaming and upgraded requests get a dedicated connection, as do all requests when debugging
+	// so that the raw bytes are logged
 	var passUpstream = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		s.ServeViaUpstreamSocket(l, w, req)
+		if Debug || isUpgrade(req) || IsStreaming(req) {
+			s.ServeViaUpstreamSocket(l, w, req)
+		} else {
+			s.ServeViaTransport(l, w, req)
+		}
 	})
 
-	s.director.Direct(l, req, passUpstream).ServeHTTP(w, req)
+	direct(req.Context(), s.director, l, req, passUpstream).ServeHTTP(w, req)
 }
 
 func (s *SocketProxy) ServeViaUpstreamSocket(l *log.Logger, w http.ResponseWriter, req *http.Request) {
@@ -82,10 +146,11 @@ func (s *SocketProxy) ServeViaUpstreamSocket(l *log.Logger, w http.ResponseWrite
 		defer connStreamer.Close()
 	}
 
-	// Dial a new socket connection for this request. Re-use might be possible, but this gets
-	// things working reliably to start with
-	sock, err := net.Dial("unix", s.path)
+	// Dial a dedicated socket connection for this request, hijacked connections become a raw
+	// stream so it can't be returned to the transport for reuse
+	sock, err := s.dial(req.Context())
 	if err != nil {
+		s.observer().Error(req, err)
 		http.Error(w, "Error contacting backend server.", 500)
 		return
 	}
@@ -101,19 +166,47 @@ func (s *SocketProxy) ServeViaUpstreamSocket(l *log.Logger, w http.ResponseWrite
 	reqConn, bufrw, err := hj.Hijack()
 	if err != nil {
 		l.Printf("Hijack error: %v", err)
+		s.observer().Error(req, err)
 		return
 	}
+	s.observer().Hijacked(req)
 
 	defer reqConn.Close()
 
 	// This is really important, otherwise subsequent requests will be streamed in without
-	// being passed via the director
-	req.Header.Set("Connection", "close")
+	// being passed via the director. Upgraded connections (e.g. POST /session) become a raw
+	// stream after the response, so there are no subsequent requests to pass via it.
+	if isUpgrade(req) {
+		l.Printf("Upgrading connection to %q", req.Header.Get("Upgrade"))
+		req.Header.Set("Connection", "Upgrade")
+	} else {
+		req.Header.Set("Connection", "close")
+	}
+
+	// measure how long upstream takes to start responding to requests it should answer quickly
+	// (when shedding), see isLatencySample
+	var upstreamReader io.Reader = sock
+	if s.ShedLatency > 0 && isLatencySample(req) {
+		start := time.Now()
+		upstreamReader = &firstByteReader{Reader: sock, onFirstByte: func() {
+			s.latency.record(time.Since(start))
+		}}
+	}
 
 	// write the request to the remote side
-	err = req.Write(io.MultiWriter(sock, sockDebug))
+	var reqWriter io.Writer = sock
+	if Debug {
+		reqWriter = io.MultiWriter(sock, &redactingWriter{w: sockDebug})
+	}
+	var reqBody *countingReadCloser
+	if s.Observer != nil && req.Body != nil && req.Body != http.NoBody {
+		reqBody = &countingReadCloser{ReadCloser: req.Body}
+		req.Body = reqBody
+	}
+	err = req.Write(reqWriter)
 	if err != nil {
 		l.Printf("Error copying request to target: %v", err)
+		s.observer().Error(req, err)
 		return
 	}
 
@@ -130,27 +223,49 @@ func (s *SocketProxy) ServeViaUpstreamSocket(l *log.Logger, w http.ResponseWrite
 		panic("Buffered bytes not handled")
 	}
 
+	// End the stream if the request's context is done first, e.g. a director set a deadline on it
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-req.Context().Done():
+			l.Printf("Closing stream: %v", req.Context().Err())
+			sock.Close()
+			reqConn.Close()
+		case <-done:
+		}
+	}()
+
 	var wg sync.WaitGroup
+	var toUpstream, toClient int64
 	wg.Add(2)
 
 	// Copy from request to socket
 	go func() {
 		defer wg.Done()
-		n, err := io.Copy(io.MultiWriter(sock, sockDebug), reqConn)
+		n, err := copyStream(sock, reqConn, sockDebug)
 		if err != nil {
 			l.Printf("Error copying request to socket: %v", err)
+			if !errors.Is(err, net.ErrClosed) {
+				s.observer().Error(req, err)
+			}
 		}
 		l.Printf("Copied %d bytes from downstream connection", n)
+		toUpstream = n
 	}()
 
 	// copy from socket to request
 	go func() {
 		defer wg.Done()
-		n, err := io.Copy(io.MultiWriter(reqConn, connDebug), sock)
+		n, err := copyStream(reqConn, upstreamReader, connDebug)
 		if err != nil {
 			l.Printf("Error copying socket to request: %v", err)
+			if !errors.Is(err, net.ErrClosed) {
+				s.observer().Error(req, err)
+			}
 		}
 		l.Printf("Copied %d bytes from upstream socket", n)
+		toClient = n
 
 		if err := bufrw.Flush(); err != nil {
 			l.Printf("Error flushing buffer: %v", err)
@@ -161,5 +276,21 @@ func (s *SocketProxy) ServeViaUpstreamSocket(l *log.Logger, w http.ResponseWrite
 	}()
 
 	wg.Wait()
+	s.observer().BytesCopied(req, reqBody.count()+toUpstream, toClient)
 	l.Printf("Done, closing")
 }
+
+// isUpgrade returns whether req asks to upgrade the connection to another protocol
+func isUpgrade(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range req.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
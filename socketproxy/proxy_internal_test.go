@@ -0,0 +1,214 @@
+package socketproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsUpgrade(t *testing.T) {
+	tests := []struct {
+		connection string
+		upgrade    string
+		expected   bool
+	}{
+		{"Upgrade", "h2c", true},
+		{"keep-alive, upgrade", "tcp", true},
+		{"close", "h2c", false},
+		{"Upgrade", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", "/session", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.connection != "" {
+			req.Header.Set("Connection", test.connection)
+		}
+		if test.upgrade != "" {
+			req.Header.Set("Upgrade", test.upgrade)
+		}
+		if actual := isUpgrade(req); actual != test.expected {
+			t.Errorf("Connection %q, Upgrade %q : Expected %t, got %t", test.connection, test.upgrade, test.expected, actual)
+		}
+	}
+}
+
+func TestProxyUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sockguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An upstream that upgrades the connection and then echoes the raw stream back
+	sockPath := filepath.Join(dir, "docker.sock")
+	ln, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if c := req.Header.Get("Connection"); c != "Upgrade" {
+			t.Errorf("Expected Connection: Upgrade upstream, got %q", c)
+		}
+		io.WriteString(conn, "HTTP/1.1 101 UPGRADED\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+		io.Copy(conn, br)
+	}()
+
+	proxy := New(sockPath, DirectorFunc(func(l Logger, req *http.Request, upstream http.Handler) http.Handler {
+		return upstream
+	}))
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "POST /v1.37/session HTTP/1.1\r\nHost: docker\r\nConnection: Upgrade\r\nUpgrade: h2c\r\nContent-Length: 0\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, got %s", resp.Status)
+	}
+
+	io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("Expected the raw stream to be echoed, got %q", buf)
+	}
+}
+
+func TestProxyClosesStreamWhenContextDone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sockguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An upstream that starts a streamed response and never ends it, like following logs
+	sockPath := filepath.Join(dir, "docker.sock")
+	ln, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			t.Error(err)
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nstarted")
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	proxy := New(sockPath, DirectorFunc(func(l Logger, req *http.Request, upstream http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(req.Context(), 100*time.Millisecond)
+			defer cancel()
+			upstream.ServeHTTP(w, req.WithContext(ctx))
+		})
+	}))
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(conn, "GET /v1.37/containers/abc/logs?follow=1 HTTP/1.1\r\nHost: docker\r\n\r\n")
+
+	body, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Expected the stream to be closed, got %v", err)
+	}
+	if !strings.HasSuffix(string(body), "started") {
+		t.Errorf("Expected the streamed response before it was closed, got %q", body)
+	}
+}
+
+func TestCopyStream(t *testing.T) {
+	src := strings.Repeat("docker logs output\n", 10000)
+
+	for _, debug := range []bool{false, true} {
+		var dst, debugged strings.Builder
+		var debugWriter io.Writer = ioutil.Discard
+		if debug {
+			debugWriter = &debugged
+		}
+		n, err := copyStream(&dst, strings.NewReader(src), debugWriter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(src)) || dst.String() != src {
+			t.Errorf("Expected %d bytes to be copied, got %d", len(src), n)
+		}
+		if debug && debugged.String() != src {
+			t.Errorf("Expected the stream to be copied to debug too")
+		}
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	var pool bufferPool
+	buf := pool.Get()
+	if len(buf) != 32*1024 {
+		t.Errorf("Expected a 32KB buffer, got %d bytes", len(buf))
+	}
+	pool.Put(buf)
+}
+
+func BenchmarkCopyStream(b *testing.B) {
+	src := []byte(strings.Repeat("docker logs output\n", 10000))
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(src)))
+	for i := 0; i < b.N; i++ {
+		// without ReadFrom or WriteTo, so a buffer is needed
+		if _, err := copyStream(struct{ io.Writer }{ioutil.Discard}, struct{ io.Reader }{bytes.NewReader(src)}, ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
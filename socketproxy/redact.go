@@ -0,0 +1,99 @@
+package socketproxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const redactedMarker = "<redacted>"
+
+var (
+	// Redact secrets in logged query strings and debug output, see RedactedQueryParams and RedactedHeaders
+	Redact = true
+
+	// Query parameters that carry secrets, e.g. build args
+	RedactedQueryParams = []string{"buildargs"}
+
+	// Headers that carry secrets, e.g. registry credentials
+	RedactedHeaders = []string{"X-Registry-Auth", "X-Registry-Config"}
+)
+
+// RedactQuery replaces the values of RedactedQueryParams in a raw query string with a marker,
+// so it's visible that a value was present without logging it
+func RedactQuery(rawQuery string) string {
+	if !Redact || rawQuery == "" {
+		return rawQuery
+	}
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		key, value := param, ""
+		if idx := strings.Index(param, "="); idx >= 0 {
+			key, value = param[:idx], param[idx+1:]
+		}
+		for _, redacted := range RedactedQueryParams {
+			if key == redacted && value != "" {
+				params[i] = key + "=" + redactedMarker
+			}
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// redactHeadLine redacts a single line of the head of an HTTP request
+func redactHeadLine(line string, first bool) string {
+	if first {
+		// Request line, e.g. POST /build?buildargs=... HTTP/1.1
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) == 3 {
+			if idx := strings.Index(fields[1], "?"); idx >= 0 {
+				fields[1] = fields[1][:idx+1] + RedactQuery(fields[1][idx+1:])
+			}
+		}
+		return strings.Join(fields, " ")
+	}
+	idx := strings.Index(line, ":")
+	if idx < 0 {
+		return line
+	}
+	for _, redacted := range RedactedHeaders {
+		if http.CanonicalHeaderKey(line[:idx]) == http.CanonicalHeaderKey(redacted) {
+			return line[:idx] + ": " + redactedMarker
+		}
+	}
+	return line
+}
+
+// redactingWriter redacts the head of an HTTP request written through it, and passes the
+// body through as is
+type redactingWriter struct {
+	w    io.Writer
+	head bytes.Buffer
+	done bool
+}
+
+func (rw *redactingWriter) Write(p []byte) (int, error) {
+	if rw.done || !Redact {
+		return rw.w.Write(p)
+	}
+	rw.head.Write(p)
+	idx := bytes.Index(rw.head.Bytes(), []byte("\r\n\r\n"))
+	if idx < 0 {
+		return len(p), nil
+	}
+	rw.done = true
+
+	buffered := rw.head.Bytes()
+	lines := strings.Split(string(buffered[:idx]), "\r\n")
+	for i, line := range lines {
+		lines[i] = redactHeadLine(line, i == 0)
+	}
+	if _, err := io.WriteString(rw.w, strings.Join(lines, "\r\n")); err != nil {
+		return 0, err
+	}
+	if _, err := rw.w.Write(buffered[idx:]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,46 @@
+package socketproxy
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRedactQuery(t *testing.T) {
+	tests := map[string]string{
+		"":                 "",
+		"t=app&buildargs=": "t=app&buildargs=",
+		"t=app&buildargs=%7B%22TOKEN%22%3A%22s%22%7D": "t=app&buildargs=<redacted>",
+		"buildargs=%7B%7D&dockerfile=Dockerfile":      "buildargs=<redacted>&dockerfile=Dockerfile",
+	}
+	for in, expected := range tests {
+		if out := RedactQuery(in); out != expected {
+			t.Errorf("%q : Expected %q, got %q", in, expected, out)
+		}
+	}
+}
+
+func TestRedactingWriter(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://docker/v1.37/build?buildargs=%7B%22TOKEN%22%3A%22secret%22%7D", strings.NewReader("context"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Registry-Config", "c2VjcmV0")
+
+	var buf bytes.Buffer
+	if err := req.Write(&redactingWriter{w: &buf}); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	if strings.Contains(out, "secret") || strings.Contains(out, "c2VjcmV0") {
+		t.Errorf("Expected secrets to be redacted, got:\n%s", out)
+	}
+	if !strings.Contains(out, "buildargs=<redacted>") || !strings.Contains(out, "X-Registry-Config: <redacted>") {
+		t.Errorf("Expected redaction markers, got:\n%s", out)
+	}
+	if !strings.HasSuffix(out, "\r\n\r\ncontext") {
+		t.Errorf("Expected body to be passed through, got:\n%s", out)
+	}
+}
@@ -0,0 +1,85 @@
+package socketproxy
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// The weight of each new sample in the moving average of upstream latency
+const latencySampleWeight = 0.2
+
+// How often a low priority request is let through while shedding, so the moving average can
+// recover if low priority requests are all there are
+const shedProbeInterval = time.Second
+
+// Low priority requests, which are shed when upstream is slow: lists and stats
+var lowPriorityPathRegex = regexp.MustCompile(`^/(containers/json|images/json|networks|volumes|services|tasks|nodes|secrets|configs|plugins|system/df|containers/[^/]+/stats)$`)
+
+// Requests that upstream should answer quickly, which are sampled for its latency: pings, lists and
+// inspects. Others can be slow without upstream being overloaded, e.g. stopping a container waits for
+// it to exit, and stats take a second to measure CPU usage.
+var latencySamplePathRegex = regexp.MustCompile(`^/(_ping|version|info|(containers|images|plugins)/json|(networks|volumes|services|tasks|nodes|secrets|configs|plugins)(/[^/]+)?|(containers|images|exec|plugins)/.+/json)$`)
+
+// isLatencySample returns whether the time upstream takes to respond to req is sampled for shedding
+func isLatencySample(req *http.Request) bool {
+	return (req.Method == "GET" || req.Method == "HEAD") && latencySamplePathRegex.MatchString(versionPrefixRegex.ReplaceAllString(req.URL.Path, ""))
+}
+
+// IsLowPriority returns whether req can be shed when upstream is slow
+func IsLowPriority(req *http.Request) bool {
+	return req.Method == "GET" && lowPriorityPathRegex.MatchString(versionPrefixRegex.ReplaceAllString(req.URL.Path, ""))
+}
+
+// latencyTracker keeps a moving average of how long upstream takes to start responding
+type latencyTracker struct {
+	mu         sync.Mutex
+	average    time.Duration
+	lastSample time.Time
+}
+
+func (t *latencyTracker) record(latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.lastSample.IsZero() {
+		t.average = latency
+	} else {
+		t.average = time.Duration(float64(t.average)*(1-latencySampleWeight) + float64(latency)*latencySampleWeight)
+	}
+	t.lastSample = time.Now()
+}
+
+// shouldShed returns whether a low priority request should be shed with the average latency over
+// threshold. A request is let through every shedProbeInterval to keep measuring.
+func (t *latencyTracker) shouldShed(threshold time.Duration) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.average <= threshold {
+		return false, t.average
+	}
+	if time.Since(t.lastSample) > shedProbeInterval {
+		// reserve the probe, so only one request is let through
+		t.lastSample = time.Now()
+		return false, t.average
+	}
+	return true, t.average
+}
+
+// firstByteReader calls onFirstByte when the first bytes are read
+type firstByteReader struct {
+	io.Reader
+	onFirstByte func()
+}
+
+func (f *firstByteReader) Read(p []byte) (int, error) {
+	n, err := f.Reader.Read(p)
+	if n > 0 && f.onFirstByte != nil {
+		f.onFirstByte()
+		f.onFirstByte = nil
+	}
+	return n, err
+}
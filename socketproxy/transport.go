@@ -0,0 +1,90 @@
+package socketproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"time"
+)
+
+// The idle connections to keep open to upstream for reuse, enough for bursts of CLI requests
+const maxIdleUpstreamConns = 16
+
+// DialFunc connects to the upstream docker daemon
+type DialFunc func(ctx context.Context) (net.Conn, error)
+
+// UnixDialer returns a DialFunc that connects to a unix socket
+func UnixDialer(path string) DialFunc {
+	return func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+}
+
+// NewTransport returns a transport that talks to the docker daemon on the upstream unix socket,
+// reusing connections between requests. It can be shared between a SocketProxy and other clients.
+func NewTransport(upstream string) *http.Transport {
+	return NewTransportWithDialer(UnixDialer(upstream))
+}
+
+// NewTransportWithDialer returns a transport like NewTransport, that connects with dial
+func NewTransportWithDialer(dial DialFunc) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dial(ctx)
+		},
+		MaxIdleConns:        maxIdleUpstreamConns,
+		MaxIdleConnsPerHost: maxIdleUpstreamConns,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// ServeViaTransport proxies a request that has a regular response to upstream via the shared
+// transport, rather than dialing a new connection for it
+func (s *SocketProxy) ServeViaTransport(l Logger, w http.ResponseWriter, req *http.Request) {
+	// the bodies are counted for the Observer
+	var reqBody, respBody *countingReadCloser
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = "docker"
+		},
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if s.Observer != nil && req.Body != nil && req.Body != http.NoBody {
+				reqBody = &countingReadCloser{ReadCloser: req.Body}
+				req.Body = reqBody
+			}
+			start := time.Now()
+			resp, err := s.Transport.RoundTrip(req)
+			if err == nil && s.ShedLatency > 0 {
+				s.latency.record(time.Since(start))
+			}
+			if err == nil && s.Observer != nil {
+				respBody = &countingReadCloser{ReadCloser: resp.Body}
+				resp.Body = respBody
+			}
+			return resp, err
+		}),
+		// flush straight away, some responses stream progress (e.g. /images/load)
+		FlushInterval: -1,
+		BufferPool:    bufferPool{},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			l.Printf("Error proxying to upstream: %v", err)
+			s.observer().Error(req, err)
+			http.Error(w, "Error contacting backend server.", 500)
+		},
+	}
+	proxy.ServeHTTP(w, req)
+
+	if s.Observer != nil {
+		s.Observer.BytesCopied(req, reqBody.count(), respBody.count())
+	}
+}
@@ -0,0 +1,67 @@
+package socketproxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProxyReusesUpstreamConnections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sockguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sockPath := filepath.Join(dir, "docker.sock")
+	ln, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var conns int64
+	upstream := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Api-Version", "1.37")
+			w.Write([]byte(`[]`))
+		}),
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt64(&conns, 1)
+			}
+		},
+	}
+	go upstream.Serve(ln)
+	defer upstream.Close()
+
+	proxy := New(sockPath, DirectorFunc(func(l Logger, req *http.Request, upstream http.Handler) http.Handler {
+		return upstream
+	}))
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	for i := 0; i < 5; i++ {
+		resp, err := http.Get(server.URL + "/v1.37/containers/json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || string(body) != `[]` || resp.Header.Get("Api-Version") != "1.37" {
+			t.Fatalf("Unexpected response %s %q %v", resp.Status, body, resp.Header)
+		}
+	}
+
+	if n := atomic.LoadInt64(&conns); n != 1 {
+		t.Errorf("Expected 1 upstream connection to be reused, got %d", n)
+	}
+}
@@ -0,0 +1,227 @@
+package sockguardtest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var (
+	containerInspectPath = regexp.MustCompile("^/v(.*)/containers/(.*)/json$")
+	imageInspectPath     = regexp.MustCompile("^/v(.*)/images/(.*)/json$")
+	imagePath            = regexp.MustCompile("^/v(.*)/images/(.*)$")
+	// NOTE: this may not cover all name variations, but covers enough for tests
+	networkPath       = regexp.MustCompile("^/v(.*)/networks/([A-Za-z0-9]+)(/connect|/disconnect)?$")
+	volumePath        = regexp.MustCompile("^/v(.*)/volumes/(.*)$")
+	containerListPath = regexp.MustCompile("^/v(.*)/containers/json$")
+	execInspectPath   = regexp.MustCompile("^/v(.*)/exec/(.*)/json$")
+	swarmInspectPath  = regexp.MustCompile("^/v(.*)/(services|secrets|configs)/([^/]+)$")
+	taskInspectPath   = regexp.MustCompile("^/v(.*)/tasks/([^/]+)$")
+	distributionPath  = regexp.MustCompile("^/v(.*)/distribution/(.*)/json$")
+)
+
+// Digest returns the digest a registry has for ref, as answered by the distribution endpoint.
+// Refs with a digest have that one, otherwise it's derived from ref.
+func Digest(ref string) string {
+	if idx := strings.Index(ref, "@"); idx >= 0 {
+		return ref[idx+1:]
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(ref)))
+}
+
+// Client returns an http.Client that answers requests from the State
+func (s *State) Client() *http.Client {
+	return &http.Client{Transport: s}
+}
+
+// RoundTrip answers a request from the State, with partial responses that have enough for
+// sockguard to check ownership. Paths that aren't simulated get a 501.
+func (s *State) RoundTrip(req *http.Request) (*http.Response, error) {
+	status, body := s.respond(req)
+	return &http.Response{
+		StatusCode: status,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		Request:    req,
+	}, nil
+}
+
+func (s *State) respond(req *http.Request) (int, string) {
+	p := req.URL.Path
+
+	switch {
+	case distributionPath.MatchString(p):
+		// registry image information - /distribution/{name}/json
+		ref := distributionPath.FindStringSubmatch(p)[2]
+		return 200, fmt.Sprintf("{\"Descriptor\":{\"Digest\":\"%s\"}}", Digest(ref))
+
+	case swarmInspectPath.MatchString(p):
+		// inspect service, secret or config - /services/{id}, /secrets/{id}, /configs/{id}
+		m := swarmInspectPath.FindStringSubmatch(p)
+		kind, id := m[2], m[3]
+		s.mu.Lock()
+		owner, ok := map[string]map[string]string{"services": s.Services, "secrets": s.Secrets, "configs": s.Configs}[kind][id]
+		s.mu.Unlock()
+		if !ok {
+			return 404, fmt.Sprintf("{\"message\":\"%s %s not found\"}", strings.TrimSuffix(kind, "s"), id)
+		}
+		return 200, fmt.Sprintf("{\"ID\":\"%s\",\"Spec\":{\"Labels\":%s}}", id, ownerLabels(owner))
+
+	case taskInspectPath.MatchString(p):
+		// inspect task - /tasks/{id}
+		taskID := taskInspectPath.FindStringSubmatch(p)[2]
+		s.mu.Lock()
+		serviceID, ok := s.Tasks[taskID]
+		s.mu.Unlock()
+		if !ok {
+			return 404, fmt.Sprintf("{\"message\":\"task %s not found\"}", taskID)
+		}
+		return 200, fmt.Sprintf("{\"ID\":\"%s\",\"ServiceID\":\"%s\"}", taskID, serviceID)
+
+	case execInspectPath.MatchString(p):
+		// inspect exec - /exec/{id}/json
+		execID := execInspectPath.FindStringSubmatch(p)[2]
+		s.mu.Lock()
+		containerID, ok := s.Execs[execID]
+		s.mu.Unlock()
+		if !ok {
+			return 404, fmt.Sprintf("{\"message\":\"No such exec instance: %s\"}", execID)
+		}
+		return 200, fmt.Sprintf("{\"ID\":\"%s\",\"ContainerID\":\"%s\"}", execID, containerID)
+
+	case containerListPath.MatchString(p):
+		// list containers - /containers/json, with label and ancestor filters
+		var filters map[string][]string
+		if qf := req.URL.Query().Get("filters"); qf != "" {
+			if err := json.Unmarshal([]byte(qf), &filters); err != nil {
+				return 400, fmt.Sprintf("{\"message\":\"%s\"}", err.Error())
+			}
+		}
+		results := []string{}
+		s.mu.Lock()
+		for idOrName, c := range s.Containers {
+			if containerMatchesFilters(c, filters) {
+				results = append(results, fmt.Sprintf("{\"Id\":\"%s\",\"Image\":\"%s\",\"Labels\":%s}", idOrName, c.Image, ownerLabels(c.Owner)))
+			}
+		}
+		s.mu.Unlock()
+		return 200, "[" + strings.Join(results, ",") + "]"
+
+	case containerInspectPath.MatchString(p):
+		// inspect container - /containers/{id}/json
+		if req.Method != "GET" {
+			return 501, fmt.Sprintf("Unsupported HTTP method %s for %s\n", req.Method, p)
+		}
+		id := containerInspectPath.FindStringSubmatch(p)[2]
+		s.mu.Lock()
+		c, ok := s.Containers[id]
+		s.mu.Unlock()
+		if !ok {
+			return 404, fmt.Sprintf("{\"message\":\"No such container: %s\"}", id)
+		}
+		return 200, fmt.Sprintf("{\"Id\":\"%s\",\"Config\":{\"Labels\":%s},\"HostConfig\":{\"Memory\":%d,\"NanoCpus\":%d}}", id, ownerLabels(c.Owner), c.Memory, c.NanoCpus)
+
+	case imageInspectPath.MatchString(p):
+		// inspect image - /images/{id}/json
+		if req.Method != "GET" {
+			return 501, fmt.Sprintf("Unsupported HTTP method %s for %s\n", req.Method, p)
+		}
+		id := imageInspectPath.FindStringSubmatch(p)[2]
+		s.mu.Lock()
+		image, ok := s.Images[id]
+		s.mu.Unlock()
+		if !ok {
+			return 404, fmt.Sprintf("{\"message\":\"no such image: %s: No such image: %s:latest\"}", id, id)
+		}
+		return 200, fmt.Sprintf("{\"Id\":\"%s\",\"Config\":{\"Labels\":%s}}", id, ownerLabels(image.Owner))
+
+	case req.Method == "DELETE" && imagePath.MatchString(p):
+		// delete image - /images/{id}
+		id := imagePath.FindStringSubmatch(p)[2]
+		if err := s.DeleteImage(id); err != nil {
+			return 404, fmt.Sprintf("{\"message\":\"No such image: %s\"}", id)
+		}
+		return 200, fmt.Sprintf("[{\"Deleted\":\"%s\"}]", id)
+
+	case networkPath.MatchString(p):
+		m := networkPath.FindStringSubmatch(p)
+		return s.respondNetwork(req, m[2], m[3])
+
+	case volumePath.MatchString(p):
+		// inspect volume - /volumes/{name}
+		if req.Method != "GET" {
+			return 501, fmt.Sprintf("Unsupported HTTP method %s for %s\n", req.Method, p)
+		}
+		name := volumePath.FindStringSubmatch(p)[2]
+		s.mu.Lock()
+		volume, ok := s.Volumes[name]
+		s.mu.Unlock()
+		if !ok {
+			return 404, fmt.Sprintf("{\"message\":\"get %s: no such volume\"}", name)
+		}
+		return 200, fmt.Sprintf("{\"Name\":\"%s\",\"Labels\":%s}", name, ownerLabels(volume.Owner))
+	}
+
+	return 501, fmt.Sprintf("Path %s not implemented\n", p)
+}
+
+func (s *State) respondNetwork(req *http.Request, id, action string) (int, string) {
+	if !s.NetworkExists(id) {
+		return 404, fmt.Sprintf("{\"message\":\"network %s not found\"}", id)
+	}
+
+	switch {
+	case req.Method == "GET" && action == "":
+		// inspect network - /networks/{id}
+		s.mu.Lock()
+		network := s.Networks[id]
+		s.mu.Unlock()
+		return 200, fmt.Sprintf("{\"Id\":\"%s\",\"Labels\":%s}", id, ownerLabels(network.Owner))
+
+	case req.Method == "DELETE" && action == "":
+		// delete network - /networks/{id}
+		if err := s.DeleteNetwork(id); err != nil {
+			return 403, fmt.Sprintf("{\"message\":\"%s\"}", err.Error())
+		}
+		return 200, "OK"
+
+	case req.Method == "POST" && action != "":
+		// connect or disconnect a container - /networks/{id}/connect, /networks/{id}/disconnect
+		// The daemon requires a JSON content type
+		if contentType := req.Header.Get("Content-Type"); contentType != "application/json" {
+			return 400, fmt.Sprintf("{\"message\":\"Content-Type specified (%s) must be 'application/json'\"}", contentType)
+		}
+		var body struct {
+			Container      string
+			EndpointConfig struct {
+				Aliases []string
+			}
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return 500, err.Error()
+		}
+		var err error
+		if action == "/connect" {
+			aliases := []string{}
+			for _, alias := range body.EndpointConfig.Aliases {
+				if alias != "" {
+					aliases = append(aliases, alias)
+				}
+			}
+			err = s.ConnectContainer(body.Container, id, aliases)
+		} else {
+			err = s.DisconnectContainer(body.Container, id)
+		}
+		if err != nil {
+			return 500, fmt.Sprintf("{\"message\":\"error %sing container '%s' to/from network '%s': %s\"}", strings.TrimPrefix(action, "/"), body.Container, id, err.Error())
+		}
+		return 200, "OK"
+	}
+
+	return 501, fmt.Sprintf("Unsupported HTTP method %s for %s\n", req.Method, req.URL.Path)
+}
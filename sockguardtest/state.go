@@ -0,0 +1,338 @@
+// Package sockguardtest provides a simulated docker daemon for testing directors, such as a
+// sockguard.RulesDirector with extra rules, without a real daemon.
+//
+// A State holds the containers, images, networks and volumes that "exist", along with their
+// owners, and its Client answers the inspect, list, network connect and delete requests a
+// director makes while checking ownership:
+//
+//	state := &sockguardtest.State{
+//		Containers: map[string]sockguardtest.Container{
+//			"web": {Owner: "my-job"},
+//		},
+//	}
+//	director := &sockguard.RulesDirector{Client: state.Client(), Owner: "my-job"}
+package sockguardtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// OwnerLabel is the label sockguard records the owner of resources in
+const OwnerLabel = "com.buildkite.sockguard.owner"
+
+// State is a simplified docker daemon state. The maps can be populated directly before use,
+// nil maps are treated as empty.
+type State struct {
+	// Key = container name/ID
+	Containers map[string]Container
+	// Key = image name/ID
+	Images map[string]Image
+	// Key = network name/ID
+	Networks map[string]Network
+	// Key = volume name
+	Volumes map[string]Volume
+	// Key = exec ID, value = container ID/Name
+	Execs map[string]string
+	// Key = service ID/Name, value = owner
+	Services map[string]string
+	// Key = secret ID/Name, value = owner
+	Secrets map[string]string
+	// Key = config ID/Name, value = owner
+	Configs map[string]string
+	// Key = task ID, value = service ID/Name
+	Tasks map[string]string
+
+	mu sync.Mutex
+}
+
+type Container struct {
+	Owner    string
+	Image    string
+	Networks []AttachedNetwork
+	// HostConfig resources
+	Memory   int64
+	NanoCpus int64
+}
+
+type AttachedNetwork struct {
+	Name string
+	// Alias hostnames used to talk to this container via this attached network
+	// Can be empty. Also more than 1 container can have the same alias, and Docker will round-robin them.
+	Aliases []string
+}
+
+type Image struct {
+	Owner string
+}
+
+type Network struct {
+	Owner string
+}
+
+type Volume struct {
+	Owner string
+}
+
+// ownerLabels returns the JSON labels object for a resource with an owner
+func ownerLabels(owner string) string {
+	if owner == "" {
+		return "{}"
+	}
+	labels, _ := json.Marshal(map[string]string{OwnerLabel: owner})
+	return string(labels)
+}
+
+//////////////
+// containers
+
+// CreateContainer adds a container, failing if it already exists
+func (s *State) CreateContainer(idOrName string, owner string, networks []AttachedNetwork) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Containers[idOrName]; ok {
+		return fmt.Errorf("Cannot create container with ID/Name '%s', already exists", idOrName)
+	}
+	if s.Containers == nil {
+		s.Containers = map[string]Container{}
+	}
+	s.Containers[idOrName] = Container{
+		Owner:    owner,
+		Networks: networks,
+	}
+	return nil
+}
+
+// DeleteContainer removes a container, failing if it doesn't exist
+func (s *State) DeleteContainer(idOrName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Containers[idOrName]; !ok {
+		return fmt.Errorf("Cannot delete container with ID/Name '%s', does not exist", idOrName)
+	}
+	delete(s.Containers, idOrName)
+	return nil
+}
+
+// ContainerExists returns whether a container exists
+func (s *State) ContainerExists(idOrName string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.Containers[idOrName]
+	return ok
+}
+
+// ContainerNetworks returns the networks a container is attached to
+func (s *State) ContainerNetworks(idOrName string) []AttachedNetwork {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Containers[idOrName].Networks
+}
+
+// containerMatchesFilters checks a container against list filters, only the label (owner label
+// only) and ancestor filters are supported
+func containerMatchesFilters(c Container, filters map[string][]string) bool {
+	for _, label := range filters["label"] {
+		if label != fmt.Sprintf("%s=%s", OwnerLabel, c.Owner) {
+			return false
+		}
+	}
+	for _, ancestor := range filters["ancestor"] {
+		if ancestor != c.Image {
+			return false
+		}
+	}
+	return true
+}
+
+//////////////
+// images
+
+// CreateImage adds an image, failing if it already exists
+func (s *State) CreateImage(idOrName string, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Images[idOrName]; ok {
+		return fmt.Errorf("Cannot create image with ID/Name '%s', already exists", idOrName)
+	}
+	if s.Images == nil {
+		s.Images = map[string]Image{}
+	}
+	s.Images[idOrName] = Image{Owner: owner}
+	return nil
+}
+
+// DeleteImage removes an image, failing if it doesn't exist. Unlike a real daemon, images used
+// by containers can be deleted.
+func (s *State) DeleteImage(idOrName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Images[idOrName]; !ok {
+		return fmt.Errorf("Cannot delete image with ID/Name '%s', does not exist", idOrName)
+	}
+	delete(s.Images, idOrName)
+	return nil
+}
+
+// ImageExists returns whether an image exists
+func (s *State) ImageExists(idOrName string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.Images[idOrName]
+	return ok
+}
+
+//////////////
+// networks
+
+// CreateNetwork adds a network, failing if it already exists
+func (s *State) CreateNetwork(idOrName string, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Networks[idOrName]; ok {
+		return fmt.Errorf("Cannot create network with ID/Name '%s', already exists", idOrName)
+	}
+	if s.Networks == nil {
+		s.Networks = map[string]Network{}
+	}
+	s.Networks[idOrName] = Network{Owner: owner}
+	return nil
+}
+
+// DeleteNetwork removes a network, failing if it doesn't exist or containers are still
+// attached to it, as a real daemon does
+func (s *State) DeleteNetwork(idOrName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Networks[idOrName]; !ok {
+		return fmt.Errorf("Cannot delete network with ID/Name '%s', does not exist", idOrName)
+	}
+	for containerIdOrName, c := range s.Containers {
+		for _, n := range c.Networks {
+			if n.Name == idOrName {
+				return fmt.Errorf("Cannot delete network with ID/Name '%s', endpoint still attached (container '%s')", idOrName, containerIdOrName)
+			}
+		}
+	}
+	delete(s.Networks, idOrName)
+	return nil
+}
+
+// NetworkExists returns whether a network exists
+func (s *State) NetworkExists(idOrName string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.Networks[idOrName]
+	return ok
+}
+
+// ConnectContainer attaches a container to a network, failing if either doesn't exist or
+// the container is already attached
+func (s *State) ConnectContainer(containerIdOrName string, networkIdOrName string, aliases []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkConnect(containerIdOrName, networkIdOrName); err != nil {
+		return fmt.Errorf("Cannot connect container '%s' to network '%s', %s", containerIdOrName, networkIdOrName, err.Error())
+	}
+	if s.isConnected(containerIdOrName, networkIdOrName) {
+		return fmt.Errorf("Cannot connect container '%s' to network '%s', already attached", containerIdOrName, networkIdOrName)
+	}
+	c := s.Containers[containerIdOrName]
+	c.Networks = append(c.Networks, AttachedNetwork{Name: networkIdOrName, Aliases: aliases})
+	s.Containers[containerIdOrName] = c
+	return nil
+}
+
+// DisconnectContainer detaches a container from a network, failing if either doesn't exist or
+// the container isn't attached
+func (s *State) DisconnectContainer(containerIdOrName string, networkIdOrName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkConnect(containerIdOrName, networkIdOrName); err != nil {
+		return fmt.Errorf("Cannot disconnect container '%s' from network '%s', %s", containerIdOrName, networkIdOrName, err.Error())
+	}
+	if !s.isConnected(containerIdOrName, networkIdOrName) {
+		return fmt.Errorf("Cannot disconnect container '%s' from network '%s', not attached", containerIdOrName, networkIdOrName)
+	}
+	c := s.Containers[containerIdOrName]
+	networks := []AttachedNetwork{}
+	for _, n := range c.Networks {
+		if n.Name != networkIdOrName {
+			networks = append(networks, n)
+		}
+	}
+	c.Networks = networks
+	s.Containers[containerIdOrName] = c
+	return nil
+}
+
+func (s *State) checkConnect(containerIdOrName string, networkIdOrName string) error {
+	if _, ok := s.Containers[containerIdOrName]; !ok {
+		return fmt.Errorf("container does not exist")
+	}
+	if _, ok := s.Networks[networkIdOrName]; !ok {
+		return fmt.Errorf("network does not exist")
+	}
+	return nil
+}
+
+func (s *State) isConnected(containerIdOrName string, networkIdOrName string) bool {
+	for _, n := range s.Containers[containerIdOrName].Networks {
+		if n.Name == networkIdOrName {
+			return true
+		}
+	}
+	return false
+}
+
+//////////////
+// volumes
+
+// CreateVolume adds a volume, failing if it already exists
+func (s *State) CreateVolume(name string, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Volumes[name]; ok {
+		return fmt.Errorf("Cannot create volume with Name '%s', already exists", name)
+	}
+	if s.Volumes == nil {
+		s.Volumes = map[string]Volume{}
+	}
+	s.Volumes[name] = Volume{Owner: owner}
+	return nil
+}
+
+// DeleteVolume removes a volume, failing if it doesn't exist
+func (s *State) DeleteVolume(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Volumes[name]; !ok {
+		return fmt.Errorf("Cannot delete volume with Name '%s', does not exist", name)
+	}
+	delete(s.Volumes, name)
+	return nil
+}
+
+// VolumeExists returns whether a volume exists
+func (s *State) VolumeExists(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.Volumes[name]
+	return ok
+}
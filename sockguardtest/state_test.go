@@ -0,0 +1,82 @@
+package sockguardtest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestClientInspect(t *testing.T) {
+	s := &State{
+		Containers: map[string]Container{
+			"web": {Owner: "my-job", Memory: 1024},
+		},
+		Volumes: map[string]Volume{
+			"cache": {},
+		},
+	}
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/v1.37/containers/web/json", 200, `{"Id":"web","Config":{"Labels":{"com.buildkite.sockguard.owner":"my-job"}},"HostConfig":{"Memory":1024,"NanoCpus":0}}`},
+		{"/v1.37/containers/db/json", 404, `{"message":"No such container: db"}`},
+		{"/v1.37/volumes/cache", 200, `{"Name":"cache","Labels":{}}`},
+		{"/v1.37/plugins", 501, "Path /v1.37/plugins not implemented\n"},
+	}
+
+	for _, test := range tests {
+		resp, err := s.Client().Get("http://unix" + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != test.status || string(body) != test.body {
+			t.Errorf("%s : expected %d %s, got %d %s", test.path, test.status, test.body, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestClientNetworkConnect(t *testing.T) {
+	s := &State{
+		Containers: map[string]Container{"web": {}},
+		Networks:   map[string]Network{"backend": {Owner: "my-job"}},
+	}
+
+	connect := func() int {
+		req, _ := http.NewRequest("POST", "http://unix/v1.37/networks/backend/connect", strings.NewReader(`{"Container":"web","EndpointConfig":{"Aliases":["app"]}}`))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := s.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	if status := connect(); status != 200 {
+		t.Fatalf("Expected 200 connecting, got %d", status)
+	}
+	if networks := s.ContainerNetworks("web"); len(networks) != 1 || networks[0].Name != "backend" || networks[0].Aliases[0] != "app" {
+		t.Fatalf("Expected web to be attached to backend as app, got %+v", networks)
+	}
+	if status := connect(); status != 500 {
+		t.Fatalf("Expected 500 connecting again, got %d", status)
+	}
+
+	// networks with attached containers can't be deleted
+	if err := s.DeleteNetwork("backend"); err == nil {
+		t.Fatal("Expected an error deleting a network with an attached container")
+	}
+	if err := s.DisconnectContainer("web", "backend"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteNetwork("backend"); err != nil {
+		t.Fatal(err)
+	}
+	if s.NetworkExists("backend") {
+		t.Fatal("Expected backend to be deleted")
+	}
+}
@@ -0,0 +1,81 @@
+package sockguard
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// storageSizeUnits are the multipliers of the suffixes docker accepts for StorageOpt sizes, which
+// are binary (e.g. 1g is 1024^3 bytes)
+var storageSizeUnits = map[string]int64{
+	"":  1,
+	"k": 1 << 10,
+	"m": 1 << 20,
+	"g": 1 << 30,
+	"t": 1 << 40,
+	"p": 1 << 50,
+}
+
+// ParseStorageSize parses a size in bytes, with an optional suffix like docker's --storage-opt
+// size=20G, e.g. 20G, 512m or 1073741824
+func ParseStorageSize(s string) (int64, error) {
+	unit := strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "b"), "i")
+	number := strings.TrimRight(unit, "kmgtp")
+	multiplier, ok := storageSizeUnits[unit[len(number):]]
+	if !ok {
+		return 0, fmt.Errorf("Invalid size %q, expected bytes or a number with a k, m, g, t or p suffix", s)
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("Invalid size %q, expected bytes or a number with a k, m, g, t or p suffix", s)
+	}
+	// also catches NaN and Inf, which ParseFloat accepts
+	size := value * float64(multiplier)
+	if !(size < math.MaxInt64) {
+		return 0, fmt.Errorf("Invalid size %q, larger than %d bytes", s, int64(math.MaxInt64))
+	}
+	return int64(size), nil
+}
+
+// applyContainerStorageSize sets the size of a container's writable layer (StorageOpt size) to
+// ContainerStorageSize, or MaxContainerStorageSize if that isn't set, when the container doesn't
+// set one. Containers setting sizes above MaxContainerStorageSize are denied.
+func (r *RulesDirector) applyContainerStorageSize(l socketproxy.Logger, hostConfig map[string]interface{}) error {
+	if r.ContainerStorageSize == 0 && r.MaxContainerStorageSize == 0 {
+		return nil
+	}
+
+	storageOpt, _ := hostConfig["StorageOpt"].(map[string]interface{})
+	if storageOpt == nil {
+		storageOpt = map[string]interface{}{}
+	}
+	// storage drivers lowercase the options
+	if err := canonicalJSONKeys(storageOpt, "size"); err != nil {
+		return err
+	}
+
+	if requested, _ := storageOpt["size"].(string); requested != "" {
+		size, err := ParseStorageSize(requested)
+		if err != nil {
+			return err
+		}
+		if r.MaxContainerStorageSize > 0 && size > r.MaxContainerStorageSize {
+			l.Printf("Denied storage size %q on container create, more than the maximum of %d bytes", requested, r.MaxContainerStorageSize)
+			return fmt.Errorf("Containers aren't allowed a storage size of more than %d bytes, requested %q", r.MaxContainerStorageSize, requested)
+		}
+		return nil
+	}
+
+	size := r.ContainerStorageSize
+	if size == 0 {
+		size = r.MaxContainerStorageSize
+	}
+	l.Printf("Setting storage size to %d bytes", size)
+	storageOpt["size"] = strconv.FormatInt(size, 10)
+	hostConfig["StorageOpt"] = storageOpt
+	return nil
+}
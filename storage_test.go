@@ -0,0 +1,29 @@
+package sockguard
+
+import "testing"
+
+func TestParseStorageSize(t *testing.T) {
+	tests := map[string]int64{
+		"1073741824": 1 << 30,
+		"20G":        20 << 30,
+		"20gb":       20 << 30,
+		"20GiB":      20 << 30,
+		"512m":       512 << 20,
+		"1.5k":       1536,
+		"2T":         2 << 40,
+	}
+	for s, expected := range tests {
+		size, err := ParseStorageSize(s)
+		if err != nil {
+			t.Errorf("%q : unexpected error %v", s, err)
+		} else if size != expected {
+			t.Errorf("%q : expected %d, got %d", s, expected, size)
+		}
+	}
+
+	for _, s := range []string{"", "G", "20X", "-1G", "twenty", "9999999p", "1e300", "nan", "inf"} {
+		if _, err := ParseStorageSize(s); err == nil {
+			t.Errorf("%q : expected an error", s)
+		}
+	}
+}
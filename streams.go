@@ -0,0 +1,80 @@
+package sockguard
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// The kinds of streaming endpoints that can have a maximum duration
+var streamKinds = []string{"attach", "logs", "events", "stats", "exec"}
+
+var streamKindRegex = regexp.MustCompile(`^/(?:(events)|containers/[^/]+/(attach|attach/ws|logs|stats)|(?:services|tasks)/[^/]+/(logs)|exec/[^/]+/(start))$`)
+
+// ParseStreamDurations parses a comma separated list of kind=duration maximums for streaming
+// endpoints, e.g. logs=2h,events=1h
+func ParseStreamDurations(s string) (map[string]time.Duration, error) {
+	durations := map[string]time.Duration{}
+	for _, pair := range strings.Split(s, ",") {
+		chunks := strings.SplitN(pair, "=", 2)
+		if len(chunks) != 2 {
+			return nil, fmt.Errorf("Invalid stream duration %q, expected kind=duration", pair)
+		}
+		isKnown := false
+		for _, kind := range streamKinds {
+			isKnown = isKnown || chunks[0] == kind
+		}
+		if !isKnown {
+			return nil, fmt.Errorf("Unknown stream kind %q, expected one of %s", chunks[0], strings.Join(streamKinds, ", "))
+		}
+		d, err := time.ParseDuration(chunks[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid duration for stream kind %q: %v", chunks[0], err)
+		}
+		durations[chunks[0]] = d
+	}
+	return durations, nil
+}
+
+// streamKind returns the kind of streaming endpoint req is for, or an empty string
+func streamKind(req *http.Request) string {
+	if !socketproxy.IsStreaming(req) {
+		return ""
+	}
+	m := streamKindRegex.FindStringSubmatch(versionRegex.ReplaceAllString(req.URL.Path, ""))
+	switch {
+	case m == nil:
+		return ""
+	case m[1] != "":
+		return "events"
+	case m[2] == "attach", m[2] == "attach/ws":
+		return "attach"
+	case m[2] == "stats":
+		return "stats"
+	case m[2] == "logs", m[3] != "":
+		return "logs"
+	default:
+		return "exec"
+	}
+}
+
+// limitStreamDuration ends streams that stay open longer than the MaxStreamDurations of their kind,
+// so abandoned streams don't hold on to connections forever
+func (r *RulesDirector) limitStreamDuration(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	kind := streamKind(req)
+	d := r.MaxStreamDurations[kind]
+	if kind == "" || d == 0 {
+		return upstream
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		l.Printf("Limiting %s stream to %v", kind, d)
+		ctx, cancel := context.WithTimeout(req.Context(), d)
+		defer cancel()
+		upstream.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
@@ -0,0 +1,87 @@
+package sockguard
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStreamKind(t *testing.T) {
+	tests := []struct {
+		method   string
+		url      string
+		expected string
+	}{
+		{"GET", "/v1.37/events", "events"},
+		{"POST", "/v1.37/containers/abc/attach?stream=1", "attach"},
+		{"GET", "/v1.37/containers/abc/attach/ws", "attach"},
+		{"GET", "/v1.37/containers/abc/logs?follow=1", "logs"},
+		{"GET", "/v1.37/containers/abc/logs", ""},
+		{"GET", "/v1.37/services/abc/logs?follow=1", "logs"},
+		{"GET", "/v1.37/containers/abc/stats", "stats"},
+		{"POST", "/v1.37/exec/abc/start", "exec"},
+		{"POST", "/v1.37/build", ""},
+		{"GET", "/v1.37/containers/json", ""},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := streamKind(req); actual != test.expected {
+			t.Errorf("%s %s : Expected %q, got %q", test.method, test.url, test.expected, actual)
+		}
+	}
+}
+
+func TestMaxStreamDurations(t *testing.T) {
+	l := mockLogger()
+
+	r := mockRulesDirector()
+	r.MaxStreamDurations = map[string]time.Duration{"events": time.Hour}
+
+	for _, test := range []struct {
+		url         string
+		hasDeadline bool
+	}{
+		{"/v1.37/events", true},
+		{"/v1.37/version", false},
+	} {
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			deadline, ok := req.Context().Deadline()
+			if ok != test.hasDeadline {
+				t.Errorf("%s : Expected deadline to be %t, got %t", test.url, test.hasDeadline, ok)
+			} else if ok && time.Until(deadline) > time.Hour {
+				t.Errorf("%s : Expected deadline within an hour, got %v", test.url, deadline)
+			}
+			w.WriteHeader(http.StatusOK)
+		})
+
+		req, err := http.NewRequest("GET", test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s : handler returned wrong status code: got %v want %v", test.url, rr.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestParseStreamDurations(t *testing.T) {
+	durations, err := ParseStreamDurations("logs=2h,events=30m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if durations["logs"] != 2*time.Hour || durations["events"] != 30*time.Minute {
+		t.Errorf("Unexpected durations %v", durations)
+	}
+	for _, invalid := range []string{"logs", "build=1h", "logs=forever"} {
+		if _, err := ParseStreamDurations(invalid); err == nil {
+			t.Errorf("Expected %q to be invalid", invalid)
+		}
+	}
+}
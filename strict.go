@@ -0,0 +1,190 @@
+package sockguard
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// strictHostConfigFields are the untyped HostConfig fields containers can set with Strict, as they
+// only affect the container itself (resources, ports, restarts and the like). The typed fields are
+// checked by the other rules, any other field is denied unless it's unset.
+var strictHostConfigFields = map[string]bool{
+	"AutoRemove":           true,
+	"BlkioDeviceReadBps":   true,
+	"BlkioDeviceReadIOps":  true,
+	"BlkioDeviceWriteBps":  true,
+	"BlkioDeviceWriteIOps": true,
+	"BlkioWeight":          true,
+	"BlkioWeightDevice":    true,
+	"CapDrop":              true,
+	"ConsoleSize":          true,
+	"ContainerIDFile":      true,
+	"CpuCount":             true,
+	"CpuPercent":           true,
+	"CpuPeriod":            true,
+	"CpuQuota":             true,
+	"CpuRealtimePeriod":    true,
+	"CpuRealtimeRuntime":   true,
+	"CpuShares":            true,
+	"CpusetCpus":           true,
+	"CpusetMems":           true,
+	"DiskQuota":            true,
+	"Dns":                  true,
+	"DnsOptions":           true,
+	"DnsSearch":            true,
+	"GroupAdd":             true,
+	"IOMaximumBandwidth":   true,
+	"IOMaximumIOps":        true,
+	"Init":                 true,
+	"KernelMemory":         true,
+	"KernelMemoryTCP":      true,
+	"LogConfig":            true,
+	"Memory":               true,
+	"MemoryReservation":    true,
+	"MemorySwap":           true,
+	"MemorySwappiness":     true,
+	"NanoCpus":             true,
+	"OomScoreAdj":          true,
+	"PidsLimit":            true,
+	"PortBindings":         true,
+	"PublishAllPorts":      true,
+	"ReadonlyRootfs":       true,
+	"RestartPolicy":        true,
+	"ShmSize":              true,
+	"Tmpfs":                true,
+}
+
+// strictNullOnlyFields are HostConfig fields where an empty value isn't unset, e.g. empty
+// MaskedPaths unmask all of /proc
+var strictNullOnlyFields = map[string]bool{
+	"MaskedPaths":   true,
+	"ReadonlyPaths": true,
+}
+
+// checkStrictHostConfig denies the untyped HostConfig fields that aren't in strictHostConfigFields,
+// unless they are unset. Clients send most fields with zero values, so those are allowed.
+func checkStrictHostConfig(l socketproxy.Logger, extra map[string]interface{}) error {
+	fields := make([]string, 0, len(extra))
+	for field := range extra {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		value := extra[field]
+		if strictHostConfigFields[field] || value == nil {
+			continue
+		}
+		// a storage size only limits the container's writable layer
+		if storageOpt, ok := value.(map[string]interface{}); ok && field == "StorageOpt" && len(storageOpt) == 1 && storageOpt["size"] != nil {
+			continue
+		}
+		if !strictNullOnlyFields[field] && isUnsetJSON(value) {
+			continue
+		}
+		l.Printf("Denied HostConfig.%s %v on container create in strict mode", field, value)
+		return fmt.Errorf("Containers aren't allowed to set HostConfig.%s", field)
+	}
+	return nil
+}
+
+// isUnsetJSON checks whether a decoded JSON value is null, a zero value, or only contains those
+func isUnsetJSON(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !t
+	case string:
+		return t == ""
+	case json.Number:
+		f, err := t.Float64()
+		return err == nil && f == 0
+	case float64:
+		return t == 0
+	case []interface{}:
+		for _, e := range t {
+			if !isUnsetJSON(e) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		for _, e := range t {
+			if !isUnsetJSON(e) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// checkStrictVolumeCreate only allows volumes of the local driver without options with Strict, as
+// driver options can bind mount host paths (e.g. o=bind,device=/etc)
+func checkStrictVolumeCreate(l socketproxy.Logger, decoded map[string]interface{}) error {
+	if driver, _ := decoded["Driver"].(string); driver != "" && driver != "local" {
+		l.Printf("Denied volume driver %q in strict mode", driver)
+		return fmt.Errorf("Volumes aren't allowed to use driver %q", driver)
+	}
+	if !isUnsetJSON(decoded["DriverOpts"]) {
+		l.Printf("Denied volume driver options %v in strict mode", decoded["DriverOpts"])
+		return fmt.Errorf("Volumes aren't allowed to set driver options")
+	}
+	return nil
+}
+
+// strictVolumeCreate checks volume creates with checkStrictVolumeCreate, if Strict is set
+func (r *RulesDirector) strictVolumeCreate(l socketproxy.Logger, upstream http.Handler) http.Handler {
+	if !r.Strict {
+		return upstream
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var denied error
+		err := modifyRequestBody(req, func(decoded map[string]interface{}) {
+			denied = checkStrictVolumeCreate(l, decoded)
+		})
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if denied != nil {
+			r.writeDenied(w, req, denied.Error())
+			return
+		}
+		upstream.ServeHTTP(w, req)
+	})
+}
+
+// strictNetworkDrivers are the network drivers networks can be created with in strict mode, others
+// (e.g. macvlan and ipvlan) attach to the host's interfaces
+var strictNetworkDrivers = map[string]bool{
+	"":        true,
+	"bridge":  true,
+	"overlay": true,
+}
+
+// allowNotFound is used when a resource a request is for doesn't exist. The request is allowed
+// for the daemon to fail, unless Strict is set, as the resource could be created in between.
+func (r *RulesDirector) allowNotFound(l socketproxy.Logger, kind string) bool {
+	if r.Strict {
+		l.Printf("%s not found, denying in strict mode", kind)
+		return false
+	}
+	l.Printf("%s not found, allowing", kind)
+	return true
+}
+
+// notFoundHandler is the handler for requests for resources that don't exist, see allowNotFound
+func (r *RulesDirector) notFoundHandler(l socketproxy.Logger, kind string, upstream http.Handler) http.Handler {
+	if !r.allowNotFound(l, kind) {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			r.writeDenied(w, req, kind+" not found")
+		})
+	}
+	return upstream
+}
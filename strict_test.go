@@ -0,0 +1,99 @@
+package sockguard
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/sockguard/sockguardtest"
+)
+
+func TestStrict(t *testing.T) {
+	l := mockLogger()
+
+	us := sockguardtest.State{
+		Containers: map[string]sockguardtest.Container{
+			"owned": sockguardtest.Container{
+				Owner: "test-owner",
+			},
+		},
+	}
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		strict bool
+		method string
+		url    string
+		body   string
+		status int
+	}{
+		{false, "OPTIONS", "/v1.37/containers/json", "", 200},
+		{true, "OPTIONS", "/v1.37/containers/json", "", 401},
+		{false, "GET", "/v1.37/containers/missing/logs", "", 200},
+		{true, "GET", "/v1.37/containers/missing/logs", "", 401},
+		{true, "GET", "/v1.37/containers/owned/logs", "", 200},
+		{false, "POST", "/v1.37/containers/missing/kill", "", 200},
+		{true, "POST", "/v1.37/containers/missing/kill", "", 401},
+		{false, "POST", "/v1.37/volumes/create", `{"Name":"v","Labels":{},"DriverOpts":{"o":"bind","device":"/etc","type":"none"}}`, 200},
+		{true, "POST", "/v1.37/volumes/create", `{"Name":"v","Labels":{},"DriverOpts":{"o":"bind","device":"/etc","type":"none"}}`, 401},
+		{true, "POST", "/v1.37/volumes/create", `{"Name":"v","Labels":{},"Driver":"local","DriverOpts":{}}`, 200},
+		{true, "POST", "/v1.37/volumes/create", `{"Name":"v","Labels":{},"Driver":"rexray"}`, 401},
+		{false, "POST", "/v1.37/networks/create", `{"Name":"n","Labels":{},"Driver":"macvlan"}`, 200},
+		{true, "POST", "/v1.37/networks/create", `{"Name":"n","Labels":{},"Driver":"macvlan"}`, 401},
+		{true, "POST", "/v1.37/networks/create", `{"Name":"n","Labels":{},"Driver":"bridge"}`, 200},
+		{false, "POST", "/v1.37/images/create?fromSrc=-&repo=imported", "", 200},
+		{true, "POST", "/v1.37/images/create?fromSrc=-&repo=imported", "", 401},
+		{true, "POST", "/v1.37/images/create?fromImage=alpine&tag=3", "", 200},
+	}
+
+	for _, test := range tests {
+		r := mockRulesDirectorWithUpstreamState(&us)
+		r.Strict = test.strict
+
+		req, err := http.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("strict=%v %s %s %s : handler returned wrong status code: got %v want %v", test.strict, test.method, test.url, test.body, status, test.status)
+		}
+	}
+}
+
+func TestCheckStrictHostConfig(t *testing.T) {
+	l := mockLogger()
+
+	tests := []struct {
+		extra   map[string]interface{}
+		allowed bool
+	}{
+		{map[string]interface{}{"Memory": float64(1 << 30), "RestartPolicy": map[string]interface{}{"Name": "always"}}, true},
+		{map[string]interface{}{"CapAdd": nil, "PidMode": "", "Devices": []interface{}{}, "LogConfig": map[string]interface{}{"Type": "", "Config": map[string]interface{}{}}}, true},
+		{map[string]interface{}{"CapAdd": []interface{}{"SYS_ADMIN"}}, false},
+		{map[string]interface{}{"PidMode": "host"}, false},
+		{map[string]interface{}{"Sysctls": map[string]interface{}{"net.ipv4.ip_forward": "1"}}, false},
+		{map[string]interface{}{"OomKillDisable": true}, false},
+		{map[string]interface{}{"CpuRtRuntime": json.Number("0")}, true},
+		{map[string]interface{}{"CpuRtRuntime": json.Number("950000")}, false},
+		{map[string]interface{}{"ReadonlyPaths": nil}, true},
+		{map[string]interface{}{"ReadonlyPaths": []interface{}{}}, false},
+		{map[string]interface{}{"StorageOpt": map[string]interface{}{"size": "20G"}}, true},
+		{map[string]interface{}{"StorageOpt": map[string]interface{}{"size": "20G", "dm.basesize": "1T"}}, false},
+		{map[string]interface{}{"SomeFutureField": "value"}, false},
+	}
+
+	for _, test := range tests {
+		err := checkStrictHostConfig(l, test.extra)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("%v : expected allowed %v, got error %v", test.extra, test.allowed, err)
+		}
+	}
+}
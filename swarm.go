@@ -0,0 +1,375 @@
+package sockguard
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// serviceSpecFields, serviceTaskTemplateFields and serviceContainerSpecFields are the fields of a
+// service spec that services can set, as they're either checked below or only affect the
+// service's own containers. Any other field (e.g. Privileges, CapabilityAdd, Sysctls or a plugin
+// runtime) is denied unless it's unset.
+var (
+	serviceSpecFields = map[string]bool{
+		"Name":           true,
+		"Labels":         true,
+		"TaskTemplate":   true,
+		"Mode":           true,
+		"UpdateConfig":   true,
+		"RollbackConfig": true,
+		"Networks":       true,
+		"EndpointSpec":   true,
+	}
+	serviceTaskTemplateFields = map[string]bool{
+		"ContainerSpec": true,
+		"Resources":     true,
+		"RestartPolicy": true,
+		"Placement":     true,
+		"Networks":      true,
+		"ForceUpdate":   true,
+		"Runtime":       true,
+	}
+	serviceContainerSpecFields = map[string]bool{
+		"Image":           true,
+		"Labels":          true,
+		"Command":         true,
+		"Args":            true,
+		"Hostname":        true,
+		"Env":             true,
+		"Dir":             true,
+		"User":            true,
+		"Groups":          true,
+		"Init":            true,
+		"StopSignal":      true,
+		"TTY":             true,
+		"OpenStdin":       true,
+		"ReadOnly":        true,
+		"Mounts":          true,
+		"StopGracePeriod": true,
+		"Healthcheck":     true,
+		"Hosts":           true,
+		"DNSConfig":       true,
+		"Secrets":         true,
+		"Configs":         true,
+		"Isolation":       true,
+		"CapabilityDrop":  true,
+		"Ulimits":         true,
+		"OomScoreAdj":     true,
+	}
+)
+
+// checkServiceFields denies the fields of a service spec object that aren't in allowed, unless
+// they are unset
+func checkServiceFields(l socketproxy.Logger, kind string, decoded map[string]interface{}, allowed map[string]bool) error {
+	fields := make([]string, 0, len(decoded))
+	for field := range decoded {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		if !allowed[field] && !isUnsetJSON(decoded[field]) {
+			l.Printf("Denied %s.%s %v on service create", kind, field, decoded[field])
+			return fmt.Errorf("Services aren't allowed to set %s.%s", kind, field)
+		}
+	}
+	return nil
+}
+
+// addServiceLabels adds the owner label to a service spec, and to the containers of its tasks
+// so they can be accessed via the container endpoints. The task template is checked against the
+// same rules as container creates.
+func (r *RulesDirector) addServiceLabels(l socketproxy.Logger, spec map[string]interface{}) error {
+	if err := checkServiceFields(l, "Spec", spec, serviceSpecFields); err != nil {
+		return err
+	}
+	if _, ok := spec["Labels"].(map[string]interface{}); !ok {
+		spec["Labels"] = map[string]interface{}{}
+	}
+	addLabel(ownerKey, r.Owner, spec["Labels"])
+
+	// networks used to be set on the service rather than the task template
+	networks, _ := spec["Networks"].([]interface{})
+
+	taskTemplate, ok := spec["TaskTemplate"].(map[string]interface{})
+	if !ok {
+		return r.checkServiceNetworks(l, networks)
+	}
+	if err := checkServiceFields(l, "TaskTemplate", taskTemplate, serviceTaskTemplateFields); err != nil {
+		return err
+	}
+	if runtime, _ := taskTemplate["Runtime"].(string); runtime != "" && runtime != "container" {
+		l.Printf("Denied runtime %q on service create", runtime)
+		return fmt.Errorf("Services aren't allowed to use runtime %q", runtime)
+	}
+	taskNetworks, _ := taskTemplate["Networks"].([]interface{})
+	if err := r.checkServiceNetworks(l, append(networks, taskNetworks...)); err != nil {
+		return err
+	}
+
+	containerSpec, ok := taskTemplate["ContainerSpec"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if err := checkServiceFields(l, "ContainerSpec", containerSpec, serviceContainerSpecFields); err != nil {
+		return err
+	}
+	if _, ok := containerSpec["Labels"].(map[string]interface{}); !ok {
+		containerSpec["Labels"] = map[string]interface{}{}
+	}
+	addLabel(ownerKey, r.Owner, containerSpec["Labels"])
+
+	if image, _ := containerSpec["Image"].(string); image != "" {
+		if ok, err := r.isImageAllowed(l, image); err != nil {
+			return err
+		} else if !ok {
+			l.Printf("Denied image %q on service create", image)
+			return fmt.Errorf("Image %q isn't allowed", image)
+		}
+		if err := r.checkImagePinning(image); err != nil {
+			l.Printf("Denied image on service create: %s", err.Error())
+			return err
+		}
+	}
+
+	mounts, _ := containerSpec["Mounts"].([]interface{})
+	for _, mount := range mounts {
+		m, ok := mount.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Unable to parse mount %+v", mount)
+		}
+		mountType, _ := m["Type"].(string)
+		source, _ := m["Source"].(string)
+		if bindOptions, ok := m["BindOptions"].(map[string]interface{}); ok && !r.AllowSharedBindPropagation {
+			if propagation, _ := bindOptions["Propagation"].(string); isSharedPropagation(propagation) {
+				l.Printf("Denied shared propagation on service mount %+v", m)
+				return fmt.Errorf("Shared bind propagation isn't allowed")
+			}
+		}
+		isAllowed, err := r.isMountAllowed(l, mountType, source, r.AllowBinds)
+		if err != nil {
+			return err
+		}
+		if !isAllowed {
+			l.Printf("Denied service mount %+v", m)
+			return fmt.Errorf("Mounts of type %v with source %q aren't allowed", m["Type"], m["Source"])
+		}
+	}
+
+	if err := r.checkServiceReferences(l, containerSpec, "Secrets", "secrets"); err != nil {
+		return err
+	}
+	if configs, _ := containerSpec["Configs"].([]interface{}); len(configs) > 0 && r.DenyConfigs {
+		l.Printf("Denied configs %v on service create", configs)
+		return fmt.Errorf("Swarm configs are not allowed")
+	}
+	if err := r.checkServiceReferences(l, containerSpec, "Configs", "configs"); err != nil {
+		return err
+	}
+
+	if stopSignal, _ := containerSpec["StopSignal"].(string); !r.isKillSignalAllowed(stopSignal) {
+		l.Printf("Denied stop signal %q on service create", stopSignal)
+		return fmt.Errorf("Services aren't allowed to use stop signal %q", stopSignal)
+	}
+	if hosts, _ := containerSpec["Hosts"].([]interface{}); len(hosts) > 0 && r.DenyExtraHosts {
+		l.Printf("Denied hosts %v on service create", hosts)
+		return fmt.Errorf("Services aren't allowed to add hosts")
+	}
+	if ulimits, _ := containerSpec["Ulimits"].([]interface{}); len(ulimits) > 0 && r.DenyUlimits {
+		l.Printf("Denied ulimits %v on service create", ulimits)
+		return fmt.Errorf("Services aren't allowed to set ulimits")
+	}
+	if isolation, _ := containerSpec["Isolation"].(string); !r.isIsolationAllowed(isolation) {
+		l.Printf("Denied isolation %q on service create", isolation)
+		return fmt.Errorf("Services aren't allowed to use isolation %q", isolation)
+	}
+
+	if r.ForceInit {
+		containerSpec["Init"] = true
+		l.Printf("Forcing init")
+	}
+	if r.User != "" {
+		containerSpec["User"] = r.User
+		l.Printf("Forcing user to '%s'", r.User)
+	}
+	return nil
+}
+
+// checkServiceReferences checks the swarm objects of a kind a container spec references in field
+// (e.g. the SecretID and SecretName of each of its Secrets) are owned
+func (r *RulesDirector) checkServiceReferences(l socketproxy.Logger, containerSpec map[string]interface{}, field string, kind string) error {
+	singular := strings.TrimSuffix(field, "s")
+	references, _ := containerSpec[field].([]interface{})
+	for _, reference := range references {
+		ref, ok := reference.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Unable to parse %s %+v", strings.ToLower(singular), reference)
+		}
+		for _, key := range []string{singular + "ID", singular + "Name"} {
+			identifier, _ := ref[key].(string)
+			if identifier == "" {
+				continue
+			}
+			isAllowed, err := r.checkIdentifierOwner(l, kind, identifier, r.allowUnowned(kind, false))
+			if err == errInspectNotFound {
+				// The daemon will fail the create
+				continue
+			} else if err != nil {
+				return err
+			}
+			if !isAllowed {
+				l.Printf("Denied %s %q on service create", strings.ToLower(singular), identifier)
+				return fmt.Errorf("Services aren't allowed to use %s %q", strings.ToLower(singular), identifier)
+			}
+		}
+	}
+	return nil
+}
+
+// checkServiceNetworks checks the networks a service attaches to, by the Target of each network
+// attachment, against the same rules as container networks
+func (r *RulesDirector) checkServiceNetworks(l socketproxy.Logger, networks []interface{}) error {
+	for _, network := range networks {
+		n, ok := network.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Unable to parse network %+v", network)
+		}
+		target, _ := n["Target"].(string)
+		if target == "host" && !r.AllowHostModeNetworking {
+			l.Printf("Denied host network on service create")
+			return fmt.Errorf("Services aren't allowed to use host networking")
+		}
+		isAllowed, err := r.isNetworkAllowed(l, target)
+		if err != nil {
+			return err
+		}
+		if !isAllowed {
+			l.Printf("Denied attaching to network %q on service create", target)
+			return fmt.Errorf("Services aren't allowed to attach to network %q", target)
+		}
+	}
+	return nil
+}
+
+func (r *RulesDirector) handleServiceCreate(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var labelErr error
+		err := modifyRequestBody(req, func(decoded map[string]interface{}) {
+			labelErr = r.addServiceLabels(l, decoded)
+		})
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if labelErr != nil {
+			r.writeDenied(w, req, labelErr.Error())
+			return
+		}
+		upstream.ServeHTTP(w, req)
+	})
+}
+
+// handleServiceUpdate checks the service is owned, and keeps the owner label on the updated spec
+func (r *RulesDirector) handleServiceUpdate(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ok, err := r.checkOwner(l, "services", r.allowUnowned("services", false), req); err == errInspectNotFound {
+			if !r.allowNotFound(l, "Service") {
+				r.writeDenied(w, req, "Service not found")
+				return
+			}
+		} else if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if !ok {
+			r.writeDenied(w, req, "Unauthorized access to service")
+			return
+		}
+
+		var labelErr error
+		err := modifyRequestBody(req, func(decoded map[string]interface{}) {
+			labelErr = r.addServiceLabels(l, decoded)
+		})
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if labelErr != nil {
+			r.writeDenied(w, req, labelErr.Error())
+			return
+		}
+		upstream.ServeHTTP(w, req)
+	})
+}
+
+// handleTask checks the service a task belongs to is owned
+func (r *RulesDirector) handleTask(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		m := taskRegex.FindStringSubmatch(versionRegex.ReplaceAllString(req.URL.Path, ""))
+		if len(m) < 2 {
+			writeError(w, "Unable to find a task identifier", http.StatusBadRequest)
+			return
+		}
+
+		var task struct {
+			ServiceID string
+		}
+		if err := r.getInto(&task, "/tasks/%s", m[1]); err == errInspectNotFound {
+			if !r.allowNotFound(l, "Task") {
+				r.writeDenied(w, req, "Task not found")
+				return
+			}
+			upstream.ServeHTTP(w, req)
+			return
+		} else if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if ok, err := r.checkIdentifierOwner(l, "services", task.ServiceID, r.allowUnowned("services", false)); err == errInspectNotFound {
+			if !r.allowNotFound(l, "Service") {
+				r.writeDenied(w, req, "Service not found")
+				return
+			}
+		} else if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if !ok {
+			r.writeDenied(w, req, "Unauthorized access to task")
+			return
+		}
+		upstream.ServeHTTP(w, req)
+	})
+}
+
+// handleSpecLabels adds the owner label to the spec of a created or updated swarm object (e.g. a
+// secret), checking updated objects are owned first
+func (r *RulesDirector) handleSpecLabels(l socketproxy.Logger, kind string, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if path.Base(req.URL.Path) == "update" {
+			if ok, err := r.checkOwner(l, kind, r.allowUnowned(kind, false), req); err == errInspectNotFound {
+				l.Printf("Not found, allowing")
+			} else if err != nil {
+				writeError(w, err.Error(), http.StatusInternalServerError)
+				return
+			} else if !ok {
+				r.writeDenied(w, req, "Unauthorized access to "+strings.TrimSuffix(kind, "s"))
+				return
+			}
+		}
+
+		err := modifyRequestBody(req, func(decoded map[string]interface{}) {
+			if _, ok := decoded["Labels"].(map[string]interface{}); !ok {
+				decoded["Labels"] = map[string]interface{}{}
+			}
+			addLabel(ownerKey, r.Owner, decoded["Labels"])
+		})
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		upstream.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,203 @@
+package sockguard
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/sockguard/sockguardtest"
+)
+
+func TestSwarmDeniedByDefault(t *testing.T) {
+	l := mockLogger()
+	r := mockRulesDirector()
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("%s %s shouldn't have been passed upstream", req.Method, req.URL.Path)
+	})
+
+	for _, path := range []string{"/v1.37/swarm", "/v1.37/services", "/v1.37/nodes", "/v1.37/tasks/abc"} {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusUnauthorized {
+			t.Errorf("%s : handler returned wrong status code: got %v want %v", path, status, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestSwarmEndpoints(t *testing.T) {
+	l := mockLogger()
+
+	us := sockguardtest.State{
+		Services: map[string]string{
+			"owned":   "test-owner",
+			"foreign": "adifferentowner",
+			"unowned": "",
+		},
+		Tasks: map[string]string{
+			"ownedtask":   "owned",
+			"foreigntask": "foreign",
+			"orphantask":  "removed",
+		},
+	}
+	r := mockRulesDirectorWithUpstreamState(&us)
+	r.AllowSwarm = true
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		method string
+		url    string
+		status int
+	}{
+		{"GET", "/v1.37/swarm", 401},
+		{"POST", "/v1.37/swarm/init", 401},
+		{"GET", "/v1.37/nodes", 200},
+		{"GET", "/v1.37/nodes/abc", 200},
+		{"POST", "/v1.37/nodes/abc/update", 401},
+		{"DELETE", "/v1.37/nodes/abc", 401},
+		{"GET", "/v1.37/services/owned", 200},
+		{"GET", "/v1.37/services/owned/logs", 200},
+		{"GET", "/v1.37/services/foreign", 401},
+		{"GET", "/v1.37/services/unowned", 401},
+		{"DELETE", "/v1.37/services/owned", 200},
+		{"DELETE", "/v1.37/services/foreign", 401},
+		{"POST", "/v1.37/services/foreign/update", 401},
+		{"GET", "/v1.37/tasks/ownedtask", 200},
+		{"GET", "/v1.37/tasks/ownedtask/logs", 200},
+		{"GET", "/v1.37/tasks/foreigntask", 401},
+		{"GET", "/v1.37/tasks/orphantask", 200},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.url, strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("%s %s : handler returned wrong status code: got %v want %v", test.method, test.url, status, test.status)
+		}
+	}
+}
+
+func TestServiceCreateLabels(t *testing.T) {
+	l := mockLogger()
+
+	us := sockguardtest.State{
+		Networks: map[string]sockguardtest.Network{
+			"ownednet":   sockguardtest.Network{Owner: "test-owner"},
+			"foreignnet": sockguardtest.Network{Owner: "adifferentowner"},
+		},
+		Secrets: map[string]string{
+			"ownedsecret":   "test-owner",
+			"foreignsecret": "adifferentowner",
+		},
+		Configs: map[string]string{
+			"ownedconfig":   "test-owner",
+			"foreignconfig": "adifferentowner",
+		},
+	}
+	r := mockRulesDirectorWithUpstreamState(&us)
+	r.AllowSwarm = true
+	r.AllowImages = []string{"docker.io/library/nginx"}
+
+	tests := map[string]int{
+		`{"Name":"web","TaskTemplate":{"ContainerSpec":{"Image":"nginx"}}}`:                                                                                  200,
+		`{"Name":"web","Labels":{"a":"b"},"TaskTemplate":{"ContainerSpec":{"Image":"nginx","Labels":{"c":"d"}}}}`:                                            200,
+		`{"Name":"web","TaskTemplate":{"ContainerSpec":{"Image":"nginx","Mounts":[{"Type":"bind","Source":"/var/run/docker.sock"}]}}}`:                       401,
+		`{"Name":"web","TaskTemplate":{"ContainerSpec":{"Image":"nginx","Mounts":[{"Type":"tmpfs","Target":"/tmp"}]}}}`:                                      200,
+		`{"Name":"web","TaskTemplate":{"ContainerSpec":{"Image":"alpine"}}}`:                                                                                 401,
+		`{"Name":"web","TaskTemplate":{"ContainerSpec":{"Image":"nginx","Privileges":{"SELinuxContext":{"Disable":true}}}}}`:                                 401,
+		`{"Name":"web","TaskTemplate":{"ContainerSpec":{"Image":"nginx","privileges":{"SELinuxContext":{"Disable":true}}}}}`:                                 401,
+		`{"Name":"web","TaskTemplate":{"ContainerSpec":{"Image":"nginx","CapabilityAdd":["CAP_SYS_ADMIN"]}}}`:                                                401,
+		`{"Name":"web","TaskTemplate":{"ContainerSpec":{"Image":"nginx","Sysctls":{"net.ipv4.ip_forward":"1"}}}}`:                                            401,
+		`{"Name":"web","TaskTemplate":{"ContainerSpec":{"Image":"nginx","CapabilityAdd":null,"Sysctls":{}}}}`:                                                200,
+		`{"Name":"web","TaskTemplate":{"Runtime":"plugin","PluginSpec":{"Name":"evil/plugin"}}}`:                                                             401,
+		`{"Name":"web","TaskTemplate":{"ContainerSpec":{"Image":"nginx"},"Networks":[{"Target":"ownednet"}]}}`:                                               200,
+		`{"Name":"web","TaskTemplate":{"ContainerSpec":{"Image":"nginx"},"Networks":[{"Target":"foreignnet"}]}}`:                                             401,
+		`{"Name":"web","TaskTemplate":{"ContainerSpec":{"Image":"nginx"},"Networks":[{"Target":"host"}]}}`:                                                   401,
+		`{"Name":"web","TaskTemplate":{"ContainerSpec":{"Image":"nginx"}},"Networks":[{"Target":"foreignnet"}]}`:                                             401,
+		`{"Name":"web","TaskTemplate":{"ContainerSpec":{"Image":"nginx","Mounts":[{"Type":"volume","Source":"","BindOptions":{"Propagation":"rshared"}}]}}}`: 401,
+		`{"Name":"web","TaskTemplate":{"ContainerSpec":{"Image":"nginx","Secrets":[{"SecretID":"ownedsecret","SecretName":"ownedsecret"}]}}}`:                200,
+		`{"Name":"web","TaskTemplate":{"ContainerSpec":{"Image":"nginx","Secrets":[{"SecretID":"foreignsecret"}]}}}`:                                         401,
+		`{"Name":"web","TaskTemplate":{"ContainerSpec":{"Image":"nginx","Secrets":[{"SecretID":"ownedsecret","SecretName":"foreignsecret"}]}}}`:              401,
+		`{"Name":"web","TaskTemplate":{"ContainerSpec":{"Image":"nginx","Configs":[{"ConfigID":"ownedconfig","ConfigName":"ownedconfig"}]}}}`:                200,
+		`{"Name":"web","TaskTemplate":{"ContainerSpec":{"Image":"nginx","Configs":[{"ConfigName":"foreignconfig"}]}}}`:                                       401,
+		`{"Name":"web","TaskTemplate":{"ContainerSpec":{"Image":"nginx","StopSignal":"SIGUSR1"}}}`:                                                           401,
+	}
+
+	for body, expected := range tests {
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var decoded struct {
+				Labels       map[string]string
+				TaskTemplate struct {
+					ContainerSpec struct {
+						Labels map[string]string
+					}
+				}
+			}
+			if err := json.NewDecoder(req.Body).Decode(&decoded); err != nil {
+				t.Fatal(err)
+			}
+			if decoded.Labels[ownerKey] != "test-owner" {
+				t.Errorf("Expected service owner label, got %v", decoded.Labels)
+			}
+			if decoded.TaskTemplate.ContainerSpec.Labels[ownerKey] != "test-owner" {
+				t.Errorf("Expected container spec owner label, got %v", decoded.TaskTemplate.ContainerSpec.Labels)
+			}
+			w.WriteHeader(http.StatusOK)
+		})
+
+		req, err := http.NewRequest("POST", "/v1.37/services/create", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != expected {
+			t.Errorf("%s : handler returned wrong status code: got %v want %v", body, status, expected)
+		}
+	}
+}
+
+func TestServiceCreateDenyConfigs(t *testing.T) {
+	l := mockLogger()
+
+	us := sockguardtest.State{
+		Configs: map[string]string{
+			"ownedconfig": "test-owner",
+		},
+	}
+	r := mockRulesDirectorWithUpstreamState(&us)
+	r.AllowSwarm = true
+	r.DenyConfigs = true
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("%s %s shouldn't have been passed upstream", req.Method, req.URL.Path)
+	})
+
+	body := `{"Name":"web","TaskTemplate":{"ContainerSpec":{"Image":"nginx","Configs":[{"ConfigID":"ownedconfig"}]}}}`
+	req, err := http.NewRequest("POST", "/v1.37/services/create", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnauthorized)
+	}
+}
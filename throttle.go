@@ -0,0 +1,102 @@
+package sockguard
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// rateLimiter paces bytes to a rate in bytes per second, shared between everything using it
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	// When the bytes waited for so far will have been sent at rate
+	next time.Time
+}
+
+// wait blocks until n more bytes can be sent without exceeding the rate
+func (rl *rateLimiter) wait(n int) {
+	rl.mu.Lock()
+	now := time.Now()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+	rl.next = rl.next.Add(time.Duration(int64(n) * int64(time.Second) / rl.rate))
+	delay := rl.next.Sub(now)
+	rl.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	limiter *rateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	t.limiter.wait(n)
+	return n, err
+}
+
+type throttledConn struct {
+	net.Conn
+	limiter *rateLimiter
+}
+
+func (t *throttledConn) Write(p []byte) (int, error) {
+	t.limiter.wait(len(p))
+	return t.Conn.Write(p)
+}
+
+// throttledResponseWriter throttles the hijacked connection the proxy streams responses to
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	limiter *rateLimiter
+}
+
+func (t *throttledResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := t.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("Response writer can't be hijacked")
+	}
+	conn, bufrw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &throttledConn{Conn: conn, limiter: t.limiter}, bufrw, nil
+}
+
+// streamRateLimiter returns the rateLimiter shared by our streams with MaxStreamRate
+func (r *RulesDirector) streamRateLimiter() *rateLimiter {
+	s := r.lockState()
+	defer s.mu.Unlock()
+
+	if s.streamLimiter == nil {
+		s.streamLimiter = &rateLimiter{rate: r.MaxStreamRate}
+	}
+	return s.streamLimiter
+}
+
+// throttleStream throttles the request body and streamed response of a request to MaxStreamRate,
+// shared with our other throttled streams
+func (r *RulesDirector) throttleStream(l socketproxy.Logger, upstream http.Handler) http.Handler {
+	if r.MaxStreamRate == 0 {
+		return upstream
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		limiter := r.streamRateLimiter()
+		l.Printf("Throttling stream to %d bytes/sec", r.MaxStreamRate)
+
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = &throttledReader{ReadCloser: req.Body, limiter: limiter}
+		}
+		upstream.ServeHTTP(&throttledResponseWriter{ResponseWriter: w, limiter: limiter}, req)
+	})
+}
@@ -0,0 +1,46 @@
+package sockguard
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestThrottleStream(t *testing.T) {
+	l := mockLogger()
+
+	r := mockRulesDirector()
+	r.MaxStreamRate = 10000
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, ok := w.(http.Hijacker); !ok {
+			t.Errorf("Expected the throttled response writer to be a Hijacker")
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(body) != 2000 {
+			t.Errorf("Expected 2000 bytes of body, got %d", len(body))
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("POST", "/v1.37/build", bytes.NewReader(make([]byte, 2000)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.throttleStream(l, upstream).ServeHTTP(rr, req)
+	}
+
+	// 4000 bytes at 10000 bytes/sec, the limiter is shared between requests and has no burst
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Expected streams to take at least 400ms, took %v", elapsed)
+	}
+}
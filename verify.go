@@ -0,0 +1,151 @@
+package sockguard
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// ImageVerifier verifies the signature of an image before it's pulled
+type ImageVerifier interface {
+	Verify(ref string) error
+}
+
+// ImageVerifierFunc adapts a func to an ImageVerifier
+type ImageVerifierFunc func(ref string) error
+
+func (f ImageVerifierFunc) Verify(ref string) error {
+	return f(ref)
+}
+
+// defaultCosignTimeout is how long a cosign verify can take if CosignVerifier.Timeout isn't set
+const defaultCosignTimeout = 2 * time.Minute
+
+// CosignVerifier verifies image signatures by running `cosign verify` against a set of
+// public keys, passing if any of the keys verify the image
+type CosignVerifier struct {
+	// Path to the cosign binary, defaults to cosign on the PATH
+	Path string
+	Keys []string
+	// How long each cosign verify can take before it's killed, defaults to 2 minutes
+	Timeout time.Duration
+}
+
+func (c *CosignVerifier) Verify(ref string) error {
+	bin := c.Path
+	if bin == "" {
+		bin = "cosign"
+	}
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = defaultCosignTimeout
+	}
+
+	var failures []string
+	for _, key := range c.Keys {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		var stderr bytes.Buffer
+		// refs starting with - would otherwise be taken as flags
+		cmd := exec.CommandContext(ctx, bin, "verify", "--key", key, "--", ref)
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		cancel()
+		if err == nil {
+			return nil
+		}
+		failures = append(failures, fmt.Sprintf("%s: %s %s", key, err.Error(), strings.TrimSpace(stderr.String())))
+	}
+
+	return fmt.Errorf("Signature verification failed for image %q (%s)", ref, strings.Join(failures, ", "))
+}
+
+// resolveImageDigest returns ref pinned to the digest its registry has for it, via the daemon's
+// distribution endpoint with the registry credentials auth (if any). Refs with a digest are
+// returned as they are.
+func (r *RulesDirector) resolveImageDigest(ref string, auth string) (string, error) {
+	parsed := parseImageReference(ref)
+	if parsed.Digest != "" {
+		return ref, nil
+	}
+
+	u := fmt.Sprintf("http://docker/v%s/distribution/%s/json", r.internalAPIVersion(), ref)
+	req, err := r.newRequest("GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+	if auth != "" {
+		req.Header.Set("X-Registry-Auth", auth)
+	}
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Request to %q failed: %s", u, resp.Status)
+	}
+	var distribution struct {
+		Descriptor struct {
+			Digest string
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&distribution); err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(distribution.Descriptor.Digest, "sha256:") {
+		return "", fmt.Errorf("Unexpected digest %q for image %q", distribution.Descriptor.Digest, ref)
+	}
+	return parsed.Name() + "@" + distribution.Descriptor.Digest, nil
+}
+
+// verifyImage verifies ref with the configured ImageVerifier, if any. A tag could be moved to
+// another image between verifying and pulling it, so ref is resolved to a digest (with the
+// registry credentials auth) which is verified instead. The digest pinned ref is returned, which
+// must be pulled rather than ref.
+func (r *RulesDirector) verifyImage(l socketproxy.Logger, ref string, auth string) (string, error) {
+	if r.ImageVerifier == nil {
+		return ref, nil
+	}
+
+	pinned, err := r.resolveImageDigest(ref, auth)
+	if err != nil {
+		return "", fmt.Errorf("Unable to resolve the digest of image %q to verify: %s", ref, err.Error())
+	}
+
+	l.Printf("Verifying signature of image %q", pinned)
+	if err := r.ImageVerifier.Verify(pinned); err != nil {
+		return "", err
+	}
+
+	l.Printf("Verified signature of image %q", pinned)
+	return pinned, nil
+}
+
+// verifyImageIfMissing verifies ref if it isn't present locally, as creating a container
+// from it will cause it to be pulled. The ref to use is returned, see verifyImage.
+func (r *RulesDirector) verifyImageIfMissing(l socketproxy.Logger, ref string) (string, error) {
+	if r.ImageVerifier == nil {
+		return ref, nil
+	}
+
+	var image struct{}
+	if err := r.getInto(&image, "/images/%s/json", ref); err == nil {
+		return ref, nil
+	} else if err != errInspectNotFound {
+		return "", err
+	}
+
+	auth, err := r.registryAuth(ref)
+	if err != nil {
+		return "", err
+	}
+	return r.verifyImage(l, ref, auth)
+}
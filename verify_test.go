@@ -0,0 +1,47 @@
+package sockguard
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCosignVerifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cosign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a fake cosign that records its arguments, and hangs for the slow key
+	args := filepath.Join(dir, "args")
+	cosign := filepath.Join(dir, "cosign")
+	script := "#!/bin/sh\necho \"$@\" > " + args + "\nif [ \"$3\" = slow.pub ]; then exec sleep 10; fi\n"
+	if err := ioutil.WriteFile(cosign, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	v := &CosignVerifier{Path: cosign, Keys: []string{"good.pub"}}
+	if err := v.Verify("--output-file=/etc/passwd"); err != nil {
+		t.Fatal(err)
+	}
+	received, err := ioutil.ReadFile(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "verify --key good.pub -- --output-file=/etc/passwd\n"; string(received) != expected {
+		t.Errorf("Expected cosign to be run with %q, got %q", expected, received)
+	}
+
+	v = &CosignVerifier{Path: cosign, Keys: []string{"slow.pub"}, Timeout: 100 * time.Millisecond}
+	start := time.Now()
+	if err := v.Verify("alpine@sha256:abcd"); err == nil || !strings.Contains(err.Error(), "killed") {
+		t.Errorf("Expected a hung cosign to be killed, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected verify to time out, took %s", elapsed)
+	}
+}
@@ -0,0 +1,91 @@
+package sockguard
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/sockguard/socketproxy"
+)
+
+// compareAPIVersions compares two API versions (e.g. 1.41), returning -1, 0 or 1 if a is older,
+// the same or newer than b
+func compareAPIVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var an, bn int
+		if i < len(as) {
+			an, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			bn, _ = strconv.Atoi(bs[i])
+		}
+		if an < bn {
+			return -1
+		} else if an > bn {
+			return 1
+		}
+	}
+	return 0
+}
+
+// requestAPIVersion returns the API version a request path is prefixed with (e.g. 1.41 for
+// /v1.41/info), or an empty string if it isn't
+func requestAPIVersion(req *http.Request) string {
+	return strings.TrimPrefix(versionRegex.FindString(req.URL.Path), "/v")
+}
+
+// capAPIVersion returns version, or MaxAPIVersion if version is newer
+func (r *RulesDirector) capAPIVersion(version string) string {
+	if r.MaxAPIVersion != "" && compareAPIVersions(version, r.MaxAPIVersion) > 0 {
+		return r.MaxAPIVersion
+	}
+	return version
+}
+
+// capVersionResponse caps the API versions of a /version response body to MaxAPIVersion, so
+// clients negotiate down to it
+func (r *RulesDirector) capVersionResponse(l socketproxy.Logger, body json.RawMessage) (interface{}, error) {
+	var decoded map[string]interface{}
+	if err := unmarshalJSON(body, &decoded); err != nil {
+		return nil, err
+	}
+	for _, field := range []string{"ApiVersion", "MinAPIVersion"} {
+		if v, ok := decoded[field].(string); ok {
+			if capped := r.capAPIVersion(v); capped != v {
+				l.Printf("Capping %s %s to %s", field, v, capped)
+				decoded[field] = capped
+			}
+		}
+	}
+	return decoded, nil
+}
+
+// handlePing passes through /_ping, capping the API-Version header that clients negotiate their
+// API version with to MaxAPIVersion
+func (r *RulesDirector) handlePing(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		pingReq, err := r.newRequest(req.Method, "http://docker"+req.URL.RequestURI(), nil)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp, err := r.Client.Do(pingReq)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		if v := resp.Header.Get("Api-Version"); v != "" {
+			w.Header().Set("Api-Version", r.capAPIVersion(v))
+		}
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+	})
+}
@@ -0,0 +1,200 @@
+package sockguard
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompareAPIVersions(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.41", "1.41", 0},
+		{"1.9", "1.41", -1},
+		{"1.43", "1.41", 1},
+		{"2.0", "1.41", 1},
+	}
+	for _, test := range tests {
+		if actual := compareAPIVersions(test.a, test.b); actual != test.expected {
+			t.Errorf("%s vs %s : Expected %d, got %d", test.a, test.b, test.expected, actual)
+		}
+	}
+}
+
+func TestMaxAPIVersion(t *testing.T) {
+	l := mockLogger()
+
+	r := mockRulesDirector()
+	r.MaxAPIVersion = "1.41"
+	r.Client = &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) *http.Response {
+			resp := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Api-Version": []string{"1.43"}},
+			}
+			switch req.URL.Path {
+			case "/v1.41/version":
+				resp.Body = ioutil.NopCloser(bytes.NewBufferString(`{"Version":"24.0.0","ApiVersion":"1.43","MinAPIVersion":"1.12"}`))
+			case "/v1.41/_ping":
+				resp.Body = ioutil.NopCloser(bytes.NewBufferString(`OK`))
+			default:
+				t.Errorf("Unexpected request to %s", req.URL.Path)
+			}
+			return resp
+		}),
+	}
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1.41/containers/json" {
+			t.Errorf("Expected upstream request to be for version 1.41, got %s", req.URL.Path)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// Unversioned requests are sent with the max version
+	req, err := http.NewRequest("GET", "/_ping", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	r.Direct(l, req, upstream).ServeHTTP(rr, req)
+	if v := rr.Header().Get("Api-Version"); v != "1.41" {
+		t.Errorf("Expected ping Api-Version to be capped to 1.41, got %q", v)
+	}
+	if body := rr.Body.String(); body != "OK" {
+		t.Errorf("Expected ping body OK, got %q", body)
+	}
+
+	req, err = http.NewRequest("GET", "/v1.41/version", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	r.Direct(l, req, upstream).ServeHTTP(rr, req)
+	var version struct {
+		Version       string
+		ApiVersion    string
+		MinAPIVersion string
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version.ApiVersion != "1.41" || version.MinAPIVersion != "1.12" || version.Version != "24.0.0" {
+		t.Errorf("Expected ApiVersion to be capped to 1.41, got %+v", version)
+	}
+
+	tests := map[string]int{
+		"/v1.41/containers/json": 200,
+		"/containers/json":       200,
+		"/v1.43/containers/json": 400,
+	}
+	for k, v := range tests {
+		req, err := http.NewRequest("GET", k, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+		if rr.Code != v {
+			t.Errorf("%s : handler returned wrong status code: got %v want %v", k, rr.Code, v)
+		}
+	}
+}
+
+func TestInternalCallsUseClientAPIVersion(t *testing.T) {
+	l := mockLogger()
+
+	tests := map[string]string{
+		"/v1.41/containers/owned/json": "/v1.41/containers/owned/json",
+		"/v1.25/containers/owned/json": "/v1.32/containers/owned/json",
+		"/containers/owned/json":       "/v1.32/containers/owned/json",
+	}
+
+	for k, v := range tests {
+		var inspected []string
+		r := mockRulesDirector()
+		r.Client = &http.Client{
+			Transport: roundTripFunc(func(req *http.Request) *http.Response {
+				inspected = append(inspected, req.URL.Path)
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     make(http.Header),
+					Body:       ioutil.NopCloser(bytes.NewBufferString(`{"Config":{"Labels":{"com.buildkite.sockguard.owner":"test-owner"}}}`)),
+				}
+			}),
+		}
+
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+
+		req, err := http.NewRequest("GET", k, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.Direct(l, req, upstream).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s : handler returned wrong status code: got %v want %v", k, rr.Code, http.StatusOK)
+		}
+		if len(inspected) != 1 || inspected[0] != v {
+			t.Errorf("%s : Expected container to be inspected with %s, got %v", k, v, inspected)
+		}
+	}
+}
+
+func TestForAPIVersionBounded(t *testing.T) {
+	r := mockRulesDirector()
+	for i := 0; i < 2*maxAPIVersionDirectors; i++ {
+		version := fmt.Sprintf("1.%d", 100+i)
+		if versioned := r.forAPIVersion(version); versioned.internalAPIVersion() != version {
+			t.Errorf("Expected internal calls to use %s, got %s", version, versioned.internalAPIVersion())
+		}
+	}
+	s := r.lockState()
+	n := len(s.versions)
+	s.mu.Unlock()
+	if n != maxAPIVersionDirectors {
+		t.Errorf("Expected %d RulesDirectors to be kept, got %d", maxAPIVersionDirectors, n)
+	}
+
+	r.MaxAPIVersion = "1.41"
+	if versioned := r.forAPIVersion("1.999"); versioned.internalAPIVersion() != "1.41" {
+		t.Errorf("Expected internal calls to be capped to 1.41, got %s", versioned.internalAPIVersion())
+	}
+}
+
+func TestCheckUpstreamAPIVersion(t *testing.T) {
+	tests := map[string]bool{
+		"1.25": false,
+		"1.32": true,
+		"1.43": true,
+	}
+
+	for version, expected := range tests {
+		client := &http.Client{
+			Transport: roundTripFunc(func(req *http.Request) *http.Response {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     make(http.Header),
+					Body:       ioutil.NopCloser(bytes.NewBufferString(`{"Version":"x","ApiVersion":"` + version + `"}`)),
+				}
+			}),
+		}
+
+		actualVersion, supported, err := CheckUpstreamAPIVersion(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actualVersion != version || supported != expected {
+			t.Errorf("%s : Expected %s, %t, got %s, %t", version, version, expected, actualVersion, supported)
+		}
+	}
+}